@@ -0,0 +1,319 @@
+// Package ack adds acknowledgements and at-least-once redelivery to the leg
+// between the router and servers.
+//
+// A Tracker wraps a router.Forwarder for the services set with SetAcked.
+// Each message forwarded to them is given an ID if it lacks one and stays
+// pending until the server acknowledges it by ID.  Transports acknowledge a
+// message along with its delivery by implementing Acknowledger, as
+// httptransport does for servers echoing the ID in its AckHeader, or later by
+// calling Ack, as httptransport.AckHandler does for servers POSTing the ID.
+//
+// Messages that are not acknowledged within the timeout are delivered again
+// after a backoff: to the same server while it remains in the service's
+// pool, otherwise to the server the resolver picks next, following the
+// service's policy.  Once the attempt limit is reached the failure hook is
+// called.
+package ack
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+const (
+	DefaultTimeout     = 5 * time.Second
+	DefaultMaxAttempts = 3
+	DefaultRetryDelay  = 100 * time.Millisecond
+)
+
+var (
+	ErrNotAcknowledged = errors.New("ack: message not acknowledged")
+	ErrPending         = errors.New("ack: a message with the same ID is already pending")
+)
+
+// Forwarders whose transport carries acknowledgements with the delivery
+// implement Acknowledger.  acked reports whether the server acknowledged the
+// message in its response; when it did not the Tracker waits for Ack.
+type Acknowledger interface {
+	ForwardAck(ctx context.Context, serverID router.ServerID, msg *router.Message) (reply *router.Message, acked bool, err error)
+}
+
+// An Attempt records one delivery of a message.
+type Attempt struct {
+	Time     time.Time
+	ServerID router.ServerID
+	Err      error
+}
+
+// Tracker forwards messages and waits for their acknowledgement.
+type Tracker struct {
+	// How long to wait for an acknowledgement before redelivering.  When
+	// zero DefaultTimeout is used.
+	Timeout time.Duration
+
+	// Maximum deliveries of a message.  When zero DefaultMaxAttempts is used.
+	MaxAttempts int
+
+	// Pause before the first redelivery, doubled before each one after.
+	// When zero DefaultRetryDelay is used.
+	RetryDelay time.Duration
+
+	// OnFailure, if set, is called with messages that were never
+	// acknowledged and the attempts made to deliver them.
+	OnFailure func(msg *router.Message, attempts []Attempt)
+
+	forwarder router.Forwarder
+	table     router.RoutingTable
+	resolver  *router.Resolver
+
+	lock     sync.Mutex
+	services map[router.ServiceID]bool
+	pending  map[string]chan struct{}
+}
+
+// Create a tracker delivering messages with forwarder.  The table is used to
+// check pool membership, and the resolver to pick replacement servers.
+func New(forwarder router.Forwarder, table router.RoutingTable, resolver *router.Resolver) *Tracker {
+	tracker := new(Tracker)
+	tracker.forwarder = forwarder
+	tracker.table = table
+	tracker.resolver = resolver
+	tracker.services = make(map[router.ServiceID]bool)
+	tracker.pending = make(map[string]chan struct{})
+	return tracker
+}
+
+// Enable or disable acknowledgements for a service.
+func (t *Tracker) SetAcked(serviceID router.ServiceID, acked bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if acked {
+		t.services[serviceID] = true
+	} else {
+		delete(t.services, serviceID)
+	}
+}
+
+// Forward msg to serverID and block until it is acknowledged, redelivering
+// as needed.  The reply is the one returned by the acknowledged delivery.
+// msg is not changed; the ID given to a message without one is only set on
+// the copy delivered.  Messages to services without acknowledgements are
+// forwarded once, and a message whose ID is already pending is refused with
+// ErrPending.
+func (t *Tracker) Forward(ctx context.Context, serverID router.ServerID, msg *router.Message) (*router.Message, error) {
+	if !t.isAcked(msg.ServiceID) {
+		return t.forwarder.Forward(ctx, serverID, msg)
+	}
+
+	if msg.ID == "" {
+		copied := *msg
+		copied.ID = newID()
+		msg = &copied
+	}
+
+	acked, ok := t.track(msg.ID)
+	if !ok {
+		return nil, ErrPending
+	}
+	defer t.untrack(msg.ID)
+
+	var attempts []Attempt
+	delay := t.retryDelay()
+	for len(attempts) < t.maxAttempts() {
+		if len(attempts) > 0 {
+			if !sleep(ctx, delay) {
+				break
+			}
+			delay *= 2
+
+			next, err := t.redeliveryServer(ctx, msg, serverID)
+			if err != nil {
+				attempts = append(attempts, Attempt{Time: time.Now(), ServerID: serverID, Err: err})
+				continue
+			}
+			serverID = next
+		}
+
+		reply, err := t.deliver(ctx, serverID, msg, acked)
+		if err == nil {
+			return reply, nil
+		}
+
+		attempts = append(attempts, Attempt{Time: time.Now(), ServerID: serverID, Err: err})
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if t.OnFailure != nil {
+		t.OnFailure(msg, attempts)
+	}
+	return nil, ErrNotAcknowledged
+}
+
+// Acknowledge the message with the given ID.  It reports whether the message
+// was pending.
+func (t *Tracker) Ack(id string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	acked, ok := t.pending[id]
+	if !ok {
+		return false
+	}
+
+	select {
+	case acked <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// IDs of messages waiting for acknowledgement.
+func (t *Tracker) Pending() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	ids := make([]string, 0, len(t.pending))
+	for id := range t.pending {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Forward msg once and wait for its acknowledgement, unless the transport
+// reported it with the delivery.
+func (t *Tracker) deliver(ctx context.Context, serverID router.ServerID, msg *router.Message, acked <-chan struct{}) (*router.Message, error) {
+	var reply *router.Message
+	var err error
+	if acknowledger, ok := t.forwarder.(Acknowledger); ok {
+		var ackedNow bool
+		reply, ackedNow, err = acknowledger.ForwardAck(ctx, serverID, msg)
+		if err != nil || ackedNow {
+			return reply, err
+		}
+	} else {
+		reply, err = t.forwarder.Forward(ctx, serverID, msg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := t.wait(ctx, acked); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// Wait for an acknowledgement or the timeout.
+func (t *Tracker) wait(ctx context.Context, acked <-chan struct{}) error {
+	timer := time.NewTimer(t.timeout())
+	defer timer.Stop()
+
+	select {
+	case <-acked:
+		return nil
+	case <-timer.C:
+		return ErrNotAcknowledged
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Pause for delay, reporting false if ctx is done first.
+func sleep(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Pick the server for a redelivery.  The previous server is kept unless the
+// service has a pool the server is no longer part of, in which case the
+// client's mapping is removed and the resolver picks the next server,
+// storing it as the client's mapping as its policy says.
+func (t *Tracker) redeliveryServer(ctx context.Context, msg *router.Message, previous router.ServerID) (router.ServerID, error) {
+	pool, err := t.table.GetServicePool(msg.ServiceID)
+	if err != nil || len(pool) == 0 {
+		return previous, nil
+	}
+
+	for _, serverID := range pool {
+		if serverID == previous {
+			return previous, nil
+		}
+	}
+
+	if err := t.table.RemoveClientServiceServer(msg.ClientID, msg.ServiceID); err != nil {
+		return "", err
+	}
+	return t.resolver.ResolveContext(ctx, msg.ClientID, msg.ServiceID)
+}
+
+func (t *Tracker) isAcked(serviceID router.ServiceID) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.services[serviceID]
+}
+
+// Start waiting for an acknowledgement of id, or report false if one is
+// already awaited.
+func (t *Tracker) track(id string) (<-chan struct{}, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, ok := t.pending[id]; ok {
+		return nil, false
+	}
+
+	acked := make(chan struct{}, 1)
+	t.pending[id] = acked
+	return acked, true
+}
+
+func (t *Tracker) untrack(id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.pending, id)
+}
+
+func (t *Tracker) timeout() time.Duration {
+	if t.Timeout > 0 {
+		return t.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (t *Tracker) maxAttempts() int {
+	if t.MaxAttempts > 0 {
+		return t.MaxAttempts
+	}
+	return DefaultMaxAttempts
+}
+
+func (t *Tracker) retryDelay() time.Duration {
+	if t.RetryDelay > 0 {
+		return t.RetryDelay
+	}
+	return DefaultRetryDelay
+}
+
+func newID() string {
+	var buf [16]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
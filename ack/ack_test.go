@@ -0,0 +1,211 @@
+package ack
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/robertkluin/message-flow/httptransport"
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routingtable"
+)
+
+// A forwarder that acknowledges messages delivered to the listed servers.
+type fakeServers struct {
+	lock      sync.Mutex
+	tracker   *Tracker
+	acking    map[router.ServerID]bool
+	delivered []router.ServerID
+}
+
+func (f *fakeServers) Forward(ctx context.Context, serverID router.ServerID, msg *router.Message) (*router.Message, error) {
+	f.lock.Lock()
+	f.delivered = append(f.delivered, serverID)
+	acking := f.acking[serverID]
+	f.lock.Unlock()
+
+	if acking {
+		go f.tracker.Ack(msg.ID)
+	}
+	return &router.Message{Body: []byte(serverID)}, nil
+}
+
+func TestRedeliveryToNewPoolMember(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	table.AddServerToServicePool("service.1", "server.1")
+	table.SetClientServiceServer("client.1", "service.1", "server.1")
+
+	servers := &fakeServers{acking: map[router.ServerID]bool{"server.2": true}}
+	tracker := New(servers, table, router.NewResolver(table, nil))
+	tracker.SetAcked("service.1", true)
+	tracker.Timeout = 10 * time.Millisecond
+	tracker.RetryDelay = time.Millisecond
+	servers.tracker = tracker
+
+	// server.1 leaves the pool while the message to it is unacknowledged.
+	table.RemoveServerFromServicePool("service.1", "server.1")
+	table.AddServerToServicePool("service.1", "server.2")
+
+	msg := &router.Message{ClientID: "client.1", ServiceID: "service.1"}
+	reply, err := tracker.Forward(context.Background(), "server.1", msg)
+	if err != nil || string(reply.Body) != "server.2" {
+		t.Fatalf("unexpected result: %+v, %v", reply, err)
+	}
+	if msg.ID != "" {
+		t.Errorf("the caller's message was given ID %q", msg.ID)
+	}
+	if len(servers.delivered) != 2 || servers.delivered[0] != "server.1" || servers.delivered[1] != "server.2" {
+		t.Errorf("unexpected deliveries %v", servers.delivered)
+	}
+
+	// The client's mapping follows the redelivery.
+	if serverID, _ := table.GetClientServiceServer("client.1", "service.1"); serverID != "server.2" {
+		t.Errorf("client mapping not updated, got %q", serverID)
+	}
+	if pending := tracker.Pending(); len(pending) != 0 {
+		t.Errorf("expected nothing pending, got %v", pending)
+	}
+}
+
+func TestFailureAfterMaxAttempts(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	table.AddServerToServicePool("service.1", "server.1")
+
+	servers := &fakeServers{}
+	tracker := New(servers, table, router.NewResolver(table, nil))
+	tracker.SetAcked("service.1", true)
+	tracker.Timeout = time.Millisecond
+	tracker.RetryDelay = 20 * time.Millisecond
+	tracker.MaxAttempts = 2
+
+	var failed []Attempt
+	tracker.OnFailure = func(msg *router.Message, attempts []Attempt) {
+		failed = attempts
+	}
+
+	msg := &router.Message{ID: "msg.1", ClientID: "client.1", ServiceID: "service.1"}
+	_, err := tracker.Forward(context.Background(), "server.1", msg)
+	if err != ErrNotAcknowledged {
+		t.Errorf("expected ErrNotAcknowledged, got %v", err)
+	}
+
+	// The server is still in the pool, so both attempts went to it, the
+	// second after the retry delay.
+	if len(failed) != 2 || failed[0].ServerID != "server.1" || failed[1].ServerID != "server.1" {
+		t.Fatalf("unexpected attempts %+v", failed)
+	}
+	if gap := failed[1].Time.Sub(failed[0].Time); gap < 20*time.Millisecond {
+		t.Errorf("expected redelivery to wait for the retry delay, waited %v", gap)
+	}
+
+	if tracker.Ack("msg.1") {
+		t.Errorf("expected late ack to be ignored")
+	}
+}
+
+// Always picks the last server of the pool.
+type lastSelector struct{}
+
+func (lastSelector) Select(clientID router.ClientID, serviceID router.ServiceID, pool []router.ServerID) (router.ServerID, error) {
+	return pool[len(pool)-1], nil
+}
+
+func TestRedeliveryFollowsPolicy(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	table.AddServerToServicePool("service.1", "server.1")
+	table.AddServerToServicePool("service.1", "server.2")
+	table.AddServerToServicePool("service.1", "server.3")
+
+	servers := &fakeServers{acking: map[router.ServerID]bool{"server.3": true}}
+	resolver := router.NewResolver(table, nil)
+	resolver.SetPolicy("service.1", router.Policy{Selector: lastSelector{}})
+	tracker := New(servers, table, resolver)
+	tracker.Timeout = 10 * time.Millisecond
+	tracker.RetryDelay = time.Millisecond
+	tracker.SetAcked("service.1", true)
+	servers.tracker = tracker
+
+	table.RemoveServerFromServicePool("service.1", "server.1")
+	reply, err := tracker.Forward(context.Background(), "server.1", &router.Message{ClientID: "client.1", ServiceID: "service.1"})
+	if err != nil || string(reply.Body) != "server.3" {
+		t.Errorf("expected the service's selector to pick server.3, got %+v, %v", reply, err)
+	}
+}
+
+func TestPendingID(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	servers := &fakeServers{}
+	tracker := New(servers, table, router.NewResolver(table, nil))
+	tracker.Timeout = 50 * time.Millisecond
+	tracker.MaxAttempts = 1
+	tracker.SetAcked("service.1", true)
+
+	done := make(chan struct{})
+	go func() {
+		tracker.Forward(context.Background(), "server.1", &router.Message{ID: "msg.1", ServiceID: "service.1"})
+		close(done)
+	}()
+	for len(tracker.Pending()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := tracker.Forward(context.Background(), "server.1", &router.Message{ID: "msg.1", ServiceID: "service.1"}); err != ErrPending {
+		t.Errorf("expected ErrPending, got %v", err)
+	}
+	if pending := tracker.Pending(); len(pending) != 1 {
+		t.Errorf("expected the first message to stay pending, got %v", pending)
+	}
+	<-done
+
+	// Services without acknowledgements are forwarded once.
+	if _, err := tracker.Forward(context.Background(), "server.1", &router.Message{ServiceID: "service.2"}); err != nil {
+		t.Errorf("expected unacked service to pass through, got %v", err)
+	}
+}
+
+func TestHTTPAck(t *testing.T) {
+	var tracker *Tracker
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(httptransport.MessageIDHeader)
+		if req.Header.Get(httptransport.ServiceIDHeader) == "later" {
+			// Acknowledge after responding, through the router's endpoint.
+			w.WriteHeader(http.StatusAccepted)
+			go func() {
+				time.Sleep(5 * time.Millisecond)
+				ackReq := httptest.NewRequest("POST", "/ack", nil)
+				ackReq.Header.Set(httptransport.MessageIDHeader, id)
+				httptransport.AckHandler(tracker.Ack).ServeHTTP(httptest.NewRecorder(), ackReq)
+			}()
+			return
+		}
+		if req.Header.Get(httptransport.ServiceIDHeader) == "now" {
+			w.Header().Set(httptransport.AckHeader, id)
+		}
+		w.Write([]byte("reply"))
+	}))
+	defer server.Close()
+
+	table := routingtable.NewMemoryRoutingTable()
+	tracker = New(httptransport.NewForwarder(nil), table, router.NewResolver(table, nil))
+	tracker.Timeout = time.Second
+	tracker.MaxAttempts = 1
+	for _, serviceID := range []router.ServiceID{"now", "later", "never"} {
+		tracker.SetAcked(serviceID, true)
+	}
+
+	serverID := router.ServerID(server.URL)
+	if reply, err := tracker.Forward(context.Background(), serverID, &router.Message{ServiceID: "now"}); err != nil || string(reply.Body) != "reply" {
+		t.Errorf("expected the header to acknowledge, got %+v, %v", reply, err)
+	}
+	if _, err := tracker.Forward(context.Background(), serverID, &router.Message{ServiceID: "later"}); err != nil {
+		t.Errorf("expected the ack endpoint to acknowledge, got %v", err)
+	}
+
+	tracker.Timeout = 10 * time.Millisecond
+	if _, err := tracker.Forward(context.Background(), serverID, &router.Message{ServiceID: "never"}); err != ErrNotAcknowledged {
+		t.Errorf("expected a reply without an ack to fail, got %v", err)
+	}
+}
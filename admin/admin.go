@@ -0,0 +1,317 @@
+// Package admin exposes a routing table over HTTP so operators can inspect
+// and change routes without writing Go code.
+//
+// Every ClientTable and ServiceTable operation has a JSON endpoint, as do the
+// router.Scanner listings when the table supports them, and
+// router.Resolver.Explain when the handler is given a resolver, described
+// by the OpenAPI document served at /openapi.json.  Tables implementing
+// router.ContextTable are bound to each request's context.  Values are exchanged as
+// {"server": "..."} objects, and pools as {"servers": [...]}.  Routing table
+// errors are returned as {"error": "...", "code": "..."} with a matching HTTP
+// status, see StatusCode.
+package admin
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+//go:embed openapi.json
+var openAPI []byte
+
+// Server is the body of requests and responses holding a single server ID.
+type Server struct {
+	Server router.ServerID `json:"server"`
+}
+
+// Pool is the body of responses listing a service's pool.
+type Pool struct {
+	Servers []router.ServerID `json:"servers"`
+}
+
+// Clients is the body of responses listing every client.
+type Clients struct {
+	Clients []router.ClientID `json:"clients"`
+}
+
+// Services is the body of responses listing every service.
+type Services struct {
+	Services []router.ServiceID `json:"services"`
+}
+
+// Mappings is the body of responses listing a client's service servers.
+type Mappings struct {
+	Services map[router.ServiceID]router.ServerID `json:"services"`
+}
+
+// Error is the body of error responses.
+type Error struct {
+	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
+}
+
+// Handler serves the admin API for a routing table.
+type Handler struct {
+	table router.RoutingTable
+	mux   *http.ServeMux
+
+	lock     sync.Mutex
+	resolver *router.Resolver
+}
+
+func NewHandler(table router.RoutingTable) *Handler {
+	handler := new(Handler)
+	handler.table = table
+	handler.mux = http.NewServeMux()
+
+	handler.mux.HandleFunc("GET /openapi.json", handler.serveOpenAPI)
+
+	handler.mux.HandleFunc("GET /clients", handler.listClients)
+	handler.mux.HandleFunc("GET /clients/{client}/services", handler.getClientServices)
+	handler.mux.HandleFunc("GET /clients/{client}/message-server", handler.getClientMessageServer)
+	handler.mux.HandleFunc("PUT /clients/{client}/message-server", handler.setClientMessageServer)
+	handler.mux.HandleFunc("GET /clients/{client}/services/{service}/server", handler.getClientServiceServer)
+	handler.mux.HandleFunc("PUT /clients/{client}/services/{service}/server", handler.setClientServiceServer)
+	handler.mux.HandleFunc("DELETE /clients/{client}/services/{service}/server", handler.removeClientServiceServer)
+	handler.mux.HandleFunc("GET /clients/{client}/services/{service}/explain", handler.explain)
+
+	handler.mux.HandleFunc("GET /services", handler.listServices)
+	handler.mux.HandleFunc("GET /services/{service}/server", handler.getServiceServer)
+	handler.mux.HandleFunc("PUT /services/{service}/server", handler.setServiceServer)
+	handler.mux.HandleFunc("GET /services/{service}/registrar", handler.getServiceRegistrar)
+	handler.mux.HandleFunc("PUT /services/{service}/registrar", handler.setServiceRegistrar)
+	handler.mux.HandleFunc("GET /services/{service}/random-server", handler.getServiceRandomServer)
+	handler.mux.HandleFunc("GET /services/{service}/pool", handler.getServicePool)
+	handler.mux.HandleFunc("POST /services/{service}/pool", handler.addServerToServicePool)
+	handler.mux.HandleFunc("DELETE /services/{service}/pool/{server}", handler.removeServerFromServicePool)
+
+	return handler
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.mux.ServeHTTP(w, req)
+}
+
+// Register an additional endpoint on the admin API.
+func (h *Handler) HandleFunc(pattern string, fn http.HandlerFunc) {
+	h.mux.HandleFunc(pattern, fn)
+}
+
+// HTTP status for a routing table error.
+func StatusCode(err error) int {
+	code, ok := router.ErrorCode(err)
+	if !ok {
+		return http.StatusInternalServerError
+	}
+
+	switch code {
+	case router.UnknownClient, router.UnknownService, router.MappingNotFoundError, router.ServerNotFoundError:
+		return http.StatusNotFound
+	case router.ServerPoolEmptyError:
+		return http.StatusConflict
+	case router.ServiceError, router.LookupError:
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (h *Handler) serveOpenAPI(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPI)
+}
+
+func (h *Handler) getClientMessageServer(w http.ResponseWriter, req *http.Request) {
+	serverID, err := h.tableFor(req).GetClientMessageServer(clientID(req))
+	writeServer(w, serverID, err)
+}
+
+func (h *Handler) setClientMessageServer(w http.ResponseWriter, req *http.Request) {
+	body, ok := readServer(w, req)
+	if !ok {
+		return
+	}
+	writeResult(w, h.tableFor(req).SetClientMessageServer(clientID(req), body.Server))
+}
+
+func (h *Handler) getClientServiceServer(w http.ResponseWriter, req *http.Request) {
+	serverID, err := h.tableFor(req).GetClientServiceServer(clientID(req), serviceID(req))
+	writeServer(w, serverID, err)
+}
+
+func (h *Handler) setClientServiceServer(w http.ResponseWriter, req *http.Request) {
+	body, ok := readServer(w, req)
+	if !ok {
+		return
+	}
+	writeResult(w, h.tableFor(req).SetClientServiceServer(clientID(req), serviceID(req), body.Server))
+}
+
+func (h *Handler) removeClientServiceServer(w http.ResponseWriter, req *http.Request) {
+	writeResult(w, h.tableFor(req).RemoveClientServiceServer(clientID(req), serviceID(req)))
+}
+
+func (h *Handler) getServiceServer(w http.ResponseWriter, req *http.Request) {
+	serverID, err := h.tableFor(req).GetServiceServer(serviceID(req))
+	writeServer(w, serverID, err)
+}
+
+func (h *Handler) setServiceServer(w http.ResponseWriter, req *http.Request) {
+	body, ok := readServer(w, req)
+	if !ok {
+		return
+	}
+	writeResult(w, h.tableFor(req).SetServiceServer(serviceID(req), body.Server))
+}
+
+func (h *Handler) getServiceRegistrar(w http.ResponseWriter, req *http.Request) {
+	serverID, err := h.tableFor(req).GetServiceRegistrar(serviceID(req))
+	writeServer(w, serverID, err)
+}
+
+func (h *Handler) setServiceRegistrar(w http.ResponseWriter, req *http.Request) {
+	body, ok := readServer(w, req)
+	if !ok {
+		return
+	}
+	writeResult(w, h.tableFor(req).SetServiceRegistrar(serviceID(req), body.Server))
+}
+
+func (h *Handler) getServiceRandomServer(w http.ResponseWriter, req *http.Request) {
+	serverID, err := h.tableFor(req).GetServiceRandomServer(serviceID(req))
+	writeServer(w, serverID, err)
+}
+
+func (h *Handler) getServicePool(w http.ResponseWriter, req *http.Request) {
+	pool, err := h.tableFor(req).GetServicePool(serviceID(req))
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, Pool{Servers: pool})
+}
+
+func (h *Handler) addServerToServicePool(w http.ResponseWriter, req *http.Request) {
+	body, ok := readServer(w, req)
+	if !ok {
+		return
+	}
+	writeResult(w, h.tableFor(req).AddServerToServicePool(serviceID(req), body.Server))
+}
+
+func (h *Handler) removeServerFromServicePool(w http.ResponseWriter, req *http.Request) {
+	serverID := router.ServerID(req.PathValue("server"))
+	writeResult(w, h.tableFor(req).RemoveServerFromServicePool(serviceID(req), serverID))
+}
+
+func (h *Handler) listClients(w http.ResponseWriter, req *http.Request) {
+	scanner, ok := h.scanner(w)
+	if !ok {
+		return
+	}
+
+	clients, err := scanner.Clients()
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, Clients{Clients: clients})
+}
+
+func (h *Handler) getClientServices(w http.ResponseWriter, req *http.Request) {
+	scanner, ok := h.scanner(w)
+	if !ok {
+		return
+	}
+
+	mappings, err := scanner.GetClientServices(clientID(req))
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, Mappings{Services: mappings})
+}
+
+func (h *Handler) listServices(w http.ResponseWriter, req *http.Request) {
+	scanner, ok := h.scanner(w)
+	if !ok {
+		return
+	}
+
+	services, err := scanner.Services()
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, Services{Services: services})
+}
+
+// The table bound to the request's context, when it is a
+// router.ContextTable.
+func (h *Handler) tableFor(req *http.Request) router.RoutingTable {
+	if contextTable, ok := h.table.(router.ContextTable); ok {
+		return contextTable.WithContext(req.Context())
+	}
+	return h.table
+}
+
+// The table as a router.Scanner, writing an error response when it cannot
+// list its contents.
+func (h *Handler) scanner(w http.ResponseWriter) (router.Scanner, bool) {
+	scanner, ok := h.table.(router.Scanner)
+	if !ok {
+		WriteJSON(w, http.StatusNotImplemented, Error{Error: "routing table cannot list its contents"})
+	}
+	return scanner, ok
+}
+
+func clientID(req *http.Request) router.ClientID {
+	return router.ClientID(req.PathValue("client"))
+}
+
+func serviceID(req *http.Request) router.ServiceID {
+	return router.ServiceID(req.PathValue("service"))
+}
+
+func readServer(w http.ResponseWriter, req *http.Request) (Server, bool) {
+	var body Server
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		WriteJSON(w, http.StatusBadRequest, Error{Error: "invalid request body: " + err.Error()})
+		return body, false
+	}
+	return body, true
+}
+
+func writeServer(w http.ResponseWriter, serverID router.ServerID, err error) {
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, Server{Server: serverID})
+}
+
+func writeResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Write err as an Error body with the status StatusCode gives it.
+func WriteError(w http.ResponseWriter, err error) {
+	var body Error
+	body.Error, body.Code = describeError(err)
+	WriteJSON(w, StatusCode(err), body)
+}
+
+// Write value as a JSON response.
+func WriteJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,137 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routingtable"
+)
+
+func TestHandler(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	server := httptest.NewServer(NewHandler(table))
+	defer server.Close()
+
+	do := func(method, path, body string) (int, map[string]interface{}) {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+
+		var result map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		field  string
+		value  interface{}
+	}{
+		{"GET", "/services/service.1/server", "", 404, "code", "UnknownService"},
+		{"PUT", "/services/service.1/server", `{"server": "server.1"}`, 204, "", nil},
+		{"GET", "/services/service.1/server", "", 200, "server", "server.1"},
+		{"GET", "/services/service.1/registrar", "", 404, "code", "ServerNotFoundError"},
+		{"PUT", "/services/service.1/registrar", `{"server": "registrar.1"}`, 204, "", nil},
+		{"GET", "/services/service.1/registrar", "", 200, "server", "registrar.1"},
+		{"GET", "/services/service.1/random-server", "", 409, "code", "ServerPoolEmptyError"},
+		{"POST", "/services/service.1/pool", `{"server": "pool.1"}`, 204, "", nil},
+		{"POST", "/services/service.1/pool", `{"server": "pool.2"}`, 204, "", nil},
+		{"DELETE", "/services/service.1/pool/pool.1", "", 204, "", nil},
+		{"GET", "/services/service.1/random-server", "", 200, "server", "pool.2"},
+		{"GET", "/services/service.1/pool", "", 200, "servers", []interface{}{"pool.2"}},
+
+		{"GET", "/clients/client.1/message-server", "", 404, "code", "UnknownClient"},
+		{"PUT", "/clients/client.1/message-server", `{"server": "tcp.1"}`, 204, "", nil},
+		{"GET", "/clients/client.1/message-server", "", 200, "server", "tcp.1"},
+		{"GET", "/clients/client.1/services/service.1/server", "", 404, "code", "MappingNotFoundError"},
+		{"PUT", "/clients/client.1/services/service.1/server", `{"server": "pool.2"}`, 204, "", nil},
+		{"GET", "/clients/client.1/services/service.1/server", "", 200, "server", "pool.2"},
+
+		{"GET", "/clients", "", 200, "clients", []interface{}{"client.1"}},
+		{"GET", "/clients/client.1/services", "", 200, "services", map[string]interface{}{"service.1": "pool.2"}},
+		{"GET", "/services", "", 200, "services", []interface{}{"service.1"}},
+
+		{"PUT", "/services/service.1/server", `not json`, 400, "", nil},
+	}
+
+	for _, test := range tests {
+		status, result := do(test.method, test.path, test.body)
+		if status != test.status {
+			t.Errorf("%s %s: got status %d, want %d (%v)", test.method, test.path, status, test.status, result)
+			continue
+		}
+		if test.field == "" {
+			continue
+		}
+
+		got, _ := json.Marshal(result[test.field])
+		want, _ := json.Marshal(test.value)
+		if string(got) != string(want) {
+			t.Errorf("%s %s: got %s %s, want %s", test.method, test.path, test.field, got, want)
+		}
+	}
+
+	status, doc := do("GET", "/openapi.json", "")
+	if status != 200 || doc["openapi"] == nil {
+		t.Errorf("unexpected OpenAPI document response: %d", status)
+	}
+}
+
+func TestHandlerExplain(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	table.AddServerToServicePool("service.1", "pool.1")
+	table.SetClientServiceServer("client.2", "service.1", "pinned.1")
+
+	handler := NewHandler(table)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client := NewClient(server.URL, nil)
+
+	if _, err := client.Explain("client.1", "service.1"); err == nil {
+		t.Errorf("expected explain to fail without a resolver")
+	}
+
+	resolver := router.NewResolver(table, nil)
+	resolver.SetPolicy("service.1", router.Policy{StickyTTL: time.Minute})
+	handler.SetResolver(resolver)
+
+	explain, err := client.Explain("client.1", "service.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if explain.Server != "pool.1" || explain.Source != "pool" || !explain.Sticky || explain.StickyTTL != "1m0s" {
+		t.Errorf("unexpected explanation %+v", explain)
+	}
+
+	sources := make([]string, len(explain.Steps))
+	for i, step := range explain.Steps {
+		sources[i] = step.Source + ":" + step.Code
+	}
+	if got := strings.Join(sources, " "); got != "mapping:UnknownClient catch-all:ServerNotFoundError registrar: pool:" {
+		t.Errorf("unexpected steps %s", got)
+	}
+	if pool := explain.Steps[3].Pool; len(pool) != 1 || pool[0] != "pool.1" || explain.Steps[3].Selector != "random" {
+		t.Errorf("unexpected pool step %+v", explain.Steps[3])
+	}
+
+	// Explaining does not map the client.
+	if _, err := table.GetClientServiceServer("client.1", "service.1"); err == nil {
+		t.Errorf("expected no mapping to be stored")
+	}
+
+	explain, _ = client.Explain("client.2", "service.1")
+	if explain.Server != "pinned.1" || explain.Source != "mapping" || len(explain.Steps) != 1 || explain.Steps[0].Expires != nil {
+		t.Errorf("unexpected explanation %+v", explain)
+	}
+}
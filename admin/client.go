@@ -0,0 +1,202 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+// Client is a router.RoutingTable and router.Scanner backed by a remote admin
+// API.  Errors returned by the API are converted back into routing table
+// errors.
+type Client struct {
+	baseURL string
+	http    *http.Client
+}
+
+// Create a client for the admin API at baseURL.  When httpClient is nil
+// http.DefaultClient is used.
+func NewClient(baseURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	client := new(Client)
+	client.baseURL = strings.TrimSuffix(baseURL, "/")
+	client.http = httpClient
+	return client
+}
+
+func (c *Client) GetClientMessageServer(clientID router.ClientID) (router.ServerID, error) {
+	return c.getServer(path("clients", string(clientID), "message-server"))
+}
+
+func (c *Client) SetClientMessageServer(clientID router.ClientID, serverID router.ServerID) error {
+	return c.send("PUT", path("clients", string(clientID), "message-server"), serverID)
+}
+
+func (c *Client) GetClientServiceServer(clientID router.ClientID, serviceID router.ServiceID) (router.ServerID, error) {
+	return c.getServer(path("clients", string(clientID), "services", string(serviceID), "server"))
+}
+
+func (c *Client) SetClientServiceServer(clientID router.ClientID, serviceID router.ServiceID, serverID router.ServerID) error {
+	return c.send("PUT", path("clients", string(clientID), "services", string(serviceID), "server"), serverID)
+}
+
+func (c *Client) RemoveClientServiceServer(clientID router.ClientID, serviceID router.ServiceID) error {
+	return c.do("DELETE", path("clients", string(clientID), "services", string(serviceID), "server"), nil, nil)
+}
+
+func (c *Client) GetServiceServer(serviceID router.ServiceID) (router.ServerID, error) {
+	return c.getServer(path("services", string(serviceID), "server"))
+}
+
+func (c *Client) SetServiceServer(serviceID router.ServiceID, serverID router.ServerID) error {
+	return c.send("PUT", path("services", string(serviceID), "server"), serverID)
+}
+
+func (c *Client) GetServiceRegistrar(serviceID router.ServiceID) (router.ServerID, error) {
+	return c.getServer(path("services", string(serviceID), "registrar"))
+}
+
+func (c *Client) SetServiceRegistrar(serviceID router.ServiceID, serverID router.ServerID) error {
+	return c.send("PUT", path("services", string(serviceID), "registrar"), serverID)
+}
+
+func (c *Client) GetServiceRandomServer(serviceID router.ServiceID) (router.ServerID, error) {
+	return c.getServer(path("services", string(serviceID), "random-server"))
+}
+
+func (c *Client) GetServicePool(serviceID router.ServiceID) ([]router.ServerID, error) {
+	var pool Pool
+	err := c.do("GET", path("services", string(serviceID), "pool"), nil, &pool)
+	if err != nil {
+		return nil, err
+	}
+	return pool.Servers, nil
+}
+
+func (c *Client) AddServerToServicePool(serviceID router.ServiceID, serverID router.ServerID) error {
+	return c.send("POST", path("services", string(serviceID), "pool"), serverID)
+}
+
+func (c *Client) RemoveServerFromServicePool(serviceID router.ServiceID, serverID router.ServerID) error {
+	return c.do("DELETE", path("services", string(serviceID), "pool", string(serverID)), nil, nil)
+}
+
+func (c *Client) Clients() ([]router.ClientID, error) {
+	var body Clients
+	if err := c.do("GET", "/clients", nil, &body); err != nil {
+		return nil, err
+	}
+	return body.Clients, nil
+}
+
+func (c *Client) Services() ([]router.ServiceID, error) {
+	var body Services
+	if err := c.do("GET", "/services", nil, &body); err != nil {
+		return nil, err
+	}
+	return body.Services, nil
+}
+
+func (c *Client) GetClientServices(clientID router.ClientID) (map[router.ServiceID]router.ServerID, error) {
+	var body Mappings
+	if err := c.do("GET", path("clients", string(clientID), "services"), nil, &body); err != nil {
+		return nil, err
+	}
+	return body.Services, nil
+}
+
+// Explain how the router resolves client's messages for service.
+func (c *Client) Explain(clientID router.ClientID, serviceID router.ServiceID) (*Explanation, error) {
+	body := new(Explanation)
+	if err := c.do("GET", path("clients", string(clientID), "services", string(serviceID), "explain"), nil, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func (c *Client) getServer(path string) (router.ServerID, error) {
+	var server Server
+	err := c.do("GET", path, nil, &server)
+	if err != nil {
+		return "", err
+	}
+	return server.Server, nil
+}
+
+func (c *Client) send(method, path string, serverID router.ServerID) error {
+	return c.do(method, path, Server{Server: serverID}, nil)
+}
+
+// Make a request, encoding body and decoding the response into result when
+// they are not nil.
+func (c *Client) do(method, path string, body, result interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return decodeError(resp)
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Convert an error response into a routing table error when it carries a
+// known code.
+func decodeError(resp *http.Response) error {
+	var body Error
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error == "" {
+		return fmt.Errorf("admin: %s", resp.Status)
+	}
+
+	if code, ok := parseCode(body.Code); ok {
+		return router.NewRoutingTableError(code, body.Error)
+	}
+	return fmt.Errorf("admin: %s", body.Error)
+}
+
+func parseCode(name string) (router.RoutingTableErrorCode, bool) {
+	for code := router.ServiceError; code <= router.MappingNotFoundError; code++ {
+		if code.String() == name {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+func path(segments ...string) string {
+	var buf strings.Builder
+	for _, segment := range segments {
+		buf.WriteString("/")
+		buf.WriteString(url.PathEscape(segment))
+	}
+	return buf.String()
+}
@@ -0,0 +1,47 @@
+package admin
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routingtable"
+)
+
+func newTestClient(t *testing.T) *Client {
+	server := httptest.NewServer(NewHandler(routingtable.NewMemoryRoutingTable()))
+	t.Cleanup(server.Close)
+	return NewClient(server.URL, nil)
+}
+
+func TestClientGetClientMessageServer(t *testing.T) {
+	router.TestGetClientMessageServer(t, newTestClient(t))
+}
+
+func TestClientGetClientServiceServer(t *testing.T) {
+	router.TestGetClientServiceServer(t, newTestClient(t))
+}
+
+func TestClientRemoveClientServiceServer(t *testing.T) {
+	router.TestRemoveClientServiceServer(t, newTestClient(t))
+}
+
+func TestClientGetServiceServer(t *testing.T) {
+	router.TestGetServiceServer(t, newTestClient(t))
+}
+
+func TestClientGetServiceRegistrar(t *testing.T) {
+	router.TestGetServiceRegistrar(t, newTestClient(t))
+}
+
+func TestClientGetServiceRandomServer(t *testing.T) {
+	router.TestGetServiceRandomServer(t, newTestClient(t))
+}
+
+func TestClientGetServicePool(t *testing.T) {
+	router.TestGetServicePool(t, newTestClient(t))
+}
+
+func TestClientScan(t *testing.T) {
+	router.TestScan(t, newTestClient(t))
+}
@@ -0,0 +1,103 @@
+package admin
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+// Explanation is the body of responses explaining how a client's messages
+// for a service are routed, see router.Resolver.Explain.  Error and Code
+// are set when resolving would fail.
+type Explanation struct {
+	Client    router.ClientID  `json:"client"`
+	Service   router.ServiceID `json:"service"`
+	Server    router.ServerID  `json:"server,omitempty"`
+	Source    string           `json:"source"`
+	Error     string           `json:"error,omitempty"`
+	Code      string           `json:"code,omitempty"`
+	Sticky    bool             `json:"sticky"`
+	StickyTTL string           `json:"sticky_ttl,omitempty"`
+	Steps     []Step           `json:"steps"`
+}
+
+// Step is one step of the lookup order in an Explanation.
+type Step struct {
+	Source    string            `json:"source"`
+	Server    router.ServerID   `json:"server,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	Code      string            `json:"code,omitempty"`
+	Expires   *time.Time        `json:"expires,omitempty"`
+	Expired   bool              `json:"expired,omitempty"`
+	Registrar router.ServerID   `json:"registrar,omitempty"`
+	Pool      []router.ServerID `json:"pool,omitempty"`
+	Selector  string            `json:"selector,omitempty"`
+}
+
+// Convert a resolver's explanation into its response body.
+func NewExplanation(explain *router.Explanation) Explanation {
+	body := Explanation{
+		Client:  explain.ClientID,
+		Service: explain.ServiceID,
+		Server:  explain.ServerID,
+		Source:  explain.Source.String(),
+		Sticky:  explain.Sticky,
+		Steps:   make([]Step, 0, len(explain.Steps)),
+	}
+	body.Error, body.Code = describeError(explain.Err)
+	if explain.StickyTTL > 0 {
+		body.StickyTTL = explain.StickyTTL.String()
+	}
+
+	for _, step := range explain.Steps {
+		item := Step{
+			Source:    step.Source.String(),
+			Server:    step.ServerID,
+			Expired:   step.Expired,
+			Registrar: step.Registrar,
+			Pool:      step.Pool,
+			Selector:  step.Selector,
+		}
+		item.Error, item.Code = describeError(step.Err)
+		if !step.Expires.IsZero() {
+			expires := step.Expires
+			item.Expires = &expires
+		}
+		body.Steps = append(body.Steps, item)
+	}
+	return body
+}
+
+// Explain routing decisions with resolver, enabling the explain endpoint.
+// Without a resolver the endpoint responds 501 Not Implemented.
+func (h *Handler) SetResolver(resolver *router.Resolver) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.resolver = resolver
+}
+
+func (h *Handler) explain(w http.ResponseWriter, req *http.Request) {
+	h.lock.Lock()
+	resolver := h.resolver
+	h.lock.Unlock()
+
+	if resolver == nil {
+		WriteJSON(w, http.StatusNotImplemented, Error{Error: "no resolver to explain routing decisions"})
+		return
+	}
+	explain := resolver.ExplainContext(req.Context(), clientID(req), serviceID(req))
+	WriteJSON(w, http.StatusOK, NewExplanation(explain))
+}
+
+// The message and routing table code, if any, of err.
+func describeError(err error) (string, string) {
+	if err == nil {
+		return "", ""
+	}
+	if code, ok := router.ErrorCode(err); ok {
+		return err.Error(), code.String()
+	}
+	return err.Error(), ""
+}
@@ -0,0 +1,127 @@
+// Package audit records changes made to a routing table.
+//
+// Table wraps a routing table, writing an Entry to a Sink for every call
+// that changes it, whether or not the call succeeds.  Entries hold the value
+// before and after the change, who made it, and when:
+//
+//	log := audit.NewLog(1000)
+//	table := audit.NewTable(table, log)
+//	ctx := audit.WithCaller(ctx, "alice")
+//	table.WithContext(ctx).SetServiceServer("chat", "chat-1:9000")
+//
+// Callers are named by the context the table is bound to with WithContext,
+// which the admin API does for each request.  Only changes made through the
+// Table are recorded; the client mappings a router.Resolver stores while
+// routing go to its own table.  JSONSink writes entries as
+// JSON lines, for example to a file opened with OpenFile; Log keeps the most
+// recent entries in memory and serves them over HTTP; and SinkFunc adapts a
+// callback.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+// An Entry records one change to a routing table.  Old and New hold the
+// value a call changed; calls changing a pool set Server to the server added
+// or removed and OldPool and NewPool to the pool before and after.  Error is
+// set when the call failed.
+type Entry struct {
+	Time      time.Time         `json:"time"`
+	Caller    string            `json:"caller,omitempty"`
+	Method    string            `json:"method"`
+	ClientID  router.ClientID   `json:"client,omitempty"`
+	ServiceID router.ServiceID  `json:"service,omitempty"`
+	Server    router.ServerID   `json:"server,omitempty"`
+	Old       router.ServerID   `json:"old,omitempty"`
+	New       router.ServerID   `json:"new,omitempty"`
+	OldPool   []router.ServerID `json:"old_pool,omitempty"`
+	NewPool   []router.ServerID `json:"new_pool,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// A Sink stores audit entries.
+type Sink interface {
+	Write(Entry) error
+}
+
+// SinkFunc adapts an ordinary function to the Sink interface.
+type SinkFunc func(Entry) error
+
+func (f SinkFunc) Write(entry Entry) error {
+	return f(entry)
+}
+
+// Write every entry to each of sinks, stopping at the first error.
+func MultiSink(sinks ...Sink) Sink {
+	return SinkFunc(func(entry Entry) error {
+		for _, sink := range sinks {
+			if err := sink.Write(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// JSONSink writes entries as JSON lines.
+type JSONSink struct {
+	lock    sync.Mutex
+	w       io.Writer
+	encoder *json.Encoder
+}
+
+func NewJSONSink(w io.Writer) *JSONSink {
+	sink := new(JSONSink)
+	sink.w = w
+	sink.encoder = json.NewEncoder(w)
+	return sink
+}
+
+// Open a JSON lines sink appending to the file at path, creating it if
+// needed.
+func OpenFile(path string) (*JSONSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONSink(file), nil
+}
+
+func (s *JSONSink) Write(entry Entry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.encoder.Encode(entry)
+}
+
+// Close the underlying writer if it is an io.Closer.
+func (s *JSONSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if closer, ok := s.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+type callerKey struct{}
+
+// Return ctx naming caller as the one making changes.
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// The caller named by ctx, or "" if there is none.
+func Caller(ctx context.Context) string {
+	caller, _ := ctx.Value(callerKey{}).(string)
+	return caller
+}
@@ -0,0 +1,226 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routingtable"
+)
+
+func TestTableGetClientServiceServer(t *testing.T) {
+	router.TestGetClientServiceServer(t, NewTable(routingtable.NewMemoryRoutingTable(), NewLog(100)))
+}
+
+func TestTableRemoveClientServiceServer(t *testing.T) {
+	router.TestRemoveClientServiceServer(t, NewTable(routingtable.NewMemoryRoutingTable(), NewLog(100)))
+}
+
+func TestTableScan(t *testing.T) {
+	router.TestScan(t, NewTable(routingtable.NewMemoryRoutingTable(), NewLog(100)))
+}
+
+func TestTable(t *testing.T) {
+	log := NewLog(100)
+	table := NewTable(routingtable.NewMemoryRoutingTable(), log)
+	alice := table.WithContext(WithCaller(context.Background(), "alice"))
+
+	start := time.Now()
+	alice.SetServiceServer("service.1", "server.1")
+	alice.SetServiceServer("service.1", "server.2")
+	table.AddServerToServicePool("service.1", "pool.1")
+	alice.AddServerToServicePool("service.1", "pool.2")
+	alice.RemoveServerFromServicePool("service.1", "pool.1")
+	alice.SetClientServiceServer("client.1", "service.1", "pool.2")
+	alice.RemoveClientServiceServer("client.1", "service.1")
+	table.GetServiceServer("service.1")
+
+	want := []Entry{
+		{Caller: "alice", Method: "SetServiceServer", ServiceID: "service.1", New: "server.1"},
+		{Caller: "alice", Method: "SetServiceServer", ServiceID: "service.1", Old: "server.1", New: "server.2"},
+		{Method: "AddServerToServicePool", ServiceID: "service.1", Server: "pool.1", OldPool: []router.ServerID{}, NewPool: []router.ServerID{"pool.1"}},
+		{Caller: "alice", Method: "AddServerToServicePool", ServiceID: "service.1", Server: "pool.2", OldPool: []router.ServerID{"pool.1"}, NewPool: []router.ServerID{"pool.1", "pool.2"}},
+		{Caller: "alice", Method: "RemoveServerFromServicePool", ServiceID: "service.1", Server: "pool.1", OldPool: []router.ServerID{"pool.1", "pool.2"}, NewPool: []router.ServerID{"pool.2"}},
+		{Caller: "alice", Method: "SetClientServiceServer", ClientID: "client.1", ServiceID: "service.1", New: "pool.2"},
+		{Caller: "alice", Method: "RemoveClientServiceServer", ClientID: "client.1", ServiceID: "service.1", Old: "pool.2"},
+	}
+
+	entries := log.Query(Query{})
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d entries, got %+v", len(want), entries)
+	}
+	for i, entry := range entries {
+		if entry.Time.Before(start) {
+			t.Errorf("entry %d: time %v before the change", i, entry.Time)
+		}
+		entry.Time = time.Time{}
+		if !reflect.DeepEqual(entry, want[i]) {
+			t.Errorf("entry %d = %+v, want %+v", i, entry, want[i])
+		}
+	}
+}
+
+// A table whose catch-all servers cannot be set.
+type readOnlyTable struct {
+	router.RoutingTable
+}
+
+func (readOnlyTable) SetServiceServer(router.ServiceID, router.ServerID) error {
+	return router.NewRoutingTableError(router.ServiceError, "Read only.")
+}
+
+func TestTableScanner(t *testing.T) {
+	if _, ok := NewTable(readOnlyTable{routingtable.NewMemoryRoutingTable()}, NewLog(1)).(router.Scanner); ok {
+		t.Error("expected a table over a non-Scanner not to be a Scanner")
+	}
+	table := NewTable(routingtable.NewMemoryRoutingTable(), NewLog(1))
+	if _, ok := table.WithContext(context.Background()).(router.Scanner); !ok {
+		t.Error("expected a bound table over a Scanner to be a Scanner")
+	}
+}
+
+func TestTableFailure(t *testing.T) {
+	log := NewLog(100)
+	table := NewTable(readOnlyTable{routingtable.NewMemoryRoutingTable()}, log)
+
+	if err := table.SetServiceServer("service.1", "server.1"); err == nil {
+		t.Fatal("expected SetServiceServer to fail")
+	}
+	entries := log.Query(Query{})
+	if len(entries) != 1 || entries[0].New != "server.1" || entries[0].Error == "" {
+		t.Errorf("expected the failed call to be recorded, got %+v", entries)
+	}
+}
+
+func TestTableUpdate(t *testing.T) {
+	log := NewLog(100)
+	table := NewTable(routingtable.NewMemoryRoutingTable(), log)
+
+	err := table.Update(func(txn router.RoutingTable) error {
+		txn.SetServiceServer("service.1", "server.1")
+		return errors.New("abandoned")
+	})
+	if err == nil || len(log.Query(Query{})) != 0 {
+		t.Errorf("expected abandoned update to record nothing, got %v", log.Query(Query{}))
+	}
+
+	table.WithContext(WithCaller(context.Background(), "config")).(router.Updater).Update(func(txn router.RoutingTable) error {
+		txn.SetServiceServer("service.1", "server.1")
+		return txn.SetServiceRegistrar("service.1", "registrar.1")
+	})
+	entries := log.Query(Query{Caller: "config"})
+	if len(entries) != 2 || entries[0].Method != "SetServiceServer" || entries[1].Method != "SetServiceRegistrar" {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+}
+
+func TestTableSinkError(t *testing.T) {
+	sink := SinkFunc(func(Entry) error { return errors.New("disk full") })
+	table := NewTable(routingtable.NewMemoryRoutingTable(), sink)
+
+	if err := table.SetServiceServer("service.1", "server.1"); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("expected unrecorded change to be reported, got %v", err)
+	}
+}
+
+func TestJSONSink(t *testing.T) {
+	var buf bytes.Buffer
+	table := NewTable(routingtable.NewMemoryRoutingTable(), MultiSink(NewJSONSink(&buf), NewLog(1)))
+	table.SetServiceServer("service.1", "server.1")
+	table.SetClientMessageServer("client.1", "tcp.1")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", buf.String())
+	}
+	var entry Entry
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil || entry.Method != "SetClientMessageServer" || entry.New != "tcp.1" {
+		t.Errorf("unexpected line %s: %v", lines[1], err)
+	}
+}
+
+func TestLog(t *testing.T) {
+	log := NewLog(3)
+	for i, method := range []string{"a", "b", "c", "d"} {
+		log.Write(Entry{Time: time.Unix(int64(i), 0), Method: method, ServiceID: "service.1"})
+	}
+
+	methods := func(entries []Entry) string {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Method)
+		}
+		return strings.Join(names, "")
+	}
+
+	tests := []struct {
+		query Query
+		want  string
+	}{
+		{Query{}, "bcd"},
+		{Query{Limit: 2}, "cd"},
+		{Query{Method: "c"}, "c"},
+		{Query{Since: time.Unix(2, 0)}, "cd"},
+		{Query{ServiceID: "service.2"}, ""},
+	}
+	for _, test := range tests {
+		if got := methods(log.Query(test.query)); got != test.want {
+			t.Errorf("Query(%+v) = %q, want %q", test.query, got, test.want)
+		}
+	}
+
+	server := httptest.NewServer(HTTPCaller(log))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/audit?limit=1&since=1970-01-01T00:00:02Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body Entries
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if methods(body.Entries) != "d" {
+		t.Errorf("unexpected response %+v", body)
+	}
+
+	resp, _ = http.Get(server.URL + "/audit?limit=many")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected bad limit to be rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestHTTPCaller(t *testing.T) {
+	var caller string
+	handler := HTTPCaller(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		caller = Caller(req.Context())
+	}))
+
+	req := httptest.NewRequest("PUT", "/services/service.1/server", nil)
+	req.SetBasicAuth("alice", "secret")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if caller != "alice@"+req.RemoteAddr {
+		t.Errorf("caller = %q, want alice@%s", caller, req.RemoteAddr)
+	}
+
+	req = httptest.NewRequest("PUT", "/services/service.1/server", nil)
+	req.SetBasicAuth("alice", "secret")
+	handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(WithCaller(req.Context(), "bob")))
+	if caller != "bob" {
+		t.Errorf("caller = %q, want the authenticated bob", caller)
+	}
+
+	req = httptest.NewRequest("PUT", "/services/service.1/server", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if caller != req.RemoteAddr {
+		t.Errorf("caller = %q, want %q", caller, req.RemoteAddr)
+	}
+}
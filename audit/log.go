@@ -0,0 +1,154 @@
+package audit
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/robertkluin/message-flow/admin"
+	"github.com/robertkluin/message-flow/router"
+)
+
+// Log is a Sink keeping the most recent entries in memory so they can be
+// queried.
+type Log struct {
+	lock    sync.Mutex
+	entries []Entry
+	next    int
+	full    bool
+}
+
+// Create a log keeping the last size entries.
+func NewLog(size int) *Log {
+	log := new(Log)
+	log.entries = make([]Entry, size)
+	return log
+}
+
+func (l *Log) Write(entry Entry) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if len(l.entries) == 0 {
+		return nil
+	}
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+	return nil
+}
+
+// A Query selects entries from a Log.  Zero fields match every entry.
+type Query struct {
+	ClientID  router.ClientID
+	ServiceID router.ServiceID
+	Method    string
+	Caller    string
+
+	// Only entries recorded at or after Since.
+	Since time.Time
+
+	// At most Limit of the most recent matching entries.
+	Limit int
+}
+
+// The entries matching query, oldest first.
+func (l *Log) Query(query Query) []Entry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var matched []Entry
+	for i := 0; i < l.len(); i++ {
+		entry := l.entries[(l.start()+i)%len(l.entries)]
+		if query.matches(entry) {
+			matched = append(matched, entry)
+		}
+	}
+
+	if query.Limit > 0 && len(matched) > query.Limit {
+		matched = matched[len(matched)-query.Limit:]
+	}
+	return matched
+}
+
+func (l *Log) len() int {
+	if l.full {
+		return len(l.entries)
+	}
+	return l.next
+}
+
+func (l *Log) start() int {
+	if l.full {
+		return l.next
+	}
+	return 0
+}
+
+func (q Query) matches(entry Entry) bool {
+	return (q.ClientID == "" || entry.ClientID == q.ClientID) &&
+		(q.ServiceID == "" || entry.ServiceID == q.ServiceID) &&
+		(q.Method == "" || entry.Method == q.Method) &&
+		(q.Caller == "" || entry.Caller == q.Caller) &&
+		!entry.Time.Before(q.Since)
+}
+
+// Entries is the body of responses listing audit entries.
+type Entries struct {
+	Entries []Entry `json:"entries"`
+}
+
+// Serve entries matching the client, service, method, caller, since
+// (RFC 3339) and limit query parameters as an Entries body.
+func (l *Log) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	query := Query{
+		ClientID:  router.ClientID(params.Get("client")),
+		ServiceID: router.ServiceID(params.Get("service")),
+		Method:    params.Get("method"),
+		Caller:    params.Get("caller"),
+	}
+
+	var err error
+	if since := params.Get("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			admin.WriteJSON(w, http.StatusBadRequest, admin.Error{Error: "invalid since: " + err.Error()})
+			return
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 0 {
+			admin.WriteJSON(w, http.StatusBadRequest, admin.Error{Error: "invalid limit " + strconv.Quote(limit)})
+			return
+		}
+	}
+
+	entries := l.Query(query)
+	if entries == nil {
+		entries = []Entry{}
+	}
+	admin.WriteJSON(w, http.StatusOK, Entries{Entries: entries})
+}
+
+// Record the request's caller in its context.  A caller already named in the
+// request's context, for example by a handler that authenticated the request,
+// is kept.  Otherwise basic auth user names are not checked, so one given is
+// recorded with the remote address, as "alice@192.0.2.1:51234"; without one
+// the caller is the remote address alone.
+func HTTPCaller(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if Caller(req.Context()) != "" {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		caller := req.RemoteAddr
+		if user, _, ok := req.BasicAuth(); ok {
+			caller = user + "@" + req.RemoteAddr
+		}
+		handler.ServeHTTP(w, req.WithContext(WithCaller(req.Context(), caller)))
+	})
+}
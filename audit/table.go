@@ -0,0 +1,183 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+// A Table wraps a routing table, recording every change made through it.
+// Old values are read just before each change.  The router.Updater methods
+// are passed through, and changes made in an Update are recorded once it
+// succeeds.  Tables implement router.Scanner only when the wrapped table
+// does.
+type Table interface {
+	router.RoutingTable
+	router.ContextTable
+	router.Updater
+}
+
+type auditTable struct {
+	table router.RoutingTable
+	sink  Sink
+	ctx   context.Context
+}
+
+// An auditTable over a router.Scanner, passing its methods through.
+type scanningTable struct {
+	*auditTable
+}
+
+func NewTable(table router.RoutingTable, sink Sink) Table {
+	t := new(auditTable)
+	t.table = table
+	t.sink = sink
+	t.ctx = context.Background()
+	return t.wrap()
+}
+
+// Expose t as a router.Scanner if the wrapped table is one.
+func (t *auditTable) wrap() Table {
+	if _, ok := t.table.(router.Scanner); ok {
+		return &scanningTable{t}
+	}
+	return t
+}
+
+// A copy of the table recording changes as made by the caller in ctx.
+// Tables implementing router.ContextTable are bound to ctx as well.
+func (t *auditTable) WithContext(ctx context.Context) router.RoutingTable {
+	bound := *t
+	bound.ctx = ctx
+	if contextTable, ok := t.table.(router.ContextTable); ok {
+		bound.table = contextTable.WithContext(ctx)
+	}
+	return bound.wrap()
+}
+
+func (t *auditTable) GetClientMessageServer(clientID router.ClientID) (router.ServerID, error) {
+	return t.table.GetClientMessageServer(clientID)
+}
+
+func (t *auditTable) SetClientMessageServer(clientID router.ClientID, serverID router.ServerID) error {
+	old, _ := t.table.GetClientMessageServer(clientID)
+	err := t.table.SetClientMessageServer(clientID, serverID)
+	return t.record(Entry{Method: "SetClientMessageServer", ClientID: clientID, Old: old, New: serverID}, err)
+}
+
+func (t *auditTable) GetClientServiceServer(clientID router.ClientID, serviceID router.ServiceID) (router.ServerID, error) {
+	return t.table.GetClientServiceServer(clientID, serviceID)
+}
+
+func (t *auditTable) SetClientServiceServer(clientID router.ClientID, serviceID router.ServiceID, serverID router.ServerID) error {
+	old, _ := t.table.GetClientServiceServer(clientID, serviceID)
+	err := t.table.SetClientServiceServer(clientID, serviceID, serverID)
+	return t.record(Entry{Method: "SetClientServiceServer", ClientID: clientID, ServiceID: serviceID, Old: old, New: serverID}, err)
+}
+
+func (t *auditTable) RemoveClientServiceServer(clientID router.ClientID, serviceID router.ServiceID) error {
+	old, _ := t.table.GetClientServiceServer(clientID, serviceID)
+	err := t.table.RemoveClientServiceServer(clientID, serviceID)
+	return t.record(Entry{Method: "RemoveClientServiceServer", ClientID: clientID, ServiceID: serviceID, Old: old}, err)
+}
+
+func (t *auditTable) GetServiceServer(serviceID router.ServiceID) (router.ServerID, error) {
+	return t.table.GetServiceServer(serviceID)
+}
+
+func (t *auditTable) SetServiceServer(serviceID router.ServiceID, serverID router.ServerID) error {
+	old, _ := t.table.GetServiceServer(serviceID)
+	err := t.table.SetServiceServer(serviceID, serverID)
+	return t.record(Entry{Method: "SetServiceServer", ServiceID: serviceID, Old: old, New: serverID}, err)
+}
+
+func (t *auditTable) GetServiceRegistrar(serviceID router.ServiceID) (router.ServerID, error) {
+	return t.table.GetServiceRegistrar(serviceID)
+}
+
+func (t *auditTable) SetServiceRegistrar(serviceID router.ServiceID, serverID router.ServerID) error {
+	old, _ := t.table.GetServiceRegistrar(serviceID)
+	err := t.table.SetServiceRegistrar(serviceID, serverID)
+	return t.record(Entry{Method: "SetServiceRegistrar", ServiceID: serviceID, Old: old, New: serverID}, err)
+}
+
+func (t *auditTable) GetServiceRandomServer(serviceID router.ServiceID) (router.ServerID, error) {
+	return t.table.GetServiceRandomServer(serviceID)
+}
+
+func (t *auditTable) GetServicePool(serviceID router.ServiceID) ([]router.ServerID, error) {
+	return t.table.GetServicePool(serviceID)
+}
+
+func (t *auditTable) AddServerToServicePool(serviceID router.ServiceID, serverID router.ServerID) error {
+	old, _ := t.table.GetServicePool(serviceID)
+	err := t.table.AddServerToServicePool(serviceID, serverID)
+	pool, _ := t.table.GetServicePool(serviceID)
+	return t.record(Entry{Method: "AddServerToServicePool", ServiceID: serviceID, Server: serverID, OldPool: old, NewPool: pool}, err)
+}
+
+func (t *auditTable) RemoveServerFromServicePool(serviceID router.ServiceID, serverID router.ServerID) error {
+	old, _ := t.table.GetServicePool(serviceID)
+	err := t.table.RemoveServerFromServicePool(serviceID, serverID)
+	pool, _ := t.table.GetServicePool(serviceID)
+	return t.record(Entry{Method: "RemoveServerFromServicePool", ServiceID: serviceID, Server: serverID, OldPool: old, NewPool: pool}, err)
+}
+
+func (t *scanningTable) Clients() ([]router.ClientID, error) {
+	return t.table.(router.Scanner).Clients()
+}
+
+func (t *scanningTable) Services() ([]router.ServiceID, error) {
+	return t.table.(router.Scanner).Services()
+}
+
+func (t *scanningTable) GetClientServices(clientID router.ClientID) (map[router.ServiceID]router.ServerID, error) {
+	return t.table.(router.Scanner).GetClientServices(clientID)
+}
+
+// Make the changes fn makes all together, as router.Updater does, recording
+// them once they are made.  When the wrapped table is not an Updater fn is
+// called with the table itself and its changes are made one at a time.
+func (t *auditTable) Update(fn func(router.RoutingTable) error) error {
+	updater, ok := t.table.(router.Updater)
+	if !ok {
+		return fn(t.wrap())
+	}
+
+	var entries []Entry
+	err := updater.Update(func(txn router.RoutingTable) error {
+		entries = entries[:0]
+		view := &auditTable{table: txn, ctx: t.ctx, sink: SinkFunc(func(entry Entry) error {
+			entries = append(entries, entry)
+			return nil
+		})}
+		return fn(view.wrap())
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := t.sink.Write(entry); err != nil {
+			return fmt.Errorf("audit: changes made but not recorded: %v", err)
+		}
+	}
+	return nil
+}
+
+// Write entry for a call that returned err.  A change that was made but
+// could not be recorded is reported as an error.
+func (t *auditTable) record(entry Entry, err error) error {
+	entry.Time = time.Now()
+	entry.Caller = Caller(t.ctx)
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	if werr := t.sink.Write(entry); werr != nil && err == nil {
+		return fmt.Errorf("audit: %s made but not recorded: %v", entry.Method, werr)
+	}
+	return err
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routes"
+	"github.com/robertkluin/message-flow/routingtable"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the daemon's configuration file.  Files ending in ".toml" are
+// read as TOML, anything else as YAML.
+type Config struct {
+	// URL of the routing table backend, for example "memory://" or
+	// "bolt:///var/lib/message-flow/routes.db".
+	Table string `yaml:"table" toml:"table"`
+
+	// Address the admin API listens on.  The admin API is disabled when
+	// empty.
+	Admin string `yaml:"admin" toml:"admin"`
+
+	Listeners []ListenerConfig `yaml:"listeners" toml:"listeners"`
+
+	// Per-service resolution policies, keyed by service ID.
+	Services map[string]ServiceConfig `yaml:"services" toml:"services"`
+
+	// Static routes applied to the table at startup and on reload.
+	Routes routes.Config `yaml:"routes" toml:"routes"`
+
+	Tracing TracingConfig `yaml:"tracing" toml:"tracing"`
+
+	Audit AuditConfig `yaml:"audit" toml:"audit"`
+
+	Cache CacheConfig `yaml:"cache" toml:"cache"`
+
+	Stale StaleConfig `yaml:"stale" toml:"stale"`
+
+	Log LogConfig `yaml:"log" toml:"log"`
+
+	// How long in-flight messages are given to finish on shutdown.
+	DrainTimeout time.Duration `yaml:"drain_timeout" toml:"drain_timeout"`
+
+	// How often the file is checked for changes.  Services and routes are
+	// reloaded when it changes; other settings need a restart.
+	ReloadInterval time.Duration `yaml:"reload_interval" toml:"reload_interval"`
+
+	// Where the configuration was read from.
+	path string
+}
+
+// ListenerConfig configures a front-end.
+type ListenerConfig struct {
+	// One of "tcp", "grpc", "http", "push" or "websocket".
+	Type string `yaml:"type" toml:"type"`
+
+	Addr string `yaml:"addr" toml:"addr"`
+
+	// Message server ID registered for clients connected to push
+	// listeners: the URL servers POST messages for those clients to.  The
+	// listener accepts them at the URL's path, or at the root when it has
+	// none.  Defaults to the listen address.
+	ServerID string `yaml:"server_id" toml:"server_id"`
+}
+
+// TracingConfig sets where traces are exported.  Tracing is disabled unless
+// an endpoint is set.
+type TracingConfig struct {
+	// URL of an OTLP/HTTP collector, for example
+	// "http://otel-collector:4318".
+	Endpoint string `yaml:"endpoint" toml:"endpoint"`
+
+	// Fraction of new traces recorded, from 0 to 1.  Defaults to 1.
+	// Messages continuing a trace follow their parent's decision.
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio"`
+}
+
+// AuditConfig sets where changes made through the admin API and by
+// reloading the configuration are recorded.
+type AuditConfig struct {
+	// File changes are appended to as JSON lines.  Changes are only kept in
+	// memory when empty.
+	File string `yaml:"file" toml:"file"`
+
+	// How many recent changes are kept in memory and served at /audit on the
+	// admin address.  Defaults to 1000.
+	Entries int `yaml:"entries" toml:"entries"`
+}
+
+// CacheConfig sets up a cache of the routing table's client and service
+// records, for backends slower than memory.  Caching is disabled unless a
+// TTL is set.
+type CacheConfig struct {
+	// How long records are kept.  Records changed through the router,
+	// including its admin API, are dropped at once.
+	TTL time.Duration `yaml:"ttl" toml:"ttl"`
+
+	// How long unknown clients and services are remembered.  Defaults to
+	// five seconds.
+	NegativeTTL time.Duration `yaml:"negative_ttl" toml:"negative_ttl"`
+
+	// Most client and service records kept.  Default to 10000 and 1000.
+	Clients  int `yaml:"clients" toml:"clients"`
+	Services int `yaml:"services" toml:"services"`
+}
+
+// StaleConfig keeps the router routing with the last known answers while
+// the routing table's backend is unreachable.  It is disabled unless
+// enabled is set.
+type StaleConfig struct {
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+
+	// "reject" fails changes while the backend is unreachable, "buffer"
+	// makes them once it is reachable again.  Defaults to "reject".
+	Writes string `yaml:"writes" toml:"writes"`
+
+	// How often the backend is tried while unreachable.  Defaults to one
+	// second.
+	RetryInterval time.Duration `yaml:"retry_interval" toml:"retry_interval"`
+
+	// Most answers remembered.  Defaults to 100000.
+	Entries int `yaml:"entries" toml:"entries"`
+}
+
+// The write policy set, or RejectWrites when none is.
+func (c StaleConfig) writes() (routingtable.WritePolicy, error) {
+	switch c.Writes {
+	case "", "reject":
+		return routingtable.RejectWrites, nil
+	case "buffer":
+		return routingtable.BufferWrites, nil
+	}
+	return 0, fmt.Errorf("unsupported writes %q", c.Writes)
+}
+
+// LogConfig sets how the router logs to standard error.
+type LogConfig struct {
+	// One of "debug", "info", "warn" or "error".  Defaults to "info".  At
+	// debug level routing decisions and table changes are logged, sampled
+	// to the first 10 of each kind a second and every 100th after that.
+	Level string `yaml:"level" toml:"level"`
+
+	// "text" or "json".  Defaults to "text".
+	Format string `yaml:"format" toml:"format"`
+}
+
+// The level set, or info when none is.
+func (c LogConfig) level() (slog.Level, error) {
+	var level slog.Level
+	if c.Level == "" {
+		return slog.LevelInfo, nil
+	}
+	err := level.UnmarshalText([]byte(c.Level))
+	return level, err
+}
+
+// ServiceConfig sets a service's resolution policy.
+type ServiceConfig struct {
+	// How long a client stays mapped to the server it was given.  Zero
+	// keeps mappings until they are changed.
+	StickyTTL time.Duration `yaml:"sticky_ttl" toml:"sticky_ttl"`
+
+	// Set to false to resolve every message again instead of mapping
+	// clients to servers.
+	Sticky *bool `yaml:"sticky" toml:"sticky"`
+
+	// Pool selection strategy: "random", "round-robin" or "hash".
+	Selection string `yaml:"selection" toml:"selection"`
+
+	// Set to true to redeliver messages until servers acknowledge them,
+	// either with an Mflow-Ack reply header or by POSTing to the admin
+	// listener's /ack.
+	Ack bool `yaml:"ack" toml:"ack"`
+}
+
+const (
+	defaultDrainTimeout   = 30 * time.Second
+	defaultReloadInterval = 5 * time.Second
+	defaultAuditEntries   = 1000
+)
+
+var listenerTypes = map[string]bool{"tcp": true, "grpc": true, "http": true, "push": true, "websocket": true}
+
+// Read and validate the configuration file at path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := new(Config)
+	if filepath.Ext(path) == ".toml" {
+		err = toml.Unmarshal(data, config)
+	} else {
+		err = yaml.Unmarshal(data, config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	config.path = path
+	return config, nil
+}
+
+func (c *Config) validate() error {
+	if c.Table == "" {
+		c.Table = "memory://"
+	}
+	if c.DrainTimeout == 0 {
+		c.DrainTimeout = defaultDrainTimeout
+	}
+	if c.ReloadInterval == 0 {
+		c.ReloadInterval = defaultReloadInterval
+	}
+
+	if c.Audit.Entries == 0 {
+		c.Audit.Entries = defaultAuditEntries
+	}
+	if c.Audit.Entries < 0 {
+		return fmt.Errorf("audit: entries must not be negative")
+	}
+
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return fmt.Errorf("tracing: sample_ratio %v is not between 0 and 1", c.Tracing.SampleRatio)
+	}
+	if c.Tracing.SampleRatio == 0 {
+		c.Tracing.SampleRatio = 1
+	}
+
+	if c.Cache.TTL < 0 || c.Cache.NegativeTTL < 0 || c.Cache.Clients < 0 || c.Cache.Services < 0 {
+		return fmt.Errorf("cache: settings must not be negative")
+	}
+
+	if _, err := c.Stale.writes(); err != nil {
+		return fmt.Errorf("stale: %v", err)
+	}
+	if c.Stale.RetryInterval < 0 || c.Stale.Entries < 0 {
+		return fmt.Errorf("stale: settings must not be negative")
+	}
+
+	if _, err := c.Log.level(); err != nil {
+		return fmt.Errorf("log: %v", err)
+	}
+	if c.Log.Format != "" && c.Log.Format != "text" && c.Log.Format != "json" {
+		return fmt.Errorf("log: unsupported format %q", c.Log.Format)
+	}
+
+	for i, listener := range c.Listeners {
+		if !listenerTypes[listener.Type] {
+			return fmt.Errorf("listener %d: unsupported type %q", i, listener.Type)
+		}
+		if listener.Addr == "" {
+			return fmt.Errorf("listener %d: missing addr", i)
+		}
+		if listener.ServerID != "" && listener.Type != "push" {
+			return fmt.Errorf("listener %d: server_id is only used by push listeners", i)
+		}
+		if listener.Type == "push" {
+			if _, err := listener.deliverPath(); err != nil {
+				return fmt.Errorf("listener %d: %v", i, err)
+			}
+		}
+	}
+
+	for serviceID, service := range c.Services {
+		if _, err := service.policy(); err != nil {
+			return fmt.Errorf("service %s: %v", serviceID, err)
+		}
+	}
+	return nil
+}
+
+func (s ServiceConfig) policy() (router.Policy, error) {
+	policy := router.Policy{StickyTTL: s.StickyTTL}
+
+	if s.Sticky != nil && !*s.Sticky {
+		policy.NoSticky = true
+	}
+
+	if s.Selection != "" {
+		selector, err := router.NewSelector(s.Selection)
+		if err != nil {
+			return policy, err
+		}
+		policy.Selector = selector
+	}
+	return policy, nil
+}
+
+func (l ListenerConfig) serverID() router.ServerID {
+	if l.ServerID != "" {
+		return router.ServerID(l.ServerID)
+	}
+	return router.ServerID(l.Addr)
+}
+
+// The path a push listener accepts messages for its clients at.
+func (l ListenerConfig) deliverPath() (string, error) {
+	serverURL := string(l.serverID())
+	if !strings.Contains(serverURL, "://") {
+		serverURL = "http://" + serverURL
+	}
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid server_id: %v", err)
+	}
+
+	switch u.Path {
+	case "", "/":
+		return "/{$}", nil
+	case "/events", "/poll":
+		return "", fmt.Errorf("server_id path %s is used for clients", u.Path)
+	}
+	return u.Path, nil
+}
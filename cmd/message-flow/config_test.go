@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	yamlPath := writeConfig(t, "config.yaml", `
+table: memory://
+admin: ":8081"
+listeners:
+  - type: push
+    addr: ":7000"
+    server_id: router-1:7000
+services:
+  chat:
+    sticky_ttl: 10m
+    sticky: true
+    selection: hash
+routes:
+  services:
+    chat:
+      pool: [chat-1:9000]
+tracing:
+  endpoint: http://collector:4318
+`)
+	tomlPath := writeConfig(t, "config.toml", `
+table = "memory://"
+admin = ":8081"
+
+[[listeners]]
+type = "push"
+addr = ":7000"
+server_id = "router-1:7000"
+
+[services.chat]
+sticky_ttl = "10m"
+sticky = true
+selection = "hash"
+
+[routes.services.chat]
+pool = ["chat-1:9000"]
+
+[tracing]
+endpoint = "http://collector:4318"
+`)
+
+	for _, path := range []string{yamlPath, tomlPath} {
+		config, err := LoadConfig(path)
+		if err != nil {
+			t.Errorf("%s: %v", filepath.Base(path), err)
+			continue
+		}
+
+		if config.Admin != ":8081" || len(config.Listeners) != 1 || config.Listeners[0].serverID() != "router-1:7000" {
+			t.Errorf("%s: unexpected config %+v", filepath.Base(path), config)
+		}
+		if config.DrainTimeout != defaultDrainTimeout {
+			t.Errorf("%s: drain timeout not defaulted: %v", filepath.Base(path), config.DrainTimeout)
+		}
+
+		policy, err := config.Services["chat"].policy()
+		if err != nil || policy.StickyTTL != 10*time.Minute || policy.NoSticky || policy.Selector == nil {
+			t.Errorf("%s: unexpected policy %+v, %v", filepath.Base(path), policy, err)
+		}
+		if config.Tracing.Endpoint != "http://collector:4318" || config.Tracing.SampleRatio != 1 {
+			t.Errorf("%s: unexpected tracing %+v", filepath.Base(path), config.Tracing)
+		}
+		if pool := config.Routes.Services["chat"].Pool; len(pool) != 1 || pool[0] != "chat-1:9000" {
+			t.Errorf("%s: unexpected routes %+v", filepath.Base(path), config.Routes)
+		}
+	}
+}
+
+func TestLoadConfigRejectsInvalid(t *testing.T) {
+	tests := []string{
+		"listeners:\n  - type: udp\n    addr: \":7000\"\n",
+		"listeners:\n  - type: tcp\n",
+		"listeners:\n  - type: tcp\n    addr: \":7000\"\n    server_id: router-1:7000\n",
+		"listeners:\n  - type: push\n    addr: \":7000\"\n    server_id: http://router-1:7000/events\n",
+		"services:\n  chat:\n    selection: fastest\n",
+		"tracing:\n  endpoint: http://collector:4318\n  sample_ratio: 2\n",
+		"log:\n  level: loud\n",
+		"log:\n  format: xml\n",
+		"stale:\n  enabled: true\n  writes: queue\n",
+	}
+
+	for _, contents := range tests {
+		if _, err := LoadConfig(writeConfig(t, "config.yaml", contents)); err == nil {
+			t.Errorf("expected error for config:\n%s", contents)
+		}
+	}
+}
+
+func TestDeliverPath(t *testing.T) {
+	tests := map[string]string{
+		"":                             "/{$}",
+		"router-1:7003":                "/{$}",
+		"http://router-1:7003/":        "/{$}",
+		"http://router-1:7003/deliver": "/deliver",
+		"router-1:7003/push/in":        "/push/in",
+	}
+	for serverID, expected := range tests {
+		listener := ListenerConfig{Type: "push", Addr: ":7003", ServerID: serverID}
+		if path, err := listener.deliverPath(); path != expected || err != nil {
+			t.Errorf("%q: expected %s, got %s, %v", serverID, expected, path, err)
+		}
+	}
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/robertkluin/message-flow/ack"
+	"github.com/robertkluin/message-flow/admin"
+	"github.com/robertkluin/message-flow/audit"
+	"github.com/robertkluin/message-flow/frontend/grpcproxy"
+	"github.com/robertkluin/message-flow/frontend/httpproxy"
+	"github.com/robertkluin/message-flow/frontend/push"
+	"github.com/robertkluin/message-flow/frontend/tcp"
+	"github.com/robertkluin/message-flow/frontend/websocket"
+	"github.com/robertkluin/message-flow/httptransport"
+	"github.com/robertkluin/message-flow/logging"
+	"github.com/robertkluin/message-flow/metrics"
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routes"
+	"github.com/robertkluin/message-flow/routingtable"
+	_ "github.com/robertkluin/message-flow/routingtable/bolt"
+	"github.com/robertkluin/message-flow/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc"
+)
+
+// A service is a listener and the server answering on it.
+type service struct {
+	name     string
+	listener net.Listener
+	serve    func(net.Listener) error
+	shutdown func(context.Context) error
+}
+
+// How long buffered spans are given to be exported on shutdown.
+const tracerShutdownTimeout = 5 * time.Second
+
+type daemon struct {
+	config *Config
+	logger *slog.Logger
+	table  router.RoutingTable
+
+	// Caches the table when caching is configured.
+	cache *routingtable.CachingRoutingTable
+
+	// Answers from memory while the table is unreachable, when configured.
+	stale *routingtable.StaleRoutingTable
+
+	// The table as used for routing messages, recording metrics and
+	// traces.
+	routing router.RoutingTable
+
+	// The table as changed by operators, recording each change.  Client
+	// mappings the resolver stores while routing are routing decisions
+	// rather than operator changes, and are made through routing so they
+	// are not recorded.
+	audited  audit.Table
+	auditLog *audit.Log
+
+	// Where changes are appended when an audit file is configured.
+	auditFile *audit.JSONSink
+
+	// Records traces when tracing is configured.
+	tracer *sdktrace.TracerProvider
+
+	metrics  *metrics.Metrics
+	registry *prometheus.Registry
+	resolver *router.Resolver
+	handler  router.Handler
+	services []*service
+
+	// Redelivers messages to services that acknowledge them.
+	tracker *ack.Tracker
+
+	// Services with a policy from the configuration.
+	policies map[router.ServiceID]bool
+
+	// Signals asking for the configuration to be reloaded.
+	hangup <-chan os.Signal
+}
+
+func newDaemon(config *Config) (*daemon, error) {
+	logger, err := newLogger(config.Log, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	table, err := routingtable.Open(config.Table)
+	if err != nil {
+		return nil, err
+	}
+	if loggable, ok := table.(interface{ SetLogger(*slog.Logger) }); ok {
+		loggable.SetLogger(logger)
+	}
+
+	d := new(daemon)
+	d.config = config
+	d.logger = logger
+	d.table = table
+
+	var cached router.RoutingTable = table
+	if config.Cache.TTL > 0 {
+		d.cache = routingtable.NewCachingRoutingTable(table, &routingtable.CacheOptions{
+			Clients:     config.Cache.Clients,
+			Services:    config.Cache.Services,
+			TTL:         config.Cache.TTL,
+			NegativeTTL: config.Cache.NegativeTTL,
+		})
+		cached = d.cache
+	}
+	if config.Stale.Enabled {
+		writes, _ := config.Stale.writes()
+		d.stale = routingtable.NewStaleRoutingTable(cached, &routingtable.StaleOptions{
+			Entries:       config.Stale.Entries,
+			RetryInterval: config.Stale.RetryInterval,
+			Writes:        writes,
+		})
+		d.stale.SetLogger(logger)
+		cached = d.stale
+	}
+
+	d.auditLog = audit.NewLog(config.Audit.Entries)
+	var sink audit.Sink = d.auditLog
+	if config.Audit.File != "" {
+		d.auditFile, err = audit.OpenFile(config.Audit.File)
+		if err != nil {
+			d.closeTable()
+			return nil, err
+		}
+		sink = audit.MultiSink(d.auditFile, d.auditLog)
+	}
+	d.audited = audit.NewTable(cached, sink)
+
+	d.metrics = metrics.New()
+	d.routing = metrics.NewTable(cached, d.metrics)
+
+	var registrar router.Registrar = httptransport.NewRegistrar(nil)
+	if config.Tracing.Endpoint != "" {
+		d.tracer, err = newTracerProvider(config.Tracing)
+		if err != nil {
+			d.closeAudit()
+			d.closeTable()
+			return nil, err
+		}
+		d.routing = tracing.NewTable(d.routing, d.tracer)
+		registrar = tracing.NewRegistrar(registrar, d.tracer)
+	}
+
+	d.resolver = router.NewResolver(d.routing, registrar)
+	d.resolver.SetObserver(d.metrics.ObserveDecision)
+	d.resolver.SetLogger(d.logger)
+
+	// The tracker needs the transport's own forwarder to see acks carried
+	// on replies, so tracing wraps the tracker rather than the transport.
+	d.tracker = ack.New(httptransport.NewForwarder(nil), d.routing, d.resolver)
+	d.tracker.OnFailure = func(msg *router.Message, attempts []ack.Attempt) {
+		d.logger.Error("message never acknowledged", "message", msg.ID, "client", msg.ClientID, "service", msg.ServiceID, "attempts", len(attempts))
+	}
+	var forwarder router.Forwarder = d.tracker
+	if d.tracer != nil {
+		forwarder = tracing.NewForwarder(forwarder, d.tracer)
+	}
+	d.handler = router.NewRouter(d.resolver, forwarder)
+	if d.tracer != nil {
+		d.handler = tracing.NewHandler(d.handler, d.tracer)
+	}
+
+	d.registry = prometheus.NewRegistry()
+	d.registry.MustRegister(
+		d.metrics,
+		metrics.NewSizeCollector(table),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	if err := d.apply(config); err != nil {
+		d.closeTracer()
+		d.closeAudit()
+		d.closeTable()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Create a tracer provider exporting to the configured OTLP collector.
+func newTracerProvider(config TracingConfig) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(config.Endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "message-flow"))),
+	)
+	return provider, nil
+}
+
+// Export any spans still buffered and stop tracing.  The export is given
+// its own timeout, as the drain timeout may already have run out.
+func (d *daemon) closeTracer() {
+	if d.tracer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tracerShutdownTimeout)
+	defer cancel()
+	if err := d.tracer.Shutdown(ctx); err != nil {
+		d.logger.Error("tracing shutdown failed", router.ErrorKey, err)
+	}
+}
+
+// Create a logger writing to w as set by config.  Records below warning
+// level are sampled, as the resolver logs every routing decision at debug
+// level.
+func newLogger(config LogConfig, w io.Writer) (*slog.Logger, error) {
+	level, err := config.level()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler = slog.NewTextHandler(w, opts)
+	if config.Format == "json" {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(logging.NewSamplingHandler(handler, nil)), nil
+}
+
+// Close the audit file, if one is open.
+func (d *daemon) closeAudit() {
+	if d.auditFile == nil {
+		return
+	}
+	if err := d.auditFile.Close(); err != nil {
+		d.logger.Error("closing audit file failed", router.ErrorKey, err)
+	}
+}
+
+// Stop caching the routing table, and close it if it holds resources such
+// as open files.
+func (d *daemon) closeTable() {
+	if d.cache != nil {
+		d.cache.Close()
+	}
+	if closer, ok := d.table.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			d.logger.Error("closing table failed", router.ErrorKey, err)
+		}
+	}
+}
+
+// Apply the service policies and routes from config, replacing those from
+// the previous configuration.  Client mappings are kept unless the server
+// they point at was removed.
+func (d *daemon) apply(config *Config) error {
+	policies := make(map[router.ServiceID]bool)
+	for serviceID, service := range config.Services {
+		policy, err := service.policy()
+		if err != nil {
+			return err
+		}
+		d.resolver.SetPolicy(router.ServiceID(serviceID), policy)
+		d.tracker.SetAcked(router.ServiceID(serviceID), service.Ack)
+		policies[router.ServiceID(serviceID)] = true
+	}
+	for serviceID := range d.policies {
+		if !policies[serviceID] {
+			d.resolver.SetPolicy(serviceID, router.Policy{})
+			d.tracker.SetAcked(serviceID, false)
+		}
+	}
+	d.policies = policies
+
+	table := d.audited.WithContext(audit.WithCaller(context.Background(), "config"))
+	plan, err := routes.Apply(table, &config.Routes)
+	if err != nil {
+		return err
+	}
+	for _, op := range plan {
+		d.logger.Info("route applied", "call", op.String())
+	}
+	return nil
+}
+
+// Read the configuration file again and apply its services and routes.
+func (d *daemon) reload() error {
+	config, err := LoadConfig(d.config.path)
+	if err != nil {
+		return err
+	}
+	return d.apply(config)
+}
+
+// Reload the configuration whenever its file changes or a hangup signal
+// arrives, until ctx is done.  A configuration that fails to load is retried
+// each interval until it is fixed.
+func (d *daemon) watch(ctx context.Context) {
+	if d.config.path == "" {
+		return
+	}
+
+	loaded := modTime(d.config.path)
+	ticker := time.NewTicker(d.config.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.hangup:
+		case <-ticker.C:
+			if modTime(d.config.path).Equal(loaded) {
+				continue
+			}
+		}
+
+		modified := modTime(d.config.path)
+		if err := d.reload(); err != nil {
+			d.logger.Error("reload failed", "path", d.config.path, router.ErrorKey, err)
+			continue
+		}
+		loaded = modified
+		d.logger.Info("reloaded", "path", d.config.path)
+	}
+}
+
+// When the file at path was last modified, or the zero time if it cannot be
+// read.
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// Start listening on every configured address.
+func (d *daemon) listen() error {
+	for _, config := range d.config.Listeners {
+		if err := d.addListener(config); err != nil {
+			d.closeListeners()
+			return err
+		}
+	}
+
+	if d.config.Admin != "" {
+		handler := admin.NewHandler(d.audited)
+		handler.SetResolver(d.resolver)
+		handler.HandleFunc("GET /metrics", promhttp.HandlerFor(d.registry, promhttp.HandlerOpts{}).ServeHTTP)
+		handler.HandleFunc("GET /audit", d.auditLog.ServeHTTP)
+		handler.HandleFunc("POST /ack", httptransport.AckHandler(d.tracker.Ack).ServeHTTP)
+		if err := d.addHTTP("admin", d.config.Admin, audit.HTTPCaller(handler)); err != nil {
+			d.closeListeners()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *daemon) addListener(config ListenerConfig) error {
+	switch config.Type {
+	case "tcp":
+		listener, err := net.Listen("tcp", config.Addr)
+		if err != nil {
+			return err
+		}
+		// Clients are not registered as nothing can deliver to them.
+		server := tcp.NewServer("", d.routing, d.handler)
+		server.Logger = d.logger
+		d.services = append(d.services, &service{"tcp", listener, server.Serve, server.Shutdown})
+
+	case "grpc":
+		listener, err := net.Listen("tcp", config.Addr)
+		if err != nil {
+			return err
+		}
+		proxy := grpcproxy.NewProxy(d.resolver, nil)
+		proxy.Logger = d.logger
+		var opts []grpc.ServerOption
+		if d.tracer != nil {
+			opts = append(opts, grpc.StreamInterceptor(tracing.StreamServerInterceptor(d.tracer)))
+		}
+		server := proxy.NewServer(opts...)
+		d.services = append(d.services, &service{"grpc", listener, server.Serve, func(ctx context.Context) error {
+			defer proxy.Close()
+			return stopGRPC(ctx, server)
+		}})
+
+	case "http":
+		proxy := httpproxy.NewProxy(d.resolver)
+		proxy.Logger = d.logger
+		var handler http.Handler = proxy
+		if d.tracer != nil {
+			handler = tracing.NewHTTPHandler(handler, d.tracer)
+		}
+		return d.addHTTP("http", config.Addr, handler)
+
+	case "push":
+		path, err := config.deliverPath()
+		if err != nil {
+			return err
+		}
+		hub := push.NewHub(config.serverID(), d.routing)
+		mux := http.NewServeMux()
+		mux.Handle("/events", hub.SSEHandler())
+		mux.Handle("/poll", hub.PollHandler())
+		mux.Handle("/deliver", hub.DeliverHandler())
+		if path != "/deliver" {
+			mux.Handle(path, hub.DeliverHandler())
+		}
+		return d.addHTTP("push", config.Addr, mux)
+
+	case "websocket":
+		server := websocket.NewServer("", d.routing, d.handler)
+		server.Logger = d.logger
+		if err := d.addHTTP("websocket", config.Addr, server); err != nil {
+			return err
+		}
+
+		// The HTTP server does not wait for upgraded connections.
+		added := d.services[len(d.services)-1]
+		shutdownHTTP := added.shutdown
+		added.shutdown = func(ctx context.Context) error {
+			err := server.Shutdown(ctx)
+			if herr := shutdownHTTP(ctx); err == nil {
+				err = herr
+			}
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unsupported listener type %q", config.Type)
+	}
+
+	return nil
+}
+
+func (d *daemon) addHTTP(name, addr string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: handler}
+	serve := func(l net.Listener) error {
+		err := server.Serve(l)
+		if err == http.ErrServerClosed {
+			return nil
+		}
+		return err
+	}
+	d.services = append(d.services, &service{name, listener, serve, server.Shutdown})
+	return nil
+}
+
+func (d *daemon) closeListeners() {
+	for _, service := range d.services {
+		service.listener.Close()
+	}
+}
+
+// Listen and serve until ctx is done, then drain in-flight messages.
+func (d *daemon) run(ctx context.Context) error {
+	if err := d.listen(); err != nil {
+		return err
+	}
+	return d.serve(ctx)
+}
+
+// Serve on the open listeners until ctx is done or a server fails, then shut
+// every server down, giving in-flight messages the drain timeout to finish,
+// and close the table.  The configuration is reloaded while serving, and
+// buffered spans are exported before returning.
+func (d *daemon) serve(ctx context.Context) error {
+	go d.watch(ctx)
+
+	failed := make(chan error, len(d.services))
+	for _, s := range d.services {
+		d.logger.Info("listening", "listener", s.name, "addr", s.listener.Addr().String())
+		go func(s *service) {
+			err := s.serve(s.listener)
+			if err != nil && err != tcp.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+				failed <- fmt.Errorf("%s: %v", s.name, err)
+			}
+		}(s)
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-failed:
+	}
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), d.config.DrainTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range d.services {
+		wg.Add(1)
+		go func(s *service) {
+			defer wg.Done()
+			if serr := s.shutdown(drainCtx); serr != nil {
+				d.logger.Error("shutdown failed", "listener", s.name, router.ErrorKey, serr)
+			}
+		}(s)
+	}
+	wg.Wait()
+	d.closeTracer()
+	d.closeAudit()
+	d.closeTable()
+
+	return err
+}
+
+// Gracefully stop a gRPC server, stopping it outright if ctx is done first.
+func stopGRPC(ctx context.Context, server *grpc.Server) error {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		server.Stop()
+		return ctx.Err()
+	}
+}
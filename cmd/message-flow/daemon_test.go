@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/robertkluin/message-flow/audit"
+	"github.com/robertkluin/message-flow/frontend/tcp"
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routes"
+)
+
+func TestDaemon(t *testing.T) {
+	var traceparent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		traceparent = req.Header.Get("traceparent")
+		body, _ := io.ReadAll(req.Body)
+		io.WriteString(w, "pong:"+string(body))
+	}))
+	defer backend.Close()
+
+	exported := make(chan string, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		exported <- req.URL.Path
+	}))
+	defer collector.Close()
+
+	config := &Config{
+		Table:     "memory://",
+		Admin:     "127.0.0.1:0",
+		Listeners: []ListenerConfig{{Type: "tcp", Addr: "127.0.0.1:0"}},
+		Routes: routes.Config{
+			Services: map[router.ServiceID]routes.Service{"service.1": {Server: router.ServerID(backend.URL)}},
+		},
+		Tracing:      TracingConfig{Endpoint: collector.URL, SampleRatio: 1},
+		Audit:        AuditConfig{Entries: 100},
+		Cache:        CacheConfig{TTL: time.Minute},
+		Stale:        StaleConfig{Enabled: true},
+		DrainTimeout: time.Second,
+	}
+
+	d, err := newDaemon(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.serve(ctx) }()
+
+	conn, err := net.Dial("tcp", d.services[0].listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tcp.WriteFrame(conn, &tcp.Frame{Type: tcp.FrameHello, Payload: []byte("client.1")})
+	tcp.ReadFrame(conn, tcp.DefaultMaxFrameSize)
+	tcp.WriteFrame(conn, &tcp.Frame{Type: tcp.FrameMessage, Payload: tcp.EncodeMessage("service.1", []byte("ping"))})
+
+	reply, err := tcp.ReadFrame(conn, tcp.DefaultMaxFrameSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, body, _ := tcp.DecodeMessage(reply.Payload); string(body) != "pong:ping" {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+	if traceparent == "" {
+		t.Errorf("expected the forwarded message to carry a traceparent")
+	}
+
+	resp, err := http.Get("http://" + d.services[1].listener.Addr().String() + "/services/service.1/server")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("admin API not serving: %v, %v", resp, err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get("http://" + d.services[1].listener.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `mflow_resolver_decisions_total{result="ok",source="catch-all"} 1`) {
+		t.Errorf("metrics missing the routing decision:\n%s", body)
+	}
+
+	req, _ := http.NewRequest("PUT", "http://"+d.services[1].listener.Addr().String()+"/services/service.2/server", strings.NewReader(`{"server": "server.2"}`))
+	req.SetBasicAuth("alice", "")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get("http://" + d.services[1].listener.Addr().String() + "/audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries audit.Entries
+	json.NewDecoder(resp.Body).Decode(&entries)
+	resp.Body.Close()
+	if len(entries.Entries) != 2 || entries.Entries[0].Caller != "config" || !strings.HasPrefix(entries.Entries[1].Caller, "alice@") || entries.Entries[1].New != "server.2" {
+		t.Errorf("unexpected audit entries %+v", entries)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon did not shut down")
+	}
+
+	select {
+	case path := <-exported:
+		if path != "/v1/traces" {
+			t.Errorf("spans exported to %s", path)
+		}
+	default:
+		t.Errorf("expected spans to be exported on shutdown")
+	}
+}
+
+func TestDaemonReload(t *testing.T) {
+	path := writeConfig(t, "config.yaml", `
+reload_interval: 10ms
+routes:
+  services:
+    service.1:
+      pool: [pool.1, pool.2]
+`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := newDaemon(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.table.SetClientServiceServer("client.1", "service.1", "pool.1")
+	d.table.SetClientServiceServer("client.2", "service.1", "pool.2")
+
+	hangup := make(chan os.Signal, 1)
+	d.hangup = hangup
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.watch(ctx)
+
+	waitForPool := func(expected router.ServerID) {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			pool, _ := d.table.GetServicePool("service.1")
+			if len(pool) == 1 && pool[0] == expected {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("pool never became [%s]", expected)
+	}
+
+	// Reload on hangup, even if the file looks unchanged.
+	modified := modTime(path)
+	os.WriteFile(path, []byte("routes:\n  services:\n    service.1:\n      pool: [pool.2]\n"), 0644)
+	os.Chtimes(path, modified, modified)
+	hangup <- syscall.SIGHUP
+	waitForPool("pool.2")
+
+	// Only mappings to the removed server are dropped.
+	if _, err := d.table.GetClientServiceServer("client.1", "service.1"); err == nil {
+		t.Error("client.1 still mapped to a removed server")
+	}
+	if server, _ := d.table.GetClientServiceServer("client.2", "service.1"); server != "pool.2" {
+		t.Errorf("client.2 mapping changed to %q", server)
+	}
+
+	// Reload when the file changes.
+	os.WriteFile(path, []byte("routes:\n  services:\n    service.1:\n      pool: [pool.3]\n"), 0644)
+	os.Chtimes(path, modified.Add(time.Second), modified.Add(time.Second))
+	waitForPool("pool.3")
+}
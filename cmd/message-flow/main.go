@@ -0,0 +1,136 @@
+// Command message-flow runs a message-flow router.
+//
+// Usage:
+//
+//	message-flow -config /etc/message-flow/config.yaml
+//
+// The configuration selects the routing table backend, the front-end
+// listeners, the admin API address and per-service resolution policies.  For
+// example:
+//
+//	table: memory://
+//	admin: ":8081"
+//	drain_timeout: 30s
+//	listeners:
+//	  - type: tcp
+//	    addr: ":7000"
+//	  - type: grpc
+//	    addr: ":7001"
+//	  - type: http
+//	    addr: ":7002"
+//	  - type: push
+//	    addr: ":7003"
+//	    server_id: http://router-1:7003/deliver
+//	  - type: websocket
+//	    addr: ":7004"
+//	services:
+//	  chat:
+//	    sticky_ttl: 10m
+//	    selection: hash
+//	    ack: true
+//	routes:
+//	  services:
+//	    chat:
+//	      pool: [chat-1:9000, chat-2:9000]
+//	tracing:
+//	  endpoint: http://otel-collector:4318
+//	  sample_ratio: 0.1
+//	audit:
+//	  file: /var/log/message-flow/audit.jsonl
+//	cache:
+//	  ttl: 30s
+//	stale:
+//	  enabled: true
+//	  writes: buffer
+//	log:
+//	  level: info
+//	  format: json
+//
+// The routes section is applied to the table as described by the routes
+// package.  Services and routes are reloaded when the file changes, checked
+// every reload_interval (5s by default), or on SIGHUP.  Clients mapped to a
+// server removed from its service are given a new one on their next message.
+//
+// Services with ack set are delivered to until a server acknowledges the
+// message, as described by the ack package.  Servers acknowledge with an
+// Mflow-Ack reply header echoing the Mflow-Message-Id, or later by POSTing
+// the message ID in that header to /ack on the admin address.
+//
+// A push listener registers its clients with its server_id, the URL servers
+// POST messages for them to as httptransport forwards them.  Clients of tcp
+// and websocket listeners are not registered, as servers cannot reach them.
+//
+// Push and websocket listeners do not authenticate clients: they trust the
+// client ID given in the "client" query parameter or the Mflow-Client-Id
+// header, so anyone reaching them can read or send as any client.  Run them
+// behind a proxy that authenticates clients and sets the ID.
+//
+// The admin address also serves Prometheus metrics at /metrics, described
+// by the metrics package.  When a tracing endpoint is set, spans for each
+// message's lookups and forwarding are exported to it over OTLP/HTTP, as
+// described by the tracing package.
+//
+// Changes made through the admin API, and by applying the routes section,
+// are recorded by the audit package with the remote address that made them,
+// prefixed by the basic auth user if one was given.  The admin API does not
+// authenticate requests, so the user is only a claim; keep the admin address
+// private.  Recent changes are served at /audit on the admin address, and
+// appended to the audit file when one is set.
+//
+// When a cache ttl is set, lookups are answered from a cache of the table's
+// records, as described by routingtable.CachingRoutingTable.  Records
+// changed through the router are dropped from it at once; changes made to
+// the backend by others are seen within the ttl, or at once for backends
+// reporting their changes.
+//
+// When stale is enabled, the last known answers are served while the
+// backend is unreachable, as described by routingtable.StaleRoutingTable,
+// and changes are rejected or, with writes set to buffer, made once it is
+// reachable again.
+//
+// Logs are written to standard error with the client, service and server
+// involved as fields.  At debug level every routing decision and table
+// change is logged, sampled as described by the logging package; failures
+// are always logged.
+//
+// On SIGTERM or SIGINT the router stops accepting connections and waits up
+// to drain_timeout for in-flight messages before exiting.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	configPath := flag.String("config", "/etc/message-flow/config.yaml", "path to the configuration file")
+	flag.Parse()
+
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	daemon, err := newDaemon(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	slog.SetDefault(daemon.logger)
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	daemon.hangup = hangup
+
+	if err := daemon.run(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,442 @@
+// Command mflow inspects and changes message-flow routes.
+//
+// Usage:
+//
+//	mflow [flags] <command> [arguments]
+//
+// The routing table is reached through a running router's admin API with
+// -admin, or opened directly with -table.  Commands:
+//
+//	service get-server <service>
+//	service set-server <service> <server>
+//	service get-registrar <service>
+//	service set-registrar <service> <registrar>
+//	pool add <service> <server>
+//	pool remove <service> <server>
+//	pool list <service>
+//	pool random <service>
+//	client get <client> [service]
+//	client set-message-server <client> <server>
+//	client map <client> <service> <server>
+//	client unmap <client> <service>
+//	resolve <client> <service>
+//	explain <client> <service>
+//	routes plan <file>
+//	routes apply <file>
+//	copy [-dry-run] [-verify] [-checkpoint file] <from-url> <to-url>
+//
+// resolve reports the server a client's messages would be routed to,
+// without storing it as the client's mapping.  explain lists each step of
+// the lookup order resolve takes, and why it fell through.  Through -admin
+// it explains the router's own decision, including the service's policy and
+// when the client's mapping expires.
+//
+// copy moves every route from one table to another, for example from a
+// running router's in-memory table to a bolt database:
+//
+//	mflow copy -verify http://localhost:8081 bolt:///var/lib/mflow.db
+//
+// Table URLs are opened with routingtable.Open, except http and https URLs
+// which name a router's admin API.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/robertkluin/message-flow/admin"
+	"github.com/robertkluin/message-flow/migrate"
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routes"
+	"github.com/robertkluin/message-flow/routingtable"
+	_ "github.com/robertkluin/message-flow/routingtable/bolt"
+)
+
+var errUsage = errors.New("usage")
+
+func main() {
+	err := run(os.Args[1:], os.Stdout, os.Stderr)
+	if err == errUsage || err == flag.ErrHelp {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "mflow:", err)
+		os.Exit(1)
+	}
+}
+
+// The result of a command: a table of rows, also written as a list of JSON
+// objects keyed by the column names.
+type output struct {
+	columns []string
+	rows    [][]string
+}
+
+func run(args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("mflow", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	adminURL := flags.String("admin", "", "base URL of a router's admin API")
+	tableURL := flags.String("table", "", "URL of a routing table backend to open directly, such as bolt:///var/lib/mflow.db")
+	format := flags.String("o", "table", "output format: table or json")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: mflow [flags] <command> [arguments]")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errUsage
+	}
+	if *format != "table" && *format != "json" {
+		return fmt.Errorf("unknown output format %q", *format)
+	}
+
+	var result *output
+	var err error
+	if flags.Arg(0) == "copy" {
+		result, err = runCopy(flags.Args()[1:], stderr)
+	} else {
+		result, err = runTable(*adminURL, *tableURL, flags.Args())
+	}
+	if err == errUsage {
+		flags.Usage()
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if *format == "json" {
+		return writeJSON(stdout, result)
+	}
+	return writeTable(stdout, result)
+}
+
+// Open the table named by the flags and run a command against it.
+func runTable(adminURL, tableURL string, args []string) (*output, error) {
+	table, err := openTable(adminURL, tableURL)
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := table.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	return dispatch(table, args)
+}
+
+// Copy every route from one table to another, both named by URL.
+func runCopy(args []string, stderr io.Writer) (*output, error) {
+	flags := flag.NewFlagSet("mflow copy", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	options := new(migrate.Options)
+	flags.BoolVar(&options.DryRun, "dry-run", false, "list the calls without making them")
+	flags.BoolVar(&options.Verify, "verify", false, "compare the tables after copying")
+	flags.StringVar(&options.Checkpoint, "checkpoint", "", "file recording progress, to resume an interrupted copy")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: mflow copy [flags] <from-url> <to-url>")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return nil, flag.ErrHelp
+	}
+
+	src, err := openURL(flags.Arg(0))
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := src.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	dst, err := openURL(flags.Arg(1))
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := dst.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	var plan routes.Plan
+	options.OnOp = func(op routes.Op) {
+		plan = append(plan, op)
+	}
+
+	result, err := migrate.Copy(src, dst, options)
+	if result != nil {
+		fmt.Fprintf(stderr, "%d services, %d clients, %d calls\n", result.Services, result.Clients, result.Calls)
+		for _, op := range result.Diff {
+			fmt.Fprintf(stderr, "differs: %s\n", op)
+		}
+	}
+	return planOutput(plan, err)
+}
+
+// Open a table by URL.  http and https URLs name a router's admin API.
+func openURL(rawURL string) (router.RoutingTable, error) {
+	if strings.HasPrefix(rawURL, "http://") || strings.HasPrefix(rawURL, "https://") {
+		return admin.NewClient(rawURL, nil), nil
+	}
+	return routingtable.Open(rawURL)
+}
+
+// Open the routing table named by the flags.
+func openTable(adminURL, tableURL string) (router.RoutingTable, error) {
+	switch {
+	case adminURL != "" && tableURL != "":
+		return nil, errors.New("only one of -admin and -table may be given")
+	case adminURL != "":
+		return admin.NewClient(adminURL, nil), nil
+	case tableURL != "":
+		return openURL(tableURL)
+	default:
+		return nil, errors.New("one of -admin or -table is required")
+	}
+}
+
+func dispatch(table router.RoutingTable, args []string) (*output, error) {
+	command := args[0]
+	if len(args) > 1 && command != "resolve" && command != "explain" {
+		command += " " + args[1]
+		args = args[2:]
+	} else {
+		args = args[1:]
+	}
+
+	switch {
+	case command == "service get-server" && len(args) == 1:
+		serverID, err := table.GetServiceServer(router.ServiceID(args[0]))
+		return serverOutput("service", args[0], serverID, err)
+
+	case command == "service set-server" && len(args) == 2:
+		err := table.SetServiceServer(router.ServiceID(args[0]), router.ServerID(args[1]))
+		return serverOutput("service", args[0], router.ServerID(args[1]), err)
+
+	case command == "service get-registrar" && len(args) == 1:
+		serverID, err := table.GetServiceRegistrar(router.ServiceID(args[0]))
+		return registrarOutput(args[0], serverID, err)
+
+	case command == "service set-registrar" && len(args) == 2:
+		err := table.SetServiceRegistrar(router.ServiceID(args[0]), router.ServerID(args[1]))
+		return registrarOutput(args[0], router.ServerID(args[1]), err)
+
+	case command == "pool add" && len(args) == 2:
+		err := table.AddServerToServicePool(router.ServiceID(args[0]), router.ServerID(args[1]))
+		return serverOutput("service", args[0], router.ServerID(args[1]), err)
+
+	case command == "pool remove" && len(args) == 2:
+		err := table.RemoveServerFromServicePool(router.ServiceID(args[0]), router.ServerID(args[1]))
+		return serverOutput("service", args[0], router.ServerID(args[1]), err)
+
+	case command == "pool list" && len(args) == 1:
+		pool, err := table.GetServicePool(router.ServiceID(args[0]))
+		if err != nil {
+			return nil, err
+		}
+		result := &output{columns: []string{"service", "server"}}
+		for _, serverID := range pool {
+			result.rows = append(result.rows, []string{args[0], string(serverID)})
+		}
+		return result, nil
+
+	case command == "pool random" && len(args) == 1:
+		serverID, err := table.GetServiceRandomServer(router.ServiceID(args[0]))
+		return serverOutput("service", args[0], serverID, err)
+
+	case command == "client get" && len(args) == 1:
+		serverID, err := table.GetClientMessageServer(router.ClientID(args[0]))
+		return serverOutput("client", args[0], serverID, err)
+
+	case command == "client get" && len(args) == 2:
+		serverID, err := table.GetClientServiceServer(router.ClientID(args[0]), router.ServiceID(args[1]))
+		return mappingOutput(args[0], args[1], serverID, err)
+
+	case command == "client set-message-server" && len(args) == 2:
+		err := table.SetClientMessageServer(router.ClientID(args[0]), router.ServerID(args[1]))
+		return serverOutput("client", args[0], router.ServerID(args[1]), err)
+
+	case command == "client map" && len(args) == 3:
+		err := table.SetClientServiceServer(router.ClientID(args[0]), router.ServiceID(args[1]), router.ServerID(args[2]))
+		return mappingOutput(args[0], args[1], router.ServerID(args[2]), err)
+
+	case command == "client unmap" && len(args) == 2:
+		err := table.RemoveClientServiceServer(router.ClientID(args[0]), router.ServiceID(args[1]))
+		return mappingOutput(args[0], args[1], "", err)
+
+	case command == "resolve" && len(args) == 2:
+		explain, err := explainRoute(table, router.ClientID(args[0]), router.ServiceID(args[1]))
+		if err != nil {
+			return nil, err
+		}
+		if explain.Error != "" {
+			return nil, errors.New(explain.Error)
+		}
+		return mappingOutput(args[0], args[1], explain.Server, nil)
+
+	case command == "explain" && len(args) == 2:
+		return explainOutput(explainRoute(table, router.ClientID(args[0]), router.ServiceID(args[1])))
+
+	case (command == "routes plan" || command == "routes apply") && len(args) == 1:
+		config, err := routes.Load(args[0])
+		if err != nil {
+			return nil, err
+		}
+		plan, err := routes.MakePlan(table, config)
+		if err != nil {
+			return nil, err
+		}
+		if command == "routes apply" {
+			err = plan.Apply(table)
+		}
+		return planOutput(plan, err)
+	}
+
+	return nil, errUsage
+}
+
+// Explain how the client's messages for the service would be routed,
+// without storing a mapping.  Through -admin the router explains its own
+// decision.  Otherwise there is no registrar to ask, so services with one
+// are reported as an error rather than given a server from their pool.
+func explainRoute(table router.RoutingTable, clientID router.ClientID, serviceID router.ServiceID) (*admin.Explanation, error) {
+	if client, ok := table.(*admin.Client); ok {
+		return client.Explain(clientID, serviceID)
+	}
+
+	explain := admin.NewExplanation(router.NewResolver(table, nil).Explain(clientID, serviceID))
+	if explain.Source == router.FromPool.String() {
+		if registrar, err := table.GetServiceRegistrar(serviceID); err == nil && registrar != "" {
+			return nil, fmt.Errorf("service %s is resolved by registrar %s; use -admin to ask the router", serviceID, registrar)
+		}
+	}
+	return &explain, nil
+}
+
+func planOutput(plan routes.Plan, err error) (*output, error) {
+	if err != nil {
+		return nil, err
+	}
+	result := &output{columns: []string{"call"}}
+	for _, op := range plan {
+		result.rows = append(result.rows, []string{op.String()})
+	}
+	return result, nil
+}
+
+// One row per lookup step: the server it answered with and why it fell
+// through, followed by the decision.
+func explainOutput(explain *admin.Explanation, err error) (*output, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	result := &output{columns: []string{"step", "server", "result", "detail"}}
+	for _, step := range explain.Steps {
+		outcome := step.Code
+		if outcome == "" {
+			outcome = step.Error
+		}
+		if step.Expired {
+			outcome = "expired"
+		}
+
+		var details []string
+		if step.Expires != nil {
+			details = append(details, "expires "+step.Expires.Format(time.RFC3339))
+		}
+		if step.Registrar != "" {
+			details = append(details, "registrar "+string(step.Registrar))
+		}
+		if step.Selector != "" {
+			details = append(details, fmt.Sprintf("%s from %v", step.Selector, step.Pool))
+		}
+		result.rows = append(result.rows, []string{step.Source, string(step.Server), outcome, strings.Join(details, ", ")})
+	}
+
+	outcome := "routed"
+	if explain.Code != "" || explain.Error != "" {
+		outcome = "failed"
+	}
+	detail := ""
+	if explain.Sticky {
+		detail = "mapped to client"
+		if explain.StickyTTL != "" {
+			detail += " for " + explain.StickyTTL
+		}
+	}
+	result.rows = append(result.rows, []string{"decision", string(explain.Server), outcome, detail})
+	return result, nil
+}
+
+func serverOutput(kind, id string, serverID router.ServerID, err error) (*output, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &output{columns: []string{kind, "server"}, rows: [][]string{{id, string(serverID)}}}, nil
+}
+
+func registrarOutput(serviceID string, registrar router.ServerID, err error) (*output, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &output{columns: []string{"service", "registrar"}, rows: [][]string{{serviceID, string(registrar)}}}, nil
+}
+
+func mappingOutput(clientID, serviceID string, serverID router.ServerID, err error) (*output, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &output{columns: []string{"client", "service", "server"}, rows: [][]string{{clientID, serviceID, string(serverID)}}}, nil
+}
+
+func writeTable(w io.Writer, result *output) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for i, column := range result.columns {
+		if i > 0 {
+			fmt.Fprint(tw, "\t")
+		}
+		fmt.Fprint(tw, strings.ToUpper(column))
+	}
+	fmt.Fprintln(tw)
+
+	for _, row := range result.rows {
+		for i, value := range row {
+			if i > 0 {
+				fmt.Fprint(tw, "\t")
+			}
+			fmt.Fprint(tw, value)
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+func writeJSON(w io.Writer, result *output) error {
+	objects := make([]map[string]string, 0, len(result.rows))
+	for _, row := range result.rows {
+		object := make(map[string]string)
+		for i, column := range result.columns {
+			object[column] = row[i]
+		}
+		objects = append(objects, object)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(objects)
+}
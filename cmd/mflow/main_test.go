@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/robertkluin/message-flow/admin"
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routingtable"
+)
+
+func TestRun(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	handler := admin.NewHandler(table)
+	handler.SetResolver(router.NewResolver(table, nil))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	tests := []struct {
+		args   string
+		output string
+		err    bool
+	}{
+		{"service set-server service.1 server.1", "SERVICE    SERVER\nservice.1  server.1\n", false},
+		{"pool add service.2 pool.1", "SERVICE    SERVER\nservice.2  pool.1\n", false},
+		{"-o json pool list service.2", "[\n  {\n    \"server\": \"pool.1\",\n    \"service\": \"service.2\"\n  }\n]\n", false},
+		{"resolve client.1 service.2", "CLIENT    SERVICE    SERVER\nclient.1  service.2  pool.1\n", false},
+		{"client get client.1 service.2", "", true},
+		{"client get client.2", "", true},
+		{"pool frobnicate service.1", "", true},
+	}
+
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		args := append([]string{"-admin", server.URL}, strings.Fields(test.args)...)
+		err := run(args, &stdout, &stderr)
+		if (err != nil) != test.err {
+			t.Errorf("mflow %s: unexpected error %v", test.args, err)
+		}
+		if stdout.String() != test.output {
+			t.Errorf("mflow %s: got output\n%s\nwant\n%s", test.args, stdout.String(), test.output)
+		}
+	}
+}
+
+func TestRunRoutes(t *testing.T) {
+	server := httptest.NewServer(admin.NewHandler(routingtable.NewMemoryRoutingTable()))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	os.WriteFile(path, []byte("services:\n  service.1:\n    server: server.1\n"), 0644)
+
+	tests := []struct {
+		command string
+		output  string
+	}{
+		{"plan", "CALL\nSetServiceServer(\"service.1\", \"server.1\")  # was \"\"\n"},
+		{"apply", "CALL\nSetServiceServer(\"service.1\", \"server.1\")  # was \"\"\n"},
+		{"plan", "CALL\n"},
+	}
+
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		err := run([]string{"-admin", server.URL, "routes", test.command, path}, &stdout, &stderr)
+		if err != nil {
+			t.Errorf("mflow routes %s: unexpected error %v", test.command, err)
+		}
+		if stdout.String() != test.output {
+			t.Errorf("mflow routes %s: got output\n%s\nwant\n%s", test.command, stdout.String(), test.output)
+		}
+	}
+}
+
+func TestRunTable(t *testing.T) {
+	tableURL := "bolt://" + filepath.Join(t.TempDir(), "mflow.db")
+
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{"-table", tableURL, "pool", "add", "service.1", "pool.1"}, &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout.Reset()
+	if err := run([]string{"-table", tableURL, "pool", "list", "service.1"}, &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "SERVICE    SERVER\nservice.1  pool.1\n"; stdout.String() != expected {
+		t.Errorf("got output\n%s\nwant\n%s", stdout.String(), expected)
+	}
+
+	if err := run([]string{"-table", "nosuch://", "pool", "list", "service.1"}, &stdout, &stderr); err == nil {
+		t.Error("expected an error for an unknown backend")
+	}
+}
+
+func TestRunResolveTable(t *testing.T) {
+	tableURL := "bolt://" + filepath.Join(t.TempDir(), "mflow.db")
+	for _, args := range []string{"pool add service.1 pool.1", "pool add service.2 pool.1", "service set-registrar service.2 registrar.1"} {
+		var stdout, stderr bytes.Buffer
+		if err := run(append([]string{"-table", tableURL}, strings.Fields(args)...), &stdout, &stderr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		args   string
+		output string
+		err    bool
+	}{
+		{"resolve client.1 service.1", "CLIENT    SERVICE    SERVER\nclient.1  service.1  pool.1\n", false},
+
+		// The pick is not stored.
+		{"client get client.1 service.1", "", true},
+
+		// Registrars cannot be asked without the router.
+		{"resolve client.1 service.2", "", true},
+	}
+
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		err := run(append([]string{"-table", tableURL}, strings.Fields(test.args)...), &stdout, &stderr)
+		if (err != nil) != test.err {
+			t.Errorf("mflow %s: unexpected error %v", test.args, err)
+		}
+		if stdout.String() != test.output {
+			t.Errorf("mflow %s: got output\n%s\nwant\n%s", test.args, stdout.String(), test.output)
+		}
+	}
+}
+
+func TestRunCopy(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	table.AddServerToServicePool("service.1", "pool.1")
+	table.SetClientServiceServer("client.1", "service.1", "pool.1")
+	server := httptest.NewServer(admin.NewHandler(table))
+	defer server.Close()
+
+	tableURL := "bolt://" + filepath.Join(t.TempDir(), "mflow.db")
+
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{"copy", "-verify", server.URL, tableURL}, &stdout, &stderr); err != nil {
+		t.Fatalf("copy failed: %v\n%s", err, stderr.String())
+	}
+	expected := "CALL\nAddServerToServicePool(\"service.1\", \"pool.1\")\nSetClientServiceServer(\"client.1\", \"service.1\", \"pool.1\")  # was \"\"\n"
+	if stdout.String() != expected {
+		t.Errorf("got output\n%s\nwant\n%s", stdout.String(), expected)
+	}
+
+	stdout.Reset()
+	if err := run([]string{"-table", tableURL, "client", "get", "client.1", "service.1"}, &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "CLIENT    SERVICE    SERVER\nclient.1  service.1  pool.1\n"; stdout.String() != expected {
+		t.Errorf("got output\n%s\nwant\n%s", stdout.String(), expected)
+	}
+}
+
+func TestRunExplain(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	table.AddServerToServicePool("service.1", "pool.1")
+
+	handler := admin.NewHandler(table)
+	handler.SetResolver(router.NewResolver(table, nil))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{"-admin", server.URL, "explain", "client.1", "service.1"}, &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"STEP       SERVER  RESULT               DETAIL",
+		"mapping            UnknownClient",
+		"catch-all          ServerNotFoundError",
+		"registrar",
+		"pool       pool.1                       random from [pool.1]",
+		"decision   pool.1  routed               mapped to client",
+	}
+	lines := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], " ")
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("mflow explain: got output\n%s\nwant\n%s", stdout.String(), strings.Join(want, "\n"))
+	}
+}
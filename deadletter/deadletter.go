@@ -0,0 +1,157 @@
+// Package deadletter keeps messages that could not be delivered so they can
+// be inspected, purged, or replayed.
+//
+// Letters are added directly with Put, for example from a queue's OnDrop hook
+// or a retry limit, or by wrapping a router.Handler with Handler so every
+// routing failure is recorded.
+package deadletter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+var errNoReason = errors.New("deadletter: no reason given for the failure")
+
+// DeadLetters manages the letters in a store.
+type DeadLetters struct {
+	store Store
+}
+
+func New(store Store) *DeadLetters {
+	deadLetters := new(DeadLetters)
+	deadLetters.store = store
+	return deadLetters
+}
+
+// Record msg as undeliverable because of err, along with the attempts made
+// to deliver it.  err must not be nil.
+func (d *DeadLetters) Put(msg *router.Message, err error, attempts []Attempt) (*Letter, error) {
+	if err == nil {
+		return nil, errNoReason
+	}
+
+	now := time.Now()
+
+	letter := new(Letter)
+	letter.ID = newID()
+	letter.Message = msg
+	letter.Code = errorCode(err)
+	letter.Reason = err.Error()
+	letter.Attempts = attempts
+	letter.Created = now
+	letter.Updated = now
+
+	if err := d.store.Put(letter); err != nil {
+		return nil, err
+	}
+	return letter, nil
+}
+
+// Wrap next so messages it fails to route are dead lettered.  The failure is
+// still returned to the caller, joined with the store's error if the letter
+// could not be recorded.
+func (d *DeadLetters) Handler(next router.Handler) router.Handler {
+	return router.HandlerFunc(func(ctx context.Context, msg *router.Message) (*router.Message, error) {
+		reply, err := next.Route(ctx, msg)
+		if err != nil {
+			attempt := Attempt{Time: time.Now(), Error: err.Error()}
+			if _, perr := d.Put(msg, err, []Attempt{attempt}); perr != nil {
+				err = errors.Join(err, fmt.Errorf("deadletter: message not recorded: %v", perr))
+			}
+		}
+		return reply, err
+	})
+}
+
+// Letters matching filter, oldest first.
+func (d *DeadLetters) List(filter Filter) ([]*Letter, error) {
+	return d.store.List(filter)
+}
+
+// Get a single letter.
+func (d *DeadLetters) Get(id string) (*Letter, error) {
+	return d.store.Get(id)
+}
+
+// Remove letters matching filter and return how many were removed.
+func (d *DeadLetters) Purge(filter Filter) (int, error) {
+	letters, err := d.store.List(filter)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, letter := range letters {
+		if err := d.store.Delete(letter.ID); err != nil && err != ErrNotFound {
+			return i, err
+		}
+	}
+	return len(letters), nil
+}
+
+// Remove a single letter.
+func (d *DeadLetters) Delete(id string) error {
+	return d.store.Delete(id)
+}
+
+// Route the letter's message again through handler.  On success the letter
+// is removed, otherwise the failed attempt is added to it.  If the letter
+// cannot be updated the store's error is returned as well, along with any
+// reply.
+func (d *DeadLetters) Replay(ctx context.Context, id string, handler router.Handler) (*router.Message, error) {
+	return d.replay(id, "", func(msg *router.Message) (*router.Message, error) {
+		return handler.Route(ctx, msg)
+	})
+}
+
+// Deliver the letter's message directly to serverID, bypassing routing.  On
+// success the letter is removed, otherwise the failed attempt is added to it.
+func (d *DeadLetters) ReplayTo(ctx context.Context, id string, serverID router.ServerID, forwarder router.Forwarder) (*router.Message, error) {
+	return d.replay(id, serverID, func(msg *router.Message) (*router.Message, error) {
+		return forwarder.Forward(ctx, serverID, msg)
+	})
+}
+
+func (d *DeadLetters) replay(id string, serverID router.ServerID, send func(*router.Message) (*router.Message, error)) (*router.Message, error) {
+	letter, err := d.store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := send(letter.Message)
+	if err == nil {
+		if err := d.store.Delete(id); err != nil && err != ErrNotFound {
+			return reply, fmt.Errorf("deadletter: message delivered but letter not removed: %v", err)
+		}
+		return reply, nil
+	}
+
+	letter.Updated = time.Now()
+	letter.Attempts = append(letter.Attempts, Attempt{Time: letter.Updated, ServerID: serverID, Error: err.Error()})
+	if code := errorCode(err); code != 0 {
+		letter.Code = code
+	}
+	letter.Reason = err.Error()
+	if perr := d.store.Put(letter); perr != nil {
+		return nil, errors.Join(err, fmt.Errorf("deadletter: attempt not recorded: %v", perr))
+	}
+
+	return nil, err
+}
+
+func errorCode(err error) router.RoutingTableErrorCode {
+	code, _ := router.ErrorCode(err)
+	return code
+}
+
+func newID() string {
+	var buf [16]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
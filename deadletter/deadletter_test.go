@@ -0,0 +1,153 @@
+package deadletter
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routingtable"
+)
+
+func TestHandlerRecordsFailures(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	table.SetServiceServer("service.2", "server.1")
+
+	var healthy bool
+	forwarder := router.ForwarderFunc(func(ctx context.Context, serverID router.ServerID, msg *router.Message) (*router.Message, error) {
+		if !healthy {
+			return nil, errors.New("connection refused")
+		}
+		return &router.Message{Body: []byte(serverID)}, nil
+	})
+	routes := router.NewRouter(router.NewResolver(table, nil), forwarder)
+
+	deadLetters := New(NewMemoryStore())
+	handler := deadLetters.Handler(routes)
+
+	handler.Route(context.Background(), &router.Message{ClientID: "client.1", ServiceID: "service.1"})
+	handler.Route(context.Background(), &router.Message{ClientID: "client.1", ServiceID: "service.2"})
+
+	letters, _ := deadLetters.List(Filter{})
+	if len(letters) != 2 {
+		t.Fatalf("expected 2 letters, got %d", len(letters))
+	}
+
+	letters, _ = deadLetters.List(Filter{Code: router.UnknownService})
+	if len(letters) != 1 || letters[0].Message.ServiceID != "service.1" {
+		t.Errorf("unexpected letters for UnknownService: %+v", letters)
+	}
+
+	letters, _ = deadLetters.List(Filter{ServiceID: "service.2"})
+	if len(letters) != 1 || letters[0].Code != router.ServiceError || len(letters[0].Attempts) != 1 {
+		t.Fatalf("unexpected letters for service.2: %+v", letters)
+	}
+	id := letters[0].ID
+
+	// A failed replay is recorded on the letter.
+	if _, err := deadLetters.Replay(context.Background(), id, routes); err == nil {
+		t.Errorf("expected replay to fail")
+	}
+	letter, err := deadLetters.Get(id)
+	if err != nil || len(letter.Attempts) != 2 {
+		t.Errorf("failed replay not recorded: %+v, %v", letter, err)
+	}
+
+	// A successful replay to a specific server removes the letter.
+	healthy = true
+	reply, err := deadLetters.ReplayTo(context.Background(), id, "server.2", forwarder)
+	if err != nil || string(reply.Body) != "server.2" {
+		t.Errorf("unexpected replay result: %+v, %v", reply, err)
+	}
+	if _, err := deadLetters.Get(id); err != ErrNotFound {
+		t.Errorf("expected replayed letter to be removed, got %v", err)
+	}
+
+	count, err := deadLetters.Purge(Filter{})
+	if count != 1 || err != nil {
+		t.Errorf("expected to purge 1 letter, got %d, %v", count, err)
+	}
+	if letters, _ := deadLetters.List(Filter{}); len(letters) != 0 {
+		t.Errorf("expected no letters after purge, got %+v", letters)
+	}
+}
+
+// A store whose writes fail once armed.
+type failingStore struct {
+	*MemoryStore
+	fail bool
+}
+
+func (s *failingStore) Put(letter *Letter) error {
+	if s.fail {
+		return errors.New("disk full")
+	}
+	return s.MemoryStore.Put(letter)
+}
+
+func (s *failingStore) Delete(id string) error {
+	if s.fail {
+		return errors.New("disk full")
+	}
+	return s.MemoryStore.Delete(id)
+}
+
+func TestReplayStoreErrors(t *testing.T) {
+	store := &failingStore{MemoryStore: NewMemoryStore()}
+	deadLetters := New(store)
+
+	if _, err := deadLetters.Put(&router.Message{}, nil, nil); err == nil {
+		t.Error("expected a letter without a reason to be rejected")
+	}
+
+	refused := errors.New("connection refused")
+	letter, err := deadLetters.Put(&router.Message{ServiceID: "service.1"}, refused, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.fail = true
+
+	failing := router.HandlerFunc(func(ctx context.Context, msg *router.Message) (*router.Message, error) {
+		return nil, refused
+	})
+	if _, err := deadLetters.Replay(context.Background(), letter.ID, failing); !errors.Is(err, refused) || err == refused {
+		t.Errorf("expected the failure and the store error, got %v", err)
+	}
+
+	delivered := router.HandlerFunc(func(ctx context.Context, msg *router.Message) (*router.Message, error) {
+		return &router.Message{Body: []byte("ok")}, nil
+	})
+	if reply, err := deadLetters.Replay(context.Background(), letter.ID, delivered); reply == nil || err == nil {
+		t.Errorf("expected the reply and the store error, got %v, %v", reply, err)
+	}
+
+	if _, err := deadLetters.Handler(failing).Route(context.Background(), &router.Message{}); !errors.Is(err, refused) || err == refused {
+		t.Errorf("expected the failure and the store error from the handler, got %v", err)
+	}
+}
+
+func TestLettersAreCopies(t *testing.T) {
+	deadLetters := New(NewMemoryStore())
+
+	msg := &router.Message{ServiceID: "service.1", Body: []byte("body")}
+	msg.SetHeader("Trace", "abc")
+	letter, err := deadLetters.Put(msg, errors.New("connection refused"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changing the caller's message does not change the stored letter.
+	msg.Body[0] = 'B'
+	msg.SetHeader("Trace", "changed")
+	stored, _ := deadLetters.Get(letter.ID)
+	if string(stored.Message.Body) != "body" || stored.Message.Headers["Trace"] != "abc" {
+		t.Errorf("stored letter changed with the message: %+v", stored.Message)
+	}
+
+	// Nor does changing a letter that was read.
+	stored.Message.Body[0] = 'B'
+	stored.Message.Headers["Trace"] = "changed"
+	if stored, _ = deadLetters.Get(letter.ID); string(stored.Message.Body) != "body" || stored.Message.Headers["Trace"] != "abc" {
+		t.Errorf("stored letter changed with a read copy: %+v", stored.Message)
+	}
+}
@@ -0,0 +1,155 @@
+package deadletter
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+var ErrNotFound = errors.New("deadletter: letter not found")
+
+// An Attempt records one failed try at delivering a message.
+type Attempt struct {
+	Time     time.Time
+	ServerID router.ServerID
+	Error    string
+}
+
+// A Letter is a message that could not be delivered.
+type Letter struct {
+	ID      string
+	Message *router.Message
+
+	// Code of the routing table error that caused the message to be dead
+	// lettered, or zero if the failure was not a routing table error.
+	Code   router.RoutingTableErrorCode
+	Reason string
+
+	Attempts []Attempt
+
+	// When the message was dead lettered, and when it was last updated by a
+	// failed replay.
+	Created time.Time
+	Updated time.Time
+}
+
+// A Filter selects letters.  Zero fields match every letter.
+type Filter struct {
+	ClientID  router.ClientID
+	ServiceID router.ServiceID
+	Code      router.RoutingTableErrorCode
+	Before    time.Time
+}
+
+func (f Filter) match(letter *Letter) bool {
+	if f.ClientID != "" && letter.Message.ClientID != f.ClientID {
+		return false
+	}
+	if f.ServiceID != "" && letter.Message.ServiceID != f.ServiceID {
+		return false
+	}
+	if f.Code != 0 && letter.Code != f.Code {
+		return false
+	}
+	if !f.Before.IsZero() && !letter.Created.Before(f.Before) {
+		return false
+	}
+	return true
+}
+
+// A Store persists dead letters.
+type Store interface {
+	// Save a new or updated letter.
+	Put(letter *Letter) error
+
+	// Get the letter with the given ID, or ErrNotFound.
+	Get(id string) (*Letter, error)
+
+	// Letters matching filter, oldest first.
+	List(filter Filter) ([]*Letter, error)
+
+	// Remove the letter with the given ID, or return ErrNotFound.
+	Delete(id string) error
+}
+
+// MemoryStore keeps dead letters in memory.
+type MemoryStore struct {
+	lock    sync.Mutex
+	letters map[string]*Letter
+}
+
+func NewMemoryStore() *MemoryStore {
+	store := new(MemoryStore)
+	store.letters = make(map[string]*Letter)
+	return store
+}
+
+func (s *MemoryStore) Put(letter *Letter) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.letters[letter.ID] = copyLetter(letter)
+	return nil
+}
+
+func (s *MemoryStore) Get(id string) (*Letter, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	letter, ok := s.letters[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyLetter(letter), nil
+}
+
+func (s *MemoryStore) List(filter Filter) ([]*Letter, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	letters := make([]*Letter, 0)
+	for _, letter := range s.letters {
+		if filter.match(letter) {
+			letters = append(letters, copyLetter(letter))
+		}
+	}
+
+	sort.Slice(letters, func(i, j int) bool {
+		if letters[i].Created.Equal(letters[j].Created) {
+			return letters[i].ID < letters[j].ID
+		}
+		return letters[i].Created.Before(letters[j].Created)
+	})
+	return letters, nil
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.letters[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.letters, id)
+	return nil
+}
+
+func copyLetter(letter *Letter) *Letter {
+	dup := *letter
+	dup.Attempts = append([]Attempt(nil), letter.Attempts...)
+	if letter.Message != nil {
+		msg := *letter.Message
+		if letter.Message.Headers != nil {
+			msg.Headers = make(map[string]string, len(letter.Message.Headers))
+			for key, value := range letter.Message.Headers {
+				msg.Headers[key] = value
+			}
+		}
+		msg.Body = append([]byte(nil), letter.Message.Body...)
+		dup.Message = &msg
+	}
+	return &dup
+}
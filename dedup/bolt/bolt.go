@@ -0,0 +1,168 @@
+// Package bolt stores the message IDs seen by a dedup.Filter in a bbolt
+// database file, so they are remembered across restarts of a single node
+// router.
+//
+//	store, err := bolt.Open("/var/lib/mflow-dedup.db", nil)
+//	filter := dedup.New(handler, store, dedup.Drop)
+//
+// bbolt locks the file, so it cannot be the file holding a bolt routing
+// table opened by the same process.
+package bolt
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/robertkluin/message-flow/dedup"
+	"github.com/robertkluin/message-flow/router"
+	"go.etcd.io/bbolt"
+)
+
+// DefaultBucket is the bucket used when Options.Bucket is empty.
+const DefaultBucket = "mflow.dedup"
+
+// Number of calls to Seen between sweeps of expired IDs.
+const sweepInterval = 1024
+
+// Options for opening a Store.
+type Options struct {
+	// Bucket holding the message IDs.
+	Bucket string
+
+	// How long to wait for another process to release the file.  Zero waits
+	// forever.
+	Timeout time.Duration
+}
+
+// Store implements dedup.Store in a bbolt database.  Each ID is stored with
+// its expiry and whether it was delivered, and expired IDs are deleted
+// periodically.  It is safe for concurrent use.
+type Store struct {
+	db     *bbolt.DB
+	bucket []byte
+
+	lock  sync.Mutex
+	calls int
+}
+
+// Open the store in the database file at path, creating it if needed.
+func Open(path string, options *Options) (*Store, error) {
+	if options == nil {
+		options = new(Options)
+	}
+
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: options.Timeout})
+	if err != nil {
+		return nil, err
+	}
+
+	store := new(Store)
+	store.db = db
+	store.bucket = []byte(options.Bucket)
+	if options.Bucket == "" {
+		store.bucket = []byte(DefaultBucket)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(store.bucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Close the database file.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) Seen(clientID router.ClientID, messageID string, window time.Duration) (dedup.State, error) {
+	s.lock.Lock()
+	s.calls++
+	sweep := s.calls%sweepInterval == 0
+	s.lock.Unlock()
+
+	now := time.Now()
+	state := dedup.Unseen
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(s.bucket)
+		if sweep {
+			if err := deleteExpired(bucket, now); err != nil {
+				return err
+			}
+		}
+
+		k := key(clientID, messageID)
+		if value := bucket.Get(k); len(value) >= 8 && now.Before(decodeTime(value)) {
+			state = decodeState(value)
+			return nil
+		}
+		return bucket.Put(k, encodeValue(now.Add(window), dedup.InFlight))
+	})
+	return state, err
+}
+
+func (s *Store) Done(clientID router.ClientID, messageID string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(s.bucket)
+		k := key(clientID, messageID)
+		value := bucket.Get(k)
+		if len(value) < 8 || decodeState(value) == dedup.Delivered {
+			return nil
+		}
+		return bucket.Put(k, encodeValue(decodeTime(value), dedup.Delivered))
+	})
+}
+
+func (s *Store) Forget(clientID router.ClientID, messageID string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(s.bucket).Delete(key(clientID, messageID))
+	})
+}
+
+func deleteExpired(bucket *bbolt.Bucket, now time.Time) error {
+	var expired [][]byte
+	err := bucket.ForEach(func(k, value []byte) error {
+		if len(value) < 8 || !now.Before(decodeTime(value)) {
+			expired = append(expired, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range expired {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The key of a client's message ID.  Client IDs cannot hold a NUL byte.
+func key(clientID router.ClientID, messageID string) []byte {
+	return []byte(string(clientID) + "\x00" + messageID)
+}
+
+// Values are the expiry in Unix nanoseconds, big endian, followed by a byte
+// holding the state.  Values written before states were stored lack the
+// byte and are taken as delivered.
+func encodeValue(expires time.Time, state dedup.State) []byte {
+	return append(binary.BigEndian.AppendUint64(nil, uint64(expires.UnixNano())), byte(state))
+}
+
+func decodeTime(value []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(value)))
+}
+
+func decodeState(value []byte) dedup.State {
+	if len(value) < 9 {
+		return dedup.Delivered
+	}
+	return dedup.State(value[8])
+}
@@ -0,0 +1,38 @@
+package bolt
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/robertkluin/message-flow/dedup"
+)
+
+func TestBoltStore(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "dedup.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	dedup.TestStore(t, store)
+}
+
+func TestBoltStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.db")
+	store, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Seen("client.1", "msg.1", time.Minute)
+	store.Close()
+
+	store, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if state, err := store.Seen("client.1", "msg.1", time.Minute); state != dedup.InFlight || err != nil {
+		t.Errorf("expected ID to survive a restart, got %v, %v", state, err)
+	}
+}
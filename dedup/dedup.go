@@ -0,0 +1,111 @@
+// Package dedup drops or marks messages a client has already sent.
+//
+// A Filter wraps a router.Handler and checks each message's ID, scoped to its
+// client, against a Store before the message is routed.  Messages without an
+// ID are passed through unchecked, and IDs of messages that fail to route
+// are forgotten so they may be retried.
+//
+// MemoryStore suits a single router, and the dedup/bolt package stores IDs
+// in a database file so they survive restarts.  TableStore keeps IDs in a
+// routing table backend, so a cluster of routers sharing the backend share
+// which messages were seen.
+package dedup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+// How long message IDs are remembered unless the filter is configured
+// otherwise.
+const DefaultWindow = 10 * time.Minute
+
+// Header set on duplicate messages in Mark mode.
+const DuplicateHeader = "Mflow-Duplicate"
+
+// ErrInFlight is returned in Drop mode for a duplicate of a message still
+// being routed.  The first copy may yet fail, so the client should retry.
+var ErrInFlight = errors.New("dedup: message is already being routed")
+
+type Mode int
+
+const (
+	_         = iota
+	Drop Mode = iota
+	Mark
+)
+
+// Filter handles duplicate messages before they are routed.
+type Filter struct {
+	// How long a message ID is remembered.  When zero DefaultWindow is used.
+	Window time.Duration
+
+	// OnDuplicate, if set, is called with each duplicate message.
+	OnDuplicate func(msg *router.Message)
+
+	next  router.Handler
+	store Store
+	mode  Mode
+}
+
+// Create a filter that handles duplicates according to mode: Drop reports
+// them as routed without routing them, or fails them with ErrInFlight while
+// the first copy is being routed; Mark routes them with DuplicateHeader set.
+func New(next router.Handler, store Store, mode Mode) *Filter {
+	filter := new(Filter)
+	filter.next = next
+	filter.store = store
+	filter.mode = mode
+	return filter
+}
+
+func (f *Filter) Route(ctx context.Context, msg *router.Message) (*router.Message, error) {
+	if msg.ID == "" {
+		return f.next.Route(ctx, msg)
+	}
+
+	state, err := f.store.Seen(msg.ClientID, msg.ID, f.window())
+	if err != nil {
+		return nil, err
+	}
+
+	if state != Unseen {
+		if f.OnDuplicate != nil {
+			f.OnDuplicate(msg)
+		}
+		if f.mode == Drop && state == InFlight {
+			return nil, ErrInFlight
+		}
+		if f.mode == Drop {
+			return nil, nil
+		}
+		msg.SetHeader(DuplicateHeader, "true")
+		return f.next.Route(ctx, msg)
+	}
+
+	// Messages that fail to route are forgotten, so the client's retry is
+	// not taken for a duplicate.
+	reply, err := f.next.Route(ctx, msg)
+	if err != nil {
+		if forgetErr := f.store.Forget(msg.ClientID, msg.ID); forgetErr != nil {
+			return nil, errors.Join(err, forgetErr)
+		}
+		return nil, err
+	}
+
+	if err := f.store.Done(msg.ClientID, msg.ID); err != nil {
+		return reply, fmt.Errorf("dedup: message routed but not recorded: %v", err)
+	}
+	return reply, nil
+}
+
+func (f *Filter) window() time.Duration {
+	if f.Window > 0 {
+		return f.Window
+	}
+	return DefaultWindow
+}
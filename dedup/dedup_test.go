@@ -0,0 +1,118 @@
+package dedup
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routingtable"
+)
+
+func TestMemoryStore(t *testing.T) {
+	TestStore(t, NewMemoryStore())
+}
+
+func TestTableStore(t *testing.T) {
+	TestStore(t, NewTableStore(routingtable.NewMemoryRoutingTable()))
+}
+
+func TestTableStoreShared(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	first, second := NewTableStore(table), NewTableStore(table)
+
+	if state, _ := first.Seen("client.1", "msg.1", time.Minute); state != Unseen {
+		t.Errorf("expected the first router to see a new ID, got %v", state)
+	}
+	if state, _ := second.Seen("client.1", "msg.1", time.Minute); state != InFlight {
+		t.Errorf("expected the second router to see the ID in flight, got %v", state)
+	}
+
+	// Expired IDs are swept from the table.
+	first.Seen("client.1", "msg.2", -time.Second)
+	for i := 0; i < sweepInterval; i++ {
+		first.Seen("client.2", "msg.1", time.Minute)
+	}
+	services, _ := table.GetClientServices("client.1")
+	if _, ok := services[TableServicePrefix+"msg.2"]; ok {
+		t.Errorf("expected the expired ID to be swept, got %v", services)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	var routed []*router.Message
+	next := router.HandlerFunc(func(ctx context.Context, msg *router.Message) (*router.Message, error) {
+		routed = append(routed, msg)
+		return nil, nil
+	})
+
+	store := NewMemoryStore()
+	drop := New(next, store, Drop)
+	mark := New(next, store, Mark)
+
+	drop.Route(context.Background(), &router.Message{ID: "msg.1", ClientID: "client.1"})
+	drop.Route(context.Background(), &router.Message{ID: "msg.1", ClientID: "client.1"})
+	drop.Route(context.Background(), &router.Message{ClientID: "client.1"})
+	drop.Route(context.Background(), &router.Message{ClientID: "client.1"})
+	if len(routed) != 3 {
+		t.Fatalf("expected duplicate to be dropped, routed %d", len(routed))
+	}
+
+	mark.Route(context.Background(), &router.Message{ID: "msg.1", ClientID: "client.1"})
+	if len(routed) != 4 || routed[3].Headers[DuplicateHeader] != "true" {
+		t.Errorf("expected duplicate to be marked, got %+v", routed[len(routed)-1])
+	}
+}
+
+func TestFilterRetry(t *testing.T) {
+	var routed int
+	fail := true
+	next := router.HandlerFunc(func(ctx context.Context, msg *router.Message) (*router.Message, error) {
+		if fail {
+			return nil, errors.New("unavailable")
+		}
+		routed++
+		return nil, nil
+	})
+	filter := New(next, NewMemoryStore(), Drop)
+
+	msg := &router.Message{ID: "msg.1", ClientID: "client.1"}
+	if _, err := filter.Route(context.Background(), msg); err == nil {
+		t.Fatalf("expected the routing error")
+	}
+
+	// The retry is delivered, and later copies dropped.
+	fail = false
+	filter.Route(context.Background(), msg)
+	filter.Route(context.Background(), msg)
+	if routed != 1 {
+		t.Errorf("expected the retry to be delivered once, routed %d", routed)
+	}
+}
+
+func TestFilterInFlight(t *testing.T) {
+	routing := make(chan struct{})
+	release := make(chan struct{})
+	next := router.HandlerFunc(func(ctx context.Context, msg *router.Message) (*router.Message, error) {
+		close(routing)
+		<-release
+		return nil, errors.New("unavailable")
+	})
+	filter := New(next, NewMemoryStore(), Drop)
+
+	done := make(chan struct{})
+	go func() {
+		filter.Route(context.Background(), &router.Message{ID: "msg.1", ClientID: "client.1"})
+		close(done)
+	}()
+	<-routing
+
+	// The first copy may still fail, so the duplicate is not reported as
+	// routed.
+	if _, err := filter.Route(context.Background(), &router.Message{ID: "msg.1", ClientID: "client.1"}); err != ErrInFlight {
+		t.Errorf("expected ErrInFlight, got %v", err)
+	}
+	close(release)
+	<-done
+}
@@ -0,0 +1,257 @@
+package dedup
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+// The state of a message ID in a Store.
+type State int
+
+const (
+	// Not seen within the window.
+	Unseen State = iota
+
+	// Seen, and the first copy is still being routed.
+	InFlight
+
+	// Seen, and the first copy was routed.
+	Delivered
+)
+
+// A Store remembers which message IDs have been seen.
+type Store interface {
+	// Report the state of the client's message ID, recording it as InFlight
+	// for window if it was Unseen.  The check and the record are atomic, so
+	// of several calls for an unseen ID only one reports Unseen.
+	Seen(clientID router.ClientID, messageID string, window time.Duration) (State, error)
+
+	// Record that the first copy of the message was routed.
+	Done(clientID router.ClientID, messageID string) error
+
+	// Forget the client sent the message, so it is not reported as seen
+	// again.
+	Forget(clientID router.ClientID, messageID string) error
+}
+
+type seenKey struct {
+	clientID  router.ClientID
+	messageID string
+}
+
+type seenEntry struct {
+	state   State
+	expires time.Time
+}
+
+// Number of calls to Seen between sweeps of expired entries.
+const sweepInterval = 1024
+
+// MemoryStore remembers message IDs in memory.  It suits a single router.
+type MemoryStore struct {
+	lock    sync.Mutex
+	entries map[seenKey]seenEntry
+	calls   int
+}
+
+func NewMemoryStore() *MemoryStore {
+	store := new(MemoryStore)
+	store.entries = make(map[seenKey]seenEntry)
+	return store
+}
+
+func (s *MemoryStore) Seen(clientID router.ClientID, messageID string, window time.Duration) (State, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+
+	s.calls++
+	if s.calls%sweepInterval == 0 {
+		for key, entry := range s.entries {
+			if now.After(entry.expires) {
+				delete(s.entries, key)
+			}
+		}
+	}
+
+	key := seenKey{clientID, messageID}
+	entry, ok := s.entries[key]
+	if ok && now.Before(entry.expires) {
+		return entry.state, nil
+	}
+
+	s.entries[key] = seenEntry{state: InFlight, expires: now.Add(window)}
+	return Unseen, nil
+}
+
+func (s *MemoryStore) Done(clientID router.ClientID, messageID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := seenKey{clientID, messageID}
+	if entry, ok := s.entries[key]; ok {
+		entry.state = Delivered
+		s.entries[key] = entry
+	}
+	return nil
+}
+
+func (s *MemoryStore) Forget(clientID router.ClientID, messageID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.entries, seenKey{clientID, messageID})
+	return nil
+}
+
+// TableStore remembers message IDs in a routing table, so routers sharing
+// the table's backend share which messages were seen.  Give it a table of
+// its own, for example one opened with routingtable.Open, rather than the
+// table routing messages: each ID is stored as a client service mapping
+// under a reserved service name, with its state and expiry as the server.
+// Each ID is checked and recorded in one Update, so of several routers
+// receiving a message at once only one passes it.  Expired IDs are swept
+// periodically when the table is a router.Scanner.
+type TableStore struct {
+	table router.Updater
+
+	lock  sync.Mutex
+	calls int
+}
+
+// Prefix of the service names used to store message IDs.
+const TableServicePrefix = "mflow.dedup/"
+
+func NewTableStore(table router.Updater) *TableStore {
+	store := new(TableStore)
+	store.table = table
+	return store
+}
+
+func (s *TableStore) Seen(clientID router.ClientID, messageID string, window time.Duration) (State, error) {
+	s.lock.Lock()
+	s.calls++
+	sweep := s.calls%sweepInterval == 0
+	s.lock.Unlock()
+
+	serviceID := router.ServiceID(TableServicePrefix + messageID)
+	now := time.Now()
+
+	var state State
+	err := s.table.Update(func(txn router.RoutingTable) error {
+		if sweep {
+			if err := sweepTable(txn, now); err != nil {
+				return err
+			}
+		}
+
+		value, err := txn.GetClientServiceServer(clientID, serviceID)
+		if err != nil && !notFound(err) {
+			return err
+		}
+		if err == nil {
+			if entry, ok := decodeEntry(value); ok && now.Before(entry.expires) {
+				state = entry.state
+				return nil
+			}
+		}
+
+		state = Unseen
+		return txn.SetClientServiceServer(clientID, serviceID, encodeEntry(seenEntry{InFlight, now.Add(window)}))
+	})
+	return state, err
+}
+
+func (s *TableStore) Done(clientID router.ClientID, messageID string) error {
+	serviceID := router.ServiceID(TableServicePrefix + messageID)
+
+	return s.table.Update(func(txn router.RoutingTable) error {
+		value, err := txn.GetClientServiceServer(clientID, serviceID)
+		if notFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		entry, ok := decodeEntry(value)
+		if !ok || entry.state == Delivered {
+			return nil
+		}
+		entry.state = Delivered
+		return txn.SetClientServiceServer(clientID, serviceID, encodeEntry(entry))
+	})
+}
+
+func (s *TableStore) Forget(clientID router.ClientID, messageID string) error {
+	return s.table.Update(func(txn router.RoutingTable) error {
+		return txn.RemoveClientServiceServer(clientID, router.ServiceID(TableServicePrefix+messageID))
+	})
+}
+
+// Remove expired IDs from txn, if it can list its contents.
+func sweepTable(txn router.RoutingTable, now time.Time) error {
+	scanner, ok := txn.(router.Scanner)
+	if !ok {
+		return nil
+	}
+
+	clients, err := scanner.Clients()
+	if err != nil {
+		return err
+	}
+	for _, clientID := range clients {
+		services, err := scanner.GetClientServices(clientID)
+		if err != nil {
+			return err
+		}
+		for serviceID, value := range services {
+			if !strings.HasPrefix(string(serviceID), TableServicePrefix) {
+				continue
+			}
+			if entry, ok := decodeEntry(value); ok && now.Before(entry.expires) {
+				continue
+			}
+			if err := txn.RemoveClientServiceServer(clientID, serviceID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Encode entry as "inflight <expiry>" or "delivered <expiry>".
+func encodeEntry(entry seenEntry) router.ServerID {
+	state := "inflight"
+	if entry.state == Delivered {
+		state = "delivered"
+	}
+	return router.ServerID(state + " " + entry.expires.UTC().Format(time.RFC3339Nano))
+}
+
+func decodeEntry(value router.ServerID) (seenEntry, bool) {
+	state, expires, _ := strings.Cut(string(value), " ")
+
+	var entry seenEntry
+	switch state {
+	case "inflight":
+		entry.state = InFlight
+	case "delivered":
+		entry.state = Delivered
+	default:
+		return entry, false
+	}
+
+	var err error
+	entry.expires, err = time.Parse(time.RFC3339Nano, expires)
+	return entry, err == nil
+}
+
+func notFound(err error) bool {
+	return errors.Is(err, router.ErrUnknownClient) || errors.Is(err, router.ErrMappingNotFound)
+}
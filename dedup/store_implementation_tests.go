@@ -0,0 +1,85 @@
+package dedup
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+// Check store remembers, scopes, expires and forgets message IDs, tracks
+// whether they were delivered, and records each ID once under concurrent
+// calls.
+func TestStore(t *testing.T, store Store) {
+	tests := []struct {
+		clientID  router.ClientID
+		messageID string
+		window    time.Duration
+		state     State
+	}{
+		{"client.1", "msg.1", time.Minute, Unseen},
+		{"client.1", "msg.1", time.Minute, InFlight},
+
+		// IDs are scoped to their client.
+		{"client.2", "msg.1", time.Minute, Unseen},
+
+		// Expired IDs are forgotten.
+		{"client.1", "msg.2", -time.Second, Unseen},
+		{"client.1", "msg.2", time.Minute, Unseen},
+		{"client.1", "msg.2", time.Minute, InFlight},
+	}
+
+	for _, test := range tests {
+		state, err := store.Seen(test.clientID, test.messageID, test.window)
+		if state != test.state || err != nil {
+			t.Errorf("FAIL: Seen(%v, %v) = %v, %v, want %v", test.clientID, test.messageID, state, err, test.state)
+		}
+	}
+
+	if err := store.Done("client.1", "msg.2"); err != nil {
+		t.Errorf("FAIL: Done() = %v", err)
+	}
+	if state, err := store.Seen("client.1", "msg.2", time.Minute); state != Delivered || err != nil {
+		t.Errorf("FAIL: Seen() = %v, %v after Done, want Delivered", state, err)
+	}
+	if err := store.Done("client.3", "msg.1"); err != nil {
+		t.Errorf("FAIL: Done() = %v for an unknown ID", err)
+	}
+
+	if err := store.Forget("client.1", "msg.1"); err != nil {
+		t.Errorf("FAIL: Forget() = %v", err)
+	}
+	if state, err := store.Seen("client.1", "msg.1", time.Minute); state != Unseen || err != nil {
+		t.Errorf("FAIL: Seen() = %v, %v after Forget", state, err)
+	}
+	if state, _ := store.Seen("client.2", "msg.1", time.Minute); state == Unseen {
+		t.Errorf("FAIL: Forget dropped another client's ID")
+	}
+	if err := store.Forget("client.3", "msg.1"); err != nil {
+		t.Errorf("FAIL: Forget() = %v for an unknown ID", err)
+	}
+
+	var lock sync.Mutex
+	var wait sync.WaitGroup
+	unseen := 0
+	for i := 0; i < 20; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			state, err := store.Seen("client.4", "msg.1", time.Minute)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				t.Errorf("FAIL: Seen() = %v", err)
+			}
+			if state == Unseen {
+				unseen++
+			}
+		}()
+	}
+	wait.Wait()
+	if unseen != 1 {
+		t.Errorf("FAIL: %d concurrent calls saw the ID as unseen, want 1", unseen)
+	}
+}
@@ -0,0 +1,35 @@
+package grpcproxy
+
+import (
+	"fmt"
+)
+
+// frame holds an undecoded gRPC message.
+type frame struct {
+	payload []byte
+}
+
+// rawCodec passes messages through without decoding them.  It reports itself
+// as "proto" so backends see the content-type the client originally sent.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	f, ok := v.(*frame)
+	if !ok {
+		return nil, fmt.Errorf("grpcproxy: cannot marshal %T", v)
+	}
+	return f.payload, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	f, ok := v.(*frame)
+	if !ok {
+		return fmt.Errorf("grpcproxy: cannot unmarshal into %T", v)
+	}
+	f.payload = append(f.payload[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
@@ -0,0 +1,309 @@
+// Package grpcproxy implements a transparent gRPC front-end.  Any method
+// called on the proxy is routed to a backend chosen by the routing table and
+// streamed through without being decoded.
+//
+// The client is identified by the ClientIDKey request metadata, and the
+// service portion of the full method name ("pkg.Service" for
+// "/pkg.Service/Method") is used as the ServiceID.  Responses routed from a
+// routing table's stale data carry the StaleKey header metadata.
+package grpcproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/robertkluin/message-flow/router"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Metadata key read for the client ID unless the proxy is configured
+// otherwise.
+const DefaultClientIDKey = "x-mflow-client-id"
+
+// Header metadata key set to "true" when the backend was resolved from
+// stale data, see router.WithStaleMarker.
+const StaleKey = "x-mflow-stale"
+
+// A Dialer opens a connection to a backend server.
+type Dialer func(ctx context.Context, serverID router.ServerID) (*grpc.ClientConn, error)
+
+// Proxy routes arbitrary gRPC calls to backends.
+type Proxy struct {
+	// Metadata key holding the client ID.  When empty DefaultClientIDKey is
+	// used.
+	ClientIDKey string
+
+	// Logger receives backend failures.  Resolve failures are logged by the
+	// resolver.  When nil nothing is logged.
+	Logger *slog.Logger
+
+	resolver *router.Resolver
+	dial     Dialer
+
+	lock  sync.Mutex
+	conns map[router.ServerID]*grpc.ClientConn
+}
+
+// Create a proxy resolving backends with resolver.  When dial is nil backends
+// are dialed using their server ID as the target, without transport security.
+func NewProxy(resolver *router.Resolver, dial Dialer) *Proxy {
+	proxy := new(Proxy)
+	proxy.resolver = resolver
+	proxy.dial = dial
+	proxy.conns = make(map[router.ServerID]*grpc.ClientConn)
+	return proxy
+}
+
+// Server options that install the proxy as the handler for every method.
+func (p *Proxy) ServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ForceServerCodec(rawCodec{}),
+		grpc.UnknownServiceHandler(p.handle),
+	}
+}
+
+// Create a gRPC server that proxies all calls.
+func (p *Proxy) NewServer(opts ...grpc.ServerOption) *grpc.Server {
+	return grpc.NewServer(append(p.ServerOptions(), opts...)...)
+}
+
+// Close all backend connections.
+func (p *Proxy) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var err error
+	for serverID, conn := range p.conns {
+		if cerr := conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(p.conns, serverID)
+	}
+	return err
+}
+
+func (p *Proxy) handle(srv interface{}, serverStream grpc.ServerStream) error {
+	ctx := serverStream.Context()
+
+	method, ok := grpc.MethodFromServerStream(serverStream)
+	if !ok {
+		return status.Error(codes.Internal, "grpcproxy: no method in stream")
+	}
+
+	serviceID, ok := ServiceFromMethod(method)
+	if !ok {
+		return status.Errorf(codes.Unimplemented, "grpcproxy: malformed method %q", method)
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	clientID := p.clientID(md)
+	if clientID == "" {
+		return status.Errorf(codes.Unauthenticated, "grpcproxy: missing %s metadata", p.clientIDKey())
+	}
+
+	ctx = router.WithStaleMarker(ctx)
+	serverID, err := p.resolver.ResolveContext(ctx, clientID, serviceID)
+	if err != nil {
+		return statusFromError(err)
+	}
+	if router.ServedStale(ctx) {
+		serverStream.SetHeader(metadata.Pairs(StaleKey, "true"))
+	}
+
+	conn, err := p.conn(ctx, serverID)
+	if err != nil {
+		p.logBackendError(ctx, "dialing backend failed", clientID, serviceID, serverID, err)
+		return status.Errorf(codes.Unavailable, "grpcproxy: dialing %s: %v", serverID, err)
+	}
+
+	clientCtx, cancel := context.WithCancel(metadata.NewOutgoingContext(ctx, md.Copy()))
+	defer cancel()
+
+	desc := &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}
+	clientStream, err := grpc.NewClientStream(clientCtx, desc, conn, method, grpc.ForceCodec(rawCodec{}))
+	if err != nil {
+		p.logBackendError(ctx, "opening backend stream failed", clientID, serviceID, serverID, err)
+		return err
+	}
+
+	toBackend := pumpToBackend(serverStream, clientStream)
+	toClient := pumpToClient(clientStream, serverStream)
+
+	for {
+		select {
+		case err := <-toBackend:
+			if err != nil {
+				cancel()
+				return status.Errorf(codes.Internal, "grpcproxy: receiving from client: %v", err)
+			}
+			// The client finished sending; keep relaying the backend's
+			// responses.
+			toBackend = nil
+		case err := <-toClient:
+			serverStream.SetTrailer(clientStream.Trailer())
+			return err
+		}
+	}
+}
+
+// Copy messages from the client to the backend, closing the backend's send
+// side when the client is done.
+func pumpToBackend(src grpc.ServerStream, dst grpc.ClientStream) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		f := new(frame)
+		for {
+			if err := src.RecvMsg(f); err != nil {
+				if err == io.EOF {
+					dst.CloseSend()
+					err = nil
+				}
+				done <- err
+				return
+			}
+			if err := dst.SendMsg(f); err != nil {
+				// The backend's error is reported by its receive side.
+				done <- nil
+				return
+			}
+		}
+	}()
+	return done
+}
+
+// Copy the backend's headers and messages to the client.  The returned
+// channel yields nil when the backend finished cleanly, otherwise its status.
+func pumpToClient(src grpc.ClientStream, dst grpc.ServerStream) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		f := new(frame)
+		for i := 0; ; i++ {
+			if err := src.RecvMsg(f); err != nil {
+				if i == 0 {
+					if header, herr := src.Header(); herr == nil {
+						dst.SendHeader(header)
+					}
+				}
+				if err == io.EOF {
+					err = nil
+				}
+				done <- err
+				return
+			}
+			if i == 0 {
+				header, err := src.Header()
+				if err != nil {
+					done <- err
+					return
+				}
+				if err := dst.SendHeader(header); err != nil {
+					done <- err
+					return
+				}
+			}
+			if err := dst.SendMsg(f); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	return done
+}
+
+// Get the service portion of a full gRPC method name.
+func ServiceFromMethod(method string) (router.ServiceID, bool) {
+	method = strings.TrimPrefix(method, "/")
+	pos := strings.LastIndex(method, "/")
+	if pos <= 0 || pos == len(method)-1 {
+		return "", false
+	}
+	return router.ServiceID(method[:pos]), true
+}
+
+func (p *Proxy) logBackendError(ctx context.Context, msg string, clientID router.ClientID, serviceID router.ServiceID, serverID router.ServerID, err error) {
+	router.LoggerOrDiscard(p.Logger).LogAttrs(ctx, slog.LevelError, msg,
+		slog.String(router.ClientKey, string(clientID)),
+		slog.String(router.ServiceKey, string(serviceID)),
+		slog.String(router.ServerKey, string(serverID)),
+		slog.String(router.ErrorKey, err.Error()))
+}
+
+func (p *Proxy) clientIDKey() string {
+	if p.ClientIDKey != "" {
+		return strings.ToLower(p.ClientIDKey)
+	}
+	return DefaultClientIDKey
+}
+
+func (p *Proxy) clientID(md metadata.MD) router.ClientID {
+	values := md.Get(p.clientIDKey())
+	if len(values) == 0 {
+		return ""
+	}
+	return router.ClientID(values[0])
+}
+
+// Get a cached connection to the backend, dialing it if needed.
+func (p *Proxy) conn(ctx context.Context, serverID router.ServerID) (*grpc.ClientConn, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if conn, ok := p.conns[serverID]; ok {
+		return conn, nil
+	}
+
+	var conn *grpc.ClientConn
+	var err error
+	if p.dial != nil {
+		conn, err = p.dial(ctx, serverID)
+	} else {
+		conn, err = grpc.NewClient(string(serverID), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p.conns[serverID] = conn
+	return conn, nil
+}
+
+var codesByError = map[router.RoutingTableErrorCode]codes.Code{
+	router.ServiceError:         codes.Unavailable,
+	router.LookupError:          codes.Unavailable,
+	router.UnknownClient:        codes.NotFound,
+	router.UnknownService:       codes.Unimplemented,
+	router.ServerPoolEmptyError: codes.Unavailable,
+	router.ServerNotFoundError:  codes.Unavailable,
+	router.MappingNotFoundError: codes.NotFound,
+}
+
+// The gRPC code the proxy answers a failure to route a call with.  It
+// follows router.HTTPStatus, except that unknown services are
+// unimplemented, as gRPC servers report them.
+func Code(err error) codes.Code {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return codes.DeadlineExceeded
+	}
+	if errors.Is(err, context.Canceled) {
+		return codes.Canceled
+	}
+	if code, ok := router.ErrorCode(err); ok {
+		if grpcCode, ok := codesByError[code]; ok {
+			return grpcCode
+		}
+	}
+	return codes.Unknown
+}
+
+// Convert a routing failure into a gRPC status.
+func statusFromError(err error) error {
+	return status.Error(Code(err), err.Error())
+}
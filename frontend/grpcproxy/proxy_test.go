@@ -0,0 +1,158 @@
+package grpcproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routingtable"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Serve server on an in-process listener and return a connection to it.
+func serve(t *testing.T, server *grpc.Server) *grpc.ClientConn {
+	listener := bufconn.Listen(1 << 20)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	dialer := func(ctx context.Context, addr string) (net.Conn, error) {
+		return listener.DialContext(ctx)
+	}
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(dialer),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// Start a backend reporting the given serving status.
+func backend(t *testing.T, servingStatus healthpb.HealthCheckResponse_ServingStatus) *grpc.ClientConn {
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("", servingStatus)
+
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	return serve(t, server)
+}
+
+func TestProxy(t *testing.T) {
+	backends := map[router.ServerID]*grpc.ClientConn{
+		"backend.1": backend(t, healthpb.HealthCheckResponse_SERVING),
+		"backend.2": backend(t, healthpb.HealthCheckResponse_NOT_SERVING),
+	}
+
+	table := routingtable.NewMemoryRoutingTable()
+	table.AddServerToServicePool("grpc.health.v1.Health", "backend.1")
+	table.SetClientServiceServer("client.2", "grpc.health.v1.Health", "backend.2")
+
+	proxy := NewProxy(router.NewResolver(table, nil), func(ctx context.Context, serverID router.ServerID) (*grpc.ClientConn, error) {
+		return backends[serverID], nil
+	})
+	health := healthpb.NewHealthClient(serve(t, proxy.NewServer()))
+
+	tests := []struct {
+		clientID router.ClientID
+		status   healthpb.HealthCheckResponse_ServingStatus
+		code     codes.Code
+	}{
+		{"client.1", healthpb.HealthCheckResponse_SERVING, codes.OK},
+		{"client.2", healthpb.HealthCheckResponse_NOT_SERVING, codes.OK},
+		{"", 0, codes.Unauthenticated},
+	}
+
+	for _, test := range tests {
+		ctx := context.Background()
+		if test.clientID != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, DefaultClientIDKey, string(test.clientID))
+		}
+
+		resp, err := health.Check(ctx, &healthpb.HealthCheckRequest{})
+		if status.Code(err) != test.code {
+			t.Errorf("client %q: got code %v, want %v (%v)", test.clientID, status.Code(err), test.code, err)
+			continue
+		}
+		if err == nil && resp.Status != test.status {
+			t.Errorf("client %q: got status %v, want %v", test.clientID, resp.Status, test.status)
+		}
+	}
+
+	// Backend errors are relayed to the client unchanged.
+	ctx := metadata.AppendToOutgoingContext(context.Background(), DefaultClientIDKey, "client.1")
+	_, err := health.Check(ctx, &healthpb.HealthCheckRequest{Service: "missing"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected backend NotFound to be relayed, got %v", err)
+	}
+
+	// Streaming calls are relayed.
+	watch, err := health.Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("watch failed: %v", err)
+	}
+	resp, err := watch.Recv()
+	if err != nil || resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("unexpected watch response: %v, %v", resp, err)
+	}
+}
+
+func TestProxyUnknownService(t *testing.T) {
+	proxy := NewProxy(router.NewResolver(routingtable.NewMemoryRoutingTable(), nil), nil)
+	health := healthpb.NewHealthClient(serve(t, proxy.NewServer()))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), DefaultClientIDKey, "client.1")
+	_, err := health.Check(ctx, &healthpb.HealthCheckRequest{})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("expected Unimplemented for unknown service, got %v", err)
+	}
+}
+
+func TestServiceFromMethod(t *testing.T) {
+	tests := []struct {
+		method  string
+		service router.ServiceID
+		ok      bool
+	}{
+		{"/grpc.health.v1.Health/Check", "grpc.health.v1.Health", true},
+		{"pkg.Service/Method", "pkg.Service", true},
+		{"/Method", "", false},
+		{"/pkg.Service/", "", false},
+	}
+
+	for _, test := range tests {
+		service, ok := ServiceFromMethod(test.method)
+		if service != test.service || ok != test.ok {
+			t.Errorf("ServiceFromMethod(%q) = %q, %v", test.method, service, ok)
+		}
+	}
+}
+
+func TestCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code codes.Code
+	}{
+		{router.NewRoutingTableError(router.UnknownService, "No service."), codes.Unimplemented},
+		{router.NewRoutingTableError(router.ServerPoolEmptyError, "No servers."), codes.Unavailable},
+		{fmt.Errorf("resolving: %w", router.NewRoutingTableError(router.MappingNotFoundError, "No mapping.")), codes.NotFound},
+		{router.WrapRoutingTableError(router.LookupError, "Registrar failed.", context.DeadlineExceeded), codes.DeadlineExceeded},
+		{errors.New("unexpected"), codes.Unknown},
+	}
+
+	for _, test := range tests {
+		if code := Code(test.err); code != test.code {
+			t.Errorf("Code(%v) = %v, want %v", test.err, code, test.code)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Package httpproxy implements a reverse proxy front-end for HTTP clients.
+//
+// The first segment of the request path names the service, and the client is
+// identified by the ClientIDHeader request header.  The request, with the
+// service segment removed from its path, is proxied to the server the
+// routing table resolves for the client.  Server IDs are used as base URLs;
+// IDs without a scheme are treated as "http://" host addresses.  Responses
+// routed from a routing table's stale data carry the StaleHeader.
+package httpproxy
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+// Header read for the client ID unless the proxy is configured otherwise.
+const DefaultClientIDHeader = "Mflow-Client-Id"
+
+// Response header set to "true" when the server was resolved from stale
+// data, see router.WithStaleMarker.
+const StaleHeader = "Mflow-Stale"
+
+// Proxy routes HTTP requests to backends.
+type Proxy struct {
+	// Header holding the client ID.  When empty DefaultClientIDHeader is
+	// used.
+	ClientIDHeader string
+
+	// Transport used to reach backends.  When nil http.DefaultTransport is
+	// used.
+	Transport http.RoundTripper
+
+	// Logger receives backend failures.  Resolve failures are logged by the
+	// resolver.  When nil nothing is logged.
+	Logger *slog.Logger
+
+	resolver *router.Resolver
+}
+
+func NewProxy(resolver *router.Resolver) *Proxy {
+	proxy := new(Proxy)
+	proxy.resolver = resolver
+	return proxy
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	serviceID, rest := splitService(req.URL.Path)
+	if serviceID == "" {
+		http.Error(w, "missing service", http.StatusNotFound)
+		return
+	}
+
+	clientID := router.ClientID(req.Header.Get(p.clientIDHeader()))
+	if clientID == "" {
+		http.Error(w, "missing "+p.clientIDHeader()+" header", http.StatusBadRequest)
+		return
+	}
+
+	ctx := router.WithStaleMarker(req.Context())
+	serverID, err := p.resolver.ResolveContext(ctx, clientID, serviceID)
+	if err != nil {
+		http.Error(w, err.Error(), router.HTTPStatus(err))
+		return
+	}
+	if router.ServedStale(ctx) {
+		w.Header().Set(StaleHeader, "true")
+	}
+
+	target, err := url.Parse(serverURL(serverID))
+	if err != nil {
+		http.Error(w, "invalid server "+string(serverID), http.StatusBadGateway)
+		return
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Transport: p.Transport,
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Path = rest
+			r.Out.URL.RawPath = ""
+			r.SetURL(target)
+			r.SetXForwarded()
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			router.LoggerOrDiscard(p.Logger).LogAttrs(req.Context(), slog.LevelError, "proxying failed",
+				slog.String(router.ClientKey, string(clientID)),
+				slog.String(router.ServiceKey, string(serviceID)),
+				slog.String(router.ServerKey, string(serverID)),
+				slog.String(router.ErrorKey, err.Error()))
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, req)
+}
+
+func (p *Proxy) clientIDHeader() string {
+	if p.ClientIDHeader != "" {
+		return p.ClientIDHeader
+	}
+	return DefaultClientIDHeader
+}
+
+// Split "/service/rest" into the service and "/rest".
+func splitService(path string) (router.ServiceID, string) {
+	path = strings.TrimPrefix(path, "/")
+	service, rest, _ := strings.Cut(path, "/")
+	return router.ServiceID(service), "/" + rest
+}
+
+func serverURL(serverID router.ServerID) string {
+	if strings.Contains(string(serverID), "://") {
+		return string(serverID)
+	}
+	return "http://" + string(serverID)
+}
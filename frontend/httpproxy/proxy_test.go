@@ -0,0 +1,55 @@
+package httpproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routingtable"
+)
+
+func TestProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "backend:"+req.URL.Path)
+	}))
+	defer backend.Close()
+
+	table := routingtable.NewMemoryRoutingTable()
+	table.AddServerToServicePool("service.1", router.ServerID(backend.URL))
+
+	proxy := httptest.NewServer(NewProxy(router.NewResolver(table, nil)))
+	defer proxy.Close()
+
+	tests := []struct {
+		path     string
+		clientID string
+		status   int
+		body     string
+	}{
+		{"/service.1/items/1", "client.1", 200, "backend:/items/1"},
+		{"/service.1/items/1", "", 400, ""},
+		{"/service.2/items/1", "client.1", 404, ""},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", proxy.URL+test.path, nil)
+		if test.clientID != "" {
+			req.Header.Set(DefaultClientIDHeader, test.clientID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: got status %d, want %d", test.path, resp.StatusCode, test.status)
+		}
+		if test.status == 200 && string(body) != test.body {
+			t.Errorf("%s: got body %q, want %q", test.path, body, test.body)
+		}
+	}
+}
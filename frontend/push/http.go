@@ -0,0 +1,208 @@
+package push
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/robertkluin/message-flow/httptransport"
+	"github.com/robertkluin/message-flow/router"
+)
+
+var errMissingClient = errors.New("push: missing client")
+
+// Handler serving events as a Server-Sent Events stream.  Clients resume
+// with the Last-Event-ID header or the "last_event_id" query parameter.
+func (h *Hub) SSEHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		clientID, err := h.register(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		lastID, err := lastEventID(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		release, err := h.attach(clientID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(h.keepAlive())
+		defer keepAlive.Stop()
+
+		for {
+			events, notify := h.since(clientID, lastID)
+			for _, event := range events {
+				if _, err := w.Write(encodeSSE(event)); err != nil {
+					return
+				}
+				lastID = event.ID
+			}
+			flusher.Flush()
+
+			select {
+			case <-notify:
+			case <-keepAlive.C:
+				if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+					return
+				}
+			case <-req.Context().Done():
+				return
+			}
+		}
+	})
+}
+
+// Handler serving events to long-polling clients as a JSON array.  Clients
+// pass the ID of the last event they received in the "last_event_id" query
+// parameter.  If no events are waiting the request is held until one arrives
+// or the poll timeout passes.
+func (h *Hub) PollHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clientID, err := h.register(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		lastID, err := lastEventID(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		release, err := h.attach(clientID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+
+		events, notify := h.since(clientID, lastID)
+		if len(events) == 0 {
+			timeout := time.NewTimer(h.PollTimeout)
+			defer timeout.Stop()
+
+			select {
+			case <-notify:
+				events, _ = h.since(clientID, lastID)
+			case <-timeout.C:
+			case <-req.Context().Done():
+				return
+			}
+		}
+
+		if events == nil {
+			events = []Event{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(events)
+	})
+}
+
+// Handler accepting messages for clients, so servers can reach clients
+// through the hub.  It speaks httptransport's protocol: the request body is
+// delivered to the client named by the Mflow-Client-Id header, tagged with
+// the Mflow-Service-Id header.  The "client" and "service" query parameters
+// are accepted in place of the headers.
+func (h *Hub) DeliverHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := req.URL.Query()
+		clientID := router.ClientID(req.Header.Get(httptransport.ClientIDHeader))
+		if clientID == "" {
+			clientID = router.ClientID(query.Get("client"))
+		}
+		if clientID == "" {
+			http.Error(w, errMissingClient.Error(), http.StatusBadRequest)
+			return
+		}
+		serviceID := router.ServiceID(req.Header.Get(httptransport.ServiceIDHeader))
+		if serviceID == "" {
+			serviceID = router.ServiceID(query.Get("service"))
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, h.maxMessageSize()))
+		if err != nil {
+			status := http.StatusBadRequest
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		if h.Deliver(&router.Message{ClientID: clientID, ServiceID: serviceID, Body: body}) == 0 {
+			http.Error(w, errTooManyClients.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func lastEventID(req *http.Request) (uint64, error) {
+	value := req.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = req.URL.Query().Get("last_event_id")
+	}
+	if value == "" {
+		return 0, nil
+	}
+
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("push: invalid last event ID %q", value)
+	}
+	return id, nil
+}
+
+// Encode an event in the SSE wire format, splitting multi-line data across
+// data fields.
+func encodeSSE(event Event) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "id: %d\n", event.ID)
+	if event.Gap {
+		// Events without data are not dispatched by browsers.
+		fmt.Fprintf(&buf, "event: %s\ndata: %d\n\n", GapEvent, event.ID)
+		return buf.Bytes()
+	}
+	if event.ServiceID != "" {
+		fmt.Fprintf(&buf, "event: %s\n", event.ServiceID)
+	}
+	for _, line := range bytes.Split(event.Data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
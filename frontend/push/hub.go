@@ -0,0 +1,330 @@
+// Package push delivers outbound messages to clients that cannot hold a
+// socket open, using Server-Sent Events or HTTP long-polling.
+//
+// A Hub buffers messages per client.  Whichever transport the client is
+// currently using drains the buffer, and clients resume after reconnecting by
+// passing the ID of the last event they saw.  Event IDs increase across the
+// whole hub, so they stay valid when a client's buffer is dropped.  When
+// events a client had not seen were dropped, because its buffer overflowed
+// or was evicted, it is sent a gap event before the remaining events.
+//
+// Unless the hub is given an Identifier, clients name themselves with the
+// "client" query parameter and anyone may read any client's events.  Set
+// Identify to authenticate clients before exposing a hub.
+package push
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+// Number of undelivered events kept per client unless the hub is configured
+// otherwise.
+const DefaultBufferSize = 256
+
+// Interval between SSE keepalive comments unless the hub is configured
+// otherwise.
+const DefaultKeepAlive = 15 * time.Second
+
+// Number of clients buffered for unless the hub is configured otherwise.
+const DefaultMaxClients = 10000
+
+// How long a client's buffer is kept once nothing reads it, unless the hub
+// is configured otherwise.
+const DefaultIdleTimeout = 10 * time.Minute
+
+// Largest message body accepted for delivery unless the hub is configured
+// otherwise.
+const DefaultMaxMessageSize = 1 << 20
+
+// SSE event type of gap events.
+const GapEvent = "mflow.gap"
+
+var errTooManyClients = errors.New("push: too many clients")
+
+// An Identifier determines which client is making a request.
+type Identifier func(req *http.Request) (router.ClientID, error)
+
+// Hub buffers outbound messages for clients and serves them over SSE and
+// long-poll endpoints.
+type Hub struct {
+	// The message server ID registered for clients connected to this hub.
+	// Servers POST messages for the clients to it, so it should be the URL
+	// DeliverHandler is served at.
+	ServerID router.ServerID
+
+	// Table receives the message server registration for each client.
+	Table router.ClientTable
+
+	// Identify determines the requesting client.  When nil the "client"
+	// query parameter is trusted, which lets any caller read any client's
+	// events; only leave it nil behind a proxy that authenticates clients
+	// and sets the parameter.
+	Identify Identifier
+
+	// Number of events kept per client.  When zero DefaultBufferSize is
+	// used.
+	BufferSize int
+
+	// How long a long-poll request waits for an event before returning an
+	// empty response.
+	PollTimeout time.Duration
+
+	// Interval at which comments are sent on idle SSE streams.  When zero
+	// DefaultKeepAlive is used.
+	KeepAlive time.Duration
+
+	// Number of clients events are buffered for.  When the hub is full the
+	// least recently read buffer not being read is dropped, and events for
+	// new clients are refused if every buffer is being read.  When zero
+	// DefaultMaxClients is used.
+	MaxClients int
+
+	// How long a client's buffer is kept once nothing is reading it.  When
+	// zero DefaultIdleTimeout is used.
+	IdleTimeout time.Duration
+
+	// Largest message body DeliverHandler accepts.  When zero
+	// DefaultMaxMessageSize is used.
+	MaxMessageSize int64
+
+	lock      sync.Mutex
+	mailboxes map[router.ClientID]*mailbox
+	lastID    uint64
+	swept     time.Time
+}
+
+// Event is a message buffered for delivery to a client.  Gap events carry no
+// message; they report that events before their ID were dropped unseen.
+type Event struct {
+	ID        uint64           `json:"id"`
+	ServiceID router.ServiceID `json:"service"`
+	Data      []byte           `json:"data"`
+	Gap       bool             `json:"gap,omitempty"`
+}
+
+type mailbox struct {
+	events []Event
+
+	// Events up to this ID are no longer buffered: they were dropped, or
+	// delivered before the mailbox was created.
+	dropped uint64
+
+	notify  chan struct{}
+	readers int
+	used    time.Time
+}
+
+func NewHub(serverID router.ServerID, table router.ClientTable) *Hub {
+	hub := new(Hub)
+	hub.ServerID = serverID
+	hub.Table = table
+	hub.PollTimeout = 30 * time.Second
+	hub.mailboxes = make(map[router.ClientID]*mailbox)
+	return hub
+}
+
+// Queue msg for delivery to its client and return the assigned event ID, or
+// 0 if the hub is full.
+func (h *Hub) Deliver(msg *router.Message) uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	box := h.mailbox(msg.ClientID)
+	if box == nil {
+		return 0
+	}
+	h.lastID++
+	box.events = append(box.events, Event{ID: h.lastID, ServiceID: msg.ServiceID, Data: msg.Body})
+	if overflow := len(box.events) - h.bufferSize(); overflow > 0 {
+		box.dropped = box.events[overflow-1].ID
+		box.events = append(box.events[:0], box.events[overflow:]...)
+	}
+
+	close(box.notify)
+	box.notify = make(chan struct{})
+
+	return h.lastID
+}
+
+// Forward delivers msg to its client, allowing the hub to act as the message
+// server for clients.  It never produces a reply.
+func (h *Hub) Forward(ctx context.Context, serverID router.ServerID, msg *router.Message) (*router.Message, error) {
+	if h.Deliver(msg) == 0 {
+		return nil, errTooManyClients
+	}
+	return nil, nil
+}
+
+// Drop all buffered events for a client.
+func (h *Hub) Remove(clientID router.ClientID) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	delete(h.mailboxes, clientID)
+}
+
+// Count a reader of the client's events until release is called, so its
+// buffer is kept.
+func (h *Hub) attach(clientID router.ClientID) (release func(), err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	box := h.mailbox(clientID)
+	if box == nil {
+		return nil, errTooManyClients
+	}
+	box.readers++
+
+	return func() {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+
+		box.readers--
+		box.used = time.Now()
+	}, nil
+}
+
+// Get the client's events after lastID, and a channel closed when another
+// event arrives.  The events start with a gap event if some after lastID
+// were dropped.  An ID the hub has not reached yet, given by a client of an
+// earlier hub, is treated as a gap before all buffered events.  If the hub
+// is full the channel is nil.
+func (h *Hub) since(clientID router.ClientID, lastID uint64) ([]Event, <-chan struct{}) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	box := h.mailbox(clientID)
+	if box == nil {
+		return nil, nil
+	}
+	box.used = time.Now()
+
+	var events []Event
+	if lastID > h.lastID || (lastID > 0 && lastID < box.dropped) {
+		events = append(events, Event{ID: box.dropped, Gap: true})
+		lastID = 0
+	}
+	for i, event := range box.events {
+		if event.ID > lastID {
+			events = append(events, box.events[i:]...)
+			break
+		}
+	}
+	return events, box.notify
+}
+
+// Identify the client and register the hub as its message server.
+func (h *Hub) register(req *http.Request) (router.ClientID, error) {
+	var clientID router.ClientID
+	if h.Identify != nil {
+		var err error
+		clientID, err = h.Identify(req)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		clientID = router.ClientID(req.URL.Query().Get("client"))
+	}
+
+	if clientID == "" {
+		return "", errMissingClient
+	}
+
+	err := h.Table.SetClientMessageServer(clientID, h.ServerID)
+	if err != nil {
+		return "", err
+	}
+
+	return clientID, nil
+}
+
+// Get the client's mailbox, creating it if there is room, or nil.  Must be
+// called with the lock held.
+func (h *Hub) mailbox(clientID router.ClientID) *mailbox {
+	box, ok := h.mailboxes[clientID]
+	if ok {
+		return box
+	}
+
+	now := time.Now()
+	if len(h.mailboxes) >= h.maxClients() || now.Sub(h.swept) >= h.idleTimeout() {
+		h.evict(now)
+	}
+	if len(h.mailboxes) >= h.maxClients() {
+		return nil
+	}
+
+	box = new(mailbox)
+	box.dropped = h.lastID
+	box.notify = make(chan struct{})
+	box.used = now
+	h.mailboxes[clientID] = box
+	return box
+}
+
+// Drop mailboxes idle for longer than the idle timeout.  If the hub is still
+// full drop the least recently used mailbox nothing is reading.  Must be
+// called with the lock held.
+func (h *Hub) evict(now time.Time) {
+	h.swept = now
+
+	var oldest router.ClientID
+	var oldestBox *mailbox
+	for clientID, box := range h.mailboxes {
+		if box.readers > 0 {
+			continue
+		}
+		if now.Sub(box.used) >= h.idleTimeout() {
+			delete(h.mailboxes, clientID)
+			continue
+		}
+		if oldestBox == nil || box.used.Before(oldestBox.used) {
+			oldest, oldestBox = clientID, box
+		}
+	}
+
+	if len(h.mailboxes) >= h.maxClients() && oldestBox != nil {
+		delete(h.mailboxes, oldest)
+	}
+}
+
+func (h *Hub) bufferSize() int {
+	if h.BufferSize > 0 {
+		return h.BufferSize
+	}
+	return DefaultBufferSize
+}
+
+func (h *Hub) maxClients() int {
+	if h.MaxClients > 0 {
+		return h.MaxClients
+	}
+	return DefaultMaxClients
+}
+
+func (h *Hub) idleTimeout() time.Duration {
+	if h.IdleTimeout > 0 {
+		return h.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+func (h *Hub) maxMessageSize() int64 {
+	if h.MaxMessageSize > 0 {
+		return h.MaxMessageSize
+	}
+	return DefaultMaxMessageSize
+}
+
+func (h *Hub) keepAlive() time.Duration {
+	if h.KeepAlive > 0 {
+		return h.KeepAlive
+	}
+	return DefaultKeepAlive
+}
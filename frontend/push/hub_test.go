@@ -0,0 +1,229 @@
+package push
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robertkluin/message-flow/httptransport"
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routingtable"
+)
+
+func TestPoll(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	hub := NewHub("push.1", table)
+	hub.PollTimeout = 10 * time.Millisecond
+
+	server := httptest.NewServer(hub.PollHandler())
+	defer server.Close()
+
+	poll := func(query string) []Event {
+		resp, err := http.Get(server.URL + "?" + query)
+		if err != nil {
+			t.Fatalf("poll failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var events []Event
+		if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+			t.Fatalf("decode failed: %v", err)
+		}
+		return events
+	}
+
+	// Nothing waiting, the poll times out empty but registers the client.
+	if events := poll("client=client.1"); len(events) != 0 {
+		t.Errorf("expected no events, got %+v", events)
+	}
+	if serverID, _ := table.GetClientMessageServer("client.1"); serverID != "push.1" {
+		t.Errorf("client message server not registered, got %q", serverID)
+	}
+
+	hub.Deliver(&router.Message{ClientID: "client.1", ServiceID: "service.1", Body: []byte("one")})
+	hub.Deliver(&router.Message{ClientID: "client.1", ServiceID: "service.1", Body: []byte("two")})
+	hub.Deliver(&router.Message{ClientID: "client.2", ServiceID: "service.1", Body: []byte("other")})
+
+	events := poll("client=client.1")
+	if len(events) != 2 || string(events[0].Data) != "one" || string(events[1].Data) != "two" {
+		t.Errorf("unexpected events: %+v", events)
+	}
+
+	// Resume after the first event.
+	events = poll("client=client.1&last_event_id=1")
+	if len(events) != 1 || events[0].ID != 2 {
+		t.Errorf("unexpected events on resume: %+v", events)
+	}
+
+	// A waiting poll is woken by a new event.
+	hub.PollTimeout = time.Minute
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		hub.Deliver(&router.Message{ClientID: "client.1", Body: []byte("three")})
+	}()
+	events = poll("client=client.1&last_event_id=2")
+	if len(events) != 1 || string(events[0].Data) != "three" {
+		t.Errorf("unexpected events after wait: %+v", events)
+	}
+}
+
+func TestDeliverHandler(t *testing.T) {
+	hub := NewHub("push.1", routingtable.NewMemoryRoutingTable())
+	server := httptest.NewServer(hub.DeliverHandler())
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"?client=client.1&service=service.1", "text/plain", strings.NewReader("hello"))
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("deliver failed: %v, %v", resp, err)
+	}
+	resp.Body.Close()
+
+	// Servers forward with httptransport, which names the client in headers.
+	forwarder := httptransport.NewForwarder(nil)
+	if _, err := forwarder.Forward(context.Background(), router.ServerID(server.URL), &router.Message{ClientID: "client.1", ServiceID: "service.2", Body: []byte("forwarded")}); err != nil {
+		t.Fatalf("forward failed: %v", err)
+	}
+
+	hub.MaxMessageSize = 4
+	resp, err = http.Post(server.URL+"?client=client.1", "text/plain", strings.NewReader("too large"))
+	if err != nil || resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected oversized message to be refused: %v, %v", resp, err)
+	}
+	resp.Body.Close()
+
+	events, _ := hub.since("client.1", 0)
+	if len(events) != 2 || string(events[0].Data) != "hello" || events[0].ServiceID != "service.1" || string(events[1].Data) != "forwarded" || events[1].ServiceID != "service.2" {
+		t.Errorf("unexpected events: %+v", events)
+	}
+}
+
+func TestSSE(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	hub := NewHub("push.1", table)
+
+	server := httptest.NewServer(hub.SSEHandler())
+	defer server.Close()
+
+	hub.Deliver(&router.Message{ClientID: "client.1", ServiceID: "service.1", Body: []byte("one")})
+	hub.Deliver(&router.Message{ClientID: "client.1", ServiceID: "service.1", Body: []byte("two\nlines")})
+
+	req, _ := http.NewRequest("GET", server.URL+"?client=client.1", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("unexpected content type %q", contentType)
+	}
+
+	hub.Deliver(&router.Message{ClientID: "client.1", Body: []byte("three")})
+
+	expected := []string{
+		"id: 2", "event: service.1", "data: two", "data: lines", "",
+		"id: 3", "data: three", "",
+	}
+	reader := bufio.NewReader(resp.Body)
+	for _, want := range expected {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if got := strings.TrimSuffix(line, "\n"); got != want {
+			t.Errorf("got line %q, want %q", got, want)
+		}
+	}
+}
+
+func TestEviction(t *testing.T) {
+	hub := NewHub("push.1", routingtable.NewMemoryRoutingTable())
+	hub.MaxClients = 2
+	hub.IdleTimeout = time.Minute
+
+	hub.Deliver(&router.Message{ClientID: "client.1", Body: []byte("one")})
+	release, err := hub.attach("client.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.Deliver(&router.Message{ClientID: "client.2", Body: []byte("two")})
+
+	// The least recently used buffer not being read makes room.
+	if id := hub.Deliver(&router.Message{ClientID: "client.3", Body: []byte("three")}); id == 0 {
+		t.Errorf("expected client.3 to be buffered, got event %d", id)
+	}
+	if _, ok := hub.mailboxes["client.2"]; ok {
+		t.Error("expected client.2 to be evicted")
+	}
+
+	// Buffers being read are kept, so a full hub refuses new clients.
+	if _, err := hub.attach("client.3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hub.Forward(context.Background(), "push.1", &router.Message{ClientID: "client.4"}); err == nil {
+		t.Error("expected a full hub to refuse client.4")
+	}
+	if events, _ := hub.since("client.1", 0); len(events) != 1 {
+		t.Errorf("expected client.1's events to be kept, got %+v", events)
+	}
+
+	// Buffers idle past the timeout are dropped.
+	release()
+	hub.mailboxes["client.1"].used = time.Now().Add(-time.Hour)
+	if id := hub.Deliver(&router.Message{ClientID: "client.4"}); id == 0 {
+		t.Errorf("expected client.4 to be buffered, got event %d", id)
+	}
+	if _, ok := hub.mailboxes["client.1"]; ok {
+		t.Error("expected idle client.1 to be evicted")
+	}
+}
+
+func TestGaps(t *testing.T) {
+	hub := NewHub("push.1", routingtable.NewMemoryRoutingTable())
+	hub.BufferSize = 2
+
+	for _, body := range []string{"one", "two", "three"} {
+		hub.Deliver(&router.Message{ClientID: "client.1", Body: []byte(body)})
+	}
+
+	// Overflow dropped event 1, which the client had not seen.
+	events, _ := hub.since("client.1", 0)
+	if len(events) != 2 || events[0].ID != 2 {
+		t.Errorf("expected a new reader to start at the buffer, got %+v", events)
+	}
+	if events, _ = hub.since("client.1", 2); len(events) != 1 || events[0].ID != 3 {
+		t.Errorf("expected no gap after seen events, got %+v", events)
+	}
+
+	// A reader that missed the dropped event is told.
+	hub.Deliver(&router.Message{ClientID: "client.1", Body: []byte("four")})
+	events, _ = hub.since("client.1", 1)
+	if len(events) != 3 || !events[0].Gap || events[0].ID != 2 || events[1].ID != 3 {
+		t.Errorf("expected a gap before event 3, got %+v", events)
+	}
+
+	// IDs continue after a buffer is removed, so resuming readers see the
+	// new events, after a gap as unseen events were lost with the buffer.
+	hub.Remove("client.1")
+	hub.Deliver(&router.Message{ClientID: "client.1", Body: []byte("five")})
+	events, _ = hub.since("client.1", 3)
+	if len(events) != 2 || !events[0].Gap || events[1].ID != 5 || string(events[1].Data) != "five" {
+		t.Errorf("expected a gap then event 5, got %+v", events)
+	}
+
+	// IDs from an earlier hub start over.
+	events, _ = hub.since("client.1", 100)
+	if len(events) != 2 || !events[0].Gap || events[1].ID != 5 {
+		t.Errorf("expected a gap then event 5, got %+v", events)
+	}
+
+	if sse := string(encodeSSE(Event{ID: 4, Gap: true})); sse != "id: 4\nevent: "+GapEvent+"\ndata: 4\n\n" {
+		t.Errorf("unexpected gap event %q", sse)
+	}
+}
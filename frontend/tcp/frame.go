@@ -0,0 +1,99 @@
+package tcp
+
+// Frames are length-prefixed.  Each frame starts with a 4 byte big-endian
+// length covering the rest of the frame, followed by a 1 byte frame type and
+// the frame's payload:
+//
+//   Hello:   the hello payload, by default the client's ID.
+//   Message: 2 byte big-endian service ID length, service ID, message body.
+//   Reply:   same layout as Message.
+//   Error:   error text.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+type FrameType byte
+
+const (
+	_                    = iota
+	FrameHello FrameType = iota
+	FrameMessage
+	FrameReply
+	FrameError
+)
+
+// Frames larger than this are rejected unless the server is configured
+// otherwise.
+const DefaultMaxFrameSize = 1 << 20
+
+var ErrFrameTooLarge = errors.New("tcp: frame too large")
+
+type Frame struct {
+	Type    FrameType
+	Payload []byte
+}
+
+// Read a single frame from r.
+func ReadFrame(r io.Reader, maxSize int) (*Frame, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := int(binary.BigEndian.Uint32(header[:4]))
+	if size < 1 {
+		return nil, fmt.Errorf("tcp: invalid frame length %d", size)
+	}
+	if size > maxSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	frame := new(Frame)
+	frame.Type = FrameType(header[4])
+	frame.Payload = make([]byte, size-1)
+	if _, err := io.ReadFull(r, frame.Payload); err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+// Write a single frame to w.
+func WriteFrame(w io.Writer, frame *Frame) error {
+	buf := make([]byte, 5+len(frame.Payload))
+	binary.BigEndian.PutUint32(buf[:4], uint32(1+len(frame.Payload)))
+	buf[4] = byte(frame.Type)
+	copy(buf[5:], frame.Payload)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// Encode the service and body of a message or reply frame.
+func EncodeMessage(serviceID router.ServiceID, body []byte) []byte {
+	buf := make([]byte, 2+len(serviceID)+len(body))
+	binary.BigEndian.PutUint16(buf[:2], uint16(len(serviceID)))
+	copy(buf[2:], serviceID)
+	copy(buf[2+len(serviceID):], body)
+	return buf
+}
+
+// Decode the service and body of a message or reply frame.
+func DecodeMessage(payload []byte) (router.ServiceID, []byte, error) {
+	if len(payload) < 2 {
+		return "", nil, errors.New("tcp: message frame too short")
+	}
+
+	size := int(binary.BigEndian.Uint16(payload[:2]))
+	if len(payload) < 2+size {
+		return "", nil, errors.New("tcp: message frame service ID truncated")
+	}
+
+	return router.ServiceID(payload[2 : 2+size]), payload[2+size:], nil
+}
@@ -0,0 +1,307 @@
+// Package tcp implements a message-flow front-end for clients that keep a
+// long-lived TCP connection and exchange length-prefixed frames.
+//
+// A client must open with a Hello frame identifying itself.  The server then
+// registers itself as the client's message server and routes each Message
+// frame to the frame's service, writing any reply back on the connection.
+package tcp
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+// An Authenticator turns a client's hello payload into its client ID, or
+// rejects the client.
+type Authenticator func(hello []byte) (router.ClientID, error)
+
+// Server accepts framed TCP connections from clients.
+type Server struct {
+	// The message server ID registered for clients connected to this server.
+	// The server has no way to accept messages for its clients, so only set
+	// it when something else delivers them at that ID.  When empty clients
+	// are not registered.
+	ServerID router.ServerID
+
+	// Table receives the message server registration for each client.
+	Table router.ClientTable
+
+	// Handler routes the messages received from clients.
+	Handler router.Handler
+
+	// Authenticate is applied to each hello frame.  When nil the hello
+	// payload is used as the client ID.
+	Authenticate Authenticator
+
+	// MaxFrameSize limits the size of frames read from clients.  When zero
+	// DefaultMaxFrameSize is used.
+	MaxFrameSize int
+
+	// Logger receives rejected hellos and frames that could not be routed.
+	// When nil nothing is logged.
+	Logger *slog.Logger
+
+	lock      sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	inFlight  int
+}
+
+var ErrServerClosed = errors.New("tcp: server closed")
+
+func NewServer(serverID router.ServerID, table router.ClientTable, handler router.Handler) *Server {
+	server := new(Server)
+	server.ServerID = serverID
+	server.Table = table
+	server.Handler = handler
+	return server
+}
+
+// Accept connections on l, serving each in its own goroutine.  Serve always
+// returns a non-nil error; after Close it returns ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		go s.ServeConn(conn)
+	}
+}
+
+// Serve a single client connection until it is closed or fails.
+func (s *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+
+	if !s.trackConn(conn, true) {
+		return ErrServerClosed
+	}
+	defer s.trackConn(conn, false)
+
+	clientID, err := s.hello(conn)
+	if err != nil {
+		router.LoggerOrDiscard(s.Logger).LogAttrs(context.Background(), slog.LevelWarn, "hello rejected",
+			slog.String("remote", conn.RemoteAddr().String()),
+			slog.String(router.ErrorKey, err.Error()))
+		WriteFrame(conn, &Frame{Type: FrameError, Payload: []byte(err.Error())})
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for {
+		frame, err := ReadFrame(conn, s.maxFrameSize())
+		if err != nil {
+			return err
+		}
+
+		if err := s.serveFrame(ctx, conn, clientID, frame); err != nil {
+			return err
+		}
+	}
+}
+
+// Route a frame and write the reply, counting it as in flight meanwhile.
+func (s *Server) serveFrame(ctx context.Context, conn net.Conn, clientID router.ClientID, frame *Frame) error {
+	s.lock.Lock()
+	s.inFlight++
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		s.inFlight--
+		s.lock.Unlock()
+	}()
+
+	reply := s.handle(ctx, clientID, frame)
+	if reply == nil {
+		return nil
+	}
+
+	return WriteFrame(conn, reply)
+}
+
+// Stop accepting connections and close all active connections.
+func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+
+	return err
+}
+
+// Stop accepting connections, wait for frames being routed to finish, then
+// close all connections.  If ctx is done first the connections are closed
+// anyway and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.lock.Unlock()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		s.lock.Lock()
+		idle := s.inFlight == 0
+		s.lock.Unlock()
+
+		if idle {
+			return s.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Read the hello frame, identify the client and register its message server.
+func (s *Server) hello(conn net.Conn) (router.ClientID, error) {
+	frame, err := ReadFrame(conn, s.maxFrameSize())
+	if err != nil {
+		return "", err
+	}
+
+	if frame.Type != FrameHello {
+		return "", errors.New("tcp: expected hello frame")
+	}
+
+	clientID := router.ClientID(frame.Payload)
+	if s.Authenticate != nil {
+		clientID, err = s.Authenticate(frame.Payload)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if clientID == "" {
+		return "", errors.New("tcp: empty client ID")
+	}
+
+	if s.ServerID != "" {
+		err = s.Table.SetClientMessageServer(clientID, s.ServerID)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = WriteFrame(conn, &Frame{Type: FrameHello, Payload: []byte(clientID)})
+	if err != nil {
+		return "", err
+	}
+
+	return clientID, nil
+}
+
+// Route a frame from the client and build the frame to reply with, if any.
+func (s *Server) handle(ctx context.Context, clientID router.ClientID, frame *Frame) *Frame {
+	if frame.Type != FrameMessage {
+		return &Frame{Type: FrameError, Payload: []byte("tcp: unexpected frame type")}
+	}
+
+	serviceID, body, err := DecodeMessage(frame.Payload)
+	if err != nil {
+		return &Frame{Type: FrameError, Payload: []byte(err.Error())}
+	}
+
+	msg := &router.Message{ClientID: clientID, ServiceID: serviceID, Body: body}
+	reply, err := s.Handler.Route(ctx, msg)
+	if err != nil {
+		attrs := []slog.Attr{
+			slog.String(router.ClientKey, string(clientID)),
+			slog.String(router.ServiceKey, string(serviceID)),
+		}
+		router.LoggerOrDiscard(s.Logger).LogAttrs(ctx, slog.LevelWarn, "routing failed", append(attrs, router.ErrorAttrs(err)...)...)
+		return &Frame{Type: FrameError, Payload: []byte(err.Error())}
+	}
+
+	if reply == nil {
+		return nil
+	}
+
+	return &Frame{Type: FrameReply, Payload: EncodeMessage(serviceID, reply.Body)}
+}
+
+func (s *Server) maxFrameSize() int {
+	if s.MaxFrameSize > 0 {
+		return s.MaxFrameSize
+	}
+	return DefaultMaxFrameSize
+}
+
+func (s *Server) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
+
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if add {
+		if s.closed {
+			return false
+		}
+		if s.listeners == nil {
+			s.listeners = make(map[net.Listener]struct{})
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+func (s *Server) trackConn(conn net.Conn, add bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if add {
+		if s.closed {
+			return false
+		}
+		if s.conns == nil {
+			s.conns = make(map[net.Conn]struct{})
+		}
+		s.conns[conn] = struct{}{}
+	} else {
+		delete(s.conns, conn)
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package tcp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routingtable"
+)
+
+func startConn(t *testing.T, server *Server) net.Conn {
+	client, conn := net.Pipe()
+	go server.ServeConn(conn)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func sendFrame(t *testing.T, conn net.Conn, frame *Frame) *Frame {
+	if err := WriteFrame(conn, frame); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	reply, err := ReadFrame(conn, DefaultMaxFrameSize)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	return reply
+}
+
+func TestServeConn(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	table.SetServiceServer("service.1", "server.1")
+
+	forwarder := router.ForwarderFunc(func(ctx context.Context, serverID router.ServerID, msg *router.Message) (*router.Message, error) {
+		body := string(serverID) + ":" + string(msg.ClientID) + ":" + string(msg.Body)
+		return &router.Message{Body: []byte(body)}, nil
+	})
+	handler := router.NewRouter(router.NewResolver(table, nil), forwarder)
+
+	conn := startConn(t, NewServer("tcp.1", table, handler))
+
+	reply := sendFrame(t, conn, &Frame{Type: FrameHello, Payload: []byte("client.1")})
+	if reply.Type != FrameHello || string(reply.Payload) != "client.1" {
+		t.Fatalf("unexpected hello reply: %+v", reply)
+	}
+
+	serverID, err := table.GetClientMessageServer("client.1")
+	if err != nil || serverID != "tcp.1" {
+		t.Errorf("client message server not registered: %q, %v", serverID, err)
+	}
+
+	reply = sendFrame(t, conn, &Frame{Type: FrameMessage, Payload: EncodeMessage("service.1", []byte("ping"))})
+	serviceID, body, err := DecodeMessage(reply.Payload)
+	if reply.Type != FrameReply || err != nil || serviceID != "service.1" || string(body) != "server.1:client.1:ping" {
+		t.Errorf("unexpected reply: %+v (%q, %q, %v)", reply, serviceID, body, err)
+	}
+
+	reply = sendFrame(t, conn, &Frame{Type: FrameMessage, Payload: EncodeMessage("service.2", []byte("ping"))})
+	if reply.Type != FrameError {
+		t.Errorf("expected error frame for unknown service, got %+v", reply)
+	}
+}
+
+func TestServeConnRejectsClient(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	server := NewServer("tcp.1", table, nil)
+	server.Authenticate = func(hello []byte) (router.ClientID, error) {
+		return "", errors.New("denied")
+	}
+
+	conn := startConn(t, server)
+
+	reply := sendFrame(t, conn, &Frame{Type: FrameHello, Payload: []byte("client.1")})
+	if reply.Type != FrameError || string(reply.Payload) != "denied" {
+		t.Errorf("expected rejection, got %+v", reply)
+	}
+
+	if _, err := table.GetClientMessageServer("client.1"); err == nil {
+		t.Errorf("rejected client was registered")
+	}
+}
+
+func TestShutdownDrainsInFlightFrames(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	routing := make(chan struct{})
+	release := make(chan struct{})
+	handler := router.HandlerFunc(func(ctx context.Context, msg *router.Message) (*router.Message, error) {
+		close(routing)
+		<-release
+		return &router.Message{Body: []byte("done")}, nil
+	})
+
+	server := NewServer("tcp.1", table, handler)
+	conn := startConn(t, server)
+	sendFrame(t, conn, &Frame{Type: FrameHello, Payload: []byte("client.1")})
+
+	WriteFrame(conn, &Frame{Type: FrameMessage, Payload: EncodeMessage("service.1", []byte("ping"))})
+	<-routing
+
+	shutdown := make(chan error)
+	go func() { shutdown <- server.Shutdown(context.Background()) }()
+	close(release)
+
+	reply, err := ReadFrame(conn, DefaultMaxFrameSize)
+	if err != nil || reply.Type != FrameReply {
+		t.Errorf("expected in-flight reply before shutdown, got %+v, %v", reply, err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("unexpected shutdown error: %v", err)
+	}
+}
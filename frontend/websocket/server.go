@@ -0,0 +1,311 @@
+// Package websocket implements a message-flow front-end for clients, such as
+// browsers, that keep a WebSocket connection open.
+//
+// When a client connects the server registers itself as the client's message
+// server, then routes each message the client sends and writes any reply
+// back on the connection.  Messages are JSON text frames:
+//
+//	{"id": "msg-1", "service": "chat", "headers": {"k": "v"}, "body": "hello"}
+//
+// Replies carry the message's ID and service, and either the reply's body or
+// the routing error:
+//
+//	{"id": "msg-1", "service": "chat", "body": "hi"}
+//	{"id": "msg-2", "service": "nope", "error": "...", "code": "UnknownService"}
+//
+// Messages from one connection are routed one at a time, in order.
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	ws "github.com/coder/websocket"
+	"github.com/robertkluin/message-flow/router"
+)
+
+// Header read for the client ID unless the server is configured otherwise.
+const DefaultClientIDHeader = "Mflow-Client-Id"
+
+// Largest message read from clients unless the server is configured
+// otherwise.
+const DefaultMaxMessageSize = 1 << 20
+
+// An Identifier determines which client is opening a connection, or rejects
+// it.
+type Identifier func(req *http.Request) (router.ClientID, error)
+
+// Server accepts WebSocket connections from clients.  It is an http.Handler
+// serving the upgrade requests.
+type Server struct {
+	// The message server ID registered for clients connected to this server.
+	// The server has no way to accept messages for its clients, so only set
+	// it when something else delivers them at that ID.  When empty clients
+	// are not registered.
+	ServerID router.ServerID
+
+	// Table receives the message server registration for each client.
+	Table router.ClientTable
+
+	// Handler routes the messages received from clients.
+	Handler router.Handler
+
+	// Identify determines the connecting client.  When nil the
+	// DefaultClientIDHeader request header is trusted, which is only safe
+	// behind a proxy that authenticates clients and sets it.
+	Identify Identifier
+
+	// Origins other than the request's host allowed to connect, as host
+	// patterns such as "*.example.com".  See the Origin header.
+	OriginPatterns []string
+
+	// MaxMessageSize limits the size of messages read from clients.  When
+	// zero DefaultMaxMessageSize is used.
+	MaxMessageSize int64
+
+	// Logger receives rejected connections and messages that could not be
+	// routed.  When nil nothing is logged.
+	Logger *slog.Logger
+
+	lock     sync.Mutex
+	conns    map[*ws.Conn]struct{}
+	closed   bool
+	inFlight int
+}
+
+// A message as sent by clients.
+type message struct {
+	ID      string            `json:"id,omitempty"`
+	Service router.ServiceID  `json:"service"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body"`
+}
+
+// A reply as sent to clients.
+type reply struct {
+	ID      string           `json:"id,omitempty"`
+	Service router.ServiceID `json:"service,omitempty"`
+	Body    string           `json:"body,omitempty"`
+	Error   string           `json:"error,omitempty"`
+	Code    string           `json:"code,omitempty"`
+}
+
+func NewServer(serverID router.ServerID, table router.ClientTable, handler router.Handler) *Server {
+	server := new(Server)
+	server.ServerID = serverID
+	server.Table = table
+	server.Handler = handler
+	return server
+}
+
+// Upgrade the request, register the client and serve its connection until
+// it is closed or fails.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if s.isClosed() {
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	clientID, err := s.identify(req)
+	if err != nil {
+		s.reject(w, req, err, http.StatusUnauthorized)
+		return
+	}
+	if s.ServerID != "" {
+		if err := s.Table.SetClientMessageServer(clientID, s.ServerID); err != nil {
+			s.reject(w, req, err, router.HTTPStatus(err))
+			return
+		}
+	}
+
+	conn, err := ws.Accept(w, req, &ws.AcceptOptions{OriginPatterns: s.OriginPatterns})
+	if err != nil {
+		return
+	}
+	defer conn.CloseNow()
+
+	if !s.trackConn(conn, true) {
+		return
+	}
+	defer s.trackConn(conn, false)
+
+	conn.SetReadLimit(s.maxMessageSize())
+	s.serveConn(conn, clientID)
+}
+
+func (s *Server) reject(w http.ResponseWriter, req *http.Request, err error, status int) {
+	router.LoggerOrDiscard(s.Logger).LogAttrs(req.Context(), slog.LevelWarn, "connection rejected",
+		slog.String("remote", req.RemoteAddr),
+		slog.String(router.ErrorKey, err.Error()))
+	http.Error(w, err.Error(), status)
+}
+
+func (s *Server) serveConn(conn *ws.Conn, clientID router.ClientID) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for {
+		typ, data, err := conn.Read(ctx)
+		if err != nil {
+			return err
+		}
+
+		if err := s.serveMessage(ctx, conn, clientID, typ, data); err != nil {
+			return err
+		}
+	}
+}
+
+// Route a message and write the reply, counting it as in flight meanwhile.
+func (s *Server) serveMessage(ctx context.Context, conn *ws.Conn, clientID router.ClientID, typ ws.MessageType, data []byte) error {
+	s.lock.Lock()
+	s.inFlight++
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		s.inFlight--
+		s.lock.Unlock()
+	}()
+
+	out := s.handle(ctx, clientID, typ, data)
+	if out == nil {
+		return nil
+	}
+
+	encoded, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	return conn.Write(ctx, ws.MessageText, encoded)
+}
+
+// Route a message from the client and build the reply to send, if any.
+func (s *Server) handle(ctx context.Context, clientID router.ClientID, typ ws.MessageType, data []byte) *reply {
+	if typ != ws.MessageText {
+		return &reply{Error: "websocket: expected a text message"}
+	}
+
+	var in message
+	if err := json.Unmarshal(data, &in); err != nil {
+		return &reply{Error: "websocket: " + err.Error()}
+	}
+	if in.Service == "" {
+		return &reply{ID: in.ID, Error: "websocket: missing service"}
+	}
+
+	msg := &router.Message{ID: in.ID, ClientID: clientID, ServiceID: in.Service, Headers: in.Headers, Body: []byte(in.Body)}
+	routed, err := s.Handler.Route(ctx, msg)
+	if err != nil {
+		attrs := []slog.Attr{
+			slog.String(router.ClientKey, string(clientID)),
+			slog.String(router.ServiceKey, string(in.Service)),
+		}
+		router.LoggerOrDiscard(s.Logger).LogAttrs(ctx, slog.LevelWarn, "routing failed", append(attrs, router.ErrorAttrs(err)...)...)
+
+		out := &reply{ID: in.ID, Service: in.Service, Error: err.Error()}
+		if code, ok := router.ErrorCode(err); ok {
+			out.Code = code.String()
+		}
+		return out
+	}
+
+	if routed == nil {
+		return nil
+	}
+
+	return &reply{ID: in.ID, Service: in.Service, Body: string(routed.Body)}
+}
+
+// Stop accepting connections and close all active connections.
+func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+	for conn := range s.conns {
+		conn.CloseNow()
+	}
+	return nil
+}
+
+// Stop accepting connections, wait for messages being routed to finish,
+// then close all connections.  If ctx is done first the connections are
+// closed anyway and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	s.closed = true
+	s.lock.Unlock()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		s.lock.Lock()
+		idle := s.inFlight == 0
+		s.lock.Unlock()
+
+		if idle {
+			return s.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) identify(req *http.Request) (router.ClientID, error) {
+	if s.Identify != nil {
+		clientID, err := s.Identify(req)
+		if err == nil && clientID == "" {
+			err = errors.New("websocket: empty client ID")
+		}
+		return clientID, err
+	}
+
+	clientID := router.ClientID(req.Header.Get(DefaultClientIDHeader))
+	if clientID == "" {
+		return "", errors.New("websocket: missing " + DefaultClientIDHeader + " header")
+	}
+	return clientID, nil
+}
+
+func (s *Server) maxMessageSize() int64 {
+	if s.MaxMessageSize > 0 {
+		return s.MaxMessageSize
+	}
+	return DefaultMaxMessageSize
+}
+
+func (s *Server) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
+
+func (s *Server) trackConn(conn *ws.Conn, add bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if add {
+		if s.closed {
+			return false
+		}
+		if s.conns == nil {
+			s.conns = make(map[*ws.Conn]struct{})
+		}
+		s.conns[conn] = struct{}{}
+	} else {
+		delete(s.conns, conn)
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ws "github.com/coder/websocket"
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routingtable"
+)
+
+func dial(t *testing.T, url string, clientID string) *ws.Conn {
+	header := http.Header{}
+	if clientID != "" {
+		header.Set(DefaultClientIDHeader, clientID)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := ws.Dial(ctx, "ws"+strings.TrimPrefix(url, "http"), &ws.DialOptions{HTTPHeader: header})
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.CloseNow() })
+	return conn
+}
+
+func send(t *testing.T, conn *ws.Conn, in message) reply {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	data, _ := json.Marshal(in)
+	if err := conn.Write(ctx, ws.MessageText, data); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	_, data, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	var out reply
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatalf("bad reply %q: %v", data, err)
+	}
+	return out
+}
+
+func TestServer(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	table.SetServiceServer("service.1", "server.1")
+
+	forwarder := router.ForwarderFunc(func(ctx context.Context, serverID router.ServerID, msg *router.Message) (*router.Message, error) {
+		body := string(serverID) + ":" + string(msg.ClientID) + ":" + string(msg.Body)
+		return &router.Message{Body: []byte(body)}, nil
+	})
+	server := NewServer("ws.1", table, router.NewRouter(router.NewResolver(table, nil), forwarder))
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	conn := dial(t, httpServer.URL, "client.1")
+	if serverID, err := table.GetClientMessageServer("client.1"); serverID != "ws.1" || err != nil {
+		t.Errorf("client message server not registered: %q, %v", serverID, err)
+	}
+
+	out := send(t, conn, message{ID: "msg.1", Service: "service.1", Body: "ping"})
+	if out.ID != "msg.1" || out.Service != "service.1" || out.Body != "server.1:client.1:ping" || out.Error != "" {
+		t.Errorf("unexpected reply %+v", out)
+	}
+
+	out = send(t, conn, message{ID: "msg.2", Service: "service.2", Body: "ping"})
+	if out.ID != "msg.2" || out.Code != "UnknownService" || out.Error == "" {
+		t.Errorf("expected an UnknownService reply, got %+v", out)
+	}
+
+	// Clients must identify themselves.
+	resp, err := http.Get(httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a client ID, got %d", resp.StatusCode)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	routing := make(chan struct{})
+	release := make(chan struct{})
+	handler := router.HandlerFunc(func(ctx context.Context, msg *router.Message) (*router.Message, error) {
+		close(routing)
+		<-release
+		return &router.Message{Body: []byte("done")}, nil
+	})
+	server := NewServer("ws.1", table, handler)
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	conn := dial(t, httpServer.URL, "client.1")
+	conn.Write(context.Background(), ws.MessageText, []byte(`{"service": "service.1"}`))
+	<-routing
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(context.Background()) }()
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned before the message was routed: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if _, data, err := conn.Read(context.Background()); err != nil || !strings.Contains(string(data), `"body":"done"`) {
+		t.Errorf("expected the in-flight reply, got %s, %v", data, err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown() = %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+// Package httptransport delivers messages to servers, and asks registrars
+// for servers, over HTTP.  Server IDs are used as URLs; IDs without a scheme
+// are treated as "http://" host addresses.
+//
+// Messages are POSTed to the server with the message body as the request
+// body and the message's routing information in Mflow-* headers.  A
+// successful response body is the reply; 204 No Content means no reply.
+//
+// Servers acknowledge a message, for an ack.Tracker, by echoing its ID in
+// the Mflow-Ack response header, or later by POSTing it in the
+// Mflow-Message-Id header to the router's AckHandler.
+package httptransport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+const (
+	ClientIDHeader  = "Mflow-Client-Id"
+	ServiceIDHeader = "Mflow-Service-Id"
+	MessageIDHeader = "Mflow-Message-Id"
+	SequenceHeader  = "Mflow-Sequence"
+	AckHeader       = "Mflow-Ack"
+)
+
+// Largest reply read from a server.
+const maxReplySize = 16 << 20
+
+// Forwarder POSTs messages to servers.
+type Forwarder struct {
+	client *http.Client
+}
+
+// Create a forwarder.  When client is nil http.DefaultClient is used.
+func NewForwarder(client *http.Client) *Forwarder {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	forwarder := new(Forwarder)
+	forwarder.client = client
+	return forwarder
+}
+
+func (f *Forwarder) Forward(ctx context.Context, serverID router.ServerID, msg *router.Message) (*router.Message, error) {
+	reply, _, err := f.ForwardAck(ctx, serverID, msg)
+	return reply, err
+}
+
+// Forward, reporting whether the server acknowledged the message with the
+// AckHeader.  It implements ack.Acknowledger.
+func (f *Forwarder) ForwardAck(ctx context.Context, serverID router.ServerID, msg *router.Message) (*router.Message, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", serverURL(serverID), bytes.NewReader(msg.Body))
+	if err != nil {
+		return nil, false, err
+	}
+
+	for key, value := range msg.Headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set(ClientIDHeader, string(msg.ClientID))
+	req.Header.Set(ServiceIDHeader, string(msg.ServiceID))
+	if msg.ID != "" {
+		req.Header.Set(MessageIDHeader, msg.ID)
+	}
+	if msg.Sequence != 0 {
+		req.Header.Set(SequenceHeader, strconv.FormatUint(msg.Sequence, 10))
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, false, fmt.Errorf("httptransport: %s responded %s", serverID, resp.Status)
+	}
+	acked := msg.ID != "" && resp.Header.Get(AckHeader) == msg.ID
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, acked, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxReplySize))
+	if err != nil {
+		return nil, false, err
+	}
+
+	reply := &router.Message{ClientID: msg.ClientID, ServiceID: msg.ServiceID, Body: body}
+	return reply, acked, nil
+}
+
+// Handler for servers acknowledging messages after responding.  POST
+// requests carry the message's ID in the MessageIDHeader and are passed to
+// ack, typically an ack.Tracker's Ack; 404 Not Found means the message was
+// not pending.
+func AckHandler(ack func(id string) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id := req.Header.Get(MessageIDHeader)
+		if id == "" {
+			http.Error(w, "missing "+MessageIDHeader+" header", http.StatusBadRequest)
+			return
+		}
+		if !ack(id) {
+			http.Error(w, "message not pending", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// Registrar asks registrars where to route a client with a GET request
+// carrying "client" and "service" query parameters.  Registrars respond with
+// {"server": "..."}, or 404 Not Found to leave the choice to the service's
+// pool.
+type Registrar struct {
+	client *http.Client
+}
+
+// Create a registrar client.  When client is nil http.DefaultClient is used.
+func NewRegistrar(client *http.Client) *Registrar {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	registrar := new(Registrar)
+	registrar.client = client
+	return registrar
+}
+
+func (r *Registrar) Lookup(registrar router.ServerID, clientID router.ClientID, serviceID router.ServiceID) (router.ServerID, error) {
+	return r.LookupContext(context.Background(), registrar, clientID, serviceID)
+}
+
+// Lookup, cancelling the request when ctx is done.
+func (r *Registrar) LookupContext(ctx context.Context, registrar router.ServerID, clientID router.ClientID, serviceID router.ServiceID) (router.ServerID, error) {
+	query := url.Values{}
+	query.Set("client", string(clientID))
+	query.Set("service", string(serviceID))
+
+	target := serverURL(registrar)
+	if strings.Contains(target, "?") {
+		target += "&" + query.Encode()
+	} else {
+		target += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", router.NewRoutingTableError(router.ServerNotFoundError, "Registrar has no server for client.")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("httptransport: registrar %s responded %s", registrar, resp.Status)
+	}
+
+	var body struct {
+		Server router.ServerID `json:"server"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Server == "" {
+		return "", router.NewRoutingTableError(router.ServerNotFoundError, "Registrar has no server for client.")
+	}
+	return body.Server, nil
+}
+
+func serverURL(serverID router.ServerID) string {
+	if strings.Contains(string(serverID), "://") {
+		return string(serverID)
+	}
+	return "http://" + string(serverID)
+}
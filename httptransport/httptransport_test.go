@@ -0,0 +1,115 @@
+package httptransport
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routingtable"
+)
+
+func TestForwarder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if string(body) == "quiet" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if string(body) == "fail" {
+			http.Error(w, "failed", http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, req.Header.Get(ClientIDHeader)+"/"+req.Header.Get(ServiceIDHeader)+"/"+req.Header.Get("Trace")+":"+string(body))
+	}))
+	defer server.Close()
+
+	forwarder := NewForwarder(nil)
+	serverID := router.ServerID(server.URL)
+
+	msg := &router.Message{ClientID: "client.1", ServiceID: "service.1", Body: []byte("ping")}
+	msg.SetHeader("Trace", "abc")
+	reply, err := forwarder.Forward(context.Background(), serverID, msg)
+	if err != nil || string(reply.Body) != "client.1/service.1/abc:ping" {
+		t.Errorf("unexpected reply: %+v, %v", reply, err)
+	}
+
+	reply, err = forwarder.Forward(context.Background(), serverID, &router.Message{Body: []byte("quiet")})
+	if err != nil || reply != nil {
+		t.Errorf("expected no reply: %+v, %v", reply, err)
+	}
+
+	_, err = forwarder.Forward(context.Background(), serverID, &router.Message{Body: []byte("fail")})
+	if err == nil {
+		t.Errorf("expected error for failed response")
+	}
+}
+
+func TestRegistrar(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("client") == "client.2" {
+			http.NotFound(w, req)
+			return
+		}
+		io.WriteString(w, `{"server": "assigned.`+req.URL.Query().Get("service")+`"}`)
+	}))
+	defer server.Close()
+
+	table := routingtable.NewMemoryRoutingTable()
+	table.SetServiceRegistrar("service.1", router.ServerID(server.URL))
+	table.AddServerToServicePool("service.1", "pool.1")
+	resolver := router.NewResolver(table, NewRegistrar(nil))
+
+	if serverID, err := resolver.Resolve("client.1", "service.1"); serverID != "assigned.service.1" || err != nil {
+		t.Errorf("expected registrar's server, got %q, %v", serverID, err)
+	}
+	if serverID, err := resolver.Resolve("client.2", "service.1"); serverID != "pool.1" || err != nil {
+		t.Errorf("expected fall through to pool, got %q, %v", serverID, err)
+	}
+}
+
+func TestForwardAck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(ServiceIDHeader) == "acking" {
+			w.Header().Set(AckHeader, req.Header.Get(MessageIDHeader))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	forwarder := NewForwarder(nil)
+	serverID := router.ServerID(server.URL)
+
+	if _, acked, err := forwarder.ForwardAck(context.Background(), serverID, &router.Message{ID: "msg.1", ServiceID: "acking"}); !acked || err != nil {
+		t.Errorf("expected the reply to acknowledge, got %v, %v", acked, err)
+	}
+	if _, acked, err := forwarder.ForwardAck(context.Background(), serverID, &router.Message{ID: "msg.2", ServiceID: "quiet"}); acked || err != nil {
+		t.Errorf("expected no acknowledgement, got %v, %v", acked, err)
+	}
+}
+
+func TestAckHandler(t *testing.T) {
+	handler := AckHandler(func(id string) bool { return id == "msg.1" })
+
+	for _, test := range []struct {
+		method, id string
+		status     int
+	}{
+		{"POST", "msg.1", http.StatusNoContent},
+		{"POST", "msg.2", http.StatusNotFound},
+		{"POST", "", http.StatusBadRequest},
+		{"GET", "msg.1", http.StatusMethodNotAllowed},
+	} {
+		req := httptest.NewRequest(test.method, "/ack", nil)
+		if test.id != "" {
+			req.Header.Set(MessageIDHeader, test.id)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("%s %q: expected %d, got %d", test.method, test.id, test.status, w.Code)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Package logging provides log/slog handlers for message-flow's logs.
+//
+// The resolver logs every routing decision, so with debug output enabled a
+// busy router logs once per message.  A SamplingHandler keeps such logs to a
+// readable volume while passing warnings and errors through untouched:
+//
+//	handler := logging.NewSamplingHandler(slog.NewTextHandler(os.Stderr, nil), nil)
+//	resolver.SetLogger(slog.New(handler))
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Options for a SamplingHandler.  Zero fields take their defaults.
+type SamplingOptions struct {
+	// Length of a sampling period.  Defaults to one second.
+	Tick time.Duration
+
+	// Records with the same level and message logged in full each period
+	// before sampling starts.  Defaults to 10.
+	First int
+
+	// After the first records, only every Thereafter-th record is logged.
+	// Defaults to 100.
+	Thereafter int
+
+	// Records at or above this level are never dropped.  Defaults to
+	// slog.LevelWarn.
+	Level slog.Leveler
+}
+
+// A SamplingHandler passes the first records with each level and message in
+// a period to the next handler, then only one in every Thereafter.  Handlers
+// derived with WithAttrs or WithGroup share their parent's counts.
+type SamplingHandler struct {
+	next    slog.Handler
+	sampler *sampler
+}
+
+type sampleKey struct {
+	level slog.Level
+	msg   string
+}
+
+type sampler struct {
+	options SamplingOptions
+
+	lock   sync.Mutex
+	start  time.Time
+	counts map[sampleKey]int
+}
+
+// Create a handler sampling the records passed to next.  opts may be nil to
+// use the defaults.
+func NewSamplingHandler(next slog.Handler, opts *SamplingOptions) *SamplingHandler {
+	s := new(sampler)
+	if opts != nil {
+		s.options = *opts
+	}
+	if s.options.Tick <= 0 {
+		s.options.Tick = time.Second
+	}
+	if s.options.First <= 0 {
+		s.options.First = 10
+	}
+	if s.options.Thereafter <= 0 {
+		s.options.Thereafter = 100
+	}
+	if s.options.Level == nil {
+		s.options.Level = slog.LevelWarn
+	}
+	s.counts = make(map[sampleKey]int)
+
+	handler := new(SamplingHandler)
+	handler.next = next
+	handler.sampler = s
+	return handler
+}
+
+func (h *SamplingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *SamplingHandler) Handle(ctx context.Context, record slog.Record) error {
+	if !h.sampler.allow(record) {
+		return nil
+	}
+	return h.next.Handle(ctx, record)
+}
+
+func (h *SamplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &SamplingHandler{next: h.next.WithAttrs(attrs), sampler: h.sampler}
+}
+
+func (h *SamplingHandler) WithGroup(name string) slog.Handler {
+	return &SamplingHandler{next: h.next.WithGroup(name), sampler: h.sampler}
+}
+
+// Report whether record should be logged, counting it.
+func (s *sampler) allow(record slog.Record) bool {
+	if record.Level >= s.options.Level.Level() {
+		return true
+	}
+
+	now := record.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if now.Sub(s.start) >= s.options.Tick || now.Before(s.start) {
+		s.start = now
+		clear(s.counts)
+	}
+
+	key := sampleKey{record.Level, record.Message}
+	n := s.counts[key] + 1
+	s.counts[key] = n
+
+	if n <= s.options.First {
+		return true
+	}
+	return (n-s.options.First)%s.options.Thereafter == 0
+}
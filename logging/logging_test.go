@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	records *[]slog.Record
+}
+
+func (r recorder) Enabled(context.Context, slog.Level) bool { return true }
+
+func (r recorder) Handle(_ context.Context, record slog.Record) error {
+	*r.records = append(*r.records, record)
+	return nil
+}
+
+func (r recorder) WithAttrs([]slog.Attr) slog.Handler { return r }
+func (r recorder) WithGroup(string) slog.Handler      { return r }
+
+func TestSamplingHandler(t *testing.T) {
+	var records []slog.Record
+	handler := NewSamplingHandler(recorder{&records}, &SamplingOptions{Tick: time.Hour, First: 2, Thereafter: 3})
+	logger := slog.New(handler)
+	derived := logger.With("client", "client.1")
+
+	for i := 0; i < 4; i++ {
+		logger.Debug("resolved")
+		derived.Debug("resolved")
+	}
+	for i := 0; i < 4; i++ {
+		logger.Debug("other")
+	}
+	for i := 0; i < 3; i++ {
+		logger.Warn("resolve failed")
+	}
+
+	count := make(map[string]int)
+	for _, record := range records {
+		count[record.Message]++
+	}
+
+	// Of 8 records, the first 2 and then every 3rd.
+	if count["resolved"] != 4 {
+		t.Errorf("logged %d resolved records, expected 4", count["resolved"])
+	}
+	if count["other"] != 2 {
+		t.Errorf("logged %d other records, expected 2", count["other"])
+	}
+	if count["resolve failed"] != 3 {
+		t.Errorf("logged %d warnings, expected all 3", count["resolve failed"])
+	}
+}
+
+func TestSamplingHandlerTick(t *testing.T) {
+	var records []slog.Record
+	handler := NewSamplingHandler(recorder{&records}, &SamplingOptions{Tick: time.Minute, First: 1, Thereafter: 100})
+
+	start := time.Now()
+	for _, offset := range []time.Duration{0, time.Second, 2 * time.Minute, 2*time.Minute + time.Second} {
+		handler.Handle(context.Background(), slog.NewRecord(start.Add(offset), slog.LevelDebug, "resolved", 0))
+	}
+
+	if len(records) != 2 {
+		t.Errorf("logged %d records, expected one per tick", len(records))
+	}
+}
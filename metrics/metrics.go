@@ -0,0 +1,146 @@
+// Package metrics records Prometheus metrics for routing tables and routing
+// decisions.
+//
+// Metrics holds the collectors and is registered like any other collector:
+//
+//	m := metrics.New()
+//	registry := prometheus.NewRegistry()
+//	registry.MustRegister(m, metrics.NewSizeCollector(table))
+//
+//	resolver := router.NewResolver(metrics.NewTable(table, m), registrar)
+//	resolver.SetObserver(m.ObserveDecision)
+//
+//	http.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+//
+// The metrics are:
+//
+//	mflow_table_call_duration_seconds{method}       histogram of table calls
+//	mflow_table_call_errors_total{method,code}      failed table calls
+//	mflow_resolver_decisions_total{source,result}   Resolve calls by lookup step
+//	mflow_service_pool_size{service}                servers in each pool
+//	mflow_table_clients, mflow_table_services       records in the table
+//
+// Error codes are RoutingTableErrorCode names, or "other" for errors that are
+// not routing table errors.  A decision's result is "ok" or the code of the
+// error it failed with.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robertkluin/message-flow/router"
+)
+
+const namespace = "mflow"
+
+// Metrics holds the table and resolver collectors.  It implements
+// prometheus.Collector.
+type Metrics struct {
+	calls     *prometheus.HistogramVec
+	errors    *prometheus.CounterVec
+	decisions *prometheus.CounterVec
+}
+
+func New() *Metrics {
+	m := new(Metrics)
+	m.calls = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "table",
+		Name:      "call_duration_seconds",
+		Help:      "Time taken by routing table calls.",
+		Buckets:   []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+	}, []string{"method"})
+	m.errors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "table",
+		Name:      "call_errors_total",
+		Help:      "Routing table calls that failed, by error code.",
+	}, []string{"method", "code"})
+	m.decisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "resolver",
+		Name:      "decisions_total",
+		Help:      "Resolve calls, by the lookup step that decided them and their result.",
+	}, []string{"source", "result"})
+	return m
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.calls.Describe(ch)
+	m.errors.Describe(ch)
+	m.decisions.Describe(ch)
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.calls.Collect(ch)
+	m.errors.Collect(ch)
+	m.decisions.Collect(ch)
+}
+
+// Count a resolver decision.  Pass to router.Resolver.SetObserver.
+func (m *Metrics) ObserveDecision(decision router.Decision) {
+	m.decisions.WithLabelValues(decision.Source.String(), errorCode(decision.Err, "ok")).Inc()
+}
+
+// The label for err: its routing table code, other for any other error, or
+// none when err is nil.
+func errorCode(err error, none string) string {
+	if err == nil {
+		return none
+	}
+	if code, ok := router.ErrorCode(err); ok {
+		return code.String()
+	}
+	return "other"
+}
+
+// A SizeCollector reports the size of each service's pool and the number of
+// clients and services in a table each time metrics are gathered.  Tables
+// that do not implement router.Scanner report nothing.
+type SizeCollector struct {
+	table router.RoutingTable
+
+	pools    *prometheus.Desc
+	clients  *prometheus.Desc
+	services *prometheus.Desc
+}
+
+func NewSizeCollector(table router.RoutingTable) *SizeCollector {
+	collector := new(SizeCollector)
+	collector.table = table
+	collector.pools = prometheus.NewDesc(namespace+"_service_pool_size", "Servers in the service's pool.", []string{"service"}, nil)
+	collector.clients = prometheus.NewDesc(namespace+"_table_clients", "Clients with routing information.", nil, nil)
+	collector.services = prometheus.NewDesc(namespace+"_table_services", "Services with routing information.", nil, nil)
+	return collector
+}
+
+func (c *SizeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.pools
+	ch <- c.clients
+	ch <- c.services
+}
+
+func (c *SizeCollector) Collect(ch chan<- prometheus.Metric) {
+	scanner, ok := c.table.(router.Scanner)
+	if !ok {
+		return
+	}
+
+	clients, err := scanner.Clients()
+	if err == nil {
+		ch <- prometheus.MustNewConstMetric(c.clients, prometheus.GaugeValue, float64(len(clients)))
+	}
+
+	services, err := scanner.Services()
+	if err != nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.services, prometheus.GaugeValue, float64(len(services)))
+
+	for _, serviceID := range services {
+		pool, err := c.table.GetServicePool(serviceID)
+		if err != nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.pools, prometheus.GaugeValue, float64(len(pool)), string(serviceID))
+	}
+}
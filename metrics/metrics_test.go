@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routingtable"
+)
+
+func TestTableGetServiceRandomServer(t *testing.T) {
+	router.TestGetServiceRandomServer(t, NewTable(routingtable.NewMemoryRoutingTable(), New()))
+}
+
+func TestTableGetServicePool(t *testing.T) {
+	router.TestGetServicePool(t, NewTable(routingtable.NewMemoryRoutingTable(), New()))
+}
+
+func TestMetrics(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	table.SetServiceServer("service.1", "server.1")
+	table.AddServerToServicePool("service.2", "pool.1")
+	table.AddServerToServicePool("service.2", "pool.2")
+
+	m := New()
+	resolver := router.NewResolver(NewTable(table, m), nil)
+	resolver.SetObserver(m.ObserveDecision)
+
+	resolver.Resolve("client.1", "service.1")
+	resolver.Resolve("client.1", "service.2")
+	resolver.Resolve("client.1", "service.2")
+	resolver.Resolve("client.1", "service.3")
+
+	decisions := []struct {
+		source, result string
+		count          float64
+	}{
+		{"catch-all", "ok", 1},
+		{"pool", "ok", 1},
+		{"mapping", "ok", 1},
+		{"catch-all", "UnknownService", 1},
+	}
+	for _, test := range decisions {
+		if count := testutil.ToFloat64(m.decisions.WithLabelValues(test.source, test.result)); count != test.count {
+			t.Errorf("decisions{%s, %s} = %v, want %v", test.source, test.result, count, test.count)
+		}
+	}
+
+	// The client had no mappings for its first two lookups.
+	if count := testutil.ToFloat64(m.errors.WithLabelValues("GetClientServiceServer", "UnknownClient")); count != 2 {
+		t.Errorf("GetClientServiceServer UnknownClient errors = %v, want 2", count)
+	}
+	if count := testutil.CollectAndCount(m.calls); count != 4 {
+		t.Errorf("expected latency for 4 methods, got %d", count)
+	}
+
+	expected := `
+# HELP mflow_service_pool_size Servers in the service's pool.
+# TYPE mflow_service_pool_size gauge
+mflow_service_pool_size{service="service.1"} 0
+mflow_service_pool_size{service="service.2"} 2
+# HELP mflow_table_clients Clients with routing information.
+# TYPE mflow_table_clients gauge
+mflow_table_clients 1
+# HELP mflow_table_services Services with routing information.
+# TYPE mflow_table_services gauge
+mflow_table_services 2
+`
+	if err := testutil.CollectAndCompare(NewSizeCollector(table), strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+// Table wraps a routing table, recording the latency and errors of each
+// call.  Only the router.RoutingTable methods are wrapped; use the wrapped
+// table directly for Scanner, Updater or Watcher.
+type Table struct {
+	*router.InterceptedTable
+}
+
+func NewTable(table router.RoutingTable, metrics *Metrics) *Table {
+	return &Table{router.Intercept(table, metrics.Interceptor())}
+}
+
+// An interceptor recording the latency and errors of each call, for tables
+// composed with router.Intercept.
+func (m *Metrics) Interceptor() router.Interceptor {
+	return func(ctx context.Context, call *router.Call, next router.Invoker) (interface{}, error) {
+		start := time.Now()
+		result, err := next(ctx, call)
+		m.calls.WithLabelValues(call.Op).Observe(time.Since(start).Seconds())
+		if err != nil {
+			m.errors.WithLabelValues(call.Op, errorCode(err, "")).Inc()
+		}
+		return result, err
+	}
+}
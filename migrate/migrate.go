@@ -0,0 +1,295 @@
+// Package migrate copies routing data from one routing table to another, for
+// example from a router's in-memory table to a bolt database.
+//
+// Copy walks every service and then every client of the source, which must
+// implement router.Scanner, one record at a time.  Each record is planned
+// and applied with the routes package, so copying is idempotent: a record
+// already in the destination makes no calls, and a copy can be rerun or
+// resumed from a checkpoint after being interrupted.  Copied services are
+// made to match the source exactly, including removing pool members the
+// source does not have, while clients only gain the values the source sets.
+// Anything only in the destination is left alone.
+package migrate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routes"
+)
+
+// ErrMismatch is returned by Copy when verification finds the destination
+// still differs from the source.
+var ErrMismatch = errors.New("migrate: destination does not match source")
+
+// Options for Copy.
+type Options struct {
+	// Report the calls a copy would make without making them.
+	DryRun bool
+
+	// Compare the tables after copying, failing with ErrMismatch if they
+	// differ.
+	Verify bool
+
+	// File recording the last record copied.  When set, a copy that is
+	// interrupted resumes after that record, and the file is removed once
+	// the copy finishes.
+	Checkpoint string
+
+	// Called with each call made, or that would be made in a dry run.
+	OnOp func(routes.Op)
+}
+
+// Result summarises a copy.
+type Result struct {
+	// Records read from the source, not counting those skipped on resume.
+	Services int
+	Clients  int
+
+	// Calls made, or that would be made in a dry run.
+	Calls int
+
+	// With Verify, the calls still needed for the destination to match the
+	// source.  Empty when the copy is complete.
+	Diff routes.Plan
+}
+
+// A checkpoint records the last service and client copied.
+type checkpoint struct {
+	Service router.ServiceID `json:"service,omitempty"`
+	Client  router.ClientID  `json:"client,omitempty"`
+}
+
+// Copy every service and client in src to dst.
+func Copy(src, dst router.RoutingTable, options *Options) (*Result, error) {
+	if options == nil {
+		options = new(Options)
+	}
+
+	scanner, ok := src.(router.Scanner)
+	if !ok {
+		return nil, fmt.Errorf("migrate: source %T cannot list its contents", src)
+	}
+
+	resume, err := readCheckpoint(options.Checkpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(Result)
+	save := func() error {
+		if options.DryRun {
+			return nil
+		}
+		return writeCheckpoint(options.Checkpoint, resume)
+	}
+
+	err = walk(scanner, src, resume, func(config *routes.Config) error {
+		var plan routes.Plan
+		var err error
+		if options.DryRun {
+			plan, err = routes.MakePlan(dst, config)
+		} else {
+			plan, err = routes.Apply(dst, config)
+		}
+		if err != nil {
+			return err
+		}
+
+		result.Calls += len(plan)
+		if options.OnOp != nil {
+			for _, op := range plan {
+				options.OnOp(op)
+			}
+		}
+
+		for serviceID := range config.Services {
+			result.Services++
+			resume.Service = serviceID
+		}
+		for clientID := range config.Clients {
+			result.Clients++
+			resume.Client = clientID
+		}
+		return save()
+	})
+	if err != nil {
+		return result, err
+	}
+
+	if !options.DryRun && options.Checkpoint != "" {
+		if err := os.Remove(options.Checkpoint); err != nil && !os.IsNotExist(err) {
+			return result, err
+		}
+	}
+
+	if options.Verify {
+		result.Diff, err = Diff(src, dst)
+		if err != nil {
+			return result, err
+		}
+		if len(result.Diff) > 0 {
+			return result, ErrMismatch
+		}
+	}
+
+	return result, nil
+}
+
+// The calls needed for dst to match src, which must implement
+// router.Scanner.  An empty plan means every record in src is in dst.
+func Diff(src, dst router.RoutingTable) (routes.Plan, error) {
+	scanner, ok := src.(router.Scanner)
+	if !ok {
+		return nil, fmt.Errorf("migrate: source %T cannot list its contents", src)
+	}
+
+	var diff routes.Plan
+	err := walk(scanner, src, new(checkpoint), func(config *routes.Config) error {
+		plan, err := routes.MakePlan(dst, config)
+		diff = append(diff, plan...)
+		return err
+	})
+	return diff, err
+}
+
+// Call fn with a config holding each service and then each client in table,
+// in ID order, skipping those up to and including resume.
+func walk(scanner router.Scanner, table router.RoutingTable, resume *checkpoint, fn func(*routes.Config) error) error {
+	services, err := scanner.Services()
+	if err != nil {
+		return err
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i] < services[j] })
+
+	for _, serviceID := range services {
+		if resume.Client != "" || (resume.Service != "" && serviceID <= resume.Service) {
+			continue
+		}
+
+		service, err := readService(table, serviceID)
+		if err != nil {
+			return fmt.Errorf("service %s: %v", serviceID, err)
+		}
+		config := &routes.Config{Services: map[router.ServiceID]routes.Service{serviceID: service}}
+		if err := fn(config); err != nil {
+			return fmt.Errorf("service %s: %v", serviceID, err)
+		}
+	}
+
+	clients, err := scanner.Clients()
+	if err != nil {
+		return err
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i] < clients[j] })
+
+	for _, clientID := range clients {
+		if resume.Client != "" && clientID <= resume.Client {
+			continue
+		}
+
+		client, err := readClient(table, scanner, clientID)
+		if err != nil {
+			return fmt.Errorf("client %s: %v", clientID, err)
+		}
+		config := &routes.Config{Clients: map[router.ClientID]routes.Client{clientID: client}}
+		if err := fn(config); err != nil {
+			return fmt.Errorf("client %s: %v", clientID, err)
+		}
+	}
+
+	return nil
+}
+
+func readService(table router.RoutingTable, serviceID router.ServiceID) (routes.Service, error) {
+	var service routes.Service
+	var err error
+
+	if service.Server, err = value(table.GetServiceServer(serviceID)); err != nil {
+		return service, err
+	}
+	if service.Registrar, err = value(table.GetServiceRegistrar(serviceID)); err != nil {
+		return service, err
+	}
+
+	service.Pool, err = table.GetServicePool(serviceID)
+	if err != nil && !notFound(err) {
+		return service, err
+	}
+	return service, nil
+}
+
+func readClient(table router.RoutingTable, scanner router.Scanner, clientID router.ClientID) (routes.Client, error) {
+	var client routes.Client
+	var err error
+
+	if client.MessageServer, err = value(table.GetClientMessageServer(clientID)); err != nil {
+		return client, err
+	}
+
+	client.Services, err = scanner.GetClientServices(clientID)
+	if err != nil && !notFound(err) {
+		return client, err
+	}
+	return client, nil
+}
+
+// Treat "not found" lookups as an empty value.
+func value(serverID router.ServerID, err error) (router.ServerID, error) {
+	if err != nil && notFound(err) {
+		return "", nil
+	}
+	return serverID, err
+}
+
+func notFound(err error) bool {
+	code, _ := router.ErrorCode(err)
+	switch code {
+	case router.UnknownClient, router.UnknownService, router.MappingNotFoundError, router.ServerNotFoundError:
+		return true
+	}
+	return false
+}
+
+// Read the checkpoint at path, if there is one.
+func readCheckpoint(path string) (*checkpoint, error) {
+	resume := new(checkpoint)
+	if path == "" {
+		return resume, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return resume, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, resume); err != nil {
+		return nil, fmt.Errorf("migrate: checkpoint %s: %v", path, err)
+	}
+	return resume, nil
+}
+
+// Replace the checkpoint at path, if set.
+func writeCheckpoint(path string, resume *checkpoint) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(resume)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,119 @@
+package migrate
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routes"
+	"github.com/robertkluin/message-flow/routingtable"
+)
+
+// A table that fails to set client.2's message server.
+type failingTable struct {
+	router.RoutingTable
+}
+
+func (t failingTable) SetClientMessageServer(clientID router.ClientID, serverID router.ServerID) error {
+	if clientID == "client.2" {
+		return errors.New("unavailable")
+	}
+	return t.RoutingTable.SetClientMessageServer(clientID, serverID)
+}
+
+func newSource() *routingtable.MemoryRoutingTable {
+	src := routingtable.NewMemoryRoutingTable()
+	src.SetServiceServer("service.1", "server.1")
+	src.SetServiceRegistrar("service.2", "registrar.1")
+	src.AddServerToServicePool("service.2", "pool.1")
+	src.AddServerToServicePool("service.2", "pool.2")
+	src.SetClientMessageServer("client.1", "tcp.1")
+	src.SetClientMessageServer("client.2", "tcp.1")
+	src.SetClientServiceServer("client.2", "service.2", "pool.2")
+	return src
+}
+
+func TestCopy(t *testing.T) {
+	src := newSource()
+	dst := routingtable.NewMemoryRoutingTable()
+
+	// A dry run reports the calls without making them.
+	var ops []routes.Op
+	result, err := Copy(src, dst, &Options{DryRun: true, OnOp: func(op routes.Op) { ops = append(ops, op) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Services != 2 || result.Clients != 2 || result.Calls != 7 || len(ops) != 7 {
+		t.Errorf("unexpected dry run result %+v, %v", result, ops)
+	}
+	if services, _ := dst.Services(); len(services) != 0 {
+		t.Errorf("dry run changed the destination: %v", services)
+	}
+
+	result, err = Copy(src, dst, &Options{Verify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Calls != 7 || len(result.Diff) != 0 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if server, _ := dst.GetClientServiceServer("client.2", "service.2"); server != "pool.2" {
+		t.Errorf("mapping not copied: %q", server)
+	}
+
+	// Copying again makes no calls.
+	result, err = Copy(src, dst, nil)
+	if err != nil || result.Calls != 0 {
+		t.Errorf("expected no calls copying again, got %+v, %v", result, err)
+	}
+}
+
+func TestCopyResume(t *testing.T) {
+	src := newSource()
+	dst := routingtable.NewMemoryRoutingTable()
+	path := filepath.Join(t.TempDir(), "checkpoint")
+
+	// The copy stops at client.2, leaving a checkpoint after client.1.
+	_, err := Copy(src, failingTable{dst}, &Options{Checkpoint: path})
+	if err == nil {
+		t.Fatal("expected the copy to fail")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("no checkpoint left behind: %v", err)
+	}
+
+	// Resuming only copies what is left.
+	result, err := Copy(src, dst, &Options{Checkpoint: path, Verify: true})
+	if err != nil {
+		t.Fatalf("resumed copy failed: %v, diff %v", err, result.Diff)
+	}
+	if result.Services != 0 || result.Clients != 1 {
+		t.Errorf("resume did not skip copied records: %+v", result)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("checkpoint not removed: %v", err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	src := newSource()
+	dst := routingtable.NewMemoryRoutingTable()
+	Copy(src, dst, nil)
+
+	dst.RemoveServerFromServicePool("service.2", "pool.1")
+	dst.AddServerToServicePool("service.2", "pool.3")
+
+	diff, err := Diff(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `AddServerToServicePool("service.2", "pool.1")
+RemoveServerFromServicePool("service.2", "pool.3")
+`
+	if diff.String() != expected {
+		t.Errorf("unexpected diff:\n%s\nwant:\n%s", diff, expected)
+	}
+}
@@ -0,0 +1,109 @@
+package ordering
+
+import (
+	"sync"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+// A Gap is a range of sequence numbers, inclusive, a server never received.
+type Gap struct {
+	ClientID  router.ClientID
+	ServiceID router.ServiceID
+	From      uint64
+	To        uint64
+}
+
+// GapDetector is used by servers to check the sequence numbers of the
+// messages they receive.
+type GapDetector struct {
+	// How long a stream is remembered after its last message.  When zero
+	// DefaultIdleTimeout is used.  It must not be longer than the
+	// Sequencer's.
+	IdleTimeout time.Duration
+
+	lock     sync.Mutex
+	expected map[streamKey]*expectation
+	swept    time.Time
+}
+
+// The next sequence number expected on a stream, and when the stream was
+// last seen.
+type expectation struct {
+	sequence uint64
+	seen     time.Time
+}
+
+func NewGapDetector() *GapDetector {
+	detector := new(GapDetector)
+	detector.expected = make(map[streamKey]*expectation)
+	return detector
+}
+
+// Check a received message.  It returns the gap preceding the message, if
+// any, and whether the message is a duplicate of, or older than, one already
+// seen.  Messages without a sequence number are never gaps or duplicates.
+//
+// The first message seen from a client to a service sets the baseline, so a
+// server taking over a client from another server does not report the
+// messages the previous server handled as missing.  Streams idle for the
+// idle timeout are forgotten, as the Sequencer numbers them afresh.
+func (d *GapDetector) Check(msg *router.Message) (*Gap, bool) {
+	if msg.Sequence == 0 {
+		return nil, false
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(d.swept) >= d.idleTimeout() {
+		d.sweep(now)
+	}
+
+	key := streamKey{msg.ClientID, msg.ServiceID}
+	expected := msg.Sequence
+	if last, ok := d.expected[key]; ok && now.Sub(last.seen) < d.idleTimeout() {
+		expected = last.sequence
+	}
+
+	if msg.Sequence < expected {
+		return nil, true
+	}
+
+	d.expected[key] = &expectation{sequence: msg.Sequence + 1, seen: now}
+
+	if msg.Sequence == expected {
+		return nil, false
+	}
+
+	gap := &Gap{ClientID: msg.ClientID, ServiceID: msg.ServiceID, From: expected, To: msg.Sequence - 1}
+	return gap, false
+}
+
+// Forget the sequence of a client's messages to a service.
+func (d *GapDetector) Reset(clientID router.ClientID, serviceID router.ServiceID) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	delete(d.expected, streamKey{clientID, serviceID})
+}
+
+// Forget streams idle for the idle timeout.  Must be called with the lock
+// held.
+func (d *GapDetector) sweep(now time.Time) {
+	d.swept = now
+	for key, last := range d.expected {
+		if now.Sub(last.seen) >= d.idleTimeout() {
+			delete(d.expected, key)
+		}
+	}
+}
+
+func (d *GapDetector) idleTimeout() time.Duration {
+	if d.IdleTimeout > 0 {
+		return d.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
@@ -0,0 +1,252 @@
+// Package ordering preserves the order of messages from a client to a
+// service.
+//
+// A Sequencer wraps a router.Handler.  For services with ordering enabled,
+// messages from each client are numbered and delivered one at a time in the
+// order they arrived, including while failed messages are retried and after
+// the client's mapping moves to a new server.  A message is only released to
+// the next handler once every earlier message has been delivered or has
+// exhausted its retries.
+//
+// Servers use a GapDetector to notice messages that were given up on and to
+// discard duplicates.  Streams are forgotten once idle for the idle timeout,
+// after which numbering starts over; GapDetectors forget streams after the
+// same time so they take the new numbers as a fresh start.
+package ordering
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+const (
+	DefaultRetries     = 3
+	DefaultRetryDelay  = 100 * time.Millisecond
+	DefaultIdleTimeout = 10 * time.Minute
+)
+
+type streamKey struct {
+	clientID  router.ClientID
+	serviceID router.ServiceID
+}
+
+// A stream tracks the messages of one client to one service.
+type stream struct {
+	lock      sync.Mutex
+	turn      chan struct{} // closed when completed changes
+	issued    uint64
+	completed uint64
+	abandoned map[uint64]bool
+	idle      time.Time
+}
+
+// Sequencer delivers messages in order per client and service.
+type Sequencer struct {
+	// Times a failed message is retried before it is given up on.  When
+	// zero DefaultRetries is used; use a negative value to disable retries.
+	Retries int
+
+	// Pause between retries.  When zero DefaultRetryDelay is used.
+	RetryDelay time.Duration
+
+	// Retry reports whether a failure should be retried.  When nil every
+	// failure is retried.
+	Retry func(err error) bool
+
+	// How long a stream is kept once its messages are done.  When zero
+	// DefaultIdleTimeout is used.  GapDetectors must not use a longer
+	// timeout.
+	IdleTimeout time.Duration
+
+	next router.Handler
+
+	lock     sync.Mutex
+	services map[router.ServiceID]bool
+	streams  map[streamKey]*stream
+	swept    time.Time
+}
+
+func New(next router.Handler) *Sequencer {
+	sequencer := new(Sequencer)
+	sequencer.next = next
+	sequencer.services = make(map[router.ServiceID]bool)
+	sequencer.streams = make(map[streamKey]*stream)
+	return sequencer
+}
+
+// Enable or disable ordered delivery for a service.
+func (s *Sequencer) SetOrdered(serviceID router.ServiceID, ordered bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if ordered {
+		s.services[serviceID] = true
+	} else {
+		delete(s.services, serviceID)
+	}
+}
+
+// Route msg after all earlier messages from its client to its service.
+// Messages to services without ordering pass straight through.  If ctx is
+// done while waiting for earlier messages, msg is given up on.
+func (s *Sequencer) Route(ctx context.Context, msg *router.Message) (*router.Message, error) {
+	stream, sequence := s.stream(msg.ClientID, msg.ServiceID)
+	if stream == nil {
+		return s.next.Route(ctx, msg)
+	}
+
+	// The number is set on a copy, leaving the caller's message unchanged.
+	numbered := *msg
+	numbered.Sequence = sequence
+	msg = &numbered
+	defer stream.done(sequence)
+
+	if err := stream.wait(ctx, sequence); err != nil {
+		return nil, err
+	}
+	return s.deliver(ctx, msg)
+}
+
+// Wait until every message before sequence is done, or ctx is.
+func (st *stream) wait(ctx context.Context, sequence uint64) error {
+	for {
+		st.lock.Lock()
+		turn := st.turn
+		ready := st.completed == sequence-1
+		st.lock.Unlock()
+
+		if ready {
+			return nil
+		}
+
+		select {
+		case <-turn:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Mark the message numbered sequence done.  Messages given up on before
+// their turn are skipped when it comes.
+func (st *stream) done(sequence uint64) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if st.completed != sequence-1 {
+		if st.abandoned == nil {
+			st.abandoned = make(map[uint64]bool)
+		}
+		st.abandoned[sequence] = true
+		return
+	}
+
+	st.completed = sequence
+	for st.abandoned[st.completed+1] {
+		delete(st.abandoned, st.completed+1)
+		st.completed++
+	}
+	st.idle = time.Now()
+	close(st.turn)
+	st.turn = make(chan struct{})
+}
+
+// Forget the sequence of a client's messages to a service.  Servers must
+// also reset their GapDetector, as numbering starts over.
+func (s *Sequencer) Reset(clientID router.ClientID, serviceID router.ServiceID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.streams, streamKey{clientID, serviceID})
+}
+
+// Route msg, retrying failures.
+func (s *Sequencer) deliver(ctx context.Context, msg *router.Message) (*router.Message, error) {
+	for attempt := 0; ; attempt++ {
+		reply, err := s.next.Route(ctx, msg)
+		if err == nil || attempt >= s.retries() || (s.Retry != nil && !s.Retry(err)) {
+			return reply, err
+		}
+
+		timer := time.NewTimer(s.retryDelay())
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		}
+	}
+}
+
+// Get the stream for a client and service and number the next message, or
+// nil if the service is not ordered.  The number is issued with the
+// Sequencer's lock held so the stream is not dropped as idle meanwhile.
+func (s *Sequencer) stream(clientID router.ClientID, serviceID router.ServiceID) (*stream, uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.services[serviceID] {
+		return nil, 0
+	}
+
+	now := time.Now()
+	if now.Sub(s.swept) >= s.idleTimeout() {
+		s.sweep(now)
+	}
+
+	key := streamKey{clientID, serviceID}
+	st, ok := s.streams[key]
+	if !ok {
+		st = new(stream)
+		st.turn = make(chan struct{})
+		s.streams[key] = st
+	}
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	st.issued++
+	return st, st.issued
+}
+
+// Drop streams whose messages have all been done for longer than the idle
+// timeout.  Must be called with the lock held.
+func (s *Sequencer) sweep(now time.Time) {
+	s.swept = now
+	for key, st := range s.streams {
+		st.lock.Lock()
+		idle := st.completed == st.issued && now.Sub(st.idle) >= s.idleTimeout()
+		st.lock.Unlock()
+
+		if idle {
+			delete(s.streams, key)
+		}
+	}
+}
+
+func (s *Sequencer) retries() int {
+	if s.Retries == 0 {
+		return DefaultRetries
+	}
+	if s.Retries < 0 {
+		return 0
+	}
+	return s.Retries
+}
+
+func (s *Sequencer) retryDelay() time.Duration {
+	if s.RetryDelay > 0 {
+		return s.RetryDelay
+	}
+	return DefaultRetryDelay
+}
+
+func (s *Sequencer) idleTimeout() time.Duration {
+	if s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
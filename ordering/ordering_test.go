@@ -0,0 +1,147 @@
+package ordering
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+func TestSequencerPreservesOrderThroughRetries(t *testing.T) {
+	var lock sync.Mutex
+	var delivered []uint64
+	failures := map[string]int{"one": 2}
+
+	next := router.HandlerFunc(func(ctx context.Context, msg *router.Message) (*router.Message, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if failures[string(msg.Body)] > 0 {
+			failures[string(msg.Body)]--
+			return nil, errors.New("server unavailable")
+		}
+		delivered = append(delivered, msg.Sequence)
+		return nil, nil
+	})
+
+	sequencer := New(next)
+	sequencer.RetryDelay = time.Millisecond
+	sequencer.SetOrdered("service.1", true)
+
+	// "one" fails twice before succeeding; "two" is sent while it is being
+	// retried and must wait for it.
+	done := make(chan struct{})
+	go func() {
+		sequencer.Route(context.Background(), &router.Message{ClientID: "client.1", ServiceID: "service.1", Body: []byte("one")})
+		close(done)
+	}()
+	for {
+		lock.Lock()
+		retrying := failures["one"] < 2
+		lock.Unlock()
+		if retrying {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	sequencer.Route(context.Background(), &router.Message{ClientID: "client.1", ServiceID: "service.1", Body: []byte("two")})
+	<-done
+
+	if len(delivered) != 2 || delivered[0] != 1 || delivered[1] != 2 {
+		t.Errorf("unexpected delivery order %v", delivered)
+	}
+
+	// Unordered services are not sequenced.
+	msg := &router.Message{ClientID: "client.1", ServiceID: "service.2"}
+	sequencer.Route(context.Background(), msg)
+	if msg.Sequence != 0 {
+		t.Errorf("unordered service was sequenced: %d", msg.Sequence)
+	}
+}
+
+func TestSequencerContext(t *testing.T) {
+	routing := make(chan uint64, 3)
+	release := make(chan struct{})
+	next := router.HandlerFunc(func(ctx context.Context, msg *router.Message) (*router.Message, error) {
+		routing <- msg.Sequence
+		if msg.Sequence == 1 {
+			<-release
+		}
+		return nil, nil
+	})
+
+	sequencer := New(next)
+	sequencer.IdleTimeout = time.Millisecond
+	sequencer.SetOrdered("service.1", true)
+
+	go sequencer.Route(context.Background(), &router.Message{ClientID: "client.1", ServiceID: "service.1"})
+	<-routing
+
+	// A message whose context ends while waiting is given up on.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := sequencer.Route(ctx, &router.Message{ClientID: "client.1", ServiceID: "service.1"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the wait to end with ctx, got %v", err)
+	}
+
+	// Later messages skip it.
+	done := make(chan struct{})
+	go func() {
+		sequencer.Route(context.Background(), &router.Message{ClientID: "client.1", ServiceID: "service.1"})
+		close(done)
+	}()
+	close(release)
+	<-done
+	if sequence := <-routing; sequence != 3 {
+		t.Errorf("expected message 3 after message 1, got %d", sequence)
+	}
+
+	// Idle streams are dropped and numbered afresh.
+	time.Sleep(5 * time.Millisecond)
+	msg := &router.Message{ClientID: "client.2", ServiceID: "service.1"}
+	sequencer.Route(context.Background(), msg)
+	<-routing
+	if _, ok := sequencer.streams[streamKey{"client.1", "service.1"}]; ok {
+		t.Error("expected the idle stream to be dropped")
+	}
+	msg = &router.Message{ClientID: "client.1", ServiceID: "service.1"}
+	sequencer.Route(context.Background(), msg)
+	if sequence := <-routing; sequence != 1 {
+		t.Errorf("expected a dropped stream to start over, got %d", sequence)
+	}
+	if msg.Sequence != 0 {
+		t.Errorf("the caller's message was numbered %d", msg.Sequence)
+	}
+}
+
+func TestGapDetector(t *testing.T) {
+	detector := NewGapDetector()
+
+	check := func(sequence uint64) (*Gap, bool) {
+		return detector.Check(&router.Message{ClientID: "client.1", ServiceID: "service.1", Sequence: sequence})
+	}
+
+	if gap, dup := check(5); gap != nil || dup {
+		t.Errorf("first message should set the baseline: %+v, %v", gap, dup)
+	}
+	if gap, dup := check(6); gap != nil || dup {
+		t.Errorf("next message flagged: %+v, %v", gap, dup)
+	}
+	if gap, dup := check(9); gap == nil || gap.From != 7 || gap.To != 8 || dup {
+		t.Errorf("expected gap 7-8: %+v, %v", gap, dup)
+	}
+	if gap, dup := check(6); gap != nil || !dup {
+		t.Errorf("expected old message to be a duplicate: %+v, %v", gap, dup)
+	}
+
+	// Idle streams are forgotten, so a fresh sequence is not a duplicate.
+	detector.IdleTimeout = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	if gap, dup := check(1); gap != nil || dup {
+		t.Errorf("expected an idle stream to start over: %+v, %v", gap, dup)
+	}
+}
@@ -0,0 +1,216 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+const fileSuffix = ".queue"
+
+// Line recording that the oldest entry was removed.
+const popRecord = "pop"
+
+// Number of pop records a queue file holds before it is compacted, unless
+// it holds more entries.
+const compactPops = 256
+
+// FileStore keeps queued messages in a directory so they survive restarts.
+// Each service's queue is a log of JSON encoded entries, one per line, with
+// a "pop" line appended for each entry removed.  Logs are rewritten without
+// the removed entries once their pop lines outnumber the entries left, and
+// removed when they empty.  Entries are also kept in memory, so the store is
+// meant for the bounded queues a Queue maintains.
+type FileStore struct {
+	dir    string
+	lock   sync.Mutex
+	memory *MemoryStore
+
+	// Pop records in each queue file.
+	popped map[router.ServiceID]int
+}
+
+// Open the file store in dir, creating the directory if needed and loading
+// any queues already in it.
+func OpenFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	store := new(FileStore)
+	store.dir = dir
+	store.memory = NewMemoryStore()
+	store.popped = make(map[router.ServiceID]int)
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+fileSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		name, err := url.PathUnescape(strings.TrimSuffix(filepath.Base(path), fileSuffix))
+		if err != nil {
+			continue
+		}
+		if err := store.load(router.ServiceID(name), path); err != nil {
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+func (s *FileStore) Push(serviceID router.ServiceID, entry Entry, limit int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// The file is written first so a failed write leaves both unchanged.
+	if n, _ := s.memory.Len(serviceID); n >= limit {
+		return ErrQueueFull
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := s.append(serviceID, data); err != nil {
+		return err
+	}
+	return s.memory.Push(serviceID, entry, limit)
+}
+
+func (s *FileStore) Peek(serviceID router.ServiceID) (Entry, bool, error) {
+	return s.memory.Peek(serviceID)
+}
+
+func (s *FileStore) Pop(serviceID router.ServiceID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	n, _ := s.memory.Len(serviceID)
+	switch {
+	case n == 0:
+		return nil
+	case n == 1:
+		if err := os.Remove(s.path(serviceID)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(s.popped, serviceID)
+		return s.memory.Pop(serviceID)
+	}
+
+	if err := s.append(serviceID, []byte(popRecord)); err != nil {
+		return err
+	}
+	s.memory.Pop(serviceID)
+	s.popped[serviceID]++
+
+	// The pop is already recorded, so a failed compaction is retried on the
+	// next pop rather than reported.
+	if s.popped[serviceID] >= compactPops && s.popped[serviceID] >= n-1 {
+		if s.save(serviceID) == nil {
+			delete(s.popped, serviceID)
+		}
+	}
+	return nil
+}
+
+func (s *FileStore) Len(serviceID router.ServiceID) (int, error) {
+	return s.memory.Len(serviceID)
+}
+
+func (s *FileStore) Services() ([]router.ServiceID, error) {
+	return s.memory.Services()
+}
+
+func (s *FileStore) path(serviceID router.ServiceID) string {
+	return filepath.Join(s.dir, url.PathEscape(string(serviceID))+fileSuffix)
+}
+
+func (s *FileStore) load(serviceID router.ServiceID, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		if scanner.Text() == popRecord {
+			if queue := s.memory.queues[serviceID]; len(queue) > 0 {
+				s.memory.queues[serviceID] = queue[1:]
+			}
+			s.popped[serviceID]++
+			continue
+		}
+
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return err
+		}
+		s.memory.queues[serviceID] = append(s.memory.queues[serviceID], entry)
+	}
+	if len(s.memory.queues[serviceID]) == 0 {
+		delete(s.memory.queues, serviceID)
+	}
+	return scanner.Err()
+}
+
+// Append a line to the service's queue file.  Must be called with the lock
+// held.
+func (s *FileStore) append(serviceID router.ServiceID, line []byte) error {
+	file, err := os.OpenFile(s.path(serviceID), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Write the service's queue to disk without pop records, replacing the
+// previous file atomically.  Must be called with the lock held.
+func (s *FileStore) save(serviceID router.ServiceID) error {
+	entries := s.memory.entries(serviceID)
+	path := s.path(serviceID)
+
+	if len(entries) == 0 {
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,227 @@
+// Package queue implements store-and-forward delivery for messages that
+// cannot be routed right away.
+//
+// A Queue wraps a router.Handler.  When a message to a service with a queue
+// policy fails because the service's pool is empty or the chosen server could
+// not be reached, the message is stored instead of lost.  Queued messages are
+// flushed, in order, when the routing table reports a change to the service,
+// and periodically while Run is active so recovered servers are retried.
+package queue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+// Queue length used for services whose policy does not set one.
+const DefaultMaxLen = 1000
+
+var (
+	ErrQueueFull = errors.New("queue: queue full")
+	ErrExpired   = errors.New("queue: message expired")
+)
+
+// Policy controls queueing for a service.
+type Policy struct {
+	// Maximum number of queued messages.  When zero DefaultMaxLen is used.
+	MaxLen int
+
+	// Messages queued longer than this are dropped.  When zero messages
+	// never expire.
+	MaxAge time.Duration
+}
+
+// Queue stores messages that could not be delivered and retries them later.
+type Queue struct {
+	// OnDrop, if set, is called with messages removed from the queue without
+	// being delivered: expired messages, and messages whose retry failed with
+	// an error that queueing cannot fix.
+	OnDrop func(entry Entry, reason error)
+
+	next  router.Handler
+	store Store
+
+	lock     sync.Mutex
+	policies map[router.ServiceID]Policy
+	flushing map[router.ServiceID]*sync.Mutex
+}
+
+func New(next router.Handler, store Store) *Queue {
+	queue := new(Queue)
+	queue.next = next
+	queue.store = store
+	queue.policies = make(map[router.ServiceID]Policy)
+	queue.flushing = make(map[router.ServiceID]*sync.Mutex)
+	return queue
+}
+
+// Enable queueing for a service.
+func (q *Queue) SetPolicy(serviceID router.ServiceID, policy Policy) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.policies[serviceID] = policy
+}
+
+// Route msg, queueing it if it cannot be delivered now.  Messages are also
+// queued while earlier messages for the service are waiting, to preserve
+// their order.  A queued message is reported as routed with no reply.
+func (q *Queue) Route(ctx context.Context, msg *router.Message) (*router.Message, error) {
+	policy, ok := q.policy(msg.ServiceID)
+	if !ok {
+		return q.next.Route(ctx, msg)
+	}
+
+	waiting, err := q.store.Len(msg.ServiceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if waiting == 0 {
+		reply, err := q.next.Route(ctx, msg)
+		if err == nil || !Retriable(err) {
+			return reply, err
+		}
+	}
+
+	err = q.store.Push(msg.ServiceID, Entry{Message: msg, Queued: time.Now()}, maxLen(policy))
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// Deliver the service's queued messages in order, stopping at the first
+// message that still cannot be delivered.
+func (q *Queue) Flush(ctx context.Context, serviceID router.ServiceID) error {
+	lock := q.flushLock(serviceID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	policy, _ := q.policy(serviceID)
+
+	for {
+		entry, ok, err := q.store.Peek(serviceID)
+		if err != nil || !ok {
+			return err
+		}
+
+		if policy.MaxAge > 0 && time.Since(entry.Queued) > policy.MaxAge {
+			if err := q.drop(serviceID, entry, ErrExpired); err != nil {
+				return err
+			}
+			continue
+		}
+
+		_, err = q.next.Route(ctx, entry.Message)
+		if err != nil && Retriable(err) {
+			return nil
+		}
+
+		if err != nil {
+			if err := q.drop(serviceID, entry, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := q.store.Pop(serviceID); err != nil {
+			return err
+		}
+	}
+}
+
+// Flush every service with queued messages.
+func (q *Queue) FlushAll(ctx context.Context) error {
+	services, err := q.store.Services()
+	if err != nil {
+		return err
+	}
+
+	for _, serviceID := range services {
+		if err := q.Flush(ctx, serviceID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush a service's queue whenever the routing table gives it somewhere new
+// to route messages, such as a server joining its pool.
+func (q *Queue) Watch(watcher router.Watcher) (cancel func()) {
+	return watcher.Watch(func(change router.Change) {
+		switch change.Op {
+		case "AddServerToServicePool", "SetServiceServer", "SetServiceRegistrar":
+		default:
+			return
+		}
+
+		if _, ok := q.policy(change.ServiceID); ok {
+			go q.Flush(context.Background(), change.ServiceID)
+		}
+	})
+}
+
+// Flush all queues every interval until ctx is done, so messages for servers
+// that have recovered are delivered.
+func (q *Queue) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			q.FlushAll(ctx)
+		}
+	}
+}
+
+// Report whether a routing failure may succeed later: the service's pool was
+// empty or the chosen server could not be reached.
+func Retriable(err error) bool {
+	return errors.Is(err, router.ErrServerPoolEmpty) || errors.Is(err, router.ErrService)
+}
+
+func (q *Queue) drop(serviceID router.ServiceID, entry Entry, reason error) error {
+	if err := q.store.Pop(serviceID); err != nil {
+		return err
+	}
+	if q.OnDrop != nil {
+		q.OnDrop(entry, reason)
+	}
+	return nil
+}
+
+func (q *Queue) policy(serviceID router.ServiceID) (Policy, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	policy, ok := q.policies[serviceID]
+	return policy, ok
+}
+
+func (q *Queue) flushLock(serviceID router.ServiceID) *sync.Mutex {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	lock, ok := q.flushing[serviceID]
+	if !ok {
+		lock = new(sync.Mutex)
+		q.flushing[serviceID] = lock
+	}
+	return lock
+}
+
+func maxLen(policy Policy) int {
+	if policy.MaxLen > 0 {
+		return policy.MaxLen
+	}
+	return DefaultMaxLen
+}
@@ -0,0 +1,261 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routingtable"
+)
+
+func testStore(t *testing.T, store Store) {
+	for _, body := range []string{"one", "two"} {
+		msg := &router.Message{ServiceID: "service.1", Body: []byte(body)}
+		if err := store.Push("service.1", Entry{Message: msg, Queued: time.Now()}, 2); err != nil {
+			t.Fatalf("push failed: %v", err)
+		}
+	}
+	if err := store.Push("service.1", Entry{Message: &router.Message{ServiceID: "service.1"}}, 2); err != ErrQueueFull {
+		t.Errorf("expected a push past the limit to fail with ErrQueueFull, got %v", err)
+	}
+
+	if n, _ := store.Len("service.1"); n != 2 {
+		t.Errorf("expected 2 entries, got %d", n)
+	}
+	if services, _ := store.Services(); len(services) != 1 || services[0] != "service.1" {
+		t.Errorf("unexpected services %v", services)
+	}
+
+	entry, ok, err := store.Peek("service.1")
+	if !ok || err != nil || string(entry.Message.Body) != "one" {
+		t.Errorf("unexpected peek: %+v, %v, %v", entry, ok, err)
+	}
+
+	store.Pop("service.1")
+	entry, ok, _ = store.Peek("service.1")
+	if !ok || string(entry.Message.Body) != "two" {
+		t.Errorf("unexpected peek after pop: %+v, %v", entry, ok)
+	}
+
+	if _, ok, _ := store.Peek("service.2"); ok {
+		t.Errorf("expected empty queue for unknown service")
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	testStore(t, store)
+
+	// Reopening the store restores the remaining entry.
+	store, err = OpenFileStore(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	entry, ok, _ := store.Peek("service.1")
+	if !ok || string(entry.Message.Body) != "two" {
+		t.Errorf("entry not restored: %+v, %v", entry, ok)
+	}
+
+	// Appended entries are restored too.
+	store.Push("service.1", Entry{Message: &router.Message{Body: []byte("three")}}, DefaultMaxLen)
+	store, err = OpenFileStore(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	if n, _ := store.Len("service.1"); n != 2 {
+		t.Errorf("expected 2 entries after reopening, got %d", n)
+	}
+
+	// A push that cannot be written is not queued.
+	os.Mkdir(store.path("service.2"), 0755)
+	if err := store.Push("service.2", Entry{Message: &router.Message{}}, DefaultMaxLen); err == nil {
+		t.Errorf("expected an unwritable push to fail")
+	}
+	if n, _ := store.Len("service.2"); n != 0 {
+		t.Errorf("expected the failed push not to be queued, got %d entries", n)
+	}
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+
+	for i := 0; i < 2*compactPops; i++ {
+		store.Push("service.1", Entry{Message: &router.Message{Body: []byte(strconv.Itoa(i))}}, DefaultMaxLen)
+	}
+	for i := 0; i < compactPops+10; i++ {
+		store.Pop("service.1")
+	}
+
+	// The log was rewritten once compactPops entries were removed, leaving
+	// the remaining entries and the pop records since.
+	data, _ := os.ReadFile(store.path("service.1"))
+	if lines := bytes.Count(data, []byte("\n")); lines != compactPops+10 {
+		t.Errorf("expected a compacted log of %d lines, got %d", compactPops+10, lines)
+	}
+
+	store, err = OpenFileStore(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	entry, _, _ := store.Peek("service.1")
+	if n, _ := store.Len("service.1"); n != compactPops-10 || string(entry.Message.Body) != strconv.Itoa(compactPops+10) {
+		t.Errorf("unexpected queue after reopening: %d entries starting at %+v", n, entry)
+	}
+
+	// Emptied queues leave no file.
+	for i := 0; i < compactPops-10; i++ {
+		store.Pop("service.1")
+	}
+	if _, err := os.Stat(store.path("service.1")); !os.IsNotExist(err) {
+		t.Errorf("expected the emptied queue's file to be removed, got %v", err)
+	}
+	if services, _ := store.Services(); len(services) != 0 {
+		t.Errorf("expected no queued services, got %v", services)
+	}
+}
+
+type recorder struct {
+	lock      sync.Mutex
+	delivered []string
+	arrived   chan struct{}
+}
+
+func (r *recorder) Forward(ctx context.Context, serverID router.ServerID, msg *router.Message) (*router.Message, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if serverID == "down.1" {
+		return nil, errors.New("connection refused")
+	}
+	r.delivered = append(r.delivered, string(msg.Body))
+	r.arrived <- struct{}{}
+	return nil, nil
+}
+
+func TestQueueFlushOnPoolChange(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	forwarder := &recorder{arrived: make(chan struct{}, 10)}
+	queue := New(router.NewRouter(router.NewResolver(table, nil), forwarder), NewMemoryStore())
+	queue.SetPolicy("service.1", Policy{MaxLen: 2})
+	defer queue.Watch(table)()
+
+	// Services must be known for their pool to be empty.
+	table.SetServiceServer("service.1", "")
+	table.SetServiceServer("service.2", "")
+
+	for _, body := range []string{"one", "two"} {
+		_, err := queue.Route(context.Background(), &router.Message{ClientID: "client.1", ServiceID: "service.1", Body: []byte(body)})
+		if err != nil {
+			t.Fatalf("expected message to be queued, got %v", err)
+		}
+	}
+
+	_, err := queue.Route(context.Background(), &router.Message{ClientID: "client.1", ServiceID: "service.1"})
+	if err != ErrQueueFull {
+		t.Errorf("expected full queue, got %v", err)
+	}
+
+	// Services without a policy are not queued.
+	_, err = queue.Route(context.Background(), &router.Message{ClientID: "client.1", ServiceID: "service.2"})
+	if !Retriable(err) {
+		t.Errorf("expected routing error for service without policy, got %v", err)
+	}
+
+	table.AddServerToServicePool("service.1", "server.1")
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-forwarder.arrived:
+		case <-time.After(time.Second):
+			t.Fatalf("queued messages were not flushed")
+		}
+	}
+
+	forwarder.lock.Lock()
+	defer forwarder.lock.Unlock()
+	if len(forwarder.delivered) != 2 || forwarder.delivered[0] != "one" || forwarder.delivered[1] != "two" {
+		t.Errorf("unexpected deliveries %v", forwarder.delivered)
+	}
+}
+
+func TestQueueMaxLenConcurrent(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	table.SetServiceServer("service.1", "down.1")
+
+	forwarder := &recorder{arrived: make(chan struct{}, 10)}
+	queue := New(router.NewRouter(router.NewResolver(table, nil), forwarder), NewMemoryStore())
+	queue.SetPolicy("service.1", Policy{MaxLen: 5})
+
+	var wait sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			queue.Route(context.Background(), &router.Message{ClientID: "client.1", ServiceID: "service.1"})
+		}()
+	}
+	wait.Wait()
+
+	if n, _ := queue.store.Len("service.1"); n != 5 {
+		t.Errorf("expected the queue to stop at 5 entries, got %d", n)
+	}
+}
+
+func TestQueueServerDown(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	table.SetServiceServer("service.1", "down.1")
+
+	forwarder := &recorder{arrived: make(chan struct{}, 10)}
+	queue := New(router.NewRouter(router.NewResolver(table, nil), forwarder), NewMemoryStore())
+	queue.SetPolicy("service.1", Policy{MaxAge: time.Hour})
+
+	var dropped []Entry
+	queue.OnDrop = func(entry Entry, reason error) {
+		dropped = append(dropped, entry)
+	}
+
+	queue.Route(context.Background(), &router.Message{ClientID: "client.1", ServiceID: "service.1", Body: []byte("old")})
+	queue.Route(context.Background(), &router.Message{ClientID: "client.1", ServiceID: "service.1", Body: []byte("new")})
+
+	// The server is still down, nothing is delivered.
+	queue.FlushAll(context.Background())
+	if n, _ := queue.store.Len("service.1"); n != 2 {
+		t.Errorf("expected messages to stay queued, got %d", n)
+	}
+
+	// Age the first message past the limit, then recover the server.
+	old, _, _ := queue.store.Peek("service.1")
+	queue.store.Pop("service.1")
+	recent, _, _ := queue.store.Peek("service.1")
+	queue.store.Pop("service.1")
+	old.Queued = time.Now().Add(-2 * time.Hour)
+	queue.store.Push("service.1", old, DefaultMaxLen)
+	queue.store.Push("service.1", recent, DefaultMaxLen)
+	table.SetServiceServer("service.1", "server.1")
+	queue.FlushAll(context.Background())
+
+	if len(dropped) != 1 || string(dropped[0].Message.Body) != "old" {
+		t.Errorf("expected expired message to be dropped, got %+v", dropped)
+	}
+	if len(forwarder.delivered) != 1 || forwarder.delivered[0] != "new" {
+		t.Errorf("unexpected deliveries %v", forwarder.delivered)
+	}
+}
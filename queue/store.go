@@ -0,0 +1,107 @@
+package queue
+
+import (
+	"sync"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+// An Entry is a message waiting for delivery.
+type Entry struct {
+	Message *router.Message
+	Queued  time.Time
+}
+
+// A Store holds queued messages in FIFO order per service.
+type Store interface {
+	// Append entry to the service's queue, unless it already holds limit
+	// entries, in which case ErrQueueFull is returned.  The check and the
+	// append are atomic.
+	Push(serviceID router.ServiceID, entry Entry, limit int) error
+
+	// Get the oldest entry in the service's queue without removing it.
+	Peek(serviceID router.ServiceID) (Entry, bool, error)
+
+	// Remove the oldest entry from the service's queue.
+	Pop(serviceID router.ServiceID) error
+
+	// Number of entries in the service's queue.
+	Len(serviceID router.ServiceID) (int, error)
+
+	// Services with queued entries.
+	Services() ([]router.ServiceID, error)
+}
+
+// MemoryStore keeps queued messages in memory.
+type MemoryStore struct {
+	lock   sync.Mutex
+	queues map[router.ServiceID][]Entry
+}
+
+func NewMemoryStore() *MemoryStore {
+	store := new(MemoryStore)
+	store.queues = make(map[router.ServiceID][]Entry)
+	return store
+}
+
+func (s *MemoryStore) Push(serviceID router.ServiceID, entry Entry, limit int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.queues[serviceID]) >= limit {
+		return ErrQueueFull
+	}
+	s.queues[serviceID] = append(s.queues[serviceID], entry)
+	return nil
+}
+
+func (s *MemoryStore) Peek(serviceID router.ServiceID) (Entry, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	queue := s.queues[serviceID]
+	if len(queue) == 0 {
+		return Entry{}, false, nil
+	}
+	return queue[0], true, nil
+}
+
+func (s *MemoryStore) Pop(serviceID router.ServiceID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	queue := s.queues[serviceID]
+	if len(queue) <= 1 {
+		delete(s.queues, serviceID)
+		return nil
+	}
+	s.queues[serviceID] = queue[1:]
+	return nil
+}
+
+func (s *MemoryStore) Len(serviceID router.ServiceID) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.queues[serviceID]), nil
+}
+
+func (s *MemoryStore) Services() ([]router.ServiceID, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	services := make([]router.ServiceID, 0, len(s.queues))
+	for serviceID := range s.queues {
+		services = append(services, serviceID)
+	}
+	return services, nil
+}
+
+// Get a copy of the service's queue.
+func (s *MemoryStore) entries(serviceID router.ServiceID) []Entry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]Entry(nil), s.queues[serviceID]...)
+}
@@ -0,0 +1,93 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// A Step is one step of the lookup order, as reported by Explain.
+type Step struct {
+	Source DecisionSource
+
+	// The server the step answered with, if any.
+	ServerID ServerID
+
+	// The error the step fell through on or failed with.
+	Err error
+
+	// For the mapping step, when the mapping expires.  Zero when the
+	// mapping was not stored by the resolver with a TTL.
+	Expires time.Time
+
+	// For the mapping step, set when the mapping expired and was ignored.
+	Expired bool
+
+	// For the registrar step, the service's registrar.  Empty when the
+	// resolver has no Registrar or the service has no registrar.
+	Registrar ServerID
+
+	// For the pool step, the servers in the pool and the name of the
+	// selector that picked from it.
+	Pool     []ServerID
+	Selector string
+}
+
+// An Explanation reports how Resolve would route a client's messages for a
+// service: the decision, and each step of the lookup order taken to reach
+// it, ending with the step that decided.
+type Explanation struct {
+	Decision
+
+	Steps []Step
+
+	// Whether the decision would be stored as the client's mapping, and for
+	// how long.  Zero keeps the mapping until it is changed.
+	Sticky    bool
+	StickyTTL time.Duration
+}
+
+// Report how messages from client to service would be resolved, without
+// storing the result.  The registrar and the service's selector are asked as
+// they would be by Resolve, so a round-robin selector moves on to its next
+// server.  The observer is not called.
+func (r *Resolver) Explain(clientID ClientID, serviceID ServiceID) *Explanation {
+	return r.ExplainContext(context.Background(), clientID, serviceID)
+}
+
+// Explain on behalf of a request carrying ctx.  ctx is used as it is by
+// ResolveContext.
+func (r *Resolver) ExplainContext(ctx context.Context, clientID ClientID, serviceID ServiceID) *Explanation {
+	explain := new(Explanation)
+	explain.ClientID = clientID
+	explain.ServiceID = serviceID
+	explain.ServerID, explain.Source, explain.Err = r.resolve(ctx, clientID, serviceID, explain)
+
+	if explain.Err == nil && (explain.Source == FromRegistrar || explain.Source == FromPool) {
+		policy := r.policy(serviceID)
+		explain.Sticky = !policy.NoSticky
+		explain.StickyTTL = policy.StickyTTL
+	}
+	return explain
+}
+
+func (e *Explanation) add(step Step) {
+	if e != nil {
+		e.Steps = append(e.Steps, step)
+	}
+}
+
+// The name NewSelector gives selector, or "random" when it is nil and the
+// table picks.
+func selectorName(selector Selector) string {
+	switch selector.(type) {
+	case nil, RandomSelector:
+		return "random"
+	case *RoundRobinSelector:
+		return "round-robin"
+	case HashSelector:
+		return "hash"
+	default:
+		return fmt.Sprintf("%T", selector)
+	}
+}
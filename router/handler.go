@@ -0,0 +1,64 @@
+package router
+
+import (
+	"context"
+)
+
+// A Forwarder delivers a message to a server and returns the server's reply,
+// if it sent one.
+type Forwarder interface {
+	Forward(ctx context.Context, serverID ServerID, msg *Message) (*Message, error)
+}
+
+// ForwarderFunc adapts an ordinary function to the Forwarder interface.
+type ForwarderFunc func(ctx context.Context, serverID ServerID, msg *Message) (*Message, error)
+
+func (f ForwarderFunc) Forward(ctx context.Context, serverID ServerID, msg *Message) (*Message, error) {
+	return f(ctx, serverID, msg)
+}
+
+// A Handler accepts messages received by a front-end and routes them to the
+// service they are addressed to.
+type Handler interface {
+	Route(ctx context.Context, msg *Message) (*Message, error)
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface.
+type HandlerFunc func(ctx context.Context, msg *Message) (*Message, error)
+
+func (f HandlerFunc) Route(ctx context.Context, msg *Message) (*Message, error) {
+	return f(ctx, msg)
+}
+
+// A Router resolves the server for each message and forwards the message to
+// it.
+type Router struct {
+	resolver  *Resolver
+	forwarder Forwarder
+}
+
+func NewRouter(resolver *Resolver, forwarder Forwarder) *Router {
+	router := new(Router)
+	router.resolver = resolver
+	router.forwarder = forwarder
+	return router
+}
+
+// Route msg to the server responsible for its client and service.  Failures
+// to deliver to the resolved server are reported as a ServiceError wrapping
+// the forwarder's error.
+func (r *Router) Route(ctx context.Context, msg *Message) (*Message, error) {
+	serverID, err := r.resolver.ResolveContext(ctx, msg.ClientID, msg.ServiceID)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := r.forwarder.Forward(ctx, serverID, msg)
+	if err != nil {
+		forwardErr := NewClientTableError(ServiceError, msg.ClientID, msg.ServiceID, "Forwarding to "+string(serverID)+" failed.")
+		forwardErr.Err = err
+		return nil, forwardErr
+	}
+
+	return reply, nil
+}
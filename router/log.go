@@ -0,0 +1,63 @@
+package router
+
+import (
+	"log/slog"
+)
+
+// Attribute keys for logging routing information.  Every package logging a
+// client, service, server or routing decision uses them, so logs from the
+// resolver, routing tables and front-ends can be searched the same way.
+const (
+	ClientKey  = "client"
+	ServiceKey = "service"
+	ServerKey  = "server"
+
+	// The routing table method making a change.
+	OpKey = "op"
+
+	// The DecisionSource of a routing decision.
+	SourceKey = "source"
+
+	// Set when a routing decision was made from stale data.
+	StaleKey = "stale"
+
+	// An error's message, and its RoutingTableErrorCode name when it has one.
+	ErrorKey = "error"
+	CodeKey  = "code"
+)
+
+// A logger discarding everything, used in place of a nil logger.
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// Return logger, or a logger discarding everything when it is nil.
+func LoggerOrDiscard(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return discardLogger
+	}
+	return logger
+}
+
+// Attributes describing err: its message, and its code when it is a routing
+// table error.
+func ErrorAttrs(err error) []slog.Attr {
+	attrs := []slog.Attr{slog.String(ErrorKey, err.Error())}
+	if code, ok := ErrorCode(err); ok {
+		attrs = append(attrs, slog.String(CodeKey, code.String()))
+	}
+	return attrs
+}
+
+// Attributes describing change, omitting its empty fields.
+func (change Change) LogAttrs() []slog.Attr {
+	attrs := []slog.Attr{slog.String(OpKey, change.Op)}
+	if change.ClientID != "" {
+		attrs = append(attrs, slog.String(ClientKey, string(change.ClientID)))
+	}
+	if change.ServiceID != "" {
+		attrs = append(attrs, slog.String(ServiceKey, string(change.ServiceID)))
+	}
+	if change.ServerID != "" {
+		attrs = append(attrs, slog.String(ServerKey, string(change.ServerID)))
+	}
+	return attrs
+}
@@ -0,0 +1,192 @@
+package router
+
+import (
+	"context"
+	"fmt"
+)
+
+// A Call is one call of a RoutingTable method made through an
+// InterceptedTable.  Op is the name of the method, and only the IDs it takes
+// are set; ServerID is the server being set, added or removed.
+type Call struct {
+	Op        string
+	ClientID  ClientID
+	ServiceID ServiceID
+	ServerID  ServerID
+}
+
+// Report whether the call changes the table.
+func (call *Call) Mutates() bool {
+	switch call.Op {
+	case "SetClientMessageServer", "SetClientServiceServer", "RemoveClientServiceServer",
+		"SetServiceServer", "SetServiceRegistrar", "AddServerToServicePool", "RemoveServerFromServicePool":
+		return true
+	}
+	return false
+}
+
+// An Invoker makes a call.  Its result is a ServerID for the Get methods
+// returning a server, a []ServerID for GetServicePool, and nil for the
+// methods changing the table.
+type Invoker func(ctx context.Context, call *Call) (interface{}, error)
+
+// An Interceptor is run in place of each call made through an
+// InterceptedTable.  It makes the call by invoking next, and may inspect or
+// change the call beforehand, or its result and error afterwards.  It may
+// also answer the call itself without invoking next.  ctx is the context the
+// table is bound to, see ContextTable.
+type Interceptor func(ctx context.Context, call *Call, next Invoker) (interface{}, error)
+
+// Compose interceptors into one running them in order, so the first sees
+// the call first and its result last.
+func Chain(interceptors ...Interceptor) Interceptor {
+	return func(ctx context.Context, call *Call, next Invoker) (interface{}, error) {
+		return chainInvoker(interceptors, next)(ctx, call)
+	}
+}
+
+func chainInvoker(interceptors []Interceptor, next Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, inner := interceptors[i], next
+		next = func(ctx context.Context, call *Call) (interface{}, error) {
+			return interceptor(ctx, call, inner)
+		}
+	}
+	return next
+}
+
+// InterceptedTable wraps a routing table, running its interceptors for each
+// call.  Only the RoutingTable methods are intercepted; use the wrapped table
+// directly for Scanner, Updater or Watcher.
+type InterceptedTable struct {
+	table  RoutingTable
+	invoke Invoker
+	ctx    context.Context
+}
+
+// Wrap table, running interceptors in order for each call.
+func Intercept(table RoutingTable, interceptors ...Interceptor) *InterceptedTable {
+	t := new(InterceptedTable)
+	t.table = table
+	t.invoke = chainInvoker(interceptors, t.call)
+	t.ctx = context.Background()
+	return t
+}
+
+// A copy of the table passing ctx to its interceptors and, if it implements
+// ContextTable, to the wrapped table.
+func (t *InterceptedTable) WithContext(ctx context.Context) RoutingTable {
+	bound := *t
+	bound.ctx = ctx
+	return &bound
+}
+
+func (t *InterceptedTable) GetClientMessageServer(clientID ClientID) (ServerID, error) {
+	return t.server(&Call{Op: "GetClientMessageServer", ClientID: clientID})
+}
+
+func (t *InterceptedTable) SetClientMessageServer(clientID ClientID, serverID ServerID) error {
+	return t.mutate(&Call{Op: "SetClientMessageServer", ClientID: clientID, ServerID: serverID})
+}
+
+func (t *InterceptedTable) GetClientServiceServer(clientID ClientID, serviceID ServiceID) (ServerID, error) {
+	return t.server(&Call{Op: "GetClientServiceServer", ClientID: clientID, ServiceID: serviceID})
+}
+
+func (t *InterceptedTable) SetClientServiceServer(clientID ClientID, serviceID ServiceID, serverID ServerID) error {
+	return t.mutate(&Call{Op: "SetClientServiceServer", ClientID: clientID, ServiceID: serviceID, ServerID: serverID})
+}
+
+func (t *InterceptedTable) RemoveClientServiceServer(clientID ClientID, serviceID ServiceID) error {
+	return t.mutate(&Call{Op: "RemoveClientServiceServer", ClientID: clientID, ServiceID: serviceID})
+}
+
+func (t *InterceptedTable) GetServiceServer(serviceID ServiceID) (ServerID, error) {
+	return t.server(&Call{Op: "GetServiceServer", ServiceID: serviceID})
+}
+
+func (t *InterceptedTable) SetServiceServer(serviceID ServiceID, serverID ServerID) error {
+	return t.mutate(&Call{Op: "SetServiceServer", ServiceID: serviceID, ServerID: serverID})
+}
+
+func (t *InterceptedTable) GetServiceRegistrar(serviceID ServiceID) (ServerID, error) {
+	return t.server(&Call{Op: "GetServiceRegistrar", ServiceID: serviceID})
+}
+
+func (t *InterceptedTable) SetServiceRegistrar(serviceID ServiceID, serverID ServerID) error {
+	return t.mutate(&Call{Op: "SetServiceRegistrar", ServiceID: serviceID, ServerID: serverID})
+}
+
+func (t *InterceptedTable) GetServiceRandomServer(serviceID ServiceID) (ServerID, error) {
+	return t.server(&Call{Op: "GetServiceRandomServer", ServiceID: serviceID})
+}
+
+func (t *InterceptedTable) GetServicePool(serviceID ServiceID) ([]ServerID, error) {
+	result, err := t.invoke(t.ctx, &Call{Op: "GetServicePool", ServiceID: serviceID})
+	pool, _ := result.([]ServerID)
+	return pool, err
+}
+
+func (t *InterceptedTable) AddServerToServicePool(serviceID ServiceID, serverID ServerID) error {
+	return t.mutate(&Call{Op: "AddServerToServicePool", ServiceID: serviceID, ServerID: serverID})
+}
+
+func (t *InterceptedTable) RemoveServerFromServicePool(serviceID ServiceID, serverID ServerID) error {
+	return t.mutate(&Call{Op: "RemoveServerFromServicePool", ServiceID: serviceID, ServerID: serverID})
+}
+
+// Invoke a call returning a server.
+func (t *InterceptedTable) server(call *Call) (ServerID, error) {
+	result, err := t.invoke(t.ctx, call)
+	serverID, _ := result.(ServerID)
+	return serverID, err
+}
+
+// Invoke a call changing the table.
+func (t *InterceptedTable) mutate(call *Call) error {
+	_, err := t.invoke(t.ctx, call)
+	return err
+}
+
+// Make call on the wrapped table.
+func (t *InterceptedTable) call(ctx context.Context, call *Call) (interface{}, error) {
+	return Invoke(ctx, t.table, call)
+}
+
+// Make call on table, bound to ctx if it is a ContextTable.  The result is
+// as described by Invoker.
+func Invoke(ctx context.Context, table RoutingTable, call *Call) (interface{}, error) {
+	if contextTable, ok := table.(ContextTable); ok {
+		table = contextTable.WithContext(ctx)
+	}
+
+	switch call.Op {
+	case "GetClientMessageServer":
+		return table.GetClientMessageServer(call.ClientID)
+	case "SetClientMessageServer":
+		return nil, table.SetClientMessageServer(call.ClientID, call.ServerID)
+	case "GetClientServiceServer":
+		return table.GetClientServiceServer(call.ClientID, call.ServiceID)
+	case "SetClientServiceServer":
+		return nil, table.SetClientServiceServer(call.ClientID, call.ServiceID, call.ServerID)
+	case "RemoveClientServiceServer":
+		return nil, table.RemoveClientServiceServer(call.ClientID, call.ServiceID)
+	case "GetServiceServer":
+		return table.GetServiceServer(call.ServiceID)
+	case "SetServiceServer":
+		return nil, table.SetServiceServer(call.ServiceID, call.ServerID)
+	case "GetServiceRegistrar":
+		return table.GetServiceRegistrar(call.ServiceID)
+	case "SetServiceRegistrar":
+		return nil, table.SetServiceRegistrar(call.ServiceID, call.ServerID)
+	case "GetServiceRandomServer":
+		return table.GetServiceRandomServer(call.ServiceID)
+	case "GetServicePool":
+		return table.GetServicePool(call.ServiceID)
+	case "AddServerToServicePool":
+		return nil, table.AddServerToServicePool(call.ServiceID, call.ServerID)
+	case "RemoveServerFromServicePool":
+		return nil, table.RemoveServerFromServicePool(call.ServiceID, call.ServerID)
+	}
+	return nil, fmt.Errorf("router: unknown routing table method %q", call.Op)
+}
@@ -0,0 +1,77 @@
+package router_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routingtable"
+)
+
+func TestInterceptedTable(t *testing.T) {
+	router.TestGetClientMessageServer(t, router.Intercept(routingtable.NewMemoryRoutingTable()))
+	router.TestGetClientServiceServer(t, router.Intercept(routingtable.NewMemoryRoutingTable()))
+	router.TestRemoveClientServiceServer(t, router.Intercept(routingtable.NewMemoryRoutingTable()))
+	router.TestGetServiceServer(t, router.Intercept(routingtable.NewMemoryRoutingTable()))
+	router.TestGetServiceRegistrar(t, router.Intercept(routingtable.NewMemoryRoutingTable()))
+	router.TestGetServiceRandomServer(t, router.Intercept(routingtable.NewMemoryRoutingTable()))
+	router.TestGetServicePool(t, router.Intercept(routingtable.NewMemoryRoutingTable()))
+}
+
+func TestIntercept(t *testing.T) {
+	memory := routingtable.NewMemoryRoutingTable()
+	memory.AddServerToServicePool("service.1", "pool.1")
+
+	var order []string
+	record := func(name string) router.Interceptor {
+		return func(ctx context.Context, call *router.Call, next router.Invoker) (interface{}, error) {
+			order = append(order, name+" "+call.Op)
+			result, err := next(ctx, call)
+			order = append(order, name+" done")
+			return result, err
+		}
+	}
+
+	// Answers lookups for service.2 without calling the table.
+	static := func(ctx context.Context, call *router.Call, next router.Invoker) (interface{}, error) {
+		if call.ServiceID == "service.2" && !call.Mutates() {
+			return router.ServerID("static.1"), nil
+		}
+		return next(ctx, call)
+	}
+
+	var bound context.Context
+	table := contextTable{memory, &bound}
+	intercepted := router.Intercept(table, router.Chain(record("outer"), record("inner")), static)
+
+	pool, err := intercepted.GetServicePool("service.1")
+	if err != nil || len(pool) != 1 || pool[0] != "pool.1" {
+		t.Errorf("GetServicePool() = %v, %v", pool, err)
+	}
+	expected := []string{"outer GetServicePool", "inner GetServicePool", "inner done", "outer done"}
+	if len(order) != len(expected) {
+		t.Fatalf("interceptors ran in order %v, want %v", order, expected)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Errorf("interceptors ran in order %v, want %v", order, expected)
+			break
+		}
+	}
+
+	if serverID, err := intercepted.GetServiceServer("service.2"); serverID != "static.1" || err != nil {
+		t.Errorf("GetServiceServer() = %q, %v", serverID, err)
+	}
+
+	ctx := context.WithValue(context.Background(), contextKey{}, "message")
+	err = intercepted.WithContext(ctx).SetClientServiceServer("client.1", "service.1", "pool.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bound != ctx {
+		t.Errorf("expected wrapped table to be bound to the call's context")
+	}
+	if serverID, _ := memory.GetClientServiceServer("client.1", "service.1"); serverID != "pool.1" {
+		t.Errorf("call not made on the wrapped table, got %q", serverID)
+	}
+}
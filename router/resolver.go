@@ -0,0 +1,390 @@
+package router
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// A Registrar is asked which server should handle a client's messages for a
+// service when the service defines a registrar instead of a catch-all server.
+type Registrar interface {
+	// Which server should messages from client to service be routed to.
+	Lookup(registrar ServerID, clientID ClientID, serviceID ServiceID) (ServerID, error)
+}
+
+// Registrars that use the context of the message being routed, for example
+// to trace or cancel their calls, implement ContextRegistrar.  The resolver
+// calls LookupContext instead of Lookup.
+type ContextRegistrar interface {
+	LookupContext(ctx context.Context, registrar ServerID, clientID ClientID, serviceID ServiceID) (ServerID, error)
+}
+
+// Routing tables that use the context of the message being routed implement
+// ContextTable.  The resolver calls WithContext once per message and makes
+// its lookups through the returned table.
+type ContextTable interface {
+	WithContext(ctx context.Context) RoutingTable
+}
+
+// A Resolver determines which server a client's messages for a service are
+// routed to.  The lookup order is:
+//
+//  1. the client's existing mapping for the service,
+//  2. the service's catch-all server,
+//  3. the service's registrar, and
+//  4. a random server from the service's pool.
+//
+// Servers picked by the registrar or from the pool are stored as the client's
+// mapping, so later messages from the client are routed consistently.  How
+// long picks are kept, and how servers are picked from the pool, is set per
+// service with a Policy.
+type Resolver struct {
+	table     RoutingTable
+	registrar Registrar
+
+	lock     sync.Mutex
+	policies map[ServiceID]Policy
+	expires  map[stickyKey]stickyEntry
+	stuck    int
+	observe  func(Decision)
+	logger   *slog.Logger
+}
+
+// A DecisionSource is the step of the lookup order that decided where a
+// client's messages are routed.
+type DecisionSource int
+
+const (
+	FromMapping DecisionSource = iota
+	FromCatchAll
+	FromRegistrar
+	FromPool
+)
+
+var decisionSourceNames = map[DecisionSource]string{
+	FromMapping:   "mapping",
+	FromCatchAll:  "catch-all",
+	FromRegistrar: "registrar",
+	FromPool:      "pool",
+}
+
+func (s DecisionSource) String() string {
+	return decisionSourceNames[s]
+}
+
+// A Decision describes one call to Resolve.  When Err is set, Source is the
+// step that failed.  Stale is set when the table answered from stale data,
+// see WithStaleMarker.
+type Decision struct {
+	ClientID  ClientID
+	ServiceID ServiceID
+	ServerID  ServerID
+	Source    DecisionSource
+	Err       error
+	Stale     bool
+}
+
+// A Policy controls how a service's messages are resolved.
+type Policy struct {
+	// How long a server picked by the registrar or from the pool stays
+	// mapped to the client.  Zero keeps the mapping until it is changed.
+	StickyTTL time.Duration
+
+	// When set, picks are not stored and every message is resolved again.
+	// Client mappings set by other means are still honored.
+	NoSticky bool
+
+	// Picks servers from the pool.  When nil the routing table picks one at
+	// random.
+	Selector Selector
+}
+
+type stickyKey struct {
+	clientID  ClientID
+	serviceID ServiceID
+}
+
+// A mapping the resolver stored with a TTL.
+type stickyEntry struct {
+	serverID ServerID
+	expires  time.Time
+}
+
+// Number of mappings stored between sweeps of expired ones.
+const stickySweepInterval = 1024
+
+// Create a resolver backed by table.  The registrar may be nil, in which case
+// services with only a registrar defined fall through to their pool.
+func NewResolver(table RoutingTable, registrar Registrar) *Resolver {
+	resolver := new(Resolver)
+	resolver.table = table
+	resolver.registrar = registrar
+	resolver.policies = make(map[ServiceID]Policy)
+	resolver.expires = make(map[stickyKey]stickyEntry)
+	resolver.logger = LoggerOrDiscard(nil)
+	return resolver
+}
+
+// Set the policy used to resolve a service's messages.
+func (r *Resolver) SetPolicy(serviceID ServiceID, policy Policy) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.policies[serviceID] = policy
+}
+
+// Call fn with every decision the resolver makes.  fn is called after each
+// Resolve and must not block.
+func (r *Resolver) SetObserver(fn func(Decision)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.observe = fn
+}
+
+// Log each decision to logger: failures at warning level and successes at
+// debug level.  Decisions are logged once per message, so loggers enabling
+// debug output should sample them, see the logging package.  A nil logger
+// discards them.
+func (r *Resolver) SetLogger(logger *slog.Logger) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.logger = LoggerOrDiscard(logger)
+}
+
+// Which server should messages from client to service be routed to.
+func (r *Resolver) Resolve(clientID ClientID, serviceID ServiceID) (ServerID, error) {
+	return r.ResolveContext(context.Background(), clientID, serviceID)
+}
+
+// Resolve on behalf of a message carrying ctx.  ctx is passed to tables
+// implementing ContextTable and registrars implementing ContextRegistrar.
+// Unless ctx was returned by WithStaleMarker, the tables are passed one
+// that was; callers wanting to know whether the table answered from stale
+// data pass their own.
+func (r *Resolver) ResolveContext(ctx context.Context, clientID ClientID, serviceID ServiceID) (ServerID, error) {
+	ctx = WithStaleMarker(ctx)
+	serverID, source, err := r.resolve(ctx, clientID, serviceID, nil)
+	stale := ServedStale(ctx)
+
+	r.lock.Lock()
+	observe, logger := r.observe, r.logger
+	r.lock.Unlock()
+	if observe != nil {
+		observe(Decision{ClientID: clientID, ServiceID: serviceID, ServerID: serverID, Source: source, Err: err, Stale: stale})
+	}
+
+	attrs := []slog.Attr{
+		slog.String(ClientKey, string(clientID)),
+		slog.String(ServiceKey, string(serviceID)),
+		slog.String(SourceKey, source.String()),
+	}
+	if stale {
+		attrs = append(attrs, slog.Bool(StaleKey, true))
+	}
+	if err != nil {
+		logger.LogAttrs(ctx, slog.LevelWarn, "resolve failed", append(attrs, ErrorAttrs(err)...)...)
+	} else {
+		logger.LogAttrs(ctx, slog.LevelDebug, "resolved", append(attrs, slog.String(ServerKey, string(serverID)))...)
+	}
+
+	return serverID, err
+}
+
+// Resolve, reporting each step to explain when it is not nil.  Explained
+// lookups are not stored as the client's mapping.
+func (r *Resolver) resolve(ctx context.Context, clientID ClientID, serviceID ServiceID, explain *Explanation) (ServerID, DecisionSource, error) {
+	policy := r.policy(serviceID)
+
+	table := r.table
+	if contextTable, ok := table.(ContextTable); ok {
+		table = contextTable.WithContext(ctx)
+	}
+
+	serverID, err := table.GetClientServiceServer(clientID, serviceID)
+	expires := r.expiry(clientID, serviceID)
+	expired := !expires.IsZero() && time.Now().After(expires)
+	explain.add(Step{Source: FromMapping, ServerID: serverID, Err: err, Expires: expires, Expired: err == nil && expired})
+	if err == nil && !expired {
+		return serverID, FromMapping, nil
+	}
+	if err != nil && !hasCode(err, UnknownClient, MappingNotFoundError) {
+		return "", FromMapping, err
+	}
+
+	serverID, err = table.GetServiceServer(serviceID)
+	explain.add(Step{Source: FromCatchAll, ServerID: serverID, Err: err})
+	if err == nil {
+		return serverID, FromCatchAll, nil
+	}
+	if !hasCode(err, ServerNotFoundError) {
+		return "", FromCatchAll, err
+	}
+
+	source := FromRegistrar
+	registrar, serverID, err := r.lookupRegistrar(ctx, table, clientID, serviceID)
+	explain.add(Step{Source: FromRegistrar, ServerID: serverID, Err: err, Registrar: registrar})
+	if err != nil && !hasCode(err, ServerNotFoundError) {
+		return "", source, err
+	}
+
+	if serverID == "" {
+		source = FromPool
+		serverID, err = selectFromPool(table, clientID, serviceID, policy.Selector)
+		if explain != nil {
+			pool, _ := table.GetServicePool(serviceID)
+			explain.add(Step{Source: FromPool, ServerID: serverID, Err: err, Pool: pool, Selector: selectorName(policy.Selector)})
+		}
+		if err != nil {
+			return "", source, err
+		}
+	}
+
+	// Picks made from stale data are not stored, as the table may not
+	// accept changes until its data is fresh again.
+	if policy.NoSticky || explain != nil || ServedStale(ctx) {
+		return serverID, source, nil
+	}
+
+	err = table.SetClientServiceServer(clientID, serviceID, serverID)
+	if err != nil {
+		return "", source, err
+	}
+	for key, entry := range r.stick(clientID, serviceID, serverID, policy.StickyTTL) {
+		r.unstick(table, key, entry)
+	}
+
+	return serverID, source, nil
+}
+
+// Pick a server from the service's pool.
+func selectFromPool(table RoutingTable, clientID ClientID, serviceID ServiceID, selector Selector) (ServerID, error) {
+	if selector == nil {
+		return table.GetServiceRandomServer(serviceID)
+	}
+
+	pool, err := table.GetServicePool(serviceID)
+	if err != nil {
+		return "", err
+	}
+	if len(pool) == 0 {
+		return "", NewRoutingTableError(ServerPoolEmptyError, "No servers in pool.")
+	}
+
+	return selector.Select(clientID, serviceID, pool)
+}
+
+func (r *Resolver) policy(serviceID ServiceID) Policy {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.policies[serviceID]
+}
+
+// Record when a mapping stored for the client expires.  Every
+// stickySweepInterval calls the expired mappings are forgotten and returned,
+// so they can be removed from the table.
+func (r *Resolver) stick(clientID ClientID, serviceID ServiceID, serverID ServerID, ttl time.Duration) map[stickyKey]stickyEntry {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	key := stickyKey{clientID, serviceID}
+	if ttl > 0 {
+		r.expires[key] = stickyEntry{serverID, now.Add(ttl)}
+	} else {
+		delete(r.expires, key)
+	}
+
+	r.stuck++
+	if r.stuck%stickySweepInterval != 0 {
+		return nil
+	}
+
+	var expired map[stickyKey]stickyEntry
+	for key, entry := range r.expires {
+		if now.After(entry.expires) {
+			if expired == nil {
+				expired = make(map[stickyKey]stickyEntry)
+			}
+			expired[key] = entry
+			delete(r.expires, key)
+		}
+	}
+	return expired
+}
+
+// Remove an expired mapping from the table, unless it was changed since it
+// was stored.  If the table fails the entry is kept so the mapping still
+// expires.
+func (r *Resolver) unstick(table RoutingTable, key stickyKey, entry stickyEntry) {
+	serverID, err := table.GetClientServiceServer(key.clientID, key.serviceID)
+	if err == nil && serverID == entry.serverID {
+		err = table.RemoveClientServiceServer(key.clientID, key.serviceID)
+	}
+	if err == nil || hasCode(err, UnknownClient, MappingNotFoundError) {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.expires[key]; !ok {
+		r.expires[key] = entry
+	}
+}
+
+// When the client's mapping, if it was stored by this resolver, expires.
+// Mappings stored by other means, or without a TTL, never expire and give
+// the zero time.
+func (r *Resolver) expiry(clientID ClientID, serviceID ServiceID) time.Time {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.expires[stickyKey{clientID, serviceID}].expires
+}
+
+// Ask the service's registrar, if one is defined, where to route the client.
+// The registrar asked is returned with its answer.  Registrar failures other
+// than routing table errors are returned as a LookupError wrapping them.
+func (r *Resolver) lookupRegistrar(ctx context.Context, table RoutingTable, clientID ClientID, serviceID ServiceID) (ServerID, ServerID, error) {
+	if r.registrar == nil {
+		return "", "", nil
+	}
+
+	registrar, err := table.GetServiceRegistrar(serviceID)
+	if err != nil {
+		return "", "", err
+	}
+
+	var serverID ServerID
+	if contextRegistrar, ok := r.registrar.(ContextRegistrar); ok {
+		serverID, err = contextRegistrar.LookupContext(ctx, registrar, clientID, serviceID)
+	} else {
+		serverID, err = r.registrar.Lookup(registrar, clientID, serviceID)
+	}
+	if _, ok := ErrorCode(err); err != nil && !ok {
+		lookupErr := NewClientTableError(LookupError, clientID, serviceID, "Registrar "+string(registrar)+" failed.")
+		lookupErr.Err = err
+		err = lookupErr
+	}
+	return registrar, serverID, err
+}
+
+// Report whether err is a routing table error with one of the given codes.
+func hasCode(err error, codes ...RoutingTableErrorCode) bool {
+	code, ok := ErrorCode(err)
+	if !ok {
+		return false
+	}
+
+	for _, c := range codes {
+		if code == c {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,390 @@
+package router_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routingtable"
+)
+
+type registrarFunc func(registrar router.ServerID, clientID router.ClientID, serviceID router.ServiceID) (router.ServerID, error)
+
+func (f registrarFunc) Lookup(registrar router.ServerID, clientID router.ClientID, serviceID router.ServiceID) (router.ServerID, error) {
+	return f(registrar, clientID, serviceID)
+}
+
+func TestResolve(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+
+	// Service with a catch-all server.
+	table.SetServiceServer("service.1", "server.1")
+
+	// Service with a registrar and a pool.
+	table.SetServiceRegistrar("service.2", "registrar.1")
+	table.AddServerToServicePool("service.2", "pool.1")
+
+	// Service with only a pool.
+	table.AddServerToServicePool("service.3", "pool.2")
+
+	// Service with a pool and a client pinned to another server.
+	table.AddServerToServicePool("service.4", "pool.3")
+	table.SetClientServiceServer("client.1", "service.4", "pinned.1")
+
+	// Service known, but with nothing to route to.
+	table.SetServiceServer("service.5", "")
+
+	registrar := registrarFunc(func(registrar router.ServerID, clientID router.ClientID, serviceID router.ServiceID) (router.ServerID, error) {
+		return router.ServerID(string(registrar) + "/" + string(clientID)), nil
+	})
+	resolver := router.NewResolver(table, registrar)
+
+	var decision router.Decision
+	resolver.SetObserver(func(d router.Decision) {
+		decision = d
+	})
+
+	tests := []struct {
+		clientID  router.ClientID
+		serviceID router.ServiceID
+		result    router.ServerID
+		code      router.RoutingTableErrorCode
+		source    router.DecisionSource
+	}{
+		{"client.1", "service.1", "server.1", 0, router.FromCatchAll},
+		{"client.1", "service.2", "registrar.1/client.1", 0, router.FromRegistrar},
+		{"client.1", "service.3", "pool.2", 0, router.FromPool},
+		{"client.1", "service.3", "pool.2", 0, router.FromMapping},
+		{"client.1", "service.4", "pinned.1", 0, router.FromMapping},
+		{"client.1", "service.5", "", router.ServerPoolEmptyError, router.FromPool},
+		{"client.1", "service.6", "", router.UnknownService, router.FromCatchAll},
+	}
+
+	for _, test := range tests {
+		result, err := resolver.Resolve(test.clientID, test.serviceID)
+		if decision.Source != test.source || decision.ServerID != result || decision.Err != err {
+			t.Errorf("Resolve(%v, %v) observed %+v, want source %v", test.clientID, test.serviceID, decision, test.source)
+		}
+		if result != test.result {
+			t.Errorf("Resolve(%v, %v) = %v, want %v", test.clientID, test.serviceID, result, test.result)
+		}
+		if test.code == 0 && err != nil {
+			t.Errorf("Resolve(%v, %v) unexpected error: %v", test.clientID, test.serviceID, err)
+		}
+		if code, _ := router.ErrorCode(err); test.code != 0 && code != test.code {
+			t.Errorf("Resolve(%v, %v) error = %v, want code %d", test.clientID, test.serviceID, err, test.code)
+		}
+	}
+
+	// Registrar and pool picks are stored as the client's mapping.
+	serverID, _ := table.GetClientServiceServer("client.1", "service.3")
+	if serverID != "pool.2" {
+		t.Errorf("pool pick was not stored for client, got %q", serverID)
+	}
+
+	// Without a registrar, services fall through to their pool.
+	resolver = router.NewResolver(table, nil)
+	serverID, _ = resolver.Resolve("client.2", "service.2")
+	if serverID != "pool.1" {
+		t.Errorf("expected fall through to pool without registrar, got %q", serverID)
+	}
+}
+
+type contextKey struct{}
+
+// A table recording the context it was bound to.
+type contextTable struct {
+	router.RoutingTable
+	bound *context.Context
+}
+
+func (t contextTable) WithContext(ctx context.Context) router.RoutingTable {
+	*t.bound = ctx
+	return t
+}
+
+type contextRegistrar struct {
+	registrarFunc
+	lookups *[]context.Context
+}
+
+func (r contextRegistrar) LookupContext(ctx context.Context, registrar router.ServerID, clientID router.ClientID, serviceID router.ServiceID) (router.ServerID, error) {
+	*r.lookups = append(*r.lookups, ctx)
+	return r.Lookup(registrar, clientID, serviceID)
+}
+
+func TestResolveContext(t *testing.T) {
+	memory := routingtable.NewMemoryRoutingTable()
+	memory.SetServiceRegistrar("service.1", "registrar.1")
+
+	var bound context.Context
+	var lookups []context.Context
+	table := contextTable{memory, &bound}
+	registrar := contextRegistrar{registrarFunc(func(registrar router.ServerID, clientID router.ClientID, serviceID router.ServiceID) (router.ServerID, error) {
+		return "server.1", nil
+	}), &lookups}
+	resolver := router.NewResolver(table, registrar)
+
+	ctx := router.WithStaleMarker(context.WithValue(context.Background(), contextKey{}, "message"))
+	serverID, err := resolver.ResolveContext(ctx, "client.1", "service.1")
+	if serverID != "server.1" || err != nil {
+		t.Fatalf("ResolveContext() = %q, %v", serverID, err)
+	}
+	if bound != ctx {
+		t.Errorf("expected table to be bound to the message's context")
+	}
+	if len(lookups) != 1 || lookups[0] != ctx {
+		t.Errorf("expected registrar to be called with the message's context, got %v", lookups)
+	}
+}
+
+func TestResolveStale(t *testing.T) {
+	memory := routingtable.NewMemoryRoutingTable()
+	memory.AddServerToServicePool("service.1", "pool.1")
+	table := router.Intercept(memory, func(ctx context.Context, call *router.Call, next router.Invoker) (interface{}, error) {
+		router.MarkStale(ctx)
+		return next(ctx, call)
+	})
+
+	var decision router.Decision
+	resolver := router.NewResolver(table, nil)
+	resolver.SetObserver(func(d router.Decision) { decision = d })
+
+	ctx := router.WithStaleMarker(context.Background())
+	if serverID, err := resolver.ResolveContext(ctx, "client.1", "service.1"); serverID != "pool.1" || err != nil {
+		t.Fatalf("ResolveContext() = %q, %v", serverID, err)
+	}
+	if !router.ServedStale(ctx) || !decision.Stale {
+		t.Errorf("expected the decision to be stale")
+	}
+
+	// Picks made from stale data are not stored.
+	if _, err := memory.GetClientServiceServer("client.1", "service.1"); !errors.Is(err, router.ErrUnknownClient) {
+		t.Errorf("expected stale pick not to be stored, got %v", err)
+	}
+}
+
+type recordHandler struct {
+	records *[]slog.Record
+}
+
+func (h recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h recordHandler) Handle(_ context.Context, record slog.Record) error {
+	*h.records = append(*h.records, record)
+	return nil
+}
+
+func (h recordHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h recordHandler) WithGroup(string) slog.Handler      { return h }
+
+func recordAttrs(record slog.Record) map[string]string {
+	attrs := make(map[string]string)
+	record.Attrs(func(attr slog.Attr) bool {
+		attrs[attr.Key] = attr.Value.String()
+		return true
+	})
+	return attrs
+}
+
+func TestResolveLogging(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	table.AddServerToServicePool("service.1", "pool.1")
+
+	var records []slog.Record
+	resolver := router.NewResolver(table, nil)
+	resolver.SetLogger(slog.New(recordHandler{&records}))
+
+	resolver.Resolve("client.1", "service.1")
+	resolver.Resolve("client.1", "service.2")
+
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+
+	if records[0].Level != slog.LevelDebug || records[0].Message != "resolved" {
+		t.Errorf("unexpected record %v %q", records[0].Level, records[0].Message)
+	}
+	attrs := recordAttrs(records[0])
+	if attrs[router.ClientKey] != "client.1" || attrs[router.ServiceKey] != "service.1" || attrs[router.ServerKey] != "pool.1" || attrs[router.SourceKey] != "pool" {
+		t.Errorf("unexpected attributes %v", attrs)
+	}
+
+	if records[1].Level != slog.LevelWarn || records[1].Message != "resolve failed" {
+		t.Errorf("unexpected record %v %q", records[1].Level, records[1].Message)
+	}
+	attrs = recordAttrs(records[1])
+	if attrs[router.ServiceKey] != "service.2" || attrs[router.CodeKey] != "UnknownService" || attrs[router.ErrorKey] == "" {
+		t.Errorf("unexpected attributes %v", attrs)
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	table.SetServiceRegistrar("service.1", "registrar.1")
+
+	unreachable := errors.New("connection refused")
+	resolver := router.NewResolver(table, registrarFunc(func(registrar router.ServerID, clientID router.ClientID, serviceID router.ServiceID) (router.ServerID, error) {
+		return "", unreachable
+	}))
+
+	_, err := resolver.Resolve("client.1", "service.1")
+	if !errors.Is(err, router.ErrLookup) || !errors.Is(err, unreachable) {
+		t.Fatalf("expected a lookup error wrapping the registrar's, got %v", err)
+	}
+	var tableErr *router.RoutingTableError
+	if !errors.As(err, &tableErr) || tableErr.ClientID != "client.1" || tableErr.ServiceID != "service.1" {
+		t.Errorf("unexpected error fields %+v", tableErr)
+	}
+	if status := router.HTTPStatus(err); status != http.StatusBadGateway {
+		t.Errorf("HTTPStatus() = %d, want %d", status, http.StatusBadGateway)
+	}
+
+	_, err = resolver.Resolve("client.1", "service.2")
+	if !errors.As(err, &tableErr) || tableErr.ServiceID != "service.2" || !errors.Is(err, router.ErrUnknownService) {
+		t.Errorf("unexpected error %+v", err)
+	}
+	if status := router.HTTPStatus(err); status != http.StatusNotFound {
+		t.Errorf("HTTPStatus() = %d, want %d", status, http.StatusNotFound)
+	}
+	if errors.Is(err, router.ErrUnknownClient) {
+		t.Errorf("%v matched a sentinel with another code", err)
+	}
+}
+
+func TestResolvePolicy(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	table.AddServerToServicePool("service.1", "pool.1")
+	table.AddServerToServicePool("service.2", "pool.1")
+	table.AddServerToServicePool("service.3", "pool.1")
+	table.AddServerToServicePool("service.3", "pool.2")
+
+	resolver := router.NewResolver(table, nil)
+	resolver.SetPolicy("service.1", router.Policy{StickyTTL: time.Millisecond})
+	resolver.SetPolicy("service.2", router.Policy{NoSticky: true})
+	resolver.SetPolicy("service.3", router.Policy{Selector: new(router.RoundRobinSelector)})
+
+	// Expired picks are resolved again.
+	resolver.Resolve("client.1", "service.1")
+	table.RemoveServerFromServicePool("service.1", "pool.1")
+	table.AddServerToServicePool("service.1", "pool.2")
+	time.Sleep(2 * time.Millisecond)
+	if serverID, _ := resolver.Resolve("client.1", "service.1"); serverID != "pool.2" {
+		t.Errorf("expected expired mapping to be resolved again, got %q", serverID)
+	}
+
+	// Picks are not stored without stickiness.
+	resolver.Resolve("client.1", "service.2")
+	if _, err := table.GetClientServiceServer("client.1", "service.2"); err == nil {
+		t.Errorf("expected no mapping to be stored")
+	}
+
+	// Selectors pick from the pool.
+	first, _ := resolver.Resolve("client.1", "service.3")
+	second, _ := resolver.Resolve("client.2", "service.3")
+	if first != "pool.1" || second != "pool.2" {
+		t.Errorf("expected round robin picks, got %q and %q", first, second)
+	}
+}
+
+func TestResolveSweepsExpiredMappings(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	table.AddServerToServicePool("service.1", "pool.1")
+	table.AddServerToServicePool("service.2", "pool.1")
+
+	resolver := router.NewResolver(table, nil)
+	resolver.SetPolicy("service.1", router.Policy{StickyTTL: time.Millisecond})
+	resolver.Resolve("client.1", "service.1")
+	resolver.Resolve("client.2", "service.1")
+	table.SetClientServiceServer("client.2", "service.1", "operator.1")
+	time.Sleep(2 * time.Millisecond)
+
+	// Expired mappings are swept once every 1024 stored mappings.
+	for i := 0; i < 1024; i++ {
+		resolver.Resolve(router.ClientID(fmt.Sprintf("other.%d", i)), "service.2")
+	}
+
+	if _, err := table.GetClientServiceServer("client.1", "service.1"); err == nil {
+		t.Errorf("expected the expired mapping to be removed")
+	}
+	if serverID, _ := table.GetClientServiceServer("client.2", "service.1"); serverID != "operator.1" {
+		t.Errorf("expected the changed mapping to be kept, got %q", serverID)
+	}
+}
+
+func TestHashSelector(t *testing.T) {
+	pool := []router.ServerID{"pool.1", "pool.2", "pool.3"}
+	reversed := []router.ServerID{"pool.3", "pool.2", "pool.1"}
+
+	selector := router.HashSelector{}
+	for _, clientID := range []router.ClientID{"client.1", "client.2", "client.3"} {
+		a, _ := selector.Select(clientID, "service.1", pool)
+		b, _ := selector.Select(clientID, "service.1", reversed)
+		if a != b {
+			t.Errorf("hash selection for %v depends on pool order: %q, %q", clientID, a, b)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	table := routingtable.NewMemoryRoutingTable()
+	table.SetServiceRegistrar("service.1", "registrar.1")
+	table.AddServerToServicePool("service.1", "pool.1")
+	table.AddServerToServicePool("service.1", "pool.2")
+	table.SetServiceServer("service.2", "server.1")
+
+	registrar := registrarFunc(func(registrar router.ServerID, clientID router.ClientID, serviceID router.ServiceID) (router.ServerID, error) {
+		return "", router.NewRoutingTableError(router.ServerNotFoundError, "No server.")
+	})
+	resolver := router.NewResolver(table, registrar)
+	resolver.SetPolicy("service.1", router.Policy{StickyTTL: time.Millisecond, Selector: router.HashSelector{}})
+
+	// An expired mapping falls through to the registrar, then the pool.
+	picked, _ := resolver.Resolve("client.1", "service.1")
+	time.Sleep(2 * time.Millisecond)
+
+	explain := resolver.Explain("client.1", "service.1")
+	if explain.ServerID != picked || explain.Source != router.FromPool || explain.Err != nil {
+		t.Fatalf("Explain() decided %+v, want %q from pool", explain.Decision, picked)
+	}
+	if !explain.Sticky || explain.StickyTTL != time.Millisecond {
+		t.Errorf("expected the pick to be sticky for 1ms, got %v, %v", explain.Sticky, explain.StickyTTL)
+	}
+
+	steps := explain.Steps
+	if len(steps) != 4 {
+		t.Fatalf("expected 4 steps, got %+v", steps)
+	}
+	if steps[0].Source != router.FromMapping || steps[0].ServerID != picked || !steps[0].Expired || steps[0].Expires.IsZero() {
+		t.Errorf("unexpected mapping step %+v", steps[0])
+	}
+	if steps[1].Source != router.FromCatchAll || !errors.Is(steps[1].Err, router.ErrServerNotFound) {
+		t.Errorf("unexpected catch-all step %+v", steps[1])
+	}
+	if steps[2].Source != router.FromRegistrar || steps[2].Registrar != "registrar.1" || !errors.Is(steps[2].Err, router.ErrServerNotFound) {
+		t.Errorf("unexpected registrar step %+v", steps[2])
+	}
+	if steps[3].Source != router.FromPool || len(steps[3].Pool) != 2 || steps[3].Selector != "hash" || steps[3].ServerID != picked {
+		t.Errorf("unexpected pool step %+v", steps[3])
+	}
+
+	// Explaining does not store the pick or reset its expiry.
+	explain = resolver.Explain("client.1", "service.1")
+	if !explain.Steps[0].Expired {
+		t.Errorf("expected mapping to stay expired after Explain")
+	}
+
+	// Steps stop at the one that decided.
+	explain = resolver.Explain("client.1", "service.2")
+	if len(explain.Steps) != 2 || explain.Source != router.FromCatchAll || !errors.Is(explain.Steps[0].Err, router.ErrMappingNotFound) {
+		t.Errorf("unexpected explanation %+v", explain)
+	}
+	if explain.Sticky {
+		t.Errorf("catch-all servers are not stored")
+	}
+}
@@ -4,3 +4,25 @@ type ClientID string
 
 type ServiceID string
 type ServerID string
+
+// A Message is a single unit of data sent from a client to a service, or
+// from a service back to a client.  The ID, when set, uniquely identifies
+// the message so servers can acknowledge it.  Sequence, when non-zero, is the
+// message's position among those sent by the client to the service.
+// Headers carry metadata added by the router or front-ends.
+type Message struct {
+	ID        string
+	ClientID  ClientID
+	ServiceID ServiceID
+	Sequence  uint64
+	Headers   map[string]string
+	Body      []byte
+}
+
+// Set a header on the message, creating the header map if needed.
+func (msg *Message) SetHeader(key, value string) {
+	if msg.Headers == nil {
+		msg.Headers = make(map[string]string)
+	}
+	msg.Headers[key] = value
+}
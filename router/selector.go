@@ -0,0 +1,75 @@
+package router
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// A Selector picks the server from a service's pool that a client's messages
+// are routed to.  The pool is never empty.
+type Selector interface {
+	Select(clientID ClientID, serviceID ServiceID, pool []ServerID) (ServerID, error)
+}
+
+// RandomSelector picks a server uniformly at random.
+type RandomSelector struct{}
+
+func (RandomSelector) Select(clientID ClientID, serviceID ServiceID, pool []ServerID) (ServerID, error) {
+	return pool[rand.Intn(len(pool))], nil
+}
+
+// RoundRobinSelector picks each server of a service's pool in turn.
+type RoundRobinSelector struct {
+	lock sync.Mutex
+	next map[ServiceID]int
+}
+
+func (s *RoundRobinSelector) Select(clientID ClientID, serviceID ServiceID, pool []ServerID) (ServerID, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.next == nil {
+		s.next = make(map[ServiceID]int)
+	}
+
+	sorted := sortedPool(pool)
+	pos := s.next[serviceID] % len(sorted)
+	s.next[serviceID] = pos + 1
+	return sorted[pos], nil
+}
+
+// HashSelector picks a server by hashing the client ID, so a client keeps
+// the same server while the pool is unchanged even without a stored mapping.
+type HashSelector struct{}
+
+func (HashSelector) Select(clientID ClientID, serviceID ServiceID, pool []ServerID) (ServerID, error) {
+	hash := fnv.New32a()
+	hash.Write([]byte(clientID))
+
+	sorted := sortedPool(pool)
+	return sorted[hash.Sum32()%uint32(len(sorted))], nil
+}
+
+// Get a selector by name: "random", "round-robin", or "hash".
+func NewSelector(name string) (Selector, error) {
+	switch name {
+	case "random":
+		return RandomSelector{}, nil
+	case "round-robin":
+		return new(RoundRobinSelector), nil
+	case "hash":
+		return HashSelector{}, nil
+	default:
+		return nil, fmt.Errorf("unknown selection strategy %q", name)
+	}
+}
+
+func sortedPool(pool []ServerID) []ServerID {
+	sorted := make([]ServerID, len(pool))
+	copy(sorted, pool)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
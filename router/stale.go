@@ -0,0 +1,33 @@
+package router
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+type staleKey struct{}
+
+// Return a context in which routing tables can report answering from stale
+// data, such as a copy kept while their backend is unreachable.  Check
+// ServedStale after making calls through a table bound to the context with
+// ContextTable.  ctx is returned as is if it already has a marker.
+func WithStaleMarker(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(staleKey{}).(*atomic.Bool); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, staleKey{}, new(atomic.Bool))
+}
+
+// Report that an answer given on behalf of ctx was stale.  It does nothing
+// unless ctx was returned by WithStaleMarker.
+func MarkStale(ctx context.Context) {
+	if stale, ok := ctx.Value(staleKey{}).(*atomic.Bool); ok {
+		stale.Store(true)
+	}
+}
+
+// Report whether any answer given on behalf of ctx was stale.
+func ServedStale(ctx context.Context) bool {
+	stale, ok := ctx.Value(staleKey{}).(*atomic.Bool)
+	return ok && stale.Load()
+}
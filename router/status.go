@@ -0,0 +1,33 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+var httpStatuses = map[RoutingTableErrorCode]int{
+	ServiceError:         http.StatusBadGateway,
+	LookupError:          http.StatusBadGateway,
+	UnknownClient:        http.StatusNotFound,
+	UnknownService:       http.StatusNotFound,
+	ServerPoolEmptyError: http.StatusServiceUnavailable,
+	ServerNotFoundError:  http.StatusServiceUnavailable,
+	MappingNotFoundError: http.StatusNotFound,
+}
+
+// The HTTP status front-ends answer a failure to route a message with.
+// Services without routing information are not found, services without a
+// server to route to are unavailable, and other failures, such as a
+// registrar or backend that could not be reached, are bad gateways.
+func HTTPStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	if code, ok := ErrorCode(err); ok {
+		if status, ok := httpStatuses[code]; ok {
+			return status
+		}
+	}
+	return http.StatusBadGateway
+}
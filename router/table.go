@@ -1,6 +1,7 @@
 package router
 
 import (
+	"errors"
 	"fmt"
 )
 
@@ -19,19 +20,101 @@ const (
 	MappingNotFoundError
 )
 
+var routingTableErrorCodeNames = map[RoutingTableErrorCode]string{
+	ServiceError:         "ServiceError",
+	LookupError:          "LookupError",
+	UnknownClient:        "UnknownClient",
+	UnknownService:       "UnknownService",
+	ServerPoolEmptyError: "ServerPoolEmptyError",
+	ServerNotFoundError:  "ServerNotFoundError",
+	MappingNotFoundError: "MappingNotFoundError",
+}
+
+func (code RoutingTableErrorCode) String() string {
+	if name, ok := routingTableErrorCodeNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("RoutingTableErrorCode(%d)", int(code))
+}
+
+// A RoutingTableError reports why a routing table, registrar or forwarder
+// call failed.  Use errors.Is with the Err sentinels below to test its code,
+// or errors.As to read its fields.
 type RoutingTableError struct {
 	Code    RoutingTableErrorCode
 	Message string
+
+	// The client and service the call was about, when known.
+	ClientID  ClientID
+	ServiceID ServiceID
+
+	// The failure behind the error, such as a storage or network error.
+	Err error
 }
 
+// Sentinels matching any RoutingTableError with their code, for use with
+// errors.Is:
+//
+//	if errors.Is(err, router.ErrUnknownService) {
+var (
+	ErrService         = &RoutingTableError{Code: ServiceError, Message: "Service error."}
+	ErrLookup          = &RoutingTableError{Code: LookupError, Message: "Lookup error."}
+	ErrUnknownClient   = &RoutingTableError{Code: UnknownClient, Message: "No client routing info found."}
+	ErrUnknownService  = &RoutingTableError{Code: UnknownService, Message: "No service routing info found."}
+	ErrServerPoolEmpty = &RoutingTableError{Code: ServerPoolEmptyError, Message: "No servers in pool."}
+	ErrServerNotFound  = &RoutingTableError{Code: ServerNotFoundError, Message: "No server found."}
+	ErrMappingNotFound = &RoutingTableError{Code: MappingNotFoundError, Message: "No mapping found."}
+)
+
 func (err RoutingTableError) Error() string {
-	return fmt.Sprintf("%v (Routing Error Code: %d)", err.Message, err.Code)
+	msg := fmt.Sprintf("%v (Routing Error Code: %d)", err.Message, err.Code)
+	if err.Err != nil {
+		msg += ": " + err.Err.Error()
+	}
+	return msg
+}
+
+// The failure behind the error, if any.
+func (err *RoutingTableError) Unwrap() error {
+	return err.Err
+}
+
+// Report whether target is a RoutingTableError with the same code.
+func (err *RoutingTableError) Is(target error) bool {
+	targetErr, ok := target.(*RoutingTableError)
+	return ok && targetErr.Code == err.Code
 }
 
 func NewRoutingTableError(code RoutingTableErrorCode, message string) *RoutingTableError {
 	return &RoutingTableError{Code: code, Message: message}
 }
 
+// Create an error about the client's routing information.  serviceID is
+// empty unless the error is about one of the client's services.
+func NewClientTableError(code RoutingTableErrorCode, clientID ClientID, serviceID ServiceID, message string) *RoutingTableError {
+	return &RoutingTableError{Code: code, Message: message, ClientID: clientID, ServiceID: serviceID}
+}
+
+// Create an error about the service's routing information.
+func NewServiceTableError(code RoutingTableErrorCode, serviceID ServiceID, message string) *RoutingTableError {
+	return &RoutingTableError{Code: code, Message: message, ServiceID: serviceID}
+}
+
+// Create an error caused by err, such as a storage failure.
+func WrapRoutingTableError(code RoutingTableErrorCode, message string, err error) *RoutingTableError {
+	return &RoutingTableError{Code: code, Message: message, Err: err}
+}
+
+// The code of the first RoutingTableError in err's chain.  ok is false when
+// there is none.
+func ErrorCode(err error) (code RoutingTableErrorCode, ok bool) {
+	var tableErr *RoutingTableError
+	if !errors.As(err, &tableErr) {
+		return 0, false
+	}
+	return tableErr.Code, true
+}
+
 // A RoutingTable provides all core interfaces.
 type RoutingTable interface {
 	ClientTable
@@ -54,6 +137,9 @@ type ClientTable interface {
 
 	// Set server for service responsible for handling messages from client.
 	SetClientServiceServer(ClientID, ServiceID, ServerID) error
+
+	// Remove the client's server for service, if one is set.
+	RemoveClientServiceServer(ClientID, ServiceID) error
 }
 
 // Routing tables meeting the ServiceTable spec answer questions about a
@@ -75,9 +161,48 @@ type ServiceTable interface {
 	// Get a server from the pool of the service's registered servers
 	GetServiceRandomServer(ServiceID) (ServerID, error)
 
+	// Get all servers in the service's pool.
+	GetServicePool(ServiceID) ([]ServerID, error)
+
 	// Add a server to the service's server pool.
 	AddServerToServicePool(ServiceID, ServerID) error
 
 	// Remove a server from the service's pool of servers.
 	RemoveServerFromServicePool(ServiceID, ServerID) error
 }
+
+// A Change describes a successful mutation of a routing table.  Op is the
+// name of the mutating method, and only the IDs it takes are set.
+type Change struct {
+	Op        string
+	ClientID  ClientID
+	ServiceID ServiceID
+	ServerID  ServerID
+}
+
+// Routing tables able to report their changes implement Watcher.
+type Watcher interface {
+	// Call fn with each change made to the table until cancel is called.
+	Watch(fn func(Change)) (cancel func())
+}
+
+// Routing tables able to list their contents implement Scanner.
+type Scanner interface {
+	// List every client with routing information.
+	Clients() ([]ClientID, error)
+
+	// List every service with routing information.
+	Services() ([]ServiceID, error)
+
+	// Get all of the client's service servers, keyed by service.
+	GetClientServices(ClientID) (map[ServiceID]ServerID, error)
+}
+
+// Routing tables able to make several changes at once implement Updater.
+type Updater interface {
+	// Call fn with a view of the table.  Changes fn makes through the view
+	// are seen by other callers all together once fn returns nil, and are
+	// discarded if it returns an error.  The view must not be used after fn
+	// returns.
+	Update(fn func(RoutingTable) error) error
+}
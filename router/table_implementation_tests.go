@@ -7,6 +7,7 @@ package router
 // and run your tests with `go test -tag=integration`.
 
 import (
+	"errors"
 	"testing"
 )
 
@@ -29,7 +30,7 @@ func evalTests(t *testing.T, tests []TestCase, runner func(test TestCase) (Serve
 		} else if err == nil && test.Err != nil {
 			t.Errorf("FAIL: Didn't get an expected error.\n\tTest Case: %+v\n\tActual: {result: \"%v\", err: %+v}",
 				test, result, err)
-		} else if err != nil && test.Err != nil && err.(*RoutingTableError).Code != test.Err.Code {
+		} else if err != nil && test.Err != nil && !errors.Is(err, test.Err) {
 			t.Errorf("FAIL: Got the wrong error.\n\tTest Case: %+v\n\tActual: {result: \"%v\", err: %+v}",
 				test, result, err)
 		}
@@ -98,6 +99,47 @@ func TestGetClientServiceServer(t *testing.T, table RoutingTable) {
 	})
 }
 
+func TestRemoveClientServiceServer(t *testing.T, table RoutingTable) {
+	// Client with two mapped services, one of which is removed.
+	table.SetClientServiceServer("client.2", "service.1", "server.1")
+	table.SetClientServiceServer("client.2", "service.2", "server.2")
+	table.RemoveClientServiceServer("client.2", "service.1")
+
+	// Removing an unmapped service leaves the client alone.
+	table.SetClientMessageServer("client.3", "server.1")
+	table.RemoveClientServiceServer("client.3", "service.1")
+
+	// Removing from an unknown client is not an error.
+	if err := table.RemoveClientServiceServer("client.1", "service.1"); err != nil {
+		t.Errorf("FAIL: Got an unexpected error removing an unknown client's mapping: %v", err)
+	}
+
+	mkArgs := func(clientID ClientID, serviceID ServiceID) []interface{} {
+		return []interface{}{clientID, serviceID}
+	}
+
+	tests := []TestCase{
+		// client.2 no longer has a mapping for service.1.
+		TestCase{mkArgs("client.2", "service.1"), "", NewRoutingTableError(MappingNotFoundError, "")},
+
+		// client.2 still has its mapping for service.2.
+		TestCase{mkArgs("client.2", "service.2"), "server.2", nil},
+
+		// client.3 had nothing to remove.
+		TestCase{mkArgs("client.3", "service.1"), "", NewRoutingTableError(MappingNotFoundError, "")},
+	}
+
+	evalTests(t, tests, func(test TestCase) (ServerID, error) {
+		clientID, _ := test.Args[0].(ClientID)
+		serviceID, _ := test.Args[1].(ServiceID)
+		return table.GetClientServiceServer(clientID, serviceID)
+	})
+
+	if server, err := table.GetClientMessageServer("client.3"); server != "server.1" || err != nil {
+		t.Errorf("FAIL: Removing a mapping changed the message server: %q, %v", server, err)
+	}
+}
+
 func TestGetServiceServer(t *testing.T, table RoutingTable) {
 	// Service with a catch-all server.
 	table.SetServiceServer("service.2", "server.1")
@@ -244,3 +286,164 @@ func TestGetServiceRandomServer(t *testing.T, table RoutingTable) {
 		return table.GetServiceRandomServer(serviceID)
 	})
 }
+
+func TestGetServicePool(t *testing.T, table RoutingTable) {
+	// Service with a catch-all server, but no server pool.
+	table.SetServiceServer("service.2", "server.1")
+
+	// Service with servers added to its pool.
+	table.AddServerToServicePool("service.3", "pool.1")
+	table.AddServerToServicePool("service.3", "pool.2")
+	table.AddServerToServicePool("service.3", "pool.1")
+
+	// Service with a server removed from its pool.
+	table.AddServerToServicePool("service.4", "pool.1")
+	table.AddServerToServicePool("service.4", "pool.2")
+	table.RemoveServerFromServicePool("service.4", "pool.1")
+
+	tests := []struct {
+		ServiceID ServiceID
+		Result    []ServerID
+		Err       *RoutingTableError
+	}{
+		// service.1 does not exist, there is no mapping.
+		{"service.1", nil, NewRoutingTableError(UnknownService, "")},
+
+		// service.2 has a server, but an empty pool.
+		{"service.2", []ServerID{}, nil},
+
+		// service.3 has two servers, added once each.
+		{"service.3", []ServerID{"pool.1", "pool.2"}, nil},
+
+		// service.4 has one server left in its pool.
+		{"service.4", []ServerID{"pool.2"}, nil},
+	}
+
+	for _, test := range tests {
+		result, err := table.GetServicePool(test.ServiceID)
+		if (err == nil) != (test.Err == nil) {
+			t.Errorf("FAIL: Error mismatch.\n\tTest Case: %+v\n\tActual: {result: %v, err: %+v}",
+				test, result, err)
+		} else if err != nil && !errors.Is(err, test.Err) {
+			t.Errorf("FAIL: Got the wrong error.\n\tTest Case: %+v\n\tActual: {result: %v, err: %+v}",
+				test, result, err)
+		} else if !sameServers(result, test.Result) {
+			t.Errorf("FAIL: Results didn't match.\n\tTest Case: %+v\n\tActual: {result: %v, err: %+v}",
+				test, result, err)
+		}
+	}
+}
+
+// Report whether a and b contain the same servers, ignoring order.
+func sameServers(a, b []ServerID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	counts := make(map[ServerID]int)
+	for _, serverID := range a {
+		counts[serverID]++
+	}
+	for _, serverID := range b {
+		counts[serverID]--
+		if counts[serverID] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestScan(t *testing.T, table RoutingTable) {
+	scanner, ok := table.(Scanner)
+	if !ok {
+		t.Fatalf("FAIL: %T does not implement Scanner", table)
+	}
+
+	table.SetClientMessageServer("client.1", "server.1")
+	table.SetClientServiceServer("client.2", "service.1", "server.1")
+	table.SetClientServiceServer("client.2", "service.2", "server.2")
+	table.SetServiceServer("service.1", "server.1")
+	table.AddServerToServicePool("service.3", "pool.1")
+
+	clients, err := scanner.Clients()
+	if err != nil || !sameClients(clients, []ClientID{"client.1", "client.2"}) {
+		t.Errorf("FAIL: Clients didn't match.\n\tActual: {result: %v, err: %+v}", clients, err)
+	}
+
+	services, err := scanner.Services()
+	if err != nil || !sameServices(services, []ServiceID{"service.1", "service.3"}) {
+		t.Errorf("FAIL: Services didn't match.\n\tActual: {result: %v, err: %+v}", services, err)
+	}
+
+	tests := []struct {
+		ClientID ClientID
+		Result   map[ServiceID]ServerID
+		Err      *RoutingTableError
+	}{
+		// client.1 has a message server, but no service mappings.
+		{"client.1", map[ServiceID]ServerID{}, nil},
+
+		// client.2 has two service mappings.
+		{"client.2", map[ServiceID]ServerID{"service.1": "server.1", "service.2": "server.2"}, nil},
+
+		// client.3 does not exist.
+		{"client.3", nil, NewRoutingTableError(UnknownClient, "")},
+	}
+
+	for _, test := range tests {
+		result, err := scanner.GetClientServices(test.ClientID)
+		if (err == nil) != (test.Err == nil) {
+			t.Errorf("FAIL: Error mismatch.\n\tTest Case: %+v\n\tActual: {result: %v, err: %+v}",
+				test, result, err)
+		} else if err != nil && !errors.Is(err, test.Err) {
+			t.Errorf("FAIL: Got the wrong error.\n\tTest Case: %+v\n\tActual: {result: %v, err: %+v}",
+				test, result, err)
+		} else if len(result) != len(test.Result) {
+			t.Errorf("FAIL: Results didn't match.\n\tTest Case: %+v\n\tActual: {result: %v, err: %+v}",
+				test, result, err)
+		} else {
+			for serviceID, serverID := range test.Result {
+				if result[serviceID] != serverID {
+					t.Errorf("FAIL: Results didn't match.\n\tTest Case: %+v\n\tActual: {result: %v, err: %+v}",
+						test, result, err)
+				}
+			}
+		}
+	}
+}
+
+// Report whether a and b contain the same clients, ignoring order.
+func sameClients(a, b []ClientID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	seen := make(map[ClientID]bool)
+	for _, clientID := range a {
+		seen[clientID] = true
+	}
+	for _, clientID := range b {
+		if !seen[clientID] {
+			return false
+		}
+	}
+	return true
+}
+
+// Report whether a and b contain the same services, ignoring order.
+func sameServices(a, b []ServiceID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	seen := make(map[ServiceID]bool)
+	for _, serviceID := range a {
+		seen[serviceID] = true
+	}
+	for _, serviceID := range b {
+		if !seen[serviceID] {
+			return false
+		}
+	}
+	return true
+}
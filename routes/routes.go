@@ -0,0 +1,364 @@
+// Package routes applies a declarative description of services and client
+// mappings to a routing table.
+//
+// A Config lists services with their catch-all server, registrar and pool,
+// and clients with their message server and pinned service mappings.  Plan
+// compares a Config against a table and returns the Set*, Add* and Remove*
+// calls needed to bring the table in line, which Apply then makes.  Applying
+// the same Config twice makes no calls the second time.
+//
+// Listed services are managed completely: an empty server or registrar
+// clears the table's value, and pool members not in the Config are removed.
+// Clients are only updated for the values the Config sets, so dynamic
+// message servers and sticky mappings made by the resolver are left alone,
+// unless the server a mapping points at is no longer a listed service's
+// catch-all server or in its pool.  Those mappings are removed when the
+// table implements router.Scanner, so the resolver picks a new server.
+// Services and clients not listed are never touched.
+//
+// Apply makes every call in one router.Updater update when the table
+// supports it, so other users of the table never see half a Config.
+package routes
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/robertkluin/message-flow/router"
+	"gopkg.in/yaml.v3"
+)
+
+// Config describes the desired routes.
+type Config struct {
+	Services map[router.ServiceID]Service `yaml:"services" toml:"services"`
+	Clients  map[router.ClientID]Client   `yaml:"clients" toml:"clients"`
+}
+
+// Service describes a service's routes.
+type Service struct {
+	Server    router.ServerID   `yaml:"server" toml:"server"`
+	Registrar router.ServerID   `yaml:"registrar" toml:"registrar"`
+	Pool      []router.ServerID `yaml:"pool" toml:"pool"`
+}
+
+// Client describes a client's routes.
+type Client struct {
+	MessageServer router.ServerID                      `yaml:"message_server" toml:"message_server"`
+	Services      map[router.ServiceID]router.ServerID `yaml:"services" toml:"services"`
+}
+
+// Read a Config from a file.  Files ending in ".toml" are read as TOML,
+// anything else as YAML.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := new(Config)
+	if filepath.Ext(path) == ".toml" {
+		err = toml.Unmarshal(data, config)
+	} else {
+		err = yaml.Unmarshal(data, config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return config, nil
+}
+
+// An Op is a single routing table call.  Old is the value being replaced,
+// for Set calls, or removed, for RemoveClientServiceServer.
+type Op struct {
+	Method    string
+	ClientID  router.ClientID
+	ServiceID router.ServiceID
+	ServerID  router.ServerID
+	Old       router.ServerID
+}
+
+func (op Op) String() string {
+	var args []string
+	if op.ClientID != "" {
+		args = append(args, fmt.Sprintf("%q", op.ClientID))
+	}
+	if op.ServiceID != "" {
+		args = append(args, fmt.Sprintf("%q", op.ServiceID))
+	}
+	if op.Method != "RemoveClientServiceServer" {
+		args = append(args, fmt.Sprintf("%q", op.ServerID))
+	}
+
+	call := fmt.Sprintf("%s(%s)", op.Method, strings.Join(args, ", "))
+	if strings.HasPrefix(op.Method, "Set") || op.Method == "RemoveClientServiceServer" {
+		call += fmt.Sprintf("  # was %q", op.Old)
+	}
+	return call
+}
+
+// Make the call on table.
+func (op Op) Apply(table router.RoutingTable) error {
+	switch op.Method {
+	case "SetClientMessageServer":
+		return table.SetClientMessageServer(op.ClientID, op.ServerID)
+	case "SetClientServiceServer":
+		return table.SetClientServiceServer(op.ClientID, op.ServiceID, op.ServerID)
+	case "RemoveClientServiceServer":
+		return table.RemoveClientServiceServer(op.ClientID, op.ServiceID)
+	case "SetServiceServer":
+		return table.SetServiceServer(op.ServiceID, op.ServerID)
+	case "SetServiceRegistrar":
+		return table.SetServiceRegistrar(op.ServiceID, op.ServerID)
+	case "AddServerToServicePool":
+		return table.AddServerToServicePool(op.ServiceID, op.ServerID)
+	case "RemoveServerFromServicePool":
+		return table.RemoveServerFromServicePool(op.ServiceID, op.ServerID)
+	default:
+		return fmt.Errorf("routes: unknown method %q", op.Method)
+	}
+}
+
+// A Plan is the calls needed to apply a Config, in order.
+type Plan []Op
+
+func (p Plan) String() string {
+	if len(p) == 0 {
+		return "No changes.\n"
+	}
+
+	var buf strings.Builder
+	for _, op := range p {
+		buf.WriteString(op.String())
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+// Make every call in the plan, stopping at the first failure.
+func (p Plan) Apply(table router.RoutingTable) error {
+	for _, op := range p {
+		if err := op.Apply(table); err != nil {
+			return fmt.Errorf("%s: %v", op, err)
+		}
+	}
+	return nil
+}
+
+// Work out the calls needed to bring table in line with config.
+func MakePlan(table router.RoutingTable, config *Config) (Plan, error) {
+	var plan Plan
+	removed := make(map[router.ServiceID]map[router.ServerID]bool)
+
+	for _, serviceID := range sortedServices(config.Services) {
+		ops, servers, err := planService(table, serviceID, config.Services[serviceID])
+		if err != nil {
+			return nil, err
+		}
+		plan = append(plan, ops...)
+		if len(servers) > 0 {
+			removed[serviceID] = servers
+		}
+	}
+
+	for _, clientID := range sortedClients(config.Clients) {
+		ops, err := planClient(table, clientID, config.Clients[clientID])
+		if err != nil {
+			return nil, err
+		}
+		plan = append(plan, ops...)
+	}
+
+	if scanner, ok := table.(router.Scanner); ok && len(removed) > 0 {
+		ops, err := planUnmap(scanner, config, removed)
+		if err != nil {
+			return nil, err
+		}
+		plan = append(plan, ops...)
+	}
+
+	return plan, nil
+}
+
+// Plan and apply config, returning the calls made.
+func Apply(table router.RoutingTable, config *Config) (Plan, error) {
+	var plan Plan
+	apply := func(table router.RoutingTable) error {
+		var err error
+		plan, err = MakePlan(table, config)
+		if err != nil {
+			return err
+		}
+		return plan.Apply(table)
+	}
+
+	var err error
+	if updater, ok := table.(router.Updater); ok {
+		err = updater.Update(apply)
+	} else {
+		err = apply(table)
+	}
+	return plan, err
+}
+
+// Plan the calls for a service, also returning the servers it will no longer
+// route to.
+func planService(table router.RoutingTable, serviceID router.ServiceID, service Service) (Plan, map[router.ServerID]bool, error) {
+	var plan Plan
+
+	server, err := current(table.GetServiceServer(serviceID))
+	if err != nil {
+		return nil, nil, err
+	}
+	if server != service.Server {
+		plan = append(plan, Op{Method: "SetServiceServer", ServiceID: serviceID, ServerID: service.Server, Old: server})
+	}
+
+	registrar, err := current(table.GetServiceRegistrar(serviceID))
+	if err != nil {
+		return nil, nil, err
+	}
+	if registrar != service.Registrar {
+		plan = append(plan, Op{Method: "SetServiceRegistrar", ServiceID: serviceID, ServerID: service.Registrar, Old: registrar})
+	}
+
+	pool, err := table.GetServicePool(serviceID)
+	if err != nil && !notFound(err) {
+		return nil, nil, err
+	}
+
+	have := make(map[router.ServerID]bool)
+	for _, serverID := range pool {
+		have[serverID] = true
+	}
+	want := make(map[router.ServerID]bool)
+	for _, serverID := range service.Pool {
+		want[serverID] = true
+		if !have[serverID] {
+			have[serverID] = true
+			plan = append(plan, Op{Method: "AddServerToServicePool", ServiceID: serviceID, ServerID: serverID})
+		}
+	}
+	for _, serverID := range pool {
+		if !want[serverID] {
+			plan = append(plan, Op{Method: "RemoveServerFromServicePool", ServiceID: serviceID, ServerID: serverID})
+		}
+	}
+
+	want[service.Server] = true
+	removed := make(map[router.ServerID]bool)
+	for _, serverID := range append(pool, server) {
+		if serverID != "" && !want[serverID] {
+			removed[serverID] = true
+		}
+	}
+
+	return plan, removed, nil
+}
+
+// Plan removing client mappings to removed servers, other than those config
+// pins.
+func planUnmap(scanner router.Scanner, config *Config, removed map[router.ServiceID]map[router.ServerID]bool) (Plan, error) {
+	var plan Plan
+
+	clients, err := scanner.Clients()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, clientID := range clients {
+		mappings, err := scanner.GetClientServices(clientID)
+		if err != nil {
+			if notFound(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		for _, serviceID := range sortedServiceServers(mappings) {
+			serverID := mappings[serviceID]
+			if !removed[serviceID][serverID] {
+				continue
+			}
+			if _, pinned := config.Clients[clientID].Services[serviceID]; pinned {
+				continue
+			}
+			plan = append(plan, Op{Method: "RemoveClientServiceServer", ClientID: clientID, ServiceID: serviceID, Old: serverID})
+		}
+	}
+
+	return plan, nil
+}
+
+func planClient(table router.RoutingTable, clientID router.ClientID, client Client) (Plan, error) {
+	var plan Plan
+
+	if client.MessageServer != "" {
+		server, err := current(table.GetClientMessageServer(clientID))
+		if err != nil {
+			return nil, err
+		}
+		if server != client.MessageServer {
+			plan = append(plan, Op{Method: "SetClientMessageServer", ClientID: clientID, ServerID: client.MessageServer, Old: server})
+		}
+	}
+
+	for _, serviceID := range sortedServiceServers(client.Services) {
+		server, err := current(table.GetClientServiceServer(clientID, serviceID))
+		if err != nil {
+			return nil, err
+		}
+		if server != client.Services[serviceID] {
+			plan = append(plan, Op{Method: "SetClientServiceServer", ClientID: clientID, ServiceID: serviceID, ServerID: client.Services[serviceID], Old: server})
+		}
+	}
+
+	return plan, nil
+}
+
+// Treat "not found" lookups as an empty value.
+func current(serverID router.ServerID, err error) (router.ServerID, error) {
+	if err != nil && notFound(err) {
+		return "", nil
+	}
+	return serverID, err
+}
+
+func notFound(err error) bool {
+	code, _ := router.ErrorCode(err)
+	switch code {
+	case router.UnknownClient, router.UnknownService, router.MappingNotFoundError, router.ServerNotFoundError:
+		return true
+	}
+	return false
+}
+
+func sortedServices(services map[router.ServiceID]Service) []router.ServiceID {
+	ids := make([]router.ServiceID, 0, len(services))
+	for serviceID := range services {
+		ids = append(ids, serviceID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func sortedClients(clients map[router.ClientID]Client) []router.ClientID {
+	ids := make([]router.ClientID, 0, len(clients))
+	for clientID := range clients {
+		ids = append(ids, clientID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func sortedServiceServers(services map[router.ServiceID]router.ServerID) []router.ServiceID {
+	ids := make([]router.ServiceID, 0, len(services))
+	for serviceID := range services {
+		ids = append(ids, serviceID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
@@ -0,0 +1,79 @@
+package routes
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/robertkluin/message-flow/routingtable"
+)
+
+const exampleConfig = `
+services:
+  chat:
+    server: chat-1:9000
+  game:
+    registrar: registrar-1:9100
+    pool: [game-1:9000, game-2:9000]
+clients:
+  client.1:
+    services:
+      game: game-3:9000
+`
+
+func TestPlanAndApply(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	os.WriteFile(path, []byte(exampleConfig), 0644)
+
+	config, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := routingtable.NewMemoryRoutingTable()
+	table.AddServerToServicePool("game", "game-old:9000")
+	table.SetServiceServer("other", "other-1:9000")
+
+	// Sticky mappings to removed servers are dropped, others are kept.
+	table.SetClientServiceServer("client.2", "game", "game-old:9000")
+	table.SetClientServiceServer("client.3", "game", "game-1:9000")
+	table.SetClientServiceServer("client.3", "other", "game-old:9000")
+
+	plan, err := MakePlan(table, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `SetServiceServer("chat", "chat-1:9000")  # was ""
+SetServiceRegistrar("game", "registrar-1:9100")  # was ""
+AddServerToServicePool("game", "game-1:9000")
+AddServerToServicePool("game", "game-2:9000")
+RemoveServerFromServicePool("game", "game-old:9000")
+SetClientServiceServer("client.1", "game", "game-3:9000")  # was ""
+RemoveClientServiceServer("client.2", "game")  # was "game-old:9000"
+`
+	if plan.String() != expected {
+		t.Errorf("unexpected plan:\n%s\nwant:\n%s", plan, expected)
+	}
+
+	if err := plan.Apply(table); err != nil {
+		t.Fatal(err)
+	}
+
+	pool, _ := table.GetServicePool("game")
+	if len(pool) != 2 {
+		t.Errorf("unexpected pool %v", pool)
+	}
+	if server, _ := table.GetServiceServer("other"); server != "other-1:9000" {
+		t.Errorf("unlisted service changed: %q", server)
+	}
+	if mappings, _ := table.GetClientServices("client.3"); len(mappings) != 2 {
+		t.Errorf("unexpected client.3 mappings %v", mappings)
+	}
+
+	// Applying again makes no calls.
+	plan, err = Apply(table, config)
+	if err != nil || len(plan) != 0 {
+		t.Errorf("expected no changes on second apply, got %v, %v", plan, err)
+	}
+}
@@ -0,0 +1,553 @@
+// Package bolt stores a routing table in a bbolt database file, for single
+// node message-flow systems that need their routes to survive restarts.
+//
+// Importing the package registers the "bolt" backend with routingtable.Open:
+//
+//	import _ "github.com/robertkluin/message-flow/routingtable/bolt"
+//
+//	table, err := routingtable.Open("bolt:///var/lib/mflow.db?timeout=5s")
+//
+// The query may set bucket, the top-level bucket holding the table (so one
+// file can hold several tables), and timeout, how long to wait for the file
+// lock held by another process.
+package bolt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routingtable"
+	"go.etcd.io/bbolt"
+)
+
+// DefaultBucket is the top-level bucket used when Options.Bucket is empty.
+const DefaultBucket = "mflow"
+
+var (
+	clientsBucket  = []byte("clients")
+	servicesBucket = []byte("services")
+	mappingsBucket = []byte("services")
+	poolBucket     = []byte("pool")
+
+	messageServerKey = []byte("message-server")
+	serverKey        = []byte("server")
+	registrarKey     = []byte("registrar")
+)
+
+// Options for opening a Table.
+type Options struct {
+	// Top-level bucket holding the table.
+	Bucket string
+
+	// How long to wait for another process to release the file.  Zero waits
+	// forever.
+	Timeout time.Duration
+}
+
+// Table implements router.RoutingTable, router.Scanner and router.Updater
+// in a bbolt database.  It is safe for concurrent use.
+type Table struct {
+	db     *bbolt.DB
+	bucket []byte
+
+	lock   sync.Mutex
+	logger *slog.Logger
+}
+
+// Open the table in the database file at path, creating it if needed.
+func Open(path string, options *Options) (*Table, error) {
+	if options == nil {
+		options = new(Options)
+	}
+
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: options.Timeout})
+	if err != nil {
+		return nil, err
+	}
+
+	table := new(Table)
+	table.db = db
+	table.logger = router.LoggerOrDiscard(nil)
+	table.bucket = []byte(options.Bucket)
+	if options.Bucket == "" {
+		table.bucket = []byte(DefaultBucket)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(table.bucket)
+		if err != nil {
+			return err
+		}
+		if _, err := root.CreateBucketIfNotExists(clientsBucket); err != nil {
+			return err
+		}
+		_, err = root.CreateBucketIfNotExists(servicesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return table, nil
+}
+
+// Log database failures, such as a full disk, at error level.  Routing
+// table errors such as unknown clients are only returned.  A nil logger
+// discards them.
+func (table *Table) SetLogger(logger *slog.Logger) {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	table.logger = router.LoggerOrDiscard(logger)
+}
+
+// Close the database file.
+func (table *Table) Close() error {
+	return table.db.Close()
+}
+
+// Which message server handles communication for client.
+func (table *Table) GetClientMessageServer(clientID router.ClientID) (router.ServerID, error) {
+	var serverID router.ServerID
+	err := table.view(func(txn *txn) (err error) {
+		serverID, err = txn.GetClientMessageServer(clientID)
+		return err
+	})
+	return serverID, err
+}
+
+// Set the message server that handles communication for the client.
+func (table *Table) SetClientMessageServer(clientID router.ClientID, messageServer router.ServerID) error {
+	return table.Update(func(txn router.RoutingTable) error {
+		return txn.SetClientMessageServer(clientID, messageServer)
+	})
+}
+
+// Which server for service should messages from client be routed to.
+func (table *Table) GetClientServiceServer(clientID router.ClientID, serviceID router.ServiceID) (router.ServerID, error) {
+	var serverID router.ServerID
+	err := table.view(func(txn *txn) (err error) {
+		serverID, err = txn.GetClientServiceServer(clientID, serviceID)
+		return err
+	})
+	return serverID, err
+}
+
+// Set server for service responsible for handling messages from client.
+func (table *Table) SetClientServiceServer(clientID router.ClientID, serviceID router.ServiceID, serverID router.ServerID) error {
+	return table.Update(func(txn router.RoutingTable) error {
+		return txn.SetClientServiceServer(clientID, serviceID, serverID)
+	})
+}
+
+// Remove the client's server for service, if one is set.
+func (table *Table) RemoveClientServiceServer(clientID router.ClientID, serviceID router.ServiceID) error {
+	return table.Update(func(txn router.RoutingTable) error {
+		return txn.RemoveClientServiceServer(clientID, serviceID)
+	})
+}
+
+// Get the catch-all server, if defined, for the service.
+func (table *Table) GetServiceServer(serviceID router.ServiceID) (router.ServerID, error) {
+	var serverID router.ServerID
+	err := table.view(func(txn *txn) (err error) {
+		serverID, err = txn.GetServiceServer(serviceID)
+		return err
+	})
+	return serverID, err
+}
+
+// Set a catch-all server for the service.
+func (table *Table) SetServiceServer(serviceID router.ServiceID, serverID router.ServerID) error {
+	return table.Update(func(txn router.RoutingTable) error {
+		return txn.SetServiceServer(serviceID, serverID)
+	})
+}
+
+// Get the registrar, if defined, for the service.
+func (table *Table) GetServiceRegistrar(serviceID router.ServiceID) (router.ServerID, error) {
+	var serverID router.ServerID
+	err := table.view(func(txn *txn) (err error) {
+		serverID, err = txn.GetServiceRegistrar(serviceID)
+		return err
+	})
+	return serverID, err
+}
+
+// Set the registrar for the service.
+func (table *Table) SetServiceRegistrar(serviceID router.ServiceID, serverID router.ServerID) error {
+	return table.Update(func(txn router.RoutingTable) error {
+		return txn.SetServiceRegistrar(serviceID, serverID)
+	})
+}
+
+// Get a server from the pool of the service's registered servers
+func (table *Table) GetServiceRandomServer(serviceID router.ServiceID) (router.ServerID, error) {
+	var serverID router.ServerID
+	err := table.view(func(txn *txn) (err error) {
+		serverID, err = txn.GetServiceRandomServer(serviceID)
+		return err
+	})
+	return serverID, err
+}
+
+// Get all servers in the service's pool.
+func (table *Table) GetServicePool(serviceID router.ServiceID) ([]router.ServerID, error) {
+	var pool []router.ServerID
+	err := table.view(func(txn *txn) (err error) {
+		pool, err = txn.GetServicePool(serviceID)
+		return err
+	})
+	return pool, err
+}
+
+// Add a server to the service's server pool.
+func (table *Table) AddServerToServicePool(serviceID router.ServiceID, serverID router.ServerID) error {
+	return table.Update(func(txn router.RoutingTable) error {
+		return txn.AddServerToServicePool(serviceID, serverID)
+	})
+}
+
+// Remove a server from the service's pool of servers.
+func (table *Table) RemoveServerFromServicePool(serviceID router.ServiceID, serverID router.ServerID) error {
+	return table.Update(func(txn router.RoutingTable) error {
+		return txn.RemoveServerFromServicePool(serviceID, serverID)
+	})
+}
+
+// List every client with routing information.
+func (table *Table) Clients() ([]router.ClientID, error) {
+	var clients []router.ClientID
+	err := table.view(func(txn *txn) (err error) {
+		clients, err = txn.Clients()
+		return err
+	})
+	return clients, err
+}
+
+// List every service with routing information.
+func (table *Table) Services() ([]router.ServiceID, error) {
+	var services []router.ServiceID
+	err := table.view(func(txn *txn) (err error) {
+		services, err = txn.Services()
+		return err
+	})
+	return services, err
+}
+
+// Get all of the client's service servers, keyed by service.
+func (table *Table) GetClientServices(clientID router.ClientID) (map[router.ServiceID]router.ServerID, error) {
+	var mappings map[router.ServiceID]router.ServerID
+	err := table.view(func(txn *txn) (err error) {
+		mappings, err = txn.GetClientServices(clientID)
+		return err
+	})
+	return mappings, err
+}
+
+// Call fn with a view of the table inside one database transaction.  The
+// changes fn makes are committed together once it returns nil, and rolled
+// back if it returns an error.  fn's error is returned as is; database
+// failures are returned as a ServiceError wrapping the failure.
+func (table *Table) Update(fn func(router.RoutingTable) error) error {
+	var fnErr error
+	err := table.db.Update(func(tx *bbolt.Tx) error {
+		fnErr = fn(&txn{tx.Bucket(table.bucket)})
+		return fnErr
+	})
+	return table.failure("table update failed", err, fnErr)
+}
+
+func (table *Table) view(fn func(*txn) error) error {
+	var fnErr error
+	err := table.db.View(func(tx *bbolt.Tx) error {
+		fnErr = fn(&txn{tx.Bucket(table.bucket)})
+		return fnErr
+	})
+	return table.failure("table read failed", err, fnErr)
+}
+
+// The error of a transaction that failed with err after fn returned fnErr.
+// fn's error is returned as is; failures committing the transaction are
+// wrapped in a ServiceError.  Database failures are logged.
+func (table *Table) failure(msg string, err, fnErr error) error {
+	if err == nil {
+		return nil
+	}
+	if err != fnErr {
+		err = storageError(err)
+	}
+	if !errors.Is(err, router.ErrService) {
+		return err
+	}
+
+	table.lock.Lock()
+	logger := table.logger
+	table.lock.Unlock()
+	logger.LogAttrs(context.Background(), slog.LevelError, msg, slog.String("path", table.db.Path()), slog.String(router.ErrorKey, err.Error()))
+	return err
+}
+
+// Wrap a database failure in a ServiceError.
+func storageError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return router.WrapRoutingTableError(router.ServiceError, "Routing table storage failed.", err)
+}
+
+// A txn reads and changes the table inside a database transaction.
+type txn struct {
+	root *bbolt.Bucket
+}
+
+func (txn *txn) GetClientMessageServer(clientID router.ClientID) (router.ServerID, error) {
+	record, err := txn.client(clientID)
+	if err != nil {
+		return "", err
+	}
+
+	serverID := record.Get(messageServerKey)
+	if len(serverID) == 0 {
+		return "", router.NewClientTableError(router.MappingNotFoundError, clientID, "", "No message server found for client.")
+	}
+	return router.ServerID(serverID), nil
+}
+
+func (txn *txn) SetClientMessageServer(clientID router.ClientID, messageServer router.ServerID) error {
+	record, err := txn.createClient(clientID)
+	if err != nil {
+		return err
+	}
+
+	return storageError(record.Put(messageServerKey, []byte(messageServer)))
+}
+
+func (txn *txn) GetClientServiceServer(clientID router.ClientID, serviceID router.ServiceID) (router.ServerID, error) {
+	record, err := txn.client(clientID)
+	if err != nil {
+		return "", err
+	}
+
+	serverID := record.Bucket(mappingsBucket).Get([]byte(serviceID))
+	if serverID == nil {
+		return "", router.NewClientTableError(router.MappingNotFoundError, clientID, serviceID, "No server found for service.")
+	}
+	return router.ServerID(serverID), nil
+}
+
+func (txn *txn) SetClientServiceServer(clientID router.ClientID, serviceID router.ServiceID, serverID router.ServerID) error {
+	record, err := txn.createClient(clientID)
+	if err != nil {
+		return err
+	}
+
+	return storageError(record.Bucket(mappingsBucket).Put([]byte(serviceID), []byte(serverID)))
+}
+
+func (txn *txn) RemoveClientServiceServer(clientID router.ClientID, serviceID router.ServiceID) error {
+	record := txn.root.Bucket(clientsBucket).Bucket([]byte(clientID))
+	if record == nil {
+		return nil
+	}
+
+	return storageError(record.Bucket(mappingsBucket).Delete([]byte(serviceID)))
+}
+
+func (txn *txn) GetServiceServer(serviceID router.ServiceID) (router.ServerID, error) {
+	record, err := txn.service(serviceID)
+	if err != nil {
+		return "", err
+	}
+
+	serverID := record.Get(serverKey)
+	if len(serverID) == 0 {
+		return "", router.NewServiceTableError(router.ServerNotFoundError, serviceID, "No catch-all server defined for service.")
+	}
+	return router.ServerID(serverID), nil
+}
+
+func (txn *txn) SetServiceServer(serviceID router.ServiceID, serverID router.ServerID) error {
+	record, err := txn.createService(serviceID)
+	if err != nil {
+		return err
+	}
+
+	return storageError(record.Put(serverKey, []byte(serverID)))
+}
+
+func (txn *txn) GetServiceRegistrar(serviceID router.ServiceID) (router.ServerID, error) {
+	record, err := txn.service(serviceID)
+	if err != nil {
+		return "", err
+	}
+
+	serverID := record.Get(registrarKey)
+	if len(serverID) == 0 {
+		return "", router.NewServiceTableError(router.ServerNotFoundError, serviceID, "No registrar defined for service.")
+	}
+	return router.ServerID(serverID), nil
+}
+
+func (txn *txn) SetServiceRegistrar(serviceID router.ServiceID, serverID router.ServerID) error {
+	record, err := txn.createService(serviceID)
+	if err != nil {
+		return err
+	}
+
+	return storageError(record.Put(registrarKey, []byte(serverID)))
+}
+
+func (txn *txn) GetServiceRandomServer(serviceID router.ServiceID) (router.ServerID, error) {
+	pool, err := txn.GetServicePool(serviceID)
+	if err != nil {
+		return "", err
+	}
+
+	if len(pool) == 0 {
+		return "", router.NewServiceTableError(router.ServerPoolEmptyError, serviceID, "No servers in pool.")
+	}
+	return pool[rand.Intn(len(pool))], nil
+}
+
+func (txn *txn) GetServicePool(serviceID router.ServiceID) ([]router.ServerID, error) {
+	record, err := txn.service(serviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := make([]router.ServerID, 0)
+	err = record.Bucket(poolBucket).ForEach(func(k, v []byte) error {
+		pool = append(pool, router.ServerID(k))
+		return nil
+	})
+	return pool, err
+}
+
+func (txn *txn) AddServerToServicePool(serviceID router.ServiceID, serverID router.ServerID) error {
+	record, err := txn.createService(serviceID)
+	if err != nil {
+		return err
+	}
+
+	return storageError(record.Bucket(poolBucket).Put([]byte(serverID), nil))
+}
+
+func (txn *txn) RemoveServerFromServicePool(serviceID router.ServiceID, serverID router.ServerID) error {
+	record, err := txn.createService(serviceID)
+	if err != nil {
+		return err
+	}
+
+	return storageError(record.Bucket(poolBucket).Delete([]byte(serverID)))
+}
+
+func (txn *txn) Clients() ([]router.ClientID, error) {
+	clients := make([]router.ClientID, 0)
+	err := txn.root.Bucket(clientsBucket).ForEach(func(k, v []byte) error {
+		clients = append(clients, router.ClientID(k))
+		return nil
+	})
+	return clients, err
+}
+
+func (txn *txn) Services() ([]router.ServiceID, error) {
+	services := make([]router.ServiceID, 0)
+	err := txn.root.Bucket(servicesBucket).ForEach(func(k, v []byte) error {
+		services = append(services, router.ServiceID(k))
+		return nil
+	})
+	return services, err
+}
+
+func (txn *txn) GetClientServices(clientID router.ClientID) (map[router.ServiceID]router.ServerID, error) {
+	record, err := txn.client(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	mappings := make(map[router.ServiceID]router.ServerID)
+	err = record.Bucket(mappingsBucket).ForEach(func(k, v []byte) error {
+		mappings[router.ServiceID(k)] = router.ServerID(v)
+		return nil
+	})
+	return mappings, err
+}
+
+// Lookup client information in the table.
+func (txn *txn) client(clientID router.ClientID) (*bbolt.Bucket, error) {
+	record := txn.root.Bucket(clientsBucket).Bucket([]byte(clientID))
+	if record == nil {
+		return nil, router.NewClientTableError(router.UnknownClient, clientID, "", "No client routing info found.")
+	}
+	return record, nil
+}
+
+// Insert a new client record in the table.
+func (txn *txn) createClient(clientID router.ClientID) (*bbolt.Bucket, error) {
+	record, err := txn.root.Bucket(clientsBucket).CreateBucketIfNotExists([]byte(clientID))
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	_, err = record.CreateBucketIfNotExists(mappingsBucket)
+	return record, storageError(err)
+}
+
+// Lookup service information in the table.
+func (txn *txn) service(serviceID router.ServiceID) (*bbolt.Bucket, error) {
+	record := txn.root.Bucket(servicesBucket).Bucket([]byte(serviceID))
+	if record == nil {
+		return nil, router.NewServiceTableError(router.UnknownService, serviceID, "No service routing info found.")
+	}
+	return record, nil
+}
+
+// Insert a new service record in the table.
+func (txn *txn) createService(serviceID router.ServiceID) (*bbolt.Bucket, error) {
+	record, err := txn.root.Bucket(servicesBucket).CreateBucketIfNotExists([]byte(serviceID))
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	_, err = record.CreateBucketIfNotExists(poolBucket)
+	return record, storageError(err)
+}
+
+// Open a table from a URL such as "bolt:///var/lib/mflow.db?bucket=mflow".
+func openURL(u *url.URL) (router.RoutingTable, error) {
+	options := new(Options)
+	for key, values := range u.Query() {
+		value := values[len(values)-1]
+		switch key {
+		case "bucket":
+			options.Bucket = value
+		case "timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("bolt: timeout: %v", err)
+			}
+			options.Timeout = timeout
+		default:
+			return nil, fmt.Errorf("bolt: unknown option %q", key)
+		}
+	}
+
+	path := u.Host + u.Path
+	if path == "" {
+		return nil, fmt.Errorf("bolt: missing database path in %q", u)
+	}
+	return Open(path, options)
+}
+
+func init() {
+	routingtable.Register("bolt", openURL)
+}
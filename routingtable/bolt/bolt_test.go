@@ -0,0 +1,84 @@
+package bolt
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routingtable"
+)
+
+func newTestTable(t *testing.T) *Table {
+	table, err := Open(filepath.Join(t.TempDir(), "mflow.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { table.Close() })
+	return table
+}
+
+func TestBoltGetClientMessageServer(t *testing.T) {
+	router.TestGetClientMessageServer(t, newTestTable(t))
+}
+
+func TestBoltGetClientServiceServer(t *testing.T) {
+	router.TestGetClientServiceServer(t, newTestTable(t))
+}
+
+func TestBoltRemoveClientServiceServer(t *testing.T) {
+	router.TestRemoveClientServiceServer(t, newTestTable(t))
+}
+
+func TestBoltGetServiceServer(t *testing.T) {
+	router.TestGetServiceServer(t, newTestTable(t))
+}
+
+func TestBoltGetServiceRegistrar(t *testing.T) {
+	router.TestGetServiceRegistrar(t, newTestTable(t))
+}
+
+func TestBoltGetServiceRandomServer(t *testing.T) {
+	router.TestGetServiceRandomServer(t, newTestTable(t))
+}
+
+func TestBoltGetServicePool(t *testing.T) {
+	router.TestGetServicePool(t, newTestTable(t))
+}
+
+func TestBoltScan(t *testing.T) {
+	router.TestScan(t, newTestTable(t))
+}
+
+func TestBoltOpenURL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mflow.db")
+
+	table, err := routingtable.Open("bolt://" + path + "?bucket=test&timeout=1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.AddServerToServicePool("service.1", "pool.1")
+	table.(*Table).Close()
+
+	// Routes survive reopening the file, and are kept per bucket.
+	table, err = routingtable.Open("bolt://" + path + "?bucket=test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server, err := table.GetServiceRandomServer("service.1"); server != "pool.1" || err != nil {
+		t.Errorf("routes not persisted: %q, %v", server, err)
+	}
+	table.(*Table).Close()
+
+	table, err = routingtable.Open("bolt://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.GetServiceRandomServer("service.1"); err == nil {
+		t.Error("default bucket shares routes with the test bucket")
+	}
+	table.(*Table).Close()
+
+	if _, err := routingtable.Open("bolt://" + path + "?frobnicate=1"); err == nil {
+		t.Error("expected an error for an unknown option")
+	}
+}
@@ -0,0 +1,340 @@
+package routingtable
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+// CacheOptions bound a CachingRoutingTable.  Zero fields take their defaults.
+type CacheOptions struct {
+	// Most client and service records kept.  Default to 10000 and 1000.
+	Clients  int
+	Services int
+
+	// How long a record is kept after it is first read.  Defaults to one
+	// minute.
+	TTL time.Duration
+
+	// How long an UnknownClient or UnknownService answer is kept.
+	// Defaults to five seconds.
+	NegativeTTL time.Duration
+}
+
+const (
+	defaultCacheClients     = 10000
+	defaultCacheServices    = 1000
+	defaultCacheTTL         = time.Minute
+	defaultCacheNegativeTTL = 5 * time.Second
+)
+
+// `CachingRoutingTable` answers lookups from bounded, least recently used
+// caches of client and service records, in front of a slower table such as
+// a remote one.  Answers that a server or mapping is missing are cached with
+// the record; unknown clients and services are cached for NegativeTTL.
+//
+// A record is dropped when it is changed through the cache and, if the
+// wrapped table implements router.Watcher, when it is changed by anyone
+// else.  Otherwise changes made elsewhere are seen once the record expires.
+// Scanner and Updater calls are passed to the wrapped table; changes made
+// in an Update are dropped from the cache once it returns.
+type CachingRoutingTable struct {
+	*router.InterceptedTable
+
+	table   router.RoutingTable
+	options CacheOptions
+	cancel  func()
+
+	lock     sync.Mutex
+	clients  *lru
+	services *lru
+
+	// Counts invalidations, so lookups racing one are not cached.
+	generation uint64
+}
+
+// A client or service record: the answers read for it so far.
+type cachedRecord struct {
+	expires time.Time
+
+	// UnknownClient or UnknownService, when the record does not exist.
+	missing error
+
+	// Answers keyed by method and, for client records, service.
+	lookups map[string]cachedLookup
+}
+
+type cachedLookup struct {
+	result interface{}
+	err    error
+}
+
+var errNotScanner = errors.New("routingtable: wrapped table cannot list its contents")
+
+// Cache the records of table.  options may be nil to use the defaults.
+// Close stops watching table for changes.
+func NewCachingRoutingTable(table router.RoutingTable, options *CacheOptions) *CachingRoutingTable {
+	t := new(CachingRoutingTable)
+	t.table = table
+	if options != nil {
+		t.options = *options
+	}
+	if t.options.Clients <= 0 {
+		t.options.Clients = defaultCacheClients
+	}
+	if t.options.Services <= 0 {
+		t.options.Services = defaultCacheServices
+	}
+	if t.options.TTL <= 0 {
+		t.options.TTL = defaultCacheTTL
+	}
+	if t.options.NegativeTTL <= 0 {
+		t.options.NegativeTTL = defaultCacheNegativeTTL
+	}
+	t.clients = newLRU(t.options.Clients)
+	t.services = newLRU(t.options.Services)
+	t.InterceptedTable = router.Intercept(table, t.intercept)
+
+	if watcher, ok := table.(router.Watcher); ok {
+		t.cancel = watcher.Watch(t.invalidateChange)
+	}
+	return t
+}
+
+// Stop watching the wrapped table for changes.  The wrapped table is not
+// closed.
+func (t *CachingRoutingTable) Close() error {
+	if t.cancel != nil {
+		t.cancel()
+	}
+	return nil
+}
+
+// Drop every cached record.
+func (t *CachingRoutingTable) Flush() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.generation++
+	t.clients.clear()
+	t.services.clear()
+}
+
+func (t *CachingRoutingTable) intercept(ctx context.Context, call *router.Call, next router.Invoker) (interface{}, error) {
+	if call.Mutates() {
+		result, err := next(ctx, call)
+		t.invalidate(call.ClientID, call.ServiceID)
+		return result, err
+	}
+
+	if call.Op == "GetServiceRandomServer" {
+		return t.randomServer(ctx, call, next)
+	}
+
+	result, err := t.lookup(ctx, call, next)
+	if pool, ok := result.([]router.ServerID); ok {
+		result = append([]router.ServerID(nil), pool...)
+	}
+	return result, err
+}
+
+// Pick a server from the service's cached pool.
+func (t *CachingRoutingTable) randomServer(ctx context.Context, call *router.Call, next router.Invoker) (interface{}, error) {
+	poolCall := &router.Call{Op: "GetServicePool", ServiceID: call.ServiceID}
+	result, err := t.lookup(ctx, poolCall, next)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, _ := result.([]router.ServerID)
+	if len(pool) == 0 {
+		return nil, router.NewServiceTableError(router.ServerPoolEmptyError, call.ServiceID, "No servers in pool.")
+	}
+	return pool[rand.Intn(len(pool))], nil
+}
+
+// Answer call from its record, reading and caching the answer on a miss.
+func (t *CachingRoutingTable) lookup(ctx context.Context, call *router.Call, next router.Invoker) (interface{}, error) {
+	cache, key, unknown := t.records(call)
+	lookupKey := call.Op + "/" + string(call.ServiceID)
+
+	t.lock.Lock()
+	generation := t.generation
+	if record, ok := cache.get(key).(*cachedRecord); ok && time.Now().Before(record.expires) {
+		if record.missing != nil {
+			t.lock.Unlock()
+			return nil, record.missing
+		}
+		if lookup, ok := record.lookups[lookupKey]; ok {
+			t.lock.Unlock()
+			return lookup.result, lookup.err
+		}
+	}
+	t.lock.Unlock()
+
+	result, err := next(ctx, call)
+
+	code, isTableErr := router.ErrorCode(err)
+	cacheable := err == nil || code == router.MappingNotFoundError || code == router.ServerNotFoundError
+	if !cacheable && (!isTableErr || code != unknown) {
+		return result, err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.generation != generation {
+		return result, err
+	}
+
+	now := time.Now()
+	if !cacheable {
+		cache.add(key, &cachedRecord{expires: now.Add(t.options.NegativeTTL), missing: err})
+		return result, err
+	}
+
+	record, ok := cache.get(key).(*cachedRecord)
+	if !ok || record.missing != nil || !now.Before(record.expires) {
+		record = &cachedRecord{expires: now.Add(t.options.TTL), lookups: make(map[string]cachedLookup)}
+		cache.add(key, record)
+	}
+	record.lookups[lookupKey] = cachedLookup{result, err}
+	return result, err
+}
+
+// The cache and key of the record holding call's answer, and the code
+// reported when that record does not exist.
+func (t *CachingRoutingTable) records(call *router.Call) (*lru, interface{}, router.RoutingTableErrorCode) {
+	if call.ClientID != "" {
+		return t.clients, call.ClientID, router.UnknownClient
+	}
+	return t.services, call.ServiceID, router.UnknownService
+}
+
+// Drop the client's record, or the service's when clientID is empty.
+func (t *CachingRoutingTable) invalidate(clientID router.ClientID, serviceID router.ServiceID) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.generation++
+	if clientID != "" {
+		t.clients.remove(clientID)
+	} else {
+		t.services.remove(serviceID)
+	}
+}
+
+func (t *CachingRoutingTable) invalidateChange(change router.Change) {
+	t.invalidate(change.ClientID, change.ServiceID)
+}
+
+// Make the changes fn makes in one update of the wrapped table, if it is an
+// Updater, then drop the records they touched.
+func (t *CachingRoutingTable) Update(fn func(router.RoutingTable) error) error {
+	updater, ok := t.table.(router.Updater)
+	if !ok {
+		return fn(t)
+	}
+
+	var changed []router.Call
+	record := func(ctx context.Context, call *router.Call, next router.Invoker) (interface{}, error) {
+		if call.Mutates() {
+			changed = append(changed, *call)
+		}
+		return next(ctx, call)
+	}
+
+	err := updater.Update(func(txn router.RoutingTable) error {
+		return fn(router.Intercept(txn, record))
+	})
+	for _, call := range changed {
+		t.invalidate(call.ClientID, call.ServiceID)
+	}
+	return err
+}
+
+func (t *CachingRoutingTable) Clients() ([]router.ClientID, error) {
+	scanner, ok := t.table.(router.Scanner)
+	if !ok {
+		return nil, errNotScanner
+	}
+	return scanner.Clients()
+}
+
+func (t *CachingRoutingTable) Services() ([]router.ServiceID, error) {
+	scanner, ok := t.table.(router.Scanner)
+	if !ok {
+		return nil, errNotScanner
+	}
+	return scanner.Services()
+}
+
+func (t *CachingRoutingTable) GetClientServices(clientID router.ClientID) (map[router.ServiceID]router.ServerID, error) {
+	scanner, ok := t.table.(router.Scanner)
+	if !ok {
+		return nil, errNotScanner
+	}
+	return scanner.GetClientServices(clientID)
+}
+
+// A cache holding at most size entries, dropping the least recently used.
+type lru struct {
+	size    int
+	order   *list.List
+	entries map[interface{}]*list.Element
+}
+
+type lruEntry struct {
+	key   interface{}
+	value interface{}
+}
+
+func newLRU(size int) *lru {
+	cache := new(lru)
+	cache.size = size
+	cache.order = list.New()
+	cache.entries = make(map[interface{}]*list.Element)
+	return cache
+}
+
+// The value stored for key, or nil.
+func (cache *lru) get(key interface{}) interface{} {
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil
+	}
+	cache.order.MoveToFront(element)
+	return element.Value.(*lruEntry).value
+}
+
+func (cache *lru) add(key, value interface{}) {
+	if element, ok := cache.entries[key]; ok {
+		element.Value.(*lruEntry).value = value
+		cache.order.MoveToFront(element)
+		return
+	}
+
+	cache.entries[key] = cache.order.PushFront(&lruEntry{key, value})
+	if cache.order.Len() > cache.size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (cache *lru) clear() {
+	cache.order.Init()
+	clear(cache.entries)
+}
+
+func (cache *lru) remove(key interface{}) {
+	if element, ok := cache.entries[key]; ok {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+	}
+}
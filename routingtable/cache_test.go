@@ -0,0 +1,151 @@
+package routingtable
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+// A memory table counting the calls made to it, without its Watcher.
+func countingTable() (*MemoryRoutingTable, router.RoutingTable, map[string]int) {
+	memory := NewMemoryRoutingTable()
+	calls := make(map[string]int)
+	table := router.Intercept(memory, func(ctx context.Context, call *router.Call, next router.Invoker) (interface{}, error) {
+		calls[call.Op]++
+		return next(ctx, call)
+	})
+	return memory, table, calls
+}
+
+func TestCachingGetClientMessageServer(t *testing.T) {
+	router.TestGetClientMessageServer(t, NewCachingRoutingTable(NewMemoryRoutingTable(), nil))
+}
+
+func TestCachingGetClientServiceServer(t *testing.T) {
+	router.TestGetClientServiceServer(t, NewCachingRoutingTable(NewMemoryRoutingTable(), nil))
+}
+
+func TestCachingRemoveClientServiceServer(t *testing.T) {
+	router.TestRemoveClientServiceServer(t, NewCachingRoutingTable(NewMemoryRoutingTable(), nil))
+}
+
+func TestCachingGetServiceServer(t *testing.T) {
+	router.TestGetServiceServer(t, NewCachingRoutingTable(NewMemoryRoutingTable(), nil))
+}
+
+func TestCachingGetServiceRegistrar(t *testing.T) {
+	router.TestGetServiceRegistrar(t, NewCachingRoutingTable(NewMemoryRoutingTable(), nil))
+}
+
+func TestCachingGetServiceRandomServer(t *testing.T) {
+	router.TestGetServiceRandomServer(t, NewCachingRoutingTable(NewMemoryRoutingTable(), nil))
+}
+
+func TestCachingGetServicePool(t *testing.T) {
+	router.TestGetServicePool(t, NewCachingRoutingTable(NewMemoryRoutingTable(), nil))
+}
+
+func TestCachingScan(t *testing.T) {
+	router.TestScan(t, NewCachingRoutingTable(NewMemoryRoutingTable(), nil))
+}
+
+func TestCache(t *testing.T) {
+	memory, table, calls := countingTable()
+	memory.AddServerToServicePool("service.1", "pool.1")
+	cache := NewCachingRoutingTable(table, nil)
+
+	// Answers, including missing servers, are read once.
+	for i := 0; i < 3; i++ {
+		cache.GetServiceServer("service.1")
+		cache.GetServiceRandomServer("service.1")
+		cache.GetServicePool("service.1")
+	}
+	if calls["GetServiceServer"] != 1 || calls["GetServicePool"] != 1 || calls["GetServiceRandomServer"] != 0 {
+		t.Errorf("unexpected calls %v", calls)
+	}
+
+	// Unknown clients are cached until the client is changed.
+	for i := 0; i < 2; i++ {
+		if _, err := cache.GetClientServiceServer("client.1", "service.1"); !errors.Is(err, router.ErrUnknownClient) {
+			t.Errorf("expected UnknownClient, got %v", err)
+		}
+	}
+	if calls["GetClientServiceServer"] != 1 {
+		t.Errorf("unknown client read %d times", calls["GetClientServiceServer"])
+	}
+	cache.SetClientServiceServer("client.1", "service.1", "pool.1")
+	if serverID, err := cache.GetClientServiceServer("client.1", "service.1"); serverID != "pool.1" || err != nil {
+		t.Errorf("GetClientServiceServer() = %q, %v after a local write", serverID, err)
+	}
+
+	// Changes made through an update are seen once it returns.
+	cache.GetServiceServer("service.1")
+	err := cache.Update(func(txn router.RoutingTable) error {
+		return txn.SetServiceServer("service.1", "server.1")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverID, _ := cache.GetServiceServer("service.1"); serverID != "server.1" {
+		t.Errorf("GetServiceServer() = %q after an update", serverID)
+	}
+
+	// Callers may not change cached pools.
+	pool, _ := cache.GetServicePool("service.1")
+	pool[0] = "changed"
+	if pool, _ := cache.GetServicePool("service.1"); pool[0] != "pool.1" {
+		t.Errorf("cached pool changed to %v", pool)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	memory, table, calls := countingTable()
+	memory.SetServiceServer("service.1", "server.1")
+	cache := NewCachingRoutingTable(table, &CacheOptions{Services: 1, TTL: 50 * time.Millisecond, NegativeTTL: time.Millisecond})
+
+	cache.GetServiceServer("service.1")
+	memory.SetServiceServer("service.1", "server.2")
+	if serverID, _ := cache.GetServiceServer("service.1"); serverID != "server.1" {
+		t.Errorf("expected the cached server, got %q", serverID)
+	}
+	time.Sleep(70 * time.Millisecond)
+	if serverID, _ := cache.GetServiceServer("service.1"); serverID != "server.2" {
+		t.Errorf("expected the record to expire, got %q", serverID)
+	}
+
+	// With room for one service, reading another evicts it.
+	calls["GetServiceServer"] = 0
+	cache.GetServiceServer("service.2")
+	cache.GetServiceServer("service.1")
+	if calls["GetServiceServer"] != 2 {
+		t.Errorf("expected service.1 to be evicted, read %d times", calls["GetServiceServer"])
+	}
+
+	// Unknown services expire after NegativeTTL.
+	time.Sleep(5 * time.Millisecond)
+	cache.GetServiceServer("service.2")
+	if calls["GetServiceServer"] != 3 {
+		t.Errorf("expected unknown service to expire, read %d times", calls["GetServiceServer"])
+	}
+}
+
+func TestCacheWatch(t *testing.T) {
+	memory := NewMemoryRoutingTable()
+	memory.SetClientServiceServer("client.1", "service.1", "server.1")
+	cache := NewCachingRoutingTable(memory, nil)
+
+	cache.GetClientServiceServer("client.1", "service.1")
+	memory.SetClientServiceServer("client.1", "service.1", "server.2")
+	if serverID, _ := cache.GetClientServiceServer("client.1", "service.1"); serverID != "server.2" {
+		t.Errorf("expected the change feed to drop the record, got %q", serverID)
+	}
+
+	cache.Close()
+	memory.SetClientServiceServer("client.1", "service.1", "server.3")
+	if serverID, _ := cache.GetClientServiceServer("client.1", "service.1"); serverID != "server.2" {
+		t.Errorf("expected the record to be kept after Close, got %q", serverID)
+	}
+}
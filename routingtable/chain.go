@@ -0,0 +1,147 @@
+package routingtable
+
+import (
+	"context"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+// `ChainRoutingTable` layers routing tables, such as a memory table of
+// emergency pins in front of a table of static overrides in front of the
+// shared cluster table.  Lookups are made on each layer in order until one
+// answers; a layer is only skipped when it reports the client, service,
+// mapping or server is not found.  Every other error, including an empty
+// pool, is returned as is.  Changes are made on the write table only.
+//
+// Scanner calls list the contents of every layer, with earlier layers'
+// mappings winning, and fail unless every layer is a Scanner.  Updates are
+// passed to the write table.
+type ChainRoutingTable struct {
+	*router.InterceptedTable
+
+	writes router.RoutingTable
+	layers []router.RoutingTable
+}
+
+// Look up in layers in order, and make changes on writes, which is usually
+// one of them.
+func NewChainRoutingTable(writes router.RoutingTable, layers ...router.RoutingTable) *ChainRoutingTable {
+	t := new(ChainRoutingTable)
+	t.writes = writes
+	t.layers = layers
+	t.InterceptedTable = router.Intercept(writes, t.intercept)
+	return t
+}
+
+func (t *ChainRoutingTable) intercept(ctx context.Context, call *router.Call, next router.Invoker) (interface{}, error) {
+	if call.Mutates() {
+		return next(ctx, call)
+	}
+
+	var result interface{}
+	err := error(router.NewServiceTableError(router.UnknownService, call.ServiceID, "No routing table layers."))
+	for _, layer := range t.layers {
+		result, err = router.Invoke(ctx, layer, call)
+		if !notFound(err) {
+			break
+		}
+	}
+	return result, err
+}
+
+// Report whether err means the layer has no answer.
+func notFound(err error) bool {
+	code, _ := router.ErrorCode(err)
+	switch code {
+	case router.UnknownClient, router.UnknownService, router.MappingNotFoundError, router.ServerNotFoundError:
+		return err != nil
+	}
+	return false
+}
+
+// Pass the update to the write table, if it is an Updater.
+func (t *ChainRoutingTable) Update(fn func(router.RoutingTable) error) error {
+	updater, ok := t.writes.(router.Updater)
+	if !ok {
+		return fn(t)
+	}
+	return updater.Update(fn)
+}
+
+func (t *ChainRoutingTable) Clients() ([]router.ClientID, error) {
+	seen := make(map[router.ClientID]bool)
+	var clients []router.ClientID
+	for _, layer := range t.layers {
+		scanner, ok := layer.(router.Scanner)
+		if !ok {
+			return nil, errNotScanner
+		}
+		layerClients, err := scanner.Clients()
+		if err != nil {
+			return nil, err
+		}
+		for _, clientID := range layerClients {
+			if !seen[clientID] {
+				seen[clientID] = true
+				clients = append(clients, clientID)
+			}
+		}
+	}
+	return clients, nil
+}
+
+func (t *ChainRoutingTable) Services() ([]router.ServiceID, error) {
+	seen := make(map[router.ServiceID]bool)
+	var services []router.ServiceID
+	for _, layer := range t.layers {
+		scanner, ok := layer.(router.Scanner)
+		if !ok {
+			return nil, errNotScanner
+		}
+		layerServices, err := scanner.Services()
+		if err != nil {
+			return nil, err
+		}
+		for _, serviceID := range layerServices {
+			if !seen[serviceID] {
+				seen[serviceID] = true
+				services = append(services, serviceID)
+			}
+		}
+	}
+	return services, nil
+}
+
+func (t *ChainRoutingTable) GetClientServices(clientID router.ClientID) (map[router.ServiceID]router.ServerID, error) {
+	var services map[router.ServiceID]router.ServerID
+	var lastErr error
+	for _, layer := range t.layers {
+		scanner, ok := layer.(router.Scanner)
+		if !ok {
+			return nil, errNotScanner
+		}
+		layerServices, err := scanner.GetClientServices(clientID)
+		if notFound(err) {
+			lastErr = err
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if services == nil {
+			services = make(map[router.ServiceID]router.ServerID)
+		}
+		for serviceID, serverID := range layerServices {
+			if _, ok := services[serviceID]; !ok {
+				services[serviceID] = serverID
+			}
+		}
+	}
+	if services == nil {
+		if lastErr == nil {
+			lastErr = router.NewClientTableError(router.UnknownClient, clientID, "", "No client routing info found.")
+		}
+		return nil, lastErr
+	}
+	return services, nil
+}
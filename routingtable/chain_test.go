@@ -0,0 +1,103 @@
+package routingtable
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+// A chain of one memory table.
+func singleChain() *ChainRoutingTable {
+	memory := NewMemoryRoutingTable()
+	return NewChainRoutingTable(memory, memory)
+}
+
+func TestChainGetClientMessageServer(t *testing.T) {
+	router.TestGetClientMessageServer(t, singleChain())
+}
+
+func TestChainGetClientServiceServer(t *testing.T) {
+	router.TestGetClientServiceServer(t, singleChain())
+}
+
+func TestChainRemoveClientServiceServer(t *testing.T) {
+	router.TestRemoveClientServiceServer(t, singleChain())
+}
+
+func TestChainGetServiceServer(t *testing.T) {
+	router.TestGetServiceServer(t, singleChain())
+}
+
+func TestChainGetServiceRegistrar(t *testing.T) {
+	router.TestGetServiceRegistrar(t, singleChain())
+}
+
+func TestChainGetServiceRandomServer(t *testing.T) {
+	router.TestGetServiceRandomServer(t, singleChain())
+}
+
+func TestChainGetServicePool(t *testing.T) {
+	router.TestGetServicePool(t, singleChain())
+}
+
+func TestChainScan(t *testing.T) {
+	router.TestScan(t, singleChain())
+}
+
+func TestChain(t *testing.T) {
+	pins := NewMemoryRoutingTable()
+	overrides := NewMemoryRoutingTable()
+	cluster := NewMemoryRoutingTable()
+	chain := NewChainRoutingTable(cluster, pins, overrides, cluster)
+
+	cluster.SetClientServiceServer("client.1", "service.1", "server.1")
+	cluster.SetClientServiceServer("client.1", "service.2", "server.1")
+	cluster.SetServiceServer("service.1", "server.1")
+	cluster.AddServerToServicePool("service.2", "pool.1")
+	overrides.SetServiceServer("service.1", "override.1")
+	pins.SetClientServiceServer("client.1", "service.1", "pin.1")
+
+	tests := []struct {
+		Name     string
+		Get      func() (router.ServerID, error)
+		ServerID router.ServerID
+	}{
+		{"pinned client", func() (router.ServerID, error) { return chain.GetClientServiceServer("client.1", "service.1") }, "pin.1"},
+		{"unpinned service", func() (router.ServerID, error) { return chain.GetClientServiceServer("client.1", "service.2") }, "server.1"},
+		{"overridden service", func() (router.ServerID, error) { return chain.GetServiceServer("service.1") }, "override.1"},
+		{"cluster pool", func() (router.ServerID, error) { return chain.GetServiceRandomServer("service.2") }, "pool.1"},
+	}
+	for _, test := range tests {
+		if serverID, err := test.Get(); serverID != test.ServerID || err != nil {
+			t.Errorf("%s: got %q, %v, expected %q", test.Name, serverID, err, test.ServerID)
+		}
+	}
+
+	// Not found in any layer.
+	if _, err := chain.GetServiceServer("service.3"); !errors.Is(err, router.ErrUnknownService) {
+		t.Errorf("expected UnknownService, got %v", err)
+	}
+
+	// Other errors stop the lookup.
+	overrides.AddServerToServicePool("service.2", "override.1")
+	overrides.RemoveServerFromServicePool("service.2", "override.1")
+	if _, err := chain.GetServiceRandomServer("service.2"); !errors.Is(err, router.ErrServerPoolEmpty) {
+		t.Errorf("expected ServerPoolEmpty from the overrides, got %v", err)
+	}
+
+	// Changes are made on the write table only.
+	chain.SetClientServiceServer("client.2", "service.1", "server.2")
+	if _, err := pins.GetClientServiceServer("client.2", "service.1"); !errors.Is(err, router.ErrUnknownClient) {
+		t.Errorf("expected the write not to reach the pins, got %v", err)
+	}
+	if serverID, _ := cluster.GetClientServiceServer("client.2", "service.1"); serverID != "server.2" {
+		t.Errorf("expected the write to reach the cluster, got %q", serverID)
+	}
+
+	// Scans merge the layers, earlier layers winning.
+	services, err := chain.GetClientServices("client.1")
+	if err != nil || services["service.1"] != "pin.1" || services["service.2"] != "server.1" {
+		t.Errorf("GetClientServices() = %v, %v", services, err)
+	}
+}
@@ -1,191 +1,468 @@
 package routingtable
 
 import (
-	"github.com/robertkluin/message-flow/router"
+	"context"
+	"log/slog"
 	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/robertkluin/message-flow/router"
 )
 
 // `MemoryRoutingTable` implements all core client, server, and service
 // registration interfaces in memory.  It is suitable for use in a single node
-// message-flow system that does not require persistence.
+// message-flow system that does not require persistence.  It is safe for
+// concurrent use.
 
 type MemoryRoutingTable struct {
+	lock         sync.RWMutex
 	clientTable  clientTable
 	serviceTable serviceTable
+
+	watchLock sync.Mutex
+	watchers  map[int]func(router.Change)
+	nextWatch int
+	logger    *slog.Logger
 }
 
 func NewMemoryRoutingTable() *MemoryRoutingTable {
 	table := new(MemoryRoutingTable)
 	table.clientTable = make(clientTable)
 	table.serviceTable = make(serviceTable)
+	table.watchers = make(map[int]func(router.Change))
+	table.logger = router.LoggerOrDiscard(nil)
 	return table
 }
 
+// Log each change made to the table at debug level, and updates that were
+// rolled back.  A nil logger discards them.
+func (table *MemoryRoutingTable) SetLogger(logger *slog.Logger) {
+	table.watchLock.Lock()
+	defer table.watchLock.Unlock()
+
+	table.logger = router.LoggerOrDiscard(logger)
+}
+
 // Which message server handles communication for client.
 func (table *MemoryRoutingTable) GetClientMessageServer(clientID router.ClientID) (router.ServerID, error) {
-	record, err := table.getClientRecord(clientID)
-	if err != nil {
-		return "", err
-	}
-
-	server, err := record.getMessageServer()
-	if err != nil {
-		return "", err
-	}
+	table.lock.RLock()
+	defer table.lock.RUnlock()
 
-	return server, nil
+	return table.view().GetClientMessageServer(clientID)
 }
 
 // Set the message server that handles communication for the client.
 func (table *MemoryRoutingTable) SetClientMessageServer(clientID router.ClientID, messageServer router.ServerID) error {
-	record, err := table.getOrCreateClientRecord(clientID)
-	if err != nil {
+	return table.change(func(txn router.RoutingTable) error {
+		return txn.SetClientMessageServer(clientID, messageServer)
+	})
+}
+
+// Which server for service should messages from client be routed to.
+func (table *MemoryRoutingTable) GetClientServiceServer(clientID router.ClientID, serviceID router.ServiceID) (router.ServerID, error) {
+	table.lock.RLock()
+	defer table.lock.RUnlock()
+
+	return table.view().GetClientServiceServer(clientID, serviceID)
+}
+
+// Set server for service responsible for handling messages from client.
+func (table *MemoryRoutingTable) SetClientServiceServer(clientID router.ClientID, serviceID router.ServiceID, serverID router.ServerID) error {
+	return table.change(func(txn router.RoutingTable) error {
+		return txn.SetClientServiceServer(clientID, serviceID, serverID)
+	})
+}
+
+// Remove the client's server for service, if one is set.
+func (table *MemoryRoutingTable) RemoveClientServiceServer(clientID router.ClientID, serviceID router.ServiceID) error {
+	return table.change(func(txn router.RoutingTable) error {
+		return txn.RemoveClientServiceServer(clientID, serviceID)
+	})
+}
+
+// Get the catch-all server, if defined, for the service.
+func (table *MemoryRoutingTable) GetServiceServer(serviceID router.ServiceID) (router.ServerID, error) {
+	table.lock.RLock()
+	defer table.lock.RUnlock()
+
+	return table.view().GetServiceServer(serviceID)
+}
+
+//  Set a catch-all server for the service.
+func (table *MemoryRoutingTable) SetServiceServer(serviceID router.ServiceID, serverID router.ServerID) error {
+	return table.change(func(txn router.RoutingTable) error {
+		return txn.SetServiceServer(serviceID, serverID)
+	})
+}
+
+// Get the registrar, if defined, for the service.
+func (table *MemoryRoutingTable) GetServiceRegistrar(serviceID router.ServiceID) (router.ServerID, error) {
+	table.lock.RLock()
+	defer table.lock.RUnlock()
+
+	return table.view().GetServiceRegistrar(serviceID)
+}
+
+// Set the registrar for the service.
+func (table *MemoryRoutingTable) SetServiceRegistrar(serviceID router.ServiceID, serverID router.ServerID) error {
+	return table.change(func(txn router.RoutingTable) error {
+		return txn.SetServiceRegistrar(serviceID, serverID)
+	})
+}
+
+// Get a server from the pool of the service's registered servers
+func (table *MemoryRoutingTable) GetServiceRandomServer(serviceID router.ServiceID) (router.ServerID, error) {
+	table.lock.RLock()
+	defer table.lock.RUnlock()
+
+	return table.view().GetServiceRandomServer(serviceID)
+}
+
+// Get all servers in the service's pool.
+func (table *MemoryRoutingTable) GetServicePool(serviceID router.ServiceID) ([]router.ServerID, error) {
+	table.lock.RLock()
+	defer table.lock.RUnlock()
+
+	return table.view().GetServicePool(serviceID)
+}
+
+// Add a server to the service's server pool.
+func (table *MemoryRoutingTable) AddServerToServicePool(serviceID router.ServiceID, serverID router.ServerID) error {
+	return table.change(func(txn router.RoutingTable) error {
+		return txn.AddServerToServicePool(serviceID, serverID)
+	})
+}
+
+// Remove a server from the service's pool of servers.
+func (table *MemoryRoutingTable) RemoveServerFromServicePool(serviceID router.ServiceID, serverID router.ServerID) error {
+	return table.change(func(txn router.RoutingTable) error {
+		return txn.RemoveServerFromServicePool(serviceID, serverID)
+	})
+}
+
+// List every client with routing information.
+func (table *MemoryRoutingTable) Clients() ([]router.ClientID, error) {
+	table.lock.RLock()
+	defer table.lock.RUnlock()
+
+	return table.view().Clients()
+}
+
+// List every service with routing information.
+func (table *MemoryRoutingTable) Services() ([]router.ServiceID, error) {
+	table.lock.RLock()
+	defer table.lock.RUnlock()
+
+	return table.view().Services()
+}
+
+// Get all of the client's service servers, keyed by service.
+func (table *MemoryRoutingTable) GetClientServices(clientID router.ClientID) (map[router.ServiceID]router.ServerID, error) {
+	table.lock.RLock()
+	defer table.lock.RUnlock()
+
+	return table.view().GetClientServices(clientID)
+}
+
+// Call fn with a view of the table, holding the table's lock throughout.
+// Other callers see all of the changes fn makes once it returns nil; if it
+// returns an error they are undone.  Watchers are told of the changes after
+// the lock is released.
+func (table *MemoryRoutingTable) Update(fn func(router.RoutingTable) error) error {
+	return table.update(fn, true)
+}
+
+// Make a single change.  The record setters cannot fail part way, so unlike
+// Update the records changed are not copied to undo them.
+func (table *MemoryRoutingTable) change(fn func(router.RoutingTable) error) error {
+	return table.update(fn, false)
+}
+
+func (table *MemoryRoutingTable) update(fn func(router.RoutingTable) error, undoable bool) error {
+	txn := table.view()
+	txn.undoable = undoable
+
+	err := func() error {
+		table.lock.Lock()
+		defer table.lock.Unlock()
+
+		err := fn(txn)
+		if err != nil {
+			txn.rollback()
+		}
 		return err
-	}
+	}()
+
+	table.watchLock.Lock()
+	logger := table.logger
+	table.watchLock.Unlock()
 
-	err = record.setMessageServer(messageServer)
 	if err != nil {
+		if len(txn.changes) > 0 {
+			logger.LogAttrs(context.Background(), slog.LevelDebug, "table update rolled back", router.ErrorAttrs(err)...)
+		}
 		return err
 	}
 
+	for _, change := range txn.changes {
+		logger.LogAttrs(context.Background(), slog.LevelDebug, "table changed", change.LogAttrs()...)
+		table.notify(change)
+	}
 	return nil
 }
 
-// Which server for service should messages from client be routed to.
-func (table *MemoryRoutingTable) GetClientServiceServer(clientID router.ClientID, serviceID router.ServiceID) (router.ServerID, error) {
-	record, err := table.getClientRecord(clientID)
+func (table *MemoryRoutingTable) view() *memoryTxn {
+	return &memoryTxn{table: table}
+}
 
-	if err != nil {
-		return "", err
+// Call fn with each change made to the table until cancel is called.
+func (table *MemoryRoutingTable) Watch(fn func(router.Change)) (cancel func()) {
+	table.watchLock.Lock()
+	defer table.watchLock.Unlock()
+
+	id := table.nextWatch
+	table.nextWatch++
+	table.watchers[id] = fn
+
+	return func() {
+		table.watchLock.Lock()
+		defer table.watchLock.Unlock()
+		delete(table.watchers, id)
 	}
+}
 
-	serverID, err := record.getServiceServer(serviceID)
+// Report a change to all watchers.  Update calls this after releasing the
+// table lock, so watchers may use the table.
+func (table *MemoryRoutingTable) notify(change router.Change) {
+	table.watchLock.Lock()
+	watchers := make([]func(router.Change), 0, len(table.watchers))
+	for _, fn := range table.watchers {
+		watchers = append(watchers, fn)
+	}
+	table.watchLock.Unlock()
 
-	if err != nil {
-		return "", err
+	for _, fn := range watchers {
+		fn(change)
 	}
+}
 
-	return serverID, nil
+// A memoryTxn reads and changes a MemoryRoutingTable whose lock is already
+// held, remembering the changes it makes and, when undoable, how to undo
+// them.
+type memoryTxn struct {
+	table    *MemoryRoutingTable
+	changes  []router.Change
+	undo     []func()
+	undoable bool
 }
 
-// Set server for service responsible for handling messages from client.
-func (table *MemoryRoutingTable) SetClientServiceServer(clientID router.ClientID, serviceID router.ServiceID, serverID router.ServerID) error {
-	record, err := table.getOrCreateClientRecord(clientID)
+func (txn *memoryTxn) GetClientMessageServer(clientID router.ClientID) (router.ServerID, error) {
+	record, err := txn.table.getClientRecord(clientID)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	err = record.setServiceServer(serviceID, serverID)
+	return record.getMessageServer(clientID)
+}
+
+func (txn *memoryTxn) SetClientMessageServer(clientID router.ClientID, messageServer router.ServerID) error {
+	txn.saveClient(clientID, router.Change{Op: "SetClientMessageServer", ClientID: clientID, ServerID: messageServer})
+
+	record, err := txn.table.getOrCreateClientRecord(clientID)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return record.setMessageServer(messageServer)
 }
 
-// Get the catch-all server, if defined, for the service.
-func (table *MemoryRoutingTable) GetServiceServer(serviceID router.ServiceID) (router.ServerID, error) {
-	record, err := table.getServiceRecord(serviceID)
-	if err != nil {
-		return "", err
-	}
-
-	serverID, err := record.getServer()
+func (txn *memoryTxn) GetClientServiceServer(clientID router.ClientID, serviceID router.ServiceID) (router.ServerID, error) {
+	record, err := txn.table.getClientRecord(clientID)
 	if err != nil {
 		return "", err
 	}
 
-	return serverID, nil
+	return record.getServiceServer(clientID, serviceID)
 }
 
-//  Set a catch-all server for the service.
-func (table *MemoryRoutingTable) SetServiceServer(serviceID router.ServiceID, serverID router.ServerID) error {
-	record, err := table.getOrCreateServiceRecord(serviceID)
+func (txn *memoryTxn) SetClientServiceServer(clientID router.ClientID, serviceID router.ServiceID, serverID router.ServerID) error {
+	txn.saveClient(clientID, router.Change{Op: "SetClientServiceServer", ClientID: clientID, ServiceID: serviceID, ServerID: serverID})
+
+	record, err := txn.table.getOrCreateClientRecord(clientID)
 	if err != nil {
 		return err
 	}
 
-	err = record.setServer(serverID)
-	if err != nil {
-		return err
+	return record.setServiceServer(serviceID, serverID)
+}
+
+func (txn *memoryTxn) RemoveClientServiceServer(clientID router.ClientID, serviceID router.ServiceID) error {
+	record, ok := txn.table.clientTable[clientID]
+	if !ok {
+		return nil
 	}
 
-	return nil
+	txn.saveClient(clientID, router.Change{Op: "RemoveClientServiceServer", ClientID: clientID, ServiceID: serviceID})
+	return record.removeServiceServer(serviceID)
 }
 
-// Get the registrar, if defined, for the service.
-func (table *MemoryRoutingTable) GetServiceRegistrar(serviceID router.ServiceID) (router.ServerID, error) {
-	record, err := table.getServiceRecord(serviceID)
+func (txn *memoryTxn) GetServiceServer(serviceID router.ServiceID) (router.ServerID, error) {
+	record, err := txn.table.getServiceRecord(serviceID)
 	if err != nil {
 		return "", err
 	}
 
-	serverID, err := record.getRegistrar()
+	return record.getServer(serviceID)
+}
+
+func (txn *memoryTxn) SetServiceServer(serviceID router.ServiceID, serverID router.ServerID) error {
+	txn.saveService(serviceID, router.Change{Op: "SetServiceServer", ServiceID: serviceID, ServerID: serverID})
+
+	record, err := txn.table.getOrCreateServiceRecord(serviceID)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	return serverID, nil
+	return record.setServer(serverID)
 }
 
-// Set the registrar for the service.
-func (table *MemoryRoutingTable) SetServiceRegistrar(serviceID router.ServiceID, serverID router.ServerID) error {
-	record, err := table.getOrCreateServiceRecord(serviceID)
+func (txn *memoryTxn) GetServiceRegistrar(serviceID router.ServiceID) (router.ServerID, error) {
+	record, err := txn.table.getServiceRecord(serviceID)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	err = record.setRegistrar(serverID)
+	return record.getRegistrar(serviceID)
+}
+
+func (txn *memoryTxn) SetServiceRegistrar(serviceID router.ServiceID, serverID router.ServerID) error {
+	txn.saveService(serviceID, router.Change{Op: "SetServiceRegistrar", ServiceID: serviceID, ServerID: serverID})
+
+	record, err := txn.table.getOrCreateServiceRecord(serviceID)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return record.setRegistrar(serverID)
 }
 
-// Get a server from the pool of the service's registered servers
-func (table *MemoryRoutingTable) GetServiceRandomServer(serviceID router.ServiceID) (router.ServerID, error) {
-	record, err := table.getServiceRecord(serviceID)
+func (txn *memoryTxn) GetServiceRandomServer(serviceID router.ServiceID) (router.ServerID, error) {
+	record, err := txn.table.getServiceRecord(serviceID)
 	if err != nil {
 		return "", err
 	}
 
-	serverID, err := record.getServerFromPool()
+	return record.getServerFromPool(serviceID)
+}
+
+func (txn *memoryTxn) GetServicePool(serviceID router.ServiceID) ([]router.ServerID, error) {
+	record, err := txn.table.getServiceRecord(serviceID)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return serverID, nil
+	return record.getPool(), nil
 }
 
-// Add a server to the service's server pool.
-func (table *MemoryRoutingTable) AddServerToServicePool(serviceID router.ServiceID, serverID router.ServerID) error {
-	record, err := table.getOrCreateServiceRecord(serviceID)
+func (txn *memoryTxn) AddServerToServicePool(serviceID router.ServiceID, serverID router.ServerID) error {
+	txn.saveService(serviceID, router.Change{Op: "AddServerToServicePool", ServiceID: serviceID, ServerID: serverID})
+
+	record, err := txn.table.getOrCreateServiceRecord(serviceID)
 	if err != nil {
 		return err
 	}
 
-	err = record.addServerToPool(serverID)
+	return record.addServerToPool(serverID)
+}
+
+func (txn *memoryTxn) RemoveServerFromServicePool(serviceID router.ServiceID, serverID router.ServerID) error {
+	txn.saveService(serviceID, router.Change{Op: "RemoveServerFromServicePool", ServiceID: serviceID, ServerID: serverID})
+
+	record, err := txn.table.getOrCreateServiceRecord(serviceID)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return record.removeServerFromPool(serverID)
 }
 
-// Remove a server from the service's pool of servers.
-func (table *MemoryRoutingTable) RemoveServerFromServicePool(serviceID router.ServiceID, serverID router.ServerID) error {
-	record, err := table.getOrCreateServiceRecord(serviceID)
-	if err != nil {
-		return err
+func (txn *memoryTxn) Clients() ([]router.ClientID, error) {
+	clients := make([]router.ClientID, 0, len(txn.table.clientTable))
+	for clientID := range txn.table.clientTable {
+		clients = append(clients, clientID)
 	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i] < clients[j] })
+	return clients, nil
+}
 
-	err = record.removeServerFromPool(serverID)
+func (txn *memoryTxn) Services() ([]router.ServiceID, error) {
+	services := make([]router.ServiceID, 0, len(txn.table.serviceTable))
+	for serviceID := range txn.table.serviceTable {
+		services = append(services, serviceID)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i] < services[j] })
+	return services, nil
+}
+
+func (txn *memoryTxn) GetClientServices(clientID router.ClientID) (map[router.ServiceID]router.ServerID, error) {
+	record, err := txn.table.getClientRecord(clientID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return record.copy().serviceMap, nil
+}
+
+// Record change and, in an undoable txn, remember the client's current
+// record so it can be restored.
+func (txn *memoryTxn) saveClient(clientID router.ClientID, change router.Change) {
+	txn.changes = append(txn.changes, change)
+	if !txn.undoable {
+		return
+	}
+
+	saved, ok := txn.table.clientTable[clientID]
+	if ok {
+		saved = saved.copy()
+	}
+	txn.undo = append(txn.undo, func() {
+		if ok {
+			txn.table.clientTable[clientID] = saved
+		} else {
+			delete(txn.table.clientTable, clientID)
+		}
+	})
+}
+
+// Record change and, in an undoable txn, remember the service's current
+// record so it can be restored.
+func (txn *memoryTxn) saveService(serviceID router.ServiceID, change router.Change) {
+	txn.changes = append(txn.changes, change)
+	if !txn.undoable {
+		return
+	}
+
+	saved, ok := txn.table.serviceTable[serviceID]
+	if ok {
+		saved = saved.copy()
+	}
+	txn.undo = append(txn.undo, func() {
+		if ok {
+			txn.table.serviceTable[serviceID] = saved
+		} else {
+			delete(txn.table.serviceTable, serviceID)
+		}
+	})
+}
+
+// Undo every change, most recent first.
+func (txn *memoryTxn) rollback() {
+	for i := len(txn.undo) - 1; i >= 0; i-- {
+		txn.undo[i]()
+	}
+	txn.changes = nil
+	txn.undo = nil
 }
 
 // Insert new client record in routing table
@@ -205,7 +482,7 @@ func (table *MemoryRoutingTable) getClientRecord(clientID router.ClientID) (*cli
 	record, ok := table.clientTable[clientID]
 
 	if !ok {
-		return nil, router.NewRoutingTableError(router.UnknownClient, "No client routing info found.")
+		return nil, router.NewClientTableError(router.UnknownClient, clientID, "", "No client routing info found.")
 	}
 
 	return record, nil
@@ -228,7 +505,7 @@ func (table *MemoryRoutingTable) getServiceRecord(serviceID router.ServiceID) (*
 	record, ok := table.serviceTable[serviceID]
 
 	if !ok {
-		return nil, router.NewRoutingTableError(router.UnknownService, "No service routing info found.")
+		return nil, router.NewServiceTableError(router.UnknownService, serviceID, "No service routing info found.")
 	}
 
 	return record, nil
@@ -251,9 +528,9 @@ func newClientRecord() *clientRecord {
 
 type clientTable map[router.ClientID]*clientRecord
 
-func (r *clientRecord) getMessageServer() (router.ServerID, error) {
+func (r *clientRecord) getMessageServer(clientID router.ClientID) (router.ServerID, error) {
 	if r.messageServer == "" {
-		return "", router.NewRoutingTableError(router.MappingNotFoundError, "No message server found for client.")
+		return "", router.NewClientTableError(router.MappingNotFoundError, clientID, "", "No message server found for client.")
 	}
 	return r.messageServer, nil
 }
@@ -263,11 +540,11 @@ func (r *clientRecord) setMessageServer(serverID router.ServerID) error {
 	return nil
 }
 
-func (r *clientRecord) getServiceServer(serviceID router.ServiceID) (router.ServerID, error) {
+func (r *clientRecord) getServiceServer(clientID router.ClientID, serviceID router.ServiceID) (router.ServerID, error) {
 	serverID, ok := r.serviceMap[serviceID]
 
 	if !ok {
-		return "", router.NewRoutingTableError(router.MappingNotFoundError, "No server found for service.")
+		return "", router.NewClientTableError(router.MappingNotFoundError, clientID, serviceID, "No server found for service.")
 	}
 
 	return serverID, nil
@@ -278,6 +555,20 @@ func (r *clientRecord) setServiceServer(serviceID router.ServiceID, serverID rou
 	return nil
 }
 
+func (r *clientRecord) removeServiceServer(serviceID router.ServiceID) error {
+	delete(r.serviceMap, serviceID)
+	return nil
+}
+
+func (r *clientRecord) copy() *clientRecord {
+	record := newClientRecord()
+	record.messageServer = r.messageServer
+	for serviceID, serverID := range r.serviceMap {
+		record.serviceMap[serviceID] = serverID
+	}
+	return record
+}
+
 // Routing information tracked per service
 type serviceRecord struct {
 	server     router.ServerID
@@ -323,9 +614,9 @@ func newServiceRecord() *serviceRecord {
 
 type serviceTable map[router.ServiceID]*serviceRecord
 
-func (r *serviceRecord) getServer() (router.ServerID, error) {
+func (r *serviceRecord) getServer(serviceID router.ServiceID) (router.ServerID, error) {
 	if r.server == "" {
-		return "", router.NewRoutingTableError(router.ServerNotFoundError, "No catch-all server defined for service.")
+		return "", router.NewServiceTableError(router.ServerNotFoundError, serviceID, "No catch-all server defined for service.")
 	}
 
 	return r.server, nil
@@ -337,9 +628,9 @@ func (r *serviceRecord) setServer(serverID router.ServerID) error {
 	return nil
 }
 
-func (r *serviceRecord) getRegistrar() (router.ServerID, error) {
+func (r *serviceRecord) getRegistrar(serviceID router.ServiceID) (router.ServerID, error) {
 	if r.registrar == "" {
-		return "", router.NewRoutingTableError(router.ServerNotFoundError, "No registrar defined for service.")
+		return "", router.NewServiceTableError(router.ServerNotFoundError, serviceID, "No registrar defined for service.")
 	}
 
 	return r.registrar, nil
@@ -351,15 +642,29 @@ func (r *serviceRecord) setRegistrar(registrar router.ServerID) error {
 	return nil
 }
 
-func (r *serviceRecord) getServerFromPool() (router.ServerID, error) {
+func (r *serviceRecord) getServerFromPool(serviceID router.ServiceID) (router.ServerID, error) {
 	pool_size := len(r.serverPool)
 	if len(r.serverPool) == 0 {
-		return "", router.NewRoutingTableError(router.ServerPoolEmptyError, "No servers in pool.")
+		return "", router.NewServiceTableError(router.ServerPoolEmptyError, serviceID, "No servers in pool.")
 	}
 
 	return r.serverPool[rand.Intn(pool_size)], nil
 }
 
+func (r *serviceRecord) getPool() []router.ServerID {
+	pool := make([]router.ServerID, len(r.serverPool))
+	copy(pool, r.serverPool)
+	return pool
+}
+
+func (r *serviceRecord) copy() *serviceRecord {
+	record := newServiceRecord()
+	record.server = r.server
+	record.registrar = r.registrar
+	record.serverPool = append(record.serverPool, r.serverPool...)
+	return record
+}
+
 func (r *serviceRecord) addServerToPool(serverID router.ServerID) error {
 	r.serverPool.add(serverID)
 
@@ -1,6 +1,7 @@
 package routingtable
 
 import (
+	"errors"
 	"github.com/robertkluin/message-flow/router"
 	"testing"
 )
@@ -15,6 +16,11 @@ func TestMemoryGetClientServiceServer(t *testing.T) {
 	router.TestGetClientServiceServer(t, table)
 }
 
+func TestMemoryRemoveClientServiceServer(t *testing.T) {
+	table := NewMemoryRoutingTable()
+	router.TestRemoveClientServiceServer(t, table)
+}
+
 func TestMemoryGetServiceServer(t *testing.T) {
 	table := NewMemoryRoutingTable()
 	router.TestGetServiceServer(t, table)
@@ -29,3 +35,97 @@ func TestMemoryGetServiceRandomServer(t *testing.T) {
 	table := NewMemoryRoutingTable()
 	router.TestGetServiceRandomServer(t, table)
 }
+
+func TestMemoryGetServicePool(t *testing.T) {
+	table := NewMemoryRoutingTable()
+	router.TestGetServicePool(t, table)
+}
+
+func TestMemoryScan(t *testing.T) {
+	table := NewMemoryRoutingTable()
+	router.TestScan(t, table)
+}
+
+func TestMemoryWatch(t *testing.T) {
+	table := NewMemoryRoutingTable()
+
+	var changes []router.Change
+	cancel := table.Watch(func(change router.Change) {
+		// Watchers may use the table.
+		table.GetServiceRandomServer(change.ServiceID)
+		changes = append(changes, change)
+	})
+
+	table.AddServerToServicePool("service.1", "pool.1")
+	table.SetClientMessageServer("client.1", "server.1")
+	cancel()
+	table.SetServiceServer("service.1", "server.1")
+
+	expected := []router.Change{
+		{Op: "AddServerToServicePool", ServiceID: "service.1", ServerID: "pool.1"},
+		{Op: "SetClientMessageServer", ClientID: "client.1", ServerID: "server.1"},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %+v", len(expected), changes)
+	}
+	for i, change := range changes {
+		if change != expected[i] {
+			t.Errorf("change %d: got %+v, want %+v", i, change, expected[i])
+		}
+	}
+}
+
+func TestMemoryUpdate(t *testing.T) {
+	table := NewMemoryRoutingTable()
+	table.AddServerToServicePool("service.1", "pool.1")
+	table.SetClientServiceServer("client.1", "service.1", "pool.1")
+
+	var changes []router.Change
+	table.Watch(func(change router.Change) {
+		changes = append(changes, change)
+	})
+
+	// A failed update leaves the table as it was.
+	failed := errors.New("failed")
+	err := table.Update(func(txn router.RoutingTable) error {
+		txn.AddServerToServicePool("service.1", "pool.2")
+		txn.RemoveServerFromServicePool("service.1", "pool.1")
+		txn.RemoveClientServiceServer("client.1", "service.1")
+		txn.SetServiceServer("service.2", "server.1")
+		return failed
+	})
+	if err != failed {
+		t.Errorf("expected update error, got %v", err)
+	}
+	if pool, _ := table.GetServicePool("service.1"); len(pool) != 1 || pool[0] != "pool.1" {
+		t.Errorf("pool not restored: %v", pool)
+	}
+	if server, _ := table.GetClientServiceServer("client.1", "service.1"); server != "pool.1" {
+		t.Errorf("mapping not restored: %q", server)
+	}
+	if services, _ := table.Services(); len(services) != 1 {
+		t.Errorf("created service not removed: %v", services)
+	}
+	if len(changes) != 0 {
+		t.Errorf("watchers told of undone changes: %+v", changes)
+	}
+
+	// A successful update is seen all at once.
+	err = table.Update(func(txn router.RoutingTable) error {
+		txn.AddServerToServicePool("service.1", "pool.2")
+		txn.RemoveServerFromServicePool("service.1", "pool.1")
+		return txn.RemoveClientServiceServer("client.1", "service.1")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool, _ := table.GetServicePool("service.1"); len(pool) != 1 || pool[0] != "pool.2" {
+		t.Errorf("unexpected pool %v", pool)
+	}
+	if mappings, _ := table.GetClientServices("client.1"); len(mappings) != 0 {
+		t.Errorf("unexpected mappings %v", mappings)
+	}
+	if len(changes) != 3 {
+		t.Errorf("expected 3 changes, got %+v", changes)
+	}
+}
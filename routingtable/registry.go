@@ -0,0 +1,74 @@
+package routingtable
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+// A Factory opens a routing table from a URL.  Backend options are given in
+// the URL's query.
+type Factory func(u *url.URL) (router.RoutingTable, error)
+
+var (
+	driversLock sync.RWMutex
+	drivers     = make(map[string]Factory)
+)
+
+// Make a routing table backend available to Open under the URL scheme name.
+// Backends register themselves from init, so importing a backend's package
+// is enough to use it.  Register panics if name is registered twice or
+// factory is nil.
+func Register(name string, factory Factory) {
+	driversLock.Lock()
+	defer driversLock.Unlock()
+
+	if factory == nil {
+		panic("routingtable: Register factory is nil")
+	}
+	if _, dup := drivers[name]; dup {
+		panic("routingtable: Register called twice for backend " + name)
+	}
+	drivers[name] = factory
+}
+
+// Open the routing table named by rawURL, such as "memory://" or
+// "bolt:///var/lib/mflow.db", with the backend registered for its scheme.
+// Tables holding resources such as open files implement io.Closer.
+func Open(rawURL string) (router.RoutingTable, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	driversLock.RLock()
+	factory, ok := drivers[u.Scheme]
+	driversLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("routingtable: unknown backend %q (forgotten import?)", u.Scheme)
+	}
+
+	return factory(u)
+}
+
+// Names of the registered backends, sorted.
+func Drivers() []string {
+	driversLock.RLock()
+	defer driversLock.RUnlock()
+
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	Register("memory", func(u *url.URL) (router.RoutingTable, error) {
+		return NewMemoryRoutingTable(), nil
+	})
+}
@@ -0,0 +1,42 @@
+package routingtable
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+// The URL last opened by the "test" driver.  Drivers can only be
+// registered once, so it is registered for every run of the tests.
+var testOpened *url.URL
+
+func init() {
+	Register("test", func(u *url.URL) (router.RoutingTable, error) {
+		testOpened = u
+		return NewMemoryRoutingTable(), nil
+	})
+}
+
+func TestOpen(t *testing.T) {
+	table, err := Open("memory://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := table.(*MemoryRoutingTable); !ok {
+		t.Errorf("memory:// opened %T", table)
+	}
+
+	if _, err := Open("nosuch://"); err == nil {
+		t.Error("expected an error for an unregistered backend")
+	}
+
+	if _, err := Open("test://host/prefix?option=1"); err != nil || testOpened.Host != "host" || testOpened.Query().Get("option") != "1" {
+		t.Errorf("factory given %v, %v", testOpened, err)
+	}
+
+	drivers := Drivers()
+	if len(drivers) != 2 || drivers[0] != "memory" || drivers[1] != "test" {
+		t.Errorf("unexpected drivers %v", drivers)
+	}
+}
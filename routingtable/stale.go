@@ -0,0 +1,412 @@
+package routingtable
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+// A WritePolicy sets what a StaleRoutingTable does with changes made while
+// its backend is unavailable.
+type WritePolicy int
+
+const (
+	// Return an error for each change.
+	RejectWrites WritePolicy = iota
+
+	// Accept changes, reflect them in the answers served, and make them in
+	// order once the backend is available again.
+	BufferWrites
+)
+
+// StaleOptions configure a StaleRoutingTable.  Zero fields take their
+// defaults.
+type StaleOptions struct {
+	// Most answers remembered.  Defaults to 100000.
+	Entries int
+
+	// While the backend is unavailable, how long answers are served from
+	// memory before it is tried again.  Defaults to one second.
+	RetryInterval time.Duration
+
+	// What to do with changes while the backend is unavailable.  Defaults
+	// to RejectWrites.
+	Writes WritePolicy
+
+	// Most changes buffered by BufferWrites; later ones are rejected.
+	// Defaults to 1000.
+	MaxBuffered int
+}
+
+const (
+	defaultStaleEntries       = 100000
+	defaultStaleRetryInterval = time.Second
+	defaultStaleMaxBuffered   = 1000
+)
+
+// `StaleRoutingTable` keeps routing when its backend is unreachable.  It
+// remembers the last answer to each lookup, and when the backend fails with
+// anything other than an answer, such as an unknown client or an empty
+// pool, serves the remembered one instead.  Answers served this way are
+// reported with router.MarkStale and logged.  Random servers are picked
+// from the service's remembered pool, and clients with no remembered
+// mapping are reported to have none, so they are given one of the
+// service's remembered servers.
+//
+// Once a call fails, the backend is only tried again after RetryInterval.
+// The first call to succeed then makes any buffered changes, in order,
+// before its own.  Scanner and Updater calls are passed to the backend
+// without being remembered or buffered.
+type StaleRoutingTable struct {
+	*router.InterceptedTable
+
+	table   router.RoutingTable
+	options StaleOptions
+
+	lock     sync.Mutex
+	answers  *lru
+	down     bool
+	lastErr  error
+	retryAt  time.Time
+	buffered []router.Call
+	logger   *slog.Logger
+
+	// Held while buffered changes are made.
+	flushLock sync.Mutex
+}
+
+type staleAnswer struct {
+	result interface{}
+	err    error
+}
+
+// Serve the last known answers of table while it is unavailable.  options
+// may be nil to use the defaults.
+func NewStaleRoutingTable(table router.RoutingTable, options *StaleOptions) *StaleRoutingTable {
+	t := new(StaleRoutingTable)
+	t.table = table
+	if options != nil {
+		t.options = *options
+	}
+	if t.options.Entries <= 0 {
+		t.options.Entries = defaultStaleEntries
+	}
+	if t.options.RetryInterval <= 0 {
+		t.options.RetryInterval = defaultStaleRetryInterval
+	}
+	if t.options.MaxBuffered <= 0 {
+		t.options.MaxBuffered = defaultStaleMaxBuffered
+	}
+	t.answers = newLRU(t.options.Entries)
+	t.logger = router.LoggerOrDiscard(nil)
+	t.InterceptedTable = router.Intercept(table, t.intercept)
+	return t
+}
+
+// Log when the backend becomes unavailable or available again, stale
+// answers at debug level, and dropped changes.  A nil logger discards them.
+func (t *StaleRoutingTable) SetLogger(logger *slog.Logger) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.logger = router.LoggerOrDiscard(logger)
+}
+
+// Report whether the backend is considered unavailable.
+func (t *StaleRoutingTable) Unavailable() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.down
+}
+
+// How many changes are waiting for the backend.
+func (t *StaleRoutingTable) Buffered() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return len(t.buffered)
+}
+
+func (t *StaleRoutingTable) intercept(ctx context.Context, call *router.Call, next router.Invoker) (interface{}, error) {
+	if call.Op == "GetServiceRandomServer" {
+		return t.randomServer(ctx, call, next)
+	}
+
+	if err := t.reconcile(ctx, next); err != nil {
+		return t.serveStale(ctx, call, err)
+	}
+
+	result, err := next(ctx, call)
+	if !isAnswer(err) {
+		t.markDown(err)
+		return t.serveStale(ctx, call, err)
+	}
+
+	if call.Mutates() {
+		if err == nil {
+			t.apply(call)
+		}
+	} else {
+		t.remember(call, result, err)
+	}
+	return result, err
+}
+
+// Pick a server from the service's pool, so the pool is remembered for
+// when the backend is unavailable.
+func (t *StaleRoutingTable) randomServer(ctx context.Context, call *router.Call, next router.Invoker) (interface{}, error) {
+	poolCall := &router.Call{Op: "GetServicePool", ServiceID: call.ServiceID}
+	result, err := t.intercept(ctx, poolCall, next)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, _ := result.([]router.ServerID)
+	if len(pool) == 0 {
+		return nil, router.NewServiceTableError(router.ServerPoolEmptyError, call.ServiceID, "No servers in pool.")
+	}
+	return pool[rand.Intn(len(pool))], nil
+}
+
+// Make buffered changes if the backend is unavailable and due to be tried
+// again.  An error is returned if the backend is still unavailable.
+func (t *StaleRoutingTable) reconcile(ctx context.Context, next router.Invoker) error {
+	t.lock.Lock()
+	down, retryAt, lastErr := t.down, t.retryAt, t.lastErr
+	t.lock.Unlock()
+	if !down {
+		return nil
+	}
+	if time.Now().Before(retryAt) {
+		return lastErr
+	}
+
+	t.flushLock.Lock()
+	defer t.flushLock.Unlock()
+
+	for {
+		t.lock.Lock()
+		if !t.down {
+			t.lock.Unlock()
+			return nil
+		}
+		if len(t.buffered) == 0 {
+			t.down = false
+			logger := t.logger
+			t.lock.Unlock()
+			logger.LogAttrs(ctx, slog.LevelInfo, "routing table available")
+			return nil
+		}
+		call := t.buffered[0]
+		t.lock.Unlock()
+
+		_, err := next(ctx, &call)
+		if !isAnswer(err) {
+			t.markDown(err)
+			return err
+		}
+
+		t.lock.Lock()
+		t.buffered = t.buffered[1:]
+		logger := t.logger
+		t.lock.Unlock()
+		if err != nil {
+			logger.LogAttrs(ctx, slog.LevelWarn, "buffered change dropped", append(callAttrs(&call), router.ErrorAttrs(err)...)...)
+		}
+	}
+}
+
+// Answer call from memory after the backend failed with err.
+func (t *StaleRoutingTable) serveStale(ctx context.Context, call *router.Call, err error) (interface{}, error) {
+	err = unavailableError(err)
+
+	if call.Mutates() {
+		if t.options.Writes != BufferWrites || !t.buffer(call) {
+			return nil, err
+		}
+		t.apply(call)
+		router.MarkStale(ctx)
+		return nil, nil
+	}
+
+	answer, ok := t.known(call)
+	if !ok {
+		return nil, err
+	}
+
+	router.MarkStale(ctx)
+	t.lock.Lock()
+	logger := t.logger
+	t.lock.Unlock()
+	logger.LogAttrs(ctx, slog.LevelDebug, "serving stale answer", callAttrs(call)...)
+	return answer.result, answer.err
+}
+
+func (t *StaleRoutingTable) markDown(err error) {
+	t.lock.Lock()
+	wasDown := t.down
+	t.down = true
+	t.lastErr = err
+	t.retryAt = time.Now().Add(t.options.RetryInterval)
+	logger := t.logger
+	t.lock.Unlock()
+
+	if !wasDown {
+		logger.LogAttrs(context.Background(), slog.LevelWarn, "routing table unavailable, serving stale answers", router.ErrorAttrs(err)...)
+	}
+}
+
+// Buffer a change, reporting whether there was room for it.
+func (t *StaleRoutingTable) buffer(call *router.Call) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if len(t.buffered) >= t.options.MaxBuffered {
+		return false
+	}
+	t.buffered = append(t.buffered, *call)
+	return true
+}
+
+// The remembered answer to call.  Clients with no remembered mapping for
+// a service are answered with MappingNotFoundError, so the service's
+// remembered servers are used.
+func (t *StaleRoutingTable) known(call *router.Call) (staleAnswer, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	answer, ok := t.answers.get(answerKey(call.Op, call.ClientID, call.ServiceID)).(staleAnswer)
+	if !ok && call.Op == "GetClientServiceServer" {
+		return staleAnswer{nil, router.NewClientTableError(router.MappingNotFoundError, call.ClientID, call.ServiceID, "No server found for service.")}, true
+	}
+	if pool, isPool := answer.result.([]router.ServerID); isPool {
+		answer.result = append([]router.ServerID(nil), pool...)
+	}
+	return answer, ok
+}
+
+func (t *StaleRoutingTable) remember(call *router.Call, result interface{}, err error) {
+	if pool, ok := result.([]router.ServerID); ok {
+		result = append([]router.ServerID(nil), pool...)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.answers.add(answerKey(call.Op, call.ClientID, call.ServiceID), staleAnswer{result, err})
+}
+
+// Update the remembered answers to reflect a change.
+func (t *StaleRoutingTable) apply(call *router.Call) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	set := func(op string, serviceID router.ServiceID, answer staleAnswer) {
+		t.answers.add(answerKey(op, call.ClientID, serviceID), answer)
+	}
+
+	switch call.Op {
+	case "SetClientMessageServer":
+		set("GetClientMessageServer", "", staleAnswer{call.ServerID, nil})
+	case "SetClientServiceServer":
+		set("GetClientServiceServer", call.ServiceID, staleAnswer{call.ServerID, nil})
+	case "RemoveClientServiceServer":
+		set("GetClientServiceServer", call.ServiceID, staleAnswer{nil, router.NewClientTableError(router.MappingNotFoundError, call.ClientID, call.ServiceID, "No server found for service.")})
+	case "SetServiceServer":
+		set("GetServiceServer", call.ServiceID, staleAnswer{call.ServerID, nil})
+	case "SetServiceRegistrar":
+		set("GetServiceRegistrar", call.ServiceID, staleAnswer{call.ServerID, nil})
+	case "AddServerToServicePool", "RemoveServerFromServicePool":
+		// Without the rest of the pool, a pool of just this change would
+		// be served as the whole pool.  An unknown service has none.
+		key := answerKey("GetServicePool", "", call.ServiceID)
+		answer, ok := t.answers.get(key).(staleAnswer)
+		if !ok || (answer.err != nil && !errors.Is(answer.err, router.ErrUnknownService)) {
+			t.answers.remove(key)
+			return
+		}
+		known, _ := answer.result.([]router.ServerID)
+		pool := make([]router.ServerID, 0, len(known)+1)
+		for _, serverID := range known {
+			if serverID != call.ServerID {
+				pool = append(pool, serverID)
+			}
+		}
+		if call.Op == "AddServerToServicePool" {
+			pool = append(pool, call.ServerID)
+		}
+		t.answers.add(key, staleAnswer{pool, nil})
+	}
+}
+
+// Pass the update to the backend, if it is an Updater.  Changes made in it
+// are not buffered.
+func (t *StaleRoutingTable) Update(fn func(router.RoutingTable) error) error {
+	updater, ok := t.table.(router.Updater)
+	if !ok {
+		return fn(t)
+	}
+	return updater.Update(fn)
+}
+
+func (t *StaleRoutingTable) Clients() ([]router.ClientID, error) {
+	scanner, ok := t.table.(router.Scanner)
+	if !ok {
+		return nil, errNotScanner
+	}
+	return scanner.Clients()
+}
+
+func (t *StaleRoutingTable) Services() ([]router.ServiceID, error) {
+	scanner, ok := t.table.(router.Scanner)
+	if !ok {
+		return nil, errNotScanner
+	}
+	return scanner.Services()
+}
+
+func (t *StaleRoutingTable) GetClientServices(clientID router.ClientID) (map[router.ServiceID]router.ServerID, error) {
+	scanner, ok := t.table.(router.Scanner)
+	if !ok {
+		return nil, errNotScanner
+	}
+	return scanner.GetClientServices(clientID)
+}
+
+func answerKey(op string, clientID router.ClientID, serviceID router.ServiceID) string {
+	return op + "/" + string(clientID) + "/" + string(serviceID)
+}
+
+// Report whether err is an answer from the table rather than a failure to
+// reach it.
+func isAnswer(err error) bool {
+	if err == nil {
+		return true
+	}
+	code, _ := router.ErrorCode(err)
+	switch code {
+	case router.UnknownClient, router.UnknownService, router.ServerPoolEmptyError, router.ServerNotFoundError, router.MappingNotFoundError:
+		return true
+	}
+	return false
+}
+
+// The error returned when the backend is unavailable and no answer is
+// remembered.
+func unavailableError(err error) error {
+	if errors.Is(err, router.ErrService) {
+		return err
+	}
+	return router.WrapRoutingTableError(router.ServiceError, "Routing table unavailable.", err)
+}
+
+func callAttrs(call *router.Call) []slog.Attr {
+	change := router.Change{Op: call.Op, ClientID: call.ClientID, ServiceID: call.ServiceID, ServerID: call.ServerID}
+	return change.LogAttrs()
+}
@@ -0,0 +1,193 @@
+package routingtable
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/robertkluin/message-flow/router"
+)
+
+// A memory table failing every call while *down is set.
+func flakyTable(down *bool) (*MemoryRoutingTable, router.RoutingTable) {
+	memory := NewMemoryRoutingTable()
+	table := router.Intercept(memory, func(ctx context.Context, call *router.Call, next router.Invoker) (interface{}, error) {
+		if *down {
+			return nil, errors.New("connection refused")
+		}
+		return next(ctx, call)
+	})
+	return memory, table
+}
+
+func TestStaleGetClientMessageServer(t *testing.T) {
+	router.TestGetClientMessageServer(t, NewStaleRoutingTable(NewMemoryRoutingTable(), nil))
+}
+
+func TestStaleGetClientServiceServer(t *testing.T) {
+	router.TestGetClientServiceServer(t, NewStaleRoutingTable(NewMemoryRoutingTable(), nil))
+}
+
+func TestStaleRemoveClientServiceServer(t *testing.T) {
+	router.TestRemoveClientServiceServer(t, NewStaleRoutingTable(NewMemoryRoutingTable(), nil))
+}
+
+func TestStaleGetServiceServer(t *testing.T) {
+	router.TestGetServiceServer(t, NewStaleRoutingTable(NewMemoryRoutingTable(), nil))
+}
+
+func TestStaleGetServiceRegistrar(t *testing.T) {
+	router.TestGetServiceRegistrar(t, NewStaleRoutingTable(NewMemoryRoutingTable(), nil))
+}
+
+func TestStaleGetServiceRandomServer(t *testing.T) {
+	router.TestGetServiceRandomServer(t, NewStaleRoutingTable(NewMemoryRoutingTable(), nil))
+}
+
+func TestStaleGetServicePool(t *testing.T) {
+	router.TestGetServicePool(t, NewStaleRoutingTable(NewMemoryRoutingTable(), nil))
+}
+
+func TestStale(t *testing.T) {
+	down := false
+	memory, table := flakyTable(&down)
+	memory.SetClientServiceServer("client.1", "service.1", "server.1")
+	memory.AddServerToServicePool("service.1", "pool.1")
+	stale := NewStaleRoutingTable(table, &StaleOptions{RetryInterval: time.Millisecond})
+
+	stale.GetClientServiceServer("client.1", "service.1")
+	stale.GetServicePool("service.1")
+	down = true
+
+	// Known answers are served and marked stale.
+	ctx := router.WithStaleMarker(context.Background())
+	bound := stale.WithContext(ctx)
+	if serverID, err := bound.GetClientServiceServer("client.1", "service.1"); serverID != "server.1" || err != nil {
+		t.Errorf("GetClientServiceServer() = %q, %v while unavailable", serverID, err)
+	}
+	if !router.ServedStale(ctx) || !stale.Unavailable() {
+		t.Errorf("expected a stale answer")
+	}
+	if serverID, err := bound.GetServiceRandomServer("service.1"); serverID != "pool.1" || err != nil {
+		t.Errorf("GetServiceRandomServer() = %q, %v while unavailable", serverID, err)
+	}
+
+	// Unknown answers fail as the service being unavailable.
+	if _, err := stale.GetServiceServer("service.1"); !errors.Is(err, router.ErrService) {
+		t.Errorf("expected ServiceError, got %v", err)
+	}
+
+	// Writes are rejected by default.
+	if err := stale.SetServiceServer("service.1", "server.1"); !errors.Is(err, router.ErrService) {
+		t.Errorf("expected ServiceError, got %v", err)
+	}
+
+	// Answers are fresh once the backend is tried again.
+	down = false
+	time.Sleep(2 * time.Millisecond)
+	memory.SetClientServiceServer("client.1", "service.1", "server.2")
+	ctx = router.WithStaleMarker(context.Background())
+	if serverID, _ := stale.WithContext(ctx).GetClientServiceServer("client.1", "service.1"); serverID != "server.2" || router.ServedStale(ctx) {
+		t.Errorf("expected a fresh answer, got %q", serverID)
+	}
+	if stale.Unavailable() {
+		t.Errorf("expected the backend to be available")
+	}
+}
+
+func TestStaleBufferWrites(t *testing.T) {
+	down := false
+	memory, table := flakyTable(&down)
+	stale := NewStaleRoutingTable(table, &StaleOptions{RetryInterval: time.Millisecond, Writes: BufferWrites, MaxBuffered: 2})
+
+	stale.GetServicePool("service.1")
+	down = true
+	stale.AddServerToServicePool("service.1", "pool.1")
+	if err := stale.SetClientServiceServer("client.1", "service.1", "server.1"); err != nil {
+		t.Fatalf("expected the write to be buffered, got %v", err)
+	}
+	if err := stale.SetServiceServer("service.1", "server.1"); !errors.Is(err, router.ErrService) {
+		t.Errorf("expected a full buffer to reject writes, got %v", err)
+	}
+
+	// Buffered writes are reflected in stale answers.
+	if pool, _ := stale.GetServicePool("service.1"); len(pool) != 1 || pool[0] != "pool.1" {
+		t.Errorf("GetServicePool() = %v while unavailable", pool)
+	}
+	if serverID, _ := stale.GetClientServiceServer("client.1", "service.1"); serverID != "server.1" {
+		t.Errorf("GetClientServiceServer() = %q while unavailable", serverID)
+	}
+
+	// And made once the backend is available.
+	down = false
+	time.Sleep(2 * time.Millisecond)
+	stale.GetServiceServer("service.1")
+	if stale.Buffered() != 0 {
+		t.Errorf("%d writes still buffered", stale.Buffered())
+	}
+	if serverID, err := memory.GetClientServiceServer("client.1", "service.1"); serverID != "server.1" || err != nil {
+		t.Errorf("expected buffered write to be made, got %q, %v", serverID, err)
+	}
+	if pool, _ := memory.GetServicePool("service.1"); len(pool) != 1 {
+		t.Errorf("expected buffered pool change to be made, got %v", pool)
+	}
+}
+
+func TestStaleResolve(t *testing.T) {
+	down := false
+	memory, table := flakyTable(&down)
+	memory.AddServerToServicePool("service.1", "pool.1")
+	resolver := router.NewResolver(NewStaleRoutingTable(table, &StaleOptions{RetryInterval: time.Hour}), nil)
+
+	if serverID, err := resolver.Resolve("client.1", "service.1"); serverID != "pool.1" || err != nil {
+		t.Fatalf("Resolve() = %q, %v", serverID, err)
+	}
+	down = true
+
+	// A new client is given a server from the remembered pool, which is
+	// not stored.
+	ctx := router.WithStaleMarker(context.Background())
+	if serverID, err := resolver.ResolveContext(ctx, "client.2", "service.1"); serverID != "pool.1" || err != nil || !router.ServedStale(ctx) {
+		t.Errorf("ResolveContext() = %q, %v while unavailable", serverID, err)
+	}
+	if serverID, err := resolver.Resolve("client.1", "service.1"); serverID != "pool.1" || err != nil {
+		t.Errorf("Resolve() = %q, %v for a mapped client while unavailable", serverID, err)
+	}
+}
+
+func TestStaleRoute(t *testing.T) {
+	down := false
+	memory, table := flakyTable(&down)
+	memory.AddServerToServicePool("service.1", "pool.1")
+	stale := NewStaleRoutingTable(table, nil)
+
+	forwarder := router.ForwarderFunc(func(ctx context.Context, serverID router.ServerID, msg *router.Message) (*router.Message, error) {
+		return &router.Message{Body: []byte(serverID)}, nil
+	})
+	handler := router.NewRouter(router.NewResolver(stale, nil), forwarder)
+
+	handler.Route(context.Background(), &router.Message{ClientID: "client.1", ServiceID: "service.1"})
+	down = true
+
+	// client.2 is routed from the remembered pool without storing its
+	// mapping, which the unavailable table would reject.
+	reply, err := handler.Route(context.Background(), &router.Message{ClientID: "client.2", ServiceID: "service.1"})
+	if err != nil || string(reply.Body) != "pool.1" {
+		t.Errorf("unexpected reply while unavailable: %+v, %v", reply, err)
+	}
+}
+
+func TestStaleUnknownPool(t *testing.T) {
+	down := true
+	_, table := flakyTable(&down)
+	stale := NewStaleRoutingTable(table, &StaleOptions{RetryInterval: time.Hour, Writes: BufferWrites})
+
+	// A pool is not made up of just the changes made while unavailable.
+	if err := stale.AddServerToServicePool("service.1", "pool.1"); err != nil {
+		t.Fatalf("expected the write to be buffered, got %v", err)
+	}
+	if pool, err := stale.GetServicePool("service.1"); !errors.Is(err, router.ErrService) {
+		t.Errorf("expected ServiceError, got %v, %v", pool, err)
+	}
+}
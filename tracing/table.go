@@ -0,0 +1,136 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/robertkluin/message-flow/router"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Table wraps a routing table, recording a span for each call.  Calls are
+// recorded as children of the span in the table's context, which the
+// resolver sets through WithContext for each message.  Only the
+// router.RoutingTable methods are wrapped; use the wrapped table directly
+// for Scanner, Updater or Watcher.
+type Table struct {
+	table  router.RoutingTable
+	tracer trace.Tracer
+	ctx    context.Context
+}
+
+func NewTable(table router.RoutingTable, provider trace.TracerProvider) *Table {
+	t := new(Table)
+	t.table = table
+	t.tracer = tracer(provider)
+	t.ctx = context.Background()
+	return t
+}
+
+// A copy of the table recording its calls under the span in ctx.  Tables
+// implementing router.ContextTable are bound to ctx as well.
+func (t *Table) WithContext(ctx context.Context) router.RoutingTable {
+	bound := *t
+	bound.ctx = ctx
+	if contextTable, ok := t.table.(router.ContextTable); ok {
+		bound.table = contextTable.WithContext(ctx)
+	}
+	return &bound
+}
+
+func (t *Table) GetClientMessageServer(clientID router.ClientID) (router.ServerID, error) {
+	span := t.start("GetClientMessageServer", ClientIDKey.String(string(clientID)))
+	serverID, err := t.table.GetClientMessageServer(clientID)
+	end(span, serverID, err)
+	return serverID, err
+}
+
+func (t *Table) SetClientMessageServer(clientID router.ClientID, serverID router.ServerID) error {
+	span := t.start("SetClientMessageServer", ClientIDKey.String(string(clientID)), ServerIDKey.String(string(serverID)))
+	err := t.table.SetClientMessageServer(clientID, serverID)
+	end(span, "", err)
+	return err
+}
+
+func (t *Table) GetClientServiceServer(clientID router.ClientID, serviceID router.ServiceID) (router.ServerID, error) {
+	span := t.start("GetClientServiceServer", ClientIDKey.String(string(clientID)), ServiceIDKey.String(string(serviceID)))
+	serverID, err := t.table.GetClientServiceServer(clientID, serviceID)
+	end(span, serverID, err)
+	return serverID, err
+}
+
+func (t *Table) SetClientServiceServer(clientID router.ClientID, serviceID router.ServiceID, serverID router.ServerID) error {
+	span := t.start("SetClientServiceServer", ClientIDKey.String(string(clientID)), ServiceIDKey.String(string(serviceID)), ServerIDKey.String(string(serverID)))
+	err := t.table.SetClientServiceServer(clientID, serviceID, serverID)
+	end(span, "", err)
+	return err
+}
+
+func (t *Table) RemoveClientServiceServer(clientID router.ClientID, serviceID router.ServiceID) error {
+	span := t.start("RemoveClientServiceServer", ClientIDKey.String(string(clientID)), ServiceIDKey.String(string(serviceID)))
+	err := t.table.RemoveClientServiceServer(clientID, serviceID)
+	end(span, "", err)
+	return err
+}
+
+func (t *Table) GetServiceServer(serviceID router.ServiceID) (router.ServerID, error) {
+	span := t.start("GetServiceServer", ServiceIDKey.String(string(serviceID)))
+	serverID, err := t.table.GetServiceServer(serviceID)
+	end(span, serverID, err)
+	return serverID, err
+}
+
+func (t *Table) SetServiceServer(serviceID router.ServiceID, serverID router.ServerID) error {
+	span := t.start("SetServiceServer", ServiceIDKey.String(string(serviceID)), ServerIDKey.String(string(serverID)))
+	err := t.table.SetServiceServer(serviceID, serverID)
+	end(span, "", err)
+	return err
+}
+
+func (t *Table) GetServiceRegistrar(serviceID router.ServiceID) (router.ServerID, error) {
+	span := t.start("GetServiceRegistrar", ServiceIDKey.String(string(serviceID)))
+	serverID, err := t.table.GetServiceRegistrar(serviceID)
+	end(span, serverID, err)
+	return serverID, err
+}
+
+func (t *Table) SetServiceRegistrar(serviceID router.ServiceID, serverID router.ServerID) error {
+	span := t.start("SetServiceRegistrar", ServiceIDKey.String(string(serviceID)), ServerIDKey.String(string(serverID)))
+	err := t.table.SetServiceRegistrar(serviceID, serverID)
+	end(span, "", err)
+	return err
+}
+
+func (t *Table) GetServiceRandomServer(serviceID router.ServiceID) (router.ServerID, error) {
+	span := t.start("GetServiceRandomServer", ServiceIDKey.String(string(serviceID)))
+	serverID, err := t.table.GetServiceRandomServer(serviceID)
+	end(span, serverID, err)
+	return serverID, err
+}
+
+func (t *Table) GetServicePool(serviceID router.ServiceID) ([]router.ServerID, error) {
+	span := t.start("GetServicePool", ServiceIDKey.String(string(serviceID)))
+	pool, err := t.table.GetServicePool(serviceID)
+	span.SetAttributes(attribute.Int("mflow.pool_size", len(pool)))
+	end(span, "", err)
+	return pool, err
+}
+
+func (t *Table) AddServerToServicePool(serviceID router.ServiceID, serverID router.ServerID) error {
+	span := t.start("AddServerToServicePool", ServiceIDKey.String(string(serviceID)), ServerIDKey.String(string(serverID)))
+	err := t.table.AddServerToServicePool(serviceID, serverID)
+	end(span, "", err)
+	return err
+}
+
+func (t *Table) RemoveServerFromServicePool(serviceID router.ServiceID, serverID router.ServerID) error {
+	span := t.start("RemoveServerFromServicePool", ServiceIDKey.String(string(serviceID)), ServerIDKey.String(string(serverID)))
+	err := t.table.RemoveServerFromServicePool(serviceID, serverID)
+	end(span, "", err)
+	return err
+}
+
+func (t *Table) start(method string, attrs ...attribute.KeyValue) trace.Span {
+	_, span := t.tracer.Start(t.ctx, "RoutingTable."+method, trace.WithAttributes(attrs...))
+	return span
+}
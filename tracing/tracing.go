@@ -0,0 +1,302 @@
+// Package tracing records OpenTelemetry spans for routing table calls,
+// registrar lookups and message forwarding, and propagates W3C trace
+// context to the servers messages are forwarded to.
+//
+// Each piece of the router is wrapped with the tracer provider spans should
+// be recorded with:
+//
+//	provider := sdktrace.NewTracerProvider(...)
+//	table = tracing.NewTable(table, provider)
+//	resolver := router.NewResolver(table, tracing.NewRegistrar(registrar, provider))
+//	forwarder = tracing.NewForwarder(forwarder, provider)
+//	handler := tracing.NewHandler(router.NewRouter(resolver, forwarder), provider)
+//
+// Handler starts a span for each message, continuing the trace named by the
+// message's traceparent header when it has one.  The resolver passes the
+// message's context on to Table and Registrar, so lookups are recorded as
+// children of the message's span, and Forwarder records the hop to the
+// server and replaces the message's traceparent with its own.  The HTTP and
+// gRPC proxies are traced by wrapping them with NewHTTPHandler and
+// StreamServerInterceptor.
+//
+// Table must be the outermost wrapper around a routing table for its spans to
+// join the message's trace.  Calls failing with one of the not-found codes
+// the resolver falls through on are recorded with an error code attribute
+// but are not marked as errors.
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/robertkluin/message-flow/router"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Instrumentation scope of the package's tracers.
+const ScopeName = "github.com/robertkluin/message-flow/tracing"
+
+// Span attributes.
+const (
+	ClientIDKey  = attribute.Key("mflow.client_id")
+	ServiceIDKey = attribute.Key("mflow.service_id")
+	ServerIDKey  = attribute.Key("mflow.server_id")
+	MessageIDKey = attribute.Key("mflow.message_id")
+	ErrorCodeKey = attribute.Key("mflow.error_code")
+)
+
+// Trace context is always propagated in the W3C format.
+var propagator = propagation.TraceContext{}
+
+// Registrar wraps a router.Registrar, recording a span for each lookup.
+type Registrar struct {
+	registrar router.Registrar
+	tracer    trace.Tracer
+}
+
+// Create a traced registrar.  When provider is nil the global tracer
+// provider is used, as it is by every constructor in this package.
+func NewRegistrar(registrar router.Registrar, provider trace.TracerProvider) *Registrar {
+	r := new(Registrar)
+	r.registrar = registrar
+	r.tracer = tracer(provider)
+	return r
+}
+
+func (r *Registrar) Lookup(registrar router.ServerID, clientID router.ClientID, serviceID router.ServiceID) (router.ServerID, error) {
+	return r.LookupContext(context.Background(), registrar, clientID, serviceID)
+}
+
+func (r *Registrar) LookupContext(ctx context.Context, registrar router.ServerID, clientID router.ClientID, serviceID router.ServiceID) (router.ServerID, error) {
+	ctx, span := r.tracer.Start(ctx, "Registrar.Lookup", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("mflow.registrar", string(registrar)),
+		ClientIDKey.String(string(clientID)),
+		ServiceIDKey.String(string(serviceID)),
+	))
+
+	var serverID router.ServerID
+	var err error
+	if contextRegistrar, ok := r.registrar.(router.ContextRegistrar); ok {
+		serverID, err = contextRegistrar.LookupContext(ctx, registrar, clientID, serviceID)
+	} else {
+		serverID, err = r.registrar.Lookup(registrar, clientID, serviceID)
+	}
+	end(span, serverID, err)
+	return serverID, err
+}
+
+// Forwarder wraps a router.Forwarder, recording a span for each message it
+// forwards and setting the message's traceparent and tracestate headers to
+// that span.  The caller's message is not modified.
+type Forwarder struct {
+	forwarder router.Forwarder
+	tracer    trace.Tracer
+}
+
+func NewForwarder(forwarder router.Forwarder, provider trace.TracerProvider) *Forwarder {
+	f := new(Forwarder)
+	f.forwarder = forwarder
+	f.tracer = tracer(provider)
+	return f
+}
+
+func (f *Forwarder) Forward(ctx context.Context, serverID router.ServerID, msg *router.Message) (*router.Message, error) {
+	ctx, span := f.tracer.Start(ctx, "Forwarder.Forward", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		append(messageAttributes(msg), ServerIDKey.String(string(serverID)))...,
+	))
+
+	out := *msg
+	out.Headers = make(map[string]string, len(msg.Headers)+2)
+	for key, value := range msg.Headers {
+		out.Headers[key] = value
+	}
+	Inject(ctx, &out)
+
+	reply, err := f.forwarder.Forward(ctx, serverID, &out)
+	end(span, "", err)
+	return reply, err
+}
+
+// Handler wraps a router.Handler, recording a span for each message routed.
+type Handler struct {
+	handler router.Handler
+	tracer  trace.Tracer
+}
+
+func NewHandler(handler router.Handler, provider trace.TracerProvider) *Handler {
+	h := new(Handler)
+	h.handler = handler
+	h.tracer = tracer(provider)
+	return h
+}
+
+func (h *Handler) Route(ctx context.Context, msg *router.Message) (*router.Message, error) {
+	ctx, span := h.tracer.Start(Extract(ctx, msg), "Handler.Route", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		messageAttributes(msg)...,
+	))
+
+	reply, err := h.handler.Route(ctx, msg)
+	end(span, "", err)
+	return reply, err
+}
+
+// Set msg's trace context headers to the span in ctx.
+func Inject(ctx context.Context, msg *router.Message) {
+	if msg.Headers == nil {
+		msg.Headers = make(map[string]string)
+	}
+	propagator.Inject(ctx, propagation.MapCarrier(msg.Headers))
+}
+
+// Return ctx with the remote span named by msg's trace context headers, if
+// it has any.
+func Extract(ctx context.Context, msg *router.Message) context.Context {
+	return propagator.Extract(ctx, propagation.MapCarrier(msg.Headers))
+}
+
+// Wrap an HTTP handler, such as the HTTP proxy, recording a span for each
+// request.  The request's trace context headers are replaced with the span's
+// before it is passed on, so proxied requests continue the trace.
+func NewHTTPHandler(handler http.Handler, provider trace.TracerProvider) http.Handler {
+	tracer := tracer(provider)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := tracer.Start(ctx, "HTTP "+req.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.path", req.URL.Path),
+		))
+		defer span.End()
+
+		req = req.WithContext(ctx)
+		req.Header = req.Header.Clone()
+		propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(recorder, req)
+
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		if recorder.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Give http.ResponseController access to the underlying writer, so the
+// proxy can still flush streamed responses.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// A gRPC interceptor recording a span for each stream, such as the calls
+// relayed by the gRPC proxy.  The call's trace context metadata is replaced
+// with the span's, so relayed calls continue the trace.
+func StreamServerInterceptor(provider trace.TracerProvider) grpc.StreamServerInterceptor {
+	tracer := tracer(provider)
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		md = md.Copy()
+
+		ctx := propagator.Extract(stream.Context(), metadataCarrier(md))
+		ctx, span := tracer.Start(ctx, info.FullMethod, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("rpc.system", "grpc"),
+		))
+		propagator.Inject(ctx, metadataCarrier(md))
+
+		err := handler(srv, &tracedStream{stream, metadata.NewIncomingContext(ctx, md)})
+		end(span, "", err)
+		return err
+	}
+}
+
+type tracedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracedStream) Context() context.Context {
+	return s.ctx
+}
+
+// Adapts gRPC metadata to propagation.TextMapCarrier.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	values := metadata.MD(c).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func tracer(provider trace.TracerProvider) trace.Tracer {
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	return provider.Tracer(ScopeName)
+}
+
+func messageAttributes(msg *router.Message) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		ClientIDKey.String(string(msg.ClientID)),
+		ServiceIDKey.String(string(msg.ServiceID)),
+	}
+	if msg.ID != "" {
+		attrs = append(attrs, MessageIDKey.String(msg.ID))
+	}
+	return attrs
+}
+
+// Finish span, recording the server returned, if any, and err.
+func end(span trace.Span, serverID router.ServerID, err error) {
+	if serverID != "" {
+		span.SetAttributes(ServerIDKey.String(string(serverID)))
+	}
+	if err != nil {
+		if code, ok := router.ErrorCode(err); ok {
+			span.SetAttributes(ErrorCodeKey.String(code.String()))
+		}
+		if !notFound(err) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+	}
+	span.End()
+}
+
+// Report whether err is one of the not-found errors lookups fall through on.
+func notFound(err error) bool {
+	code, _ := router.ErrorCode(err)
+	switch code {
+	case router.UnknownClient, router.UnknownService, router.MappingNotFoundError, router.ServerNotFoundError:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/robertkluin/message-flow/router"
+	"github.com/robertkluin/message-flow/routingtable"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// An inbound traceparent, as a client continuing its own trace would send.
+const remoteParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func newProvider() (*sdktrace.TracerProvider, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	return sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)), exporter
+}
+
+func TestTableGetClientServiceServer(t *testing.T) {
+	provider, _ := newProvider()
+	router.TestGetClientServiceServer(t, NewTable(routingtable.NewMemoryRoutingTable(), provider))
+}
+
+func TestTableGetServicePool(t *testing.T) {
+	provider, _ := newProvider()
+	router.TestGetServicePool(t, NewTable(routingtable.NewMemoryRoutingTable(), provider))
+}
+
+type registrarFunc func(registrar router.ServerID, clientID router.ClientID, serviceID router.ServiceID) (router.ServerID, error)
+
+func (f registrarFunc) Lookup(registrar router.ServerID, clientID router.ClientID, serviceID router.ServiceID) (router.ServerID, error) {
+	return f(registrar, clientID, serviceID)
+}
+
+func TestRoute(t *testing.T) {
+	provider, exporter := newProvider()
+
+	table := routingtable.NewMemoryRoutingTable()
+	table.SetServiceRegistrar("service.1", "registrar.1")
+
+	registrar := registrarFunc(func(registrar router.ServerID, clientID router.ClientID, serviceID router.ServiceID) (router.ServerID, error) {
+		return "server.1", nil
+	})
+
+	var forwarded *router.Message
+	forwarder := router.ForwarderFunc(func(ctx context.Context, serverID router.ServerID, msg *router.Message) (*router.Message, error) {
+		forwarded = msg
+		return nil, nil
+	})
+
+	resolver := router.NewResolver(NewTable(table, provider), NewRegistrar(registrar, provider))
+	handler := NewHandler(router.NewRouter(resolver, NewForwarder(forwarder, provider)), provider)
+
+	msg := &router.Message{ClientID: "client.1", ServiceID: "service.1", Headers: map[string]string{"traceparent": remoteParent}}
+	if _, err := handler.Route(context.Background(), msg); err != nil {
+		t.Fatalf("Route() error: %v", err)
+	}
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+
+	route, ok := spans["Handler.Route"]
+	if !ok {
+		t.Fatalf("no Handler.Route span in %v", exporter.GetSpans())
+	}
+	if route.Parent.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || !route.Parent.IsRemote() {
+		t.Errorf("expected Handler.Route to continue the message's trace, parent %v", route.Parent)
+	}
+
+	for _, name := range []string{"RoutingTable.GetClientServiceServer", "RoutingTable.GetServiceServer", "RoutingTable.GetServiceRegistrar", "Registrar.Lookup", "RoutingTable.SetClientServiceServer", "Forwarder.Forward"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if span.Parent.SpanID() != route.SpanContext.SpanID() {
+			t.Errorf("%s parent = %v, want Handler.Route", name, span.Parent.SpanID())
+		}
+	}
+
+	// Falling through a missing mapping is not an error.
+	if lookup := spans["RoutingTable.GetClientServiceServer"]; lookup.Status.Code != 0 || !hasAttribute(lookup, ErrorCodeKey, "UnknownClient") {
+		t.Errorf("unexpected GetClientServiceServer status %v, attributes %v", lookup.Status, lookup.Attributes)
+	}
+	if lookup := spans["Registrar.Lookup"]; !hasAttribute(lookup, ServerIDKey, "server.1") {
+		t.Errorf("expected Registrar.Lookup to record its answer, got %v", lookup.Attributes)
+	}
+
+	// The forwarded message carries the forward span's context, and the
+	// caller's message is left alone.
+	forward := spans["Forwarder.Forward"]
+	want := "00-" + forward.SpanContext.TraceID().String() + "-" + forward.SpanContext.SpanID().String() + "-01"
+	if forwarded.Headers["traceparent"] != want {
+		t.Errorf("forwarded traceparent = %q, want %q", forwarded.Headers["traceparent"], want)
+	}
+	if msg.Headers["traceparent"] != remoteParent {
+		t.Errorf("caller's message was modified: %v", msg.Headers)
+	}
+}
+
+func TestForwardError(t *testing.T) {
+	provider, exporter := newProvider()
+
+	forwarder := router.ForwarderFunc(func(ctx context.Context, serverID router.ServerID, msg *router.Message) (*router.Message, error) {
+		return nil, router.NewRoutingTableError(router.ServiceError, "unreachable")
+	})
+	NewForwarder(forwarder, provider).Forward(context.Background(), "server.1", &router.Message{ClientID: "client.1"})
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Status.Code == 0 || !hasAttribute(spans[0], ErrorCodeKey, "ServiceError") {
+		t.Errorf("expected a failed Forwarder.Forward span, got %v", spans)
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	provider, exporter := newProvider()
+
+	var received http.Header
+	handler := NewHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received = req.Header
+		w.WriteHeader(http.StatusBadGateway)
+	}), provider)
+
+	req := httptest.NewRequest("GET", "/service.1/path", nil)
+	req.Header.Set("traceparent", remoteParent)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %v", spans)
+	}
+	span := spans[0]
+	if span.Parent.TraceID() != span.SpanContext.TraceID() || span.Status.Code == 0 {
+		t.Errorf("unexpected span %+v", span)
+	}
+	if received.Get("traceparent") == remoteParent || received.Get("traceparent") == "" {
+		t.Errorf("expected proxied request to carry the span's context, got %q", received.Get("traceparent"))
+	}
+	if req.Header.Get("traceparent") != remoteParent {
+		t.Errorf("caller's request headers were modified")
+	}
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	provider, exporter := newProvider()
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("traceparent", remoteParent))
+	info := &grpc.StreamServerInfo{FullMethod: "/pkg.Service/Method"}
+
+	var relayed string
+	var spanContext trace.SpanContext
+	interceptor := StreamServerInterceptor(provider)
+	interceptor(nil, serverStream{ctx: ctx}, info, func(srv interface{}, stream grpc.ServerStream) error {
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		relayed = md.Get("traceparent")[0]
+		spanContext = trace.SpanContextFromContext(stream.Context())
+		return nil
+	})
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Name != "/pkg.Service/Method" || spans[0].Parent.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("unexpected spans %v", spans)
+	}
+	want := "00-" + spanContext.TraceID().String() + "-" + spanContext.SpanID().String() + "-01"
+	if relayed != want {
+		t.Errorf("relayed traceparent = %q, want %q", relayed, want)
+	}
+}
+
+func hasAttribute(span tracetest.SpanStub, key attribute.Key, value string) bool {
+	for _, attr := range span.Attributes {
+		if attr.Key == key && attr.Value.AsString() == value {
+			return true
+		}
+	}
+	return false
+}